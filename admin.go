@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// adminTimeout is how long clients of the admin socket have to
+	// send the headers of a request.
+	adminTimeout = 10 * time.Second
+
+	filtersPathPrefix = "/filters/"
+
+	// minRemainingParam is the query parameter that sets the minimum
+	// remaining TTL of additional hostnames that are served
+	minRemainingParam = "minRemaining"
+
+	// maxImportedStateSize is the maximum size of state that can be
+	// imported
+	maxImportedStateSize = 256 << 20
+)
+
+// listenAdminSocket creates the admin socket at path, only the owner
+// can connect to it. It has to be called before landlock rules are
+// applied so the socket can be created.
+func listenAdminSocket(path string) (*net.UnixListener, error) {
+	// remove the socket of a previous instance
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("error removing old admin socket: %w", err)
+	}
+
+	// create the socket with the correct permissions so it can't be
+	// connected to in the meantime
+	oldMask := unix.Umask(0o177)
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	unix.Umask(oldMask)
+	if err != nil {
+		return nil, fmt.Errorf("error creating admin socket: %w", err)
+	}
+	// the socket can't be removed once seccomp filters are applied,
+	// it is removed when the next instance starts instead
+	l.SetUnlinkOnClose(false)
+
+	return l, nil
+}
+
+// serveAdmin serves HTTP requests on the admin socket l until the
+// FilterManager is stopped. Filters are reloaded from the config file
+// at configPath.
+func (f *FilterManager) serveAdmin(l net.Listener, configPath string) {
+	f.configPath = configPath
+	logger := f.logger.With(zap.String("filter.type", "admin"))
+	server := &http.Server{
+		Handler:           f.adminHandler(),
+		ReadHeaderTimeout: adminTimeout,
+		ErrorLog:          zap.NewStdLog(logger),
+	}
+
+	f.wg.Add(2)
+	go func() {
+		defer f.wg.Done()
+
+		logger.Info("serving admin socket", zap.Stringer("admin.addr", l.Addr()))
+		if err := server.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("error serving admin socket", zap.NamedError("error", err))
+		}
+	}()
+	go func() {
+		defer f.wg.Done()
+
+		<-f.stopping
+		server.Close()
+	}()
+}
+
+// adminHandler returns the handler of the admin socket.
+func (f *FilterManager) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", f.handleHealthz)
+	mux.HandleFunc(filtersPathPrefix, f.handleFilter)
+	mux.HandleFunc("/state", f.handleState)
+	mux.HandleFunc("/pause", f.handlePause)
+	mux.HandleFunc("/resume", f.handlePause)
+
+	return mux
+}
+
+// handleHealthz serves the status of the FilterManager as JSON. The
+// status code is 503 if it isn't healthy.
+func (f *FilterManager) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+		return
+	}
+
+	status := f.Status()
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Ready || status.FiltersHealthy != status.FiltersTotal {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		f.logger.Warn("error writing status", zap.NamedError("error", err))
+	}
+}
+
+// handlePause pauses or resumes egress depending on the path of the
+// request.
+func (f *FilterManager) handlePause(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+
+	if r.URL.Path == "/pause" {
+		f.Pause()
+	} else {
+		f.Resume()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleState exports the state of filters on GET requests, and
+// imports state from the body of POST requests.
+func (f *FilterManager) handleState(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		if err := f.ExportState(w); err != nil {
+			f.logger.Warn("error exporting state", zap.NamedError("error", err))
+		}
+		return
+	}
+
+	if err := f.ImportState(http.MaxBytesReader(w, r.Body, maxImportedStateSize)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.logger.Info("imported state")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleFilter serves requests to /filters/{name}/{command}.
+func (f *FilterManager) handleFilter(w http.ResponseWriter, r *http.Request) {
+	name, command, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, filtersPathPrefix), "/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch command {
+	case "allowed-hostnames":
+		if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+			return
+		}
+
+		var minRemaining time.Duration
+		if param := r.URL.Query().Get(minRemainingParam); param != "" {
+			var err error
+			minRemaining, err = time.ParseDuration(param)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s: %v", minRemainingParam, err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		allowlist, err := f.Allowlist(name, minRemaining)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		f.writeJSON(w, allowlist)
+	case "hostname-stats":
+		if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+			return
+		}
+
+		stats, err := f.HostnameStats(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		f.writeJSON(w, stats)
+	case "recent-denies":
+		if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+			return
+		}
+
+		denies, err := f.RecentDenies(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		f.writeJSON(w, denies)
+	case "reload":
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+
+		if err := f.reloadFilterFromConfig(name); err != nil {
+			code := http.StatusBadRequest
+			if errors.Is(err, ErrFilterNotFound) {
+				code = http.StatusNotFound
+			} else if errors.Is(err, ErrQueueConflict) {
+				code = http.StatusConflict
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// reloadFilterFromConfig reads the config file and reloads the filter
+// named name with the options set in it.
+func (f *FilterManager) reloadFilterFromConfig(name string) error {
+	config, err := ParseConfig(f.logger, f.configPath)
+	if err != nil {
+		return fmt.Errorf("error parsing config: %w", err)
+	}
+
+	for i := range config.Filters {
+		if config.Filters[i].Name == name {
+			return f.ReloadFilter(&config.Filters[i])
+		}
+	}
+
+	return fmt.Errorf("filter %q: %w in config", name, ErrFilterNotFound)
+}
+
+// writeJSON writes v to w as JSON.
+func (f *FilterManager) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		f.logger.Warn("error writing admin response", zap.NamedError("error", err))
+	}
+}
+
+// allowMethods responds with 405 and returns false if the method of r
+// isn't one of methods.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+
+	return false
+}
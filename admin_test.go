@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"go.uber.org/zap"
+)
+
+// newAdminTestClient returns a HTTP client that connects to the admin
+// socket at path.
+func newAdminTestClient(path string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	is := is.New(t)
+
+	foo, _, _ := newCallbackTestFilter(t, &FilterOptions{
+		Name:         "foo",
+		DNSQueue:     1000,
+		TrafficQueue: 1001,
+	})
+	f, _ := newCallbackTestManager(foo)
+	handler := f.adminHandler()
+
+	get := func(method string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, "/healthz", nil))
+		return rec
+	}
+
+	rec := get(http.MethodGet)
+	is.Equal(rec.Code, http.StatusOK) // healthy manager should be reported as healthy
+	is.Equal(rec.Header().Get("Content-Type"), "application/json")
+	var status ManagerStatus
+	is.NoErr(json.NewDecoder(rec.Body).Decode(&status))
+	is.True(status.Ready)                   // status should be served
+	is.Equal(status.FiltersHealthy, 1)      // healthy filters should be counted
+	is.Equal(status.Filters[0].Name, "foo") // status of filters should be served
+
+	foo.genericNFReady = make(chan struct{})
+	rec = get(http.MethodGet)
+	is.Equal(rec.Code, http.StatusServiceUnavailable) // unhealthy filters should make the manager unhealthy
+
+	rec = get(http.MethodPost)
+	is.Equal(rec.Code, http.StatusMethodNotAllowed) // status should be read-only
+	is.Equal(rec.Header().Get("Allow"), "GET, HEAD")
+}
+
+func TestAdminSocket(t *testing.T) {
+	is := is.New(t)
+
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	is.NoErr(os.WriteFile(path, nil, 0o644)) // left over socket of previous instance
+	l, err := listenAdminSocket(path)
+	is.NoErr(err)
+
+	info, err := os.Stat(path)
+	is.NoErr(err)
+	is.True(info.Mode()&os.ModeSocket != 0)          // old socket should be replaced
+	is.Equal(info.Mode().Perm(), os.FileMode(0o600)) // only the owner should be able to connect
+
+	stopping := make(chan struct{})
+	f, _ := newCallbackTestManager()
+	f.logger = zap.NewNop()
+	f.stopping = stopping
+	f.serveAdmin(l, "")
+
+	resp, err := newAdminTestClient(path).Get("http://admin/healthz")
+	is.NoErr(err)
+	resp.Body.Close()
+	is.Equal(resp.StatusCode, http.StatusOK) // requests should be served on the admin socket
+
+	close(stopping)
+	f.wg.Wait()
+	_, err = os.Stat(path)
+	is.NoErr(err) // socket should not be removed as seccomp filters don't allow it
+}
+
+func TestHostnameStatsHandler(t *testing.T) {
+	is := is.New(t)
+
+	foo := newTestFilter(&FilterOptions{
+		Name:             "foo",
+		AllowedHostnames: []string{"example.com", "unused.example.org"},
+	})
+	t.Cleanup(foo.close)
+	f, _ := newCallbackTestManager(foo)
+	handler := f.adminHandler()
+
+	get := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+
+	is.True(foo.hostnameAllowed("www.example.com"))
+	is.True(foo.hostnameAllowed("example.com"))
+
+	rec := get(http.MethodGet, "/filters/foo/hostname-stats")
+	is.Equal(rec.Code, http.StatusOK) // hostname stats should be served
+	is.Equal(rec.Header().Get("Content-Type"), "application/json")
+	var stats []HostnameStats
+	is.NoErr(json.NewDecoder(rec.Body).Decode(&stats))
+	is.Equal(stats, []HostnameStats{
+		{Hostname: "example.com", Matches: 2},
+		{Hostname: "unused.example.org", Matches: 0}, // unused hostnames should be included
+	})
+
+	rec = get(http.MethodGet, "/filters/bar/hostname-stats")
+	is.Equal(rec.Code, http.StatusNotFound) // unknown filters should not be found
+
+	rec = get(http.MethodGet, "/filters/foo/unknown")
+	is.Equal(rec.Code, http.StatusNotFound) // unknown commands should not be found
+
+	rec = get(http.MethodPost, "/filters/foo/hostname-stats")
+	is.Equal(rec.Code, http.StatusMethodNotAllowed) // hostname stats should be read-only
+}
+
+func TestRecentDeniesHandler(t *testing.T) {
+	is := is.New(t)
+
+	foo := newTestFilter(&FilterOptions{
+		Name:             "foo",
+		AllowedHostnames: []string{"example.com"},
+	})
+	t.Cleanup(foo.close)
+	f, _ := newCallbackTestManager(foo)
+	handler := f.adminHandler()
+
+	get := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+
+	for _, hostname := range []string{"evil.com", "example.com", "bad.org"} {
+		dns := newTestDNSRequest(hostname)
+		dns.QDCount = 1
+		foo.validateDNSQuestions(zap.NewNop(), dns, connectionID{})
+	}
+
+	rec := get(http.MethodGet, "/filters/foo/recent-denies")
+	is.Equal(rec.Code, http.StatusOK) // recent denies should be served
+	is.Equal(rec.Header().Get("Content-Type"), "application/json")
+	var denies []DeniedQuestion
+	is.NoErr(json.NewDecoder(rec.Body).Decode(&denies))
+	is.Equal(len(denies), 2)                 // only denied questions should be served
+	is.Equal(denies[0].Hostname, "evil.com") // denied questions should be served from oldest to newest
+	is.Equal(denies[0].Type, "A")            // question types should be named
+	is.Equal(denies[1].Hostname, "bad.org")
+
+	rec = get(http.MethodGet, "/filters/bar/recent-denies")
+	is.Equal(rec.Code, http.StatusNotFound) // unknown filters should not be found
+
+	rec = get(http.MethodPost, "/filters/foo/recent-denies")
+	is.Equal(rec.Code, http.StatusMethodNotAllowed) // recent denies should be read-only
+}
+
+func TestReloadFilterHandler(t *testing.T) {
+	is := is.New(t)
+
+	foo := newTestFilter(&FilterOptions{
+		Name:             "foo",
+		DNSQueue:         1000,
+		TrafficQueue:     1001,
+		AllowedHostnames: []string{"example.com"},
+	})
+	t.Cleanup(foo.close)
+	bar := newTestFilter(&FilterOptions{
+		Name:             "bar",
+		DNSQueue:         2000,
+		TrafficQueue:     2001,
+		AllowedHostnames: []string{"example.com"},
+	})
+	t.Cleanup(bar.close)
+	bar.additionalHostnames.AddEntry("bar.example.net", time.Minute)
+
+	configPath := filepath.Join(t.TempDir(), "config.toml")
+	f, _ := newCallbackTestManager(foo, bar)
+	f.queueNum = 1
+	f.configPath = configPath
+	handler := f.adminHandler()
+
+	reload := func(method, name, configStr string) *httptest.ResponseRecorder {
+		is.NoErr(os.WriteFile(configPath, []byte(configStr), 0o644))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, "/filters/"+name+"/reload", nil))
+		return rec
+	}
+
+	const config = `
+inboundDNSQueue = 1
+
+[[filters]]
+name = "foo"
+dnsQueue = 1000
+trafficQueue = 1001
+allowAnswersFor = "1m"
+allowedHostnames = ["example.org"]
+
+[[filters]]
+name = "bar"
+dnsQueue = 2000
+trafficQueue = 2001
+allowAnswersFor = "1m"
+allowedHostnames = ["example.org"]`
+
+	rec := reload(http.MethodPost, "foo", config)
+	is.Equal(rec.Code, http.StatusNoContent)                        // filter should be reloaded
+	is.True(foo.hostnameAllowed("example.org"))                     // reloaded hostnames should be allowed
+	is.True(!foo.hostnameAllowed("example.com"))                    // removed hostnames should not be allowed
+	is.True(bar.hostnameAllowed("example.com"))                     // other filters should not be reloaded
+	is.True(bar.additionalHostnames.EntryExists("bar.example.net")) // hostnames other filters allowed at runtime should be kept
+
+	// the queue bar is running with is given to foo in the config
+	conflicting := strings.Replace(config, "trafficQueue = 2001", "trafficQueue = 2002", 1)
+	conflicting = strings.Replace(conflicting, "trafficQueue = 1001", "trafficQueue = 2001", 1)
+	rec = reload(http.MethodPost, "foo", conflicting)
+	is.Equal(rec.Code, http.StatusConflict) // filters should not be restarted with queues of other filters
+
+	rec = reload(http.MethodPost, "baz", config)
+	is.Equal(rec.Code, http.StatusNotFound) // filters missing from the config should not be reloaded
+
+	rec = reload(http.MethodPost, "foo", "invalid")
+	is.Equal(rec.Code, http.StatusBadRequest) // invalid configs should not be applied
+	is.True(foo.hostnameAllowed("example.org"))
+
+	rec = reload(http.MethodGet, "foo", config)
+	is.Equal(rec.Code, http.StatusMethodNotAllowed) // filters should only be reloaded by POST requests
+}
+
+func TestStateHandler(t *testing.T) {
+	is := is.New(t)
+
+	newManager := func() (http.Handler, *filter) {
+		foo := newTestFilter(&FilterOptions{
+			Name:            "foo",
+			DNSQueue:        1000,
+			TrafficQueue:    1001,
+			AllowAnswersFor: duration(time.Minute),
+		})
+		t.Cleanup(foo.close)
+		f, _ := newCallbackTestManager(foo)
+
+		return f.adminHandler(), foo
+	}
+	serve := func(handler http.Handler, method string, body io.Reader) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, "/state", body))
+		return rec
+	}
+
+	ip := netip.MustParseAddr("192.0.2.1")
+	oldHandler, oldFoo := newManager()
+	oldFoo.allowIPBy(ip, allowedByDNSAnswer, time.Minute)
+	oldFoo.additionalHostnames.AddEntry("cdn.example.net", time.Minute)
+
+	rec := serve(oldHandler, http.MethodGet, nil)
+	is.Equal(rec.Code, http.StatusOK) // state should be exported
+	is.Equal(rec.Header().Get("Content-Type"), "application/json")
+
+	newHandler, newFoo := newManager()
+	rec = serve(newHandler, http.MethodPost, rec.Body)
+	is.Equal(rec.Code, http.StatusNoContent)                           // state should be imported
+	is.Equal(newFoo.allowedBy(ip), allowedByDNSAnswer)                 // allowed IPs should be handed off
+	is.True(newFoo.additionalHostnames.EntryExists("cdn.example.net")) // additional hostnames should be handed off
+
+	rec = serve(newHandler, http.MethodPost, strings.NewReader(`{"version":2,"filters":[]}`))
+	is.Equal(rec.Code, http.StatusBadRequest) // state in unsupported formats should be rejected
+
+	rec = serve(newHandler, http.MethodDelete, nil)
+	is.Equal(rec.Code, http.StatusMethodNotAllowed)
+}
+
+func TestPauseHandler(t *testing.T) {
+	is := is.New(t)
+
+	f, _ := newCallbackTestManager()
+	f.paused = newPauseSwitch()
+	handler := f.adminHandler()
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+
+	rec := serve(http.MethodPost, "/pause")
+	is.Equal(rec.Code, http.StatusNoContent)
+	is.True(f.Paused()) // egress should be paused
+
+	rec = serve(http.MethodGet, "/resume")
+	is.Equal(rec.Code, http.StatusMethodNotAllowed) // egress should only be resumed by POST requests
+	is.True(f.Paused())
+
+	rec = serve(http.MethodPost, "/resume")
+	is.Equal(rec.Code, http.StatusNoContent)
+	is.True(!f.Paused()) // egress should be resumed
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/florianl/go-nfqueue"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// pinHook returns a hook that locks the goroutine calling it to its
+// OS thread and restricts that thread to cpus the first time it is
+// called. nfqueue calls hooks from a single goroutine per queue, so
+// every packet of the queue will be processed on cpus. If cpus is
+// empty hook is returned unchanged.
+func pinHook(logger *zap.Logger, cpus []int, hook nfqueue.HookFunc) nfqueue.HookFunc {
+	if len(cpus) == 0 {
+		return hook
+	}
+
+	var once sync.Once
+	return func(attr nfqueue.Attribute) int {
+		once.Do(func() {
+			runtime.LockOSThread()
+
+			var set unix.CPUSet
+			for _, cpu := range cpus {
+				set.Set(cpu)
+			}
+			// a pid of 0 sets the affinity of the calling thread
+			if err := unix.SchedSetaffinity(0, &set); err != nil {
+				logger.Error("error setting CPU affinity", zap.Ints("cpus", cpus), zap.NamedError("error", err))
+			}
+		})
+
+		return hook(attr)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"time"
+)
+
+// allowMechanism is what caused the IP of a packet to be allowed.
+type allowMechanism uint8
+
+const (
+	allowedByNone allowMechanism = iota
+	allowedByDNSAnswer
+	allowedByCachedLookup
+	allowedByReverseLookup
+	// allowedByPostResponseGrace is only used for packets, IPs are
+	// never allowed by it
+	allowedByPostResponseGrace
+
+	numAllowMechanisms
+)
+
+func (m allowMechanism) String() string {
+	switch m {
+	case allowedByDNSAnswer:
+		return stateSourceDNSResponse
+	case allowedByCachedLookup:
+		return stateSourceCachedLookup
+	case allowedByReverseLookup:
+		return stateSourceReverseDNS
+	case allowedByPostResponseGrace:
+		return "postResponseGrace"
+	default:
+		return "none"
+	}
+}
+
+// mechanismPrecedence is the order mechanisms are preferred in when
+// multiple allowed the same IP, from the most explicitly configured.
+var mechanismPrecedence = []allowMechanism{allowedByCachedLookup, allowedByDNSAnswer, allowedByReverseLookup}
+
+// ipMechanism is an allowed IP and a mechanism that allowed it.
+type ipMechanism struct {
+	ip        netip.Addr
+	mechanism allowMechanism
+}
+
+// allowIPBy allows ip for ttl and records that mechanism allowed it.
+func (f *filter) allowIPBy(ip netip.Addr, mechanism allowMechanism, ttl time.Duration) {
+	f.allowedIPs.AddEntry(ip, ttl)
+	if f.ipMechanisms != nil {
+		f.ipMechanisms.AddEntry(ipMechanism{ip: ip, mechanism: mechanism}, ttl)
+	}
+}
+
+// removeAllowedIP stops allowing ip.
+func (f *filter) removeAllowedIP(ip netip.Addr) {
+	f.allowedIPs.RemoveEntry(ip)
+	if f.ipMechanisms == nil {
+		return
+	}
+	for m := allowedByDNSAnswer; m < numAllowMechanisms; m++ {
+		f.ipMechanisms.RemoveEntry(ipMechanism{ip: ip, mechanism: m})
+	}
+}
+
+// allowedBy returns the mechanism that allowed ip, or allowedByNone
+// if ip isn't allowed. If multiple mechanisms allowed ip, the one
+// that was configured most explicitly is returned.
+func (f *filter) allowedBy(ip netip.Addr) allowMechanism {
+	if !f.allowedIPs.Lookup(ip) {
+		return allowedByNone
+	}
+	if f.ipMechanisms != nil {
+		for _, m := range mechanismPrecedence {
+			if f.ipMechanisms.EntryExists(ipMechanism{ip: ip, mechanism: m}) {
+				return m
+			}
+		}
+	}
+
+	// the mechanism of ip may not be recorded yet if it was just
+	// allowed, most IPs are allowed by DNS answers
+	return allowedByDNSAnswer
+}
+
+// countAllowedBy records that a packet was allowed by mechanism.
+func (f *filter) countAllowedBy(mechanism allowMechanism) {
+	atomic.AddInt64(&f.packetsAllowedBy[mechanism], 1)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Allowlist is the effective allowlist of a filter.
+type Allowlist struct {
+	Filter string `json:"filter"`
+	// AllowedHostnames are the hostnames set in the config and synced
+	// from "allowedHostnamesURL"
+	AllowedHostnames []string `json:"allowedHostnames"`
+	// AdditionalHostnames were allowed at runtime from CNAME and SRV
+	// answers
+	AdditionalHostnames []AdditionalHostname `json:"additionalHostnames"`
+}
+
+// AdditionalHostname is a hostname allowed at runtime and when it
+// will stop being allowed.
+type AdditionalHostname struct {
+	Hostname string    `json:"hostname"`
+	Expires  time.Time `json:"expires"`
+	// Remaining is how long until the hostname expires, rounded to
+	// seconds, e.g. "4m12s"
+	Remaining string `json:"remaining"`
+	// Sources are the CNAME and SRV answers that allowed the hostname
+	Sources []HostnameSource `json:"sources"`
+}
+
+// Allowlist returns the hostnames a filter currently allows. Only
+// additional hostnames that will be allowed for at least minRemaining
+// are included.
+func (f *FilterManager) Allowlist(filterName string, minRemaining time.Duration) (Allowlist, error) {
+	for _, filter := range f.currentFilters() {
+		if filter.opts.Name == filterName {
+			return filter.allowlist(time.Now(), minRemaining), nil
+		}
+	}
+
+	return Allowlist{}, fmt.Errorf("filter %q: %w", filterName, ErrFilterNotFound)
+}
+
+func (f *filter) allowlist(now time.Time, minRemaining time.Duration) Allowlist {
+	f.hostnamesMtx.RLock()
+	hostnames := make([]string, len(f.opts.AllowedHostnames))
+	copy(hostnames, f.opts.AllowedHostnames)
+	f.hostnamesMtx.RUnlock()
+
+	allowlist := Allowlist{
+		Filter:              f.opts.Name,
+		AllowedHostnames:    hostnames,
+		AdditionalHostnames: []AdditionalHostname{},
+	}
+	if f.additionalHostnames != nil {
+		sources := make(map[string][]HostnameSource)
+		if f.hostnameSources != nil {
+			f.hostnameSources.Range(func(e sourcedHostname, _ time.Time) bool {
+				sources[e.hostname] = append(sources[e.hostname], e.source)
+				return true
+			})
+		}
+
+		f.additionalHostnames.Range(func(hostname string, expires time.Time) bool {
+			remaining := expires.Sub(now)
+			if remaining < minRemaining {
+				return true
+			}
+			hostnameSources := sources[hostname]
+			if hostnameSources == nil {
+				// hostnames imported from exported state have no
+				// known sources
+				hostnameSources = []HostnameSource{}
+			}
+			sort.Slice(hostnameSources, func(i, j int) bool {
+				if hostnameSources[i].Name != hostnameSources[j].Name {
+					return hostnameSources[i].Name < hostnameSources[j].Name
+				}
+				return hostnameSources[i].Type < hostnameSources[j].Type
+			})
+			allowlist.AdditionalHostnames = append(allowlist.AdditionalHostnames, AdditionalHostname{
+				Hostname:  hostname,
+				Expires:   expires,
+				Remaining: remaining.Round(time.Second).String(),
+				Sources:   hostnameSources,
+			})
+			return true
+		})
+		sort.Slice(allowlist.AdditionalHostnames, func(i, j int) bool {
+			return allowlist.AdditionalHostnames[i].Hostname < allowlist.AdditionalHostnames[j].Hostname
+		})
+	}
+
+	return allowlist
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"go.uber.org/zap"
+)
+
+func TestAllowlistHandler(t *testing.T) {
+	is := is.New(t)
+
+	foo := newTestFilter(&FilterOptions{
+		Name:             "foo",
+		DNSQueue:         1000,
+		TrafficQueue:     1001,
+		AllowedHostnames: []string{"example.com"},
+	})
+	t.Cleanup(foo.close)
+
+	f := FilterManager{
+		logger:  zap.NewNop(),
+		filters: []*filter{foo},
+	}
+	handler := f.adminHandler()
+
+	get := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+
+	foo.allowHostname(zap.NewNop(), "cdn.example.net", HostnameSource{Type: "CNAME", Name: "www.example.com"}, time.Minute)
+	foo.allowHostname(zap.NewNop(), "cdn.example.net", HostnameSource{Type: "SRV", Name: "_https._tcp.example.com"}, time.Minute)
+	is.NoErr(foo.updateAllowedHostnames([]string{"example.com", "example.org"}))
+
+	rec := get(http.MethodGet, "/filters/foo/allowed-hostnames")
+	is.Equal(rec.Code, http.StatusOK)                              // allowlist should be served
+	is.Equal(rec.Header().Get("Content-Type"), "application/json") // allowlist should be JSON
+
+	var allowlist Allowlist
+	is.NoErr(json.NewDecoder(rec.Body).Decode(&allowlist))
+	is.Equal(allowlist.Filter, "foo")
+	is.Equal(allowlist.AllowedHostnames, []string{"example.com", "example.org"}) // updated hostnames should be included
+	is.Equal(len(allowlist.AdditionalHostnames), 1)
+	is.Equal(allowlist.AdditionalHostnames[0].Hostname, "cdn.example.net") // hostnames added at runtime should be included
+	is.True(allowlist.AdditionalHostnames[0].Expires.After(time.Now()))    // expiry of hostnames added at runtime should be included
+	is.Equal(allowlist.AdditionalHostnames[0].Sources, []HostnameSource{
+		{Type: "SRV", Name: "_https._tcp.example.com"},
+		{Type: "CNAME", Name: "www.example.com"},
+	}) // answers that allowed hostnames should be included
+
+	rec = get(http.MethodGet, "/filters/foo/allowed-hostnames?minRemaining=invalid")
+	is.Equal(rec.Code, http.StatusBadRequest) // invalid minimum remaining TTLs should be rejected
+
+	rec = get(http.MethodGet, "/filters/bar/allowed-hostnames")
+	is.Equal(rec.Code, http.StatusNotFound) // unknown filters should not be found
+
+	rec = get(http.MethodGet, "/filters/foo/unknown")
+	is.Equal(rec.Code, http.StatusNotFound) // unknown paths should not be found
+
+	rec = get(http.MethodPost, "/filters/foo/allowed-hostnames")
+	is.Equal(rec.Code, http.StatusMethodNotAllowed) // allowlist should be read-only
+}
+
+func TestAllowlistRemaining(t *testing.T) {
+	foo := newTestFilter(&FilterOptions{
+		Name:             "foo",
+		DNSQueue:         1000,
+		TrafficQueue:     1001,
+		AllowedHostnames: []string{"example.com"},
+	})
+	t.Cleanup(foo.close)
+
+	now := time.Now()
+	foo.additionalHostnames.AddEntry("a.example.net", 27*time.Second)
+	foo.additionalHostnames.AddEntry("b.example.net", 4*time.Minute+12*time.Second)
+	foo.additionalHostnames.AddEntry("c.example.net", time.Hour)
+
+	tests := []struct {
+		name         string
+		minRemaining time.Duration
+		expected     []AdditionalHostname
+	}{
+		{
+			name: "all",
+			expected: []AdditionalHostname{
+				{Hostname: "a.example.net", Remaining: "27s", Sources: []HostnameSource{}},
+				{Hostname: "b.example.net", Remaining: "4m12s", Sources: []HostnameSource{}},
+				{Hostname: "c.example.net", Remaining: "1h0m0s", Sources: []HostnameSource{}},
+			},
+		},
+		{
+			name:         "minimum remaining",
+			minRemaining: time.Minute,
+			expected: []AdditionalHostname{
+				{Hostname: "b.example.net", Remaining: "4m12s", Sources: []HostnameSource{}},
+				{Hostname: "c.example.net", Remaining: "1h0m0s", Sources: []HostnameSource{}},
+			},
+		},
+		{
+			name:         "none remaining",
+			minRemaining: 2 * time.Hour,
+			expected:     []AdditionalHostname{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+
+			allowlist := foo.allowlist(now, tt.minRemaining)
+			for i := range allowlist.AdditionalHostnames {
+				allowlist.AdditionalHostnames[i].Expires = time.Time{}
+			}
+			is.Equal(allowlist.AdditionalHostnames, tt.expected) // remaining TTLs should be humanized and filtered
+		})
+	}
+}
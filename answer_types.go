@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/google/gopacket/layers"
+	"go.uber.org/zap"
+)
+
+// DNS types gopacket doesn't define
+const (
+	dnsTypeDNAME layers.DNSType = 39
+	// dnsTypeANY is the question type of requests for all records
+	// of a name
+	dnsTypeANY layers.DNSType = 255
+)
+
+// connectionQuestionType is the type of a question of a DNS request
+// sent over a connection.
+type connectionQuestionType struct {
+	connID connectionID
+	qType  layers.DNSType
+}
+
+// trackQuestionTypes records the question types of a DNS request so
+// answers to it can be matched to them.
+func (f *filter) trackQuestionTypes(connID connectionID, dns *layers.DNS) {
+	if f.questionTypes == nil {
+		return
+	}
+
+	for _, question := range dns.Questions {
+		f.questionTypes.AddEntry(connectionQuestionType{connID: connID, qType: question.Type}, dnsQueryTimeout)
+	}
+}
+
+// matchAnswerTypes returns a copy of a DNS response without the
+// answers whose types weren't asked for by the request of connID.
+// CNAME and DNAME answers are kept, as they are part of answers of
+// any type.
+func (f *filter) matchAnswerTypes(logger *zap.Logger, dns *layers.DNS, connID connectionID) *layers.DNS {
+	requested := make(map[layers.DNSType]bool, len(dns.Questions))
+	for _, question := range dns.Questions {
+		key := connectionQuestionType{connID: connID, qType: question.Type}
+		if f.questionTypes.EntryExists(key) {
+			requested[question.Type] = true
+			f.questionTypes.RemoveEntry(key)
+		}
+	}
+
+	matched := *dns
+	matched.Answers = make([]layers.DNSResourceRecord, 0, len(dns.Answers))
+	for _, answer := range dns.Answers {
+		if answer.Type == layers.DNSTypeCNAME || answer.Type == dnsTypeDNAME || requested[answer.Type] || requested[dnsTypeANY] {
+			matched.Answers = append(matched.Answers, answer)
+			continue
+		}
+
+		logger.Warn("ignoring answer of type that wasn't requested", zap.ByteString("answer.name", answer.Name), zap.Stringer("answer.type", answer.Type), zap.Strings("response.questions", questionStrings(dns.Questions)))
+	}
+
+	return &matched
+}
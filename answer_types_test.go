@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+	"github.com/matryer/is"
+	"go.uber.org/zap"
+)
+
+func TestMatchAnswerTypeToQuestion(t *testing.T) {
+	connID := connectionID{
+		isUDP: true,
+		src:   netip.MustParseAddrPort("192.168.1.2:40000"),
+		dst:   netip.MustParseAddrPort("192.168.1.1:53"),
+	}
+	questions := func(qType layers.DNSType) []layers.DNSQuestion {
+		return []layers.DNSQuestion{
+			{Name: []byte("www.example.com"), Type: qType, Class: layers.DNSClassIN},
+		}
+	}
+	answers := []layers.DNSResourceRecord{
+		{Name: []byte("www.example.com"), Type: layers.DNSTypeCNAME, Class: layers.DNSClassIN, CNAME: []byte("cdn.example.net")},
+		{Name: []byte("cdn.example.net"), Type: layers.DNSTypeA, Class: layers.DNSClassIN, IP: net.IPv4(192, 0, 2, 1)},
+		{Name: []byte("cdn.example.net"), Type: layers.DNSTypeAAAA, Class: layers.DNSClassIN, IP: net.ParseIP("2001:db8::1")},
+	}
+	ipv4 := netip.MustParseAddr("192.0.2.1")
+	ipv6 := netip.MustParseAddr("2001:db8::1")
+
+	tests := []struct {
+		name        string
+		enabled     bool
+		requestType layers.DNSType
+		expectIPv4  bool
+		expectIPv6  bool
+	}{
+		{
+			name:        "disabled",
+			requestType: layers.DNSTypeA,
+			expectIPv4:  true,
+			expectIPv6:  true,
+		},
+		{
+			name:        "A request",
+			enabled:     true,
+			requestType: layers.DNSTypeA,
+			expectIPv4:  true,
+			expectIPv6:  false,
+		},
+		{
+			name:        "AAAA request",
+			enabled:     true,
+			requestType: layers.DNSTypeAAAA,
+			expectIPv4:  false,
+			expectIPv6:  true,
+		},
+		{
+			name:        "ANY request",
+			enabled:     true,
+			requestType: dnsTypeANY,
+			expectIPv4:  true,
+			expectIPv6:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+
+			f := newTestFilter(&FilterOptions{
+				AllowedHostnames:          []string{"example.com"},
+				AllowAnswersFor:           duration(dnsQueryTimeout),
+				MatchAnswerTypeToQuestion: tt.enabled,
+			})
+			if tt.enabled {
+				f.questionTypes = NewTimedCache[connectionQuestionType](zap.NewNop(), true)
+			}
+			t.Cleanup(f.close)
+
+			f.trackQuestionTypes(connID, &layers.DNS{Questions: questions(tt.requestType)})
+			response := &layers.DNS{
+				QR:        true,
+				Questions: questions(tt.requestType),
+				Answers:   answers,
+			}
+			f.allowAnswers(zap.NewNop(), response, connID, nil)
+
+			is.Equal(f.allowedIPs.EntryExists(ipv4), tt.expectIPv4)       // A answers should only be allowed if requested
+			is.Equal(f.allowedIPs.EntryExists(ipv6), tt.expectIPv6)       // AAAA answers should only be allowed if requested
+			is.True(f.additionalHostnames.EntryExists("cdn.example.net")) // CNAME answers should always be allowed
+			is.Equal(len(response.Answers), 3)                            // the response should not be modified
+		})
+	}
+
+	t.Run("question changed", func(t *testing.T) {
+		is := is.New(t)
+
+		f := newTestFilter(&FilterOptions{
+			AllowedHostnames:          []string{"example.com"},
+			AllowAnswersFor:           duration(dnsQueryTimeout),
+			MatchAnswerTypeToQuestion: true,
+		})
+		f.questionTypes = NewTimedCache[connectionQuestionType](zap.NewNop(), true)
+		t.Cleanup(f.close)
+
+		f.trackQuestionTypes(connID, &layers.DNS{Questions: questions(layers.DNSTypeA)})
+		f.allowAnswers(zap.NewNop(), &layers.DNS{
+			QR:        true,
+			Questions: questions(layers.DNSTypeAAAA),
+			Answers:   answers,
+		}, connID, nil)
+
+		is.True(!f.allowedIPs.EntryExists(ipv4)) // answers should not be allowed if the question type was changed
+		is.True(!f.allowedIPs.EntryExists(ipv6)) // answers should not be allowed if the question type was changed
+	})
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// cachedResolver resolves the cached hostnames of filters. Hostnames
+// cached by multiple filters are only resolved once each interval,
+// and the addresses are distributed to every filter caching them.
+type cachedResolver struct {
+	logger      *zap.Logger
+	lookupNetIP func(ctx context.Context, network, host string) ([]netip.Addr, error)
+
+	// mtx protects lookups, and is held while addresses are added to
+	// filters so filters aren't updated after they are unsubscribed
+	mtx     sync.Mutex
+	lookups map[cachedLookupKey]*cachedLookup
+	// wake is signaled when filters subscribe so their hostnames are
+	// resolved without waiting for other lookups to be due
+	wake chan struct{}
+}
+
+// cachedLookupKey identifies a lookup, as filters may resolve the
+// same hostname to addresses of different IP versions.
+type cachedLookupKey struct {
+	network  string
+	hostname string
+}
+
+type cachedLookup struct {
+	subscribers map[*filter]struct{}
+	// interval is the shortest "reCacheEvery" of the subscribers
+	interval time.Duration
+	// resolved is when the hostname was last resolved, it is zero if
+	// the hostname hasn't been resolved yet
+	resolved time.Time
+	// addrs are the addresses of the last successful lookup
+	addrs []netip.Addr
+}
+
+func newCachedResolver(logger *zap.Logger) *cachedResolver {
+	return &cachedResolver{
+		logger:      logger,
+		lookupNetIP: new(net.Resolver).LookupNetIP,
+		lookups:     make(map[cachedLookupKey]*cachedLookup),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// subscribe adds f as a subscriber of its cached hostnames. If other
+// filters already resolved any of them, f is given their addresses
+// immediately.
+func (c *cachedResolver) subscribe(f *filter) {
+	if len(f.opts.CachedHostnames) == 0 || f.allowedIPs == nil {
+		return
+	}
+
+	var (
+		network  = lookupNetwork(f.opts.IPVersion)
+		interval = time.Duration(f.opts.ReCacheEvery)
+	)
+
+	c.mtx.Lock()
+	for _, hostname := range f.opts.CachedHostnames {
+		key := cachedLookupKey{network: network, hostname: hostname}
+		lookup, ok := c.lookups[key]
+		if !ok {
+			lookup = &cachedLookup{
+				subscribers: make(map[*filter]struct{}),
+				interval:    interval,
+			}
+			c.lookups[key] = lookup
+		}
+		lookup.subscribers[f] = struct{}{}
+		if interval < lookup.interval {
+			lookup.interval = interval
+		}
+
+		if lookup.addrs != nil {
+			f.cacheAddrs(f.logger, hostname, lookup.addrs)
+		}
+	}
+	f.checkAllowedIPsThreshold(f.logger)
+	c.mtx.Unlock()
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// unsubscribe removes f as a subscriber of its cached hostnames.
+// Hostnames without any subscribers are no longer resolved.
+func (c *cachedResolver) unsubscribe(f *filter) {
+	network := lookupNetwork(f.opts.IPVersion)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for _, hostname := range f.opts.CachedHostnames {
+		key := cachedLookupKey{network: network, hostname: hostname}
+		lookup, ok := c.lookups[key]
+		if !ok {
+			continue
+		}
+
+		delete(lookup.subscribers, f)
+		if len(lookup.subscribers) == 0 {
+			delete(c.lookups, key)
+			continue
+		}
+
+		// the filter may have had the shortest interval
+		lookup.interval = 0
+		for sub := range lookup.subscribers {
+			interval := time.Duration(sub.opts.ReCacheEvery)
+			if lookup.interval == 0 || interval < lookup.interval {
+				lookup.interval = interval
+			}
+		}
+	}
+}
+
+func (c *cachedResolver) run(ctx context.Context) {
+	c.logger.Debug("starting cache loop")
+
+	for {
+		// only wait on the timer if there are hostnames to resolve
+		var (
+			timer  *time.Timer
+			timerC <-chan time.Time
+		)
+		if wait, ok := c.resolveDue(ctx, time.Now()); ok {
+			timer = time.NewTimer(wait)
+			timerC = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			c.logger.Debug("exiting cache loop")
+			return
+		case <-timerC:
+		case <-c.wake:
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+}
+
+// resolveDue resolves hostnames that haven't been resolved within
+// their interval and adds the addresses to the subscribed filters. It
+// returns how long until the next lookup is due, or false if there
+// are no hostnames to resolve.
+func (c *cachedResolver) resolveDue(ctx context.Context, now time.Time) (time.Duration, bool) {
+	// don't hold the lock while resolving so filters can subscribe
+	// and unsubscribe during slow lookups
+	var due []cachedLookupKey
+	c.mtx.Lock()
+	for key, lookup := range c.lookups {
+		if !now.Before(lookup.resolved.Add(lookup.interval)) {
+			due = append(due, key)
+		}
+	}
+	c.mtx.Unlock()
+
+	for _, key := range due {
+		c.logger.Info("caching lookup of hostname", zap.String("hostname", key.hostname))
+		addrs, err := c.lookupNetIP(ctx, key.network, key.hostname)
+		if err != nil {
+			var dnsErr *net.DNSError
+			if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+				c.logger.Warn("could not resolve hostname", zap.String("hostname", key.hostname))
+			} else {
+				c.logger.Error("error resolving hostname", zap.String("hostname", key.hostname), zap.NamedError("error", err))
+			}
+		}
+
+		c.mtx.Lock()
+		// the filters caching the hostname may have been removed
+		if lookup, ok := c.lookups[key]; ok {
+			lookup.resolved = now
+			if err == nil {
+				lookup.addrs = addrs
+				for f := range lookup.subscribers {
+					f.cacheAddrs(f.logger, key.hostname, addrs)
+					f.checkAllowedIPsThreshold(f.logger)
+				}
+			}
+		}
+		c.mtx.Unlock()
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	var (
+		next time.Time
+		ok   bool
+	)
+	for _, lookup := range c.lookups {
+		due := lookup.resolved.Add(lookup.interval)
+		if !ok || due.Before(next) {
+			next = due
+			ok = true
+		}
+	}
+
+	return next.Sub(now), ok
+}
+
+// cacheAddrs allows addrs, which hostname resolved to, until the
+// filter's hostnames are cached again.
+func (f *filter) cacheAddrs(logger *zap.Logger, hostname string, addrs []netip.Addr) {
+	// allow IPs a bit longer than the interval so they don't expire
+	// right before they are added again
+	ttl := time.Duration(f.opts.ReCacheEvery) + time.Minute
+
+	for _, addr := range addrs {
+		logger.Info("allowing IP from cached lookup", zap.String("hostname", hostname), zap.Stringer("ip", addr), zap.Duration("ttl", ttl))
+		f.allowIPBy(addr, allowedByCachedLookup, ttl)
+		f.addProvenance(addr, hostname, ttl)
+		f.mirrorAllowedIP(addr, stateSourceCachedLookup, hostname, ttl)
+
+		// If the IP address is an IPv4-mapped IPv6 address, add the
+		// unwrapped IPv4 address too. That is what will most likely
+		// be used. addrs is shared between filters so it must not be
+		// modified.
+		if addr.Is4In6() {
+			unmapped := addr.Unmap()
+			logger.Info("allowing IP from cached lookup", zap.String("hostname", hostname), zap.Stringer("ip", unmapped), zap.Duration("ttl", ttl))
+			f.allowIPBy(unmapped, allowedByCachedLookup, ttl)
+			f.addProvenance(unmapped, hostname, ttl)
+			f.mirrorAllowedIP(unmapped, stateSourceCachedLookup, hostname, ttl)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"go.uber.org/zap"
+)
+
+func TestCachedResolverSharesLookups(t *testing.T) {
+	is := is.New(t)
+
+	foo := newTestFilter(&FilterOptions{
+		Name:            "foo",
+		CachedHostnames: []string{"shared.com", "foo.com"},
+		ReCacheEvery:    duration(time.Hour),
+	})
+	t.Cleanup(foo.close)
+	bar := newTestFilter(&FilterOptions{
+		Name:            "bar",
+		CachedHostnames: []string{"shared.com"},
+		ReCacheEvery:    duration(time.Minute),
+	})
+	t.Cleanup(bar.close)
+
+	lookups := make(map[string]int)
+	r := newCachedResolver(zap.NewNop())
+	r.lookupNetIP = func(_ context.Context, _, host string) ([]netip.Addr, error) {
+		lookups[host]++
+		if host == "shared.com" {
+			return []netip.Addr{netip.MustParseAddr("::ffff:192.0.2.1")}, nil
+		}
+		return []netip.Addr{netip.MustParseAddr("192.0.2.2")}, nil
+	}
+	r.subscribe(foo)
+	r.subscribe(bar)
+
+	now := time.Now()
+	wait, ok := r.resolveDue(context.Background(), now)
+	is.True(ok)                        // more lookups should be due
+	is.Equal(wait, time.Minute)        // next lookup should be due after the shortest interval
+	is.Equal(lookups["shared.com"], 1) // shared hostname should only be resolved once
+	is.Equal(lookups["foo.com"], 1)    // other hostnames should be resolved
+	for _, f := range []*filter{foo, bar} {
+		is.True(f.allowedIPs.EntryExists(netip.MustParseAddr("::ffff:192.0.2.1"))) // shared addresses should be allowed by both filters
+		is.True(f.allowedIPs.EntryExists(netip.MustParseAddr("192.0.2.1")))        // unmapped IPv4 addresses should be allowed by both filters
+	}
+	is.True(foo.allowedIPs.EntryExists(netip.MustParseAddr("192.0.2.2")))  // addresses should be allowed by the subscribed filter
+	is.True(!bar.allowedIPs.EntryExists(netip.MustParseAddr("192.0.2.2"))) // addresses should not be allowed by other filters
+
+	r.resolveDue(context.Background(), now.Add(time.Minute))
+	is.Equal(lookups["shared.com"], 2) // shared hostname should be resolved at the shortest interval
+	is.Equal(lookups["foo.com"], 1)    // other hostnames should not be resolved before their interval
+
+	baz := newTestFilter(&FilterOptions{
+		Name:            "baz",
+		CachedHostnames: []string{"shared.com"},
+		ReCacheEvery:    duration(time.Hour),
+	})
+	t.Cleanup(baz.close)
+	r.subscribe(baz)
+	is.True(baz.allowedIPs.EntryExists(netip.MustParseAddr("192.0.2.1"))) // new subscribers should be given resolved addresses immediately
+	is.Equal(lookups["shared.com"], 2)                                    // new subscribers should not cause lookups of resolved hostnames
+
+	r.unsubscribe(bar)
+	r.unsubscribe(baz)
+	wait, ok = r.resolveDue(context.Background(), now.Add(2*time.Minute))
+	is.True(ok)                             // lookups of remaining filters should be due
+	is.Equal(wait, time.Hour-2*time.Minute) // interval should be the shortest of the remaining filters
+	is.Equal(lookups["shared.com"], 2)      // hostname should not be resolved at the interval of removed filters
+
+	r.unsubscribe(foo)
+	_, ok = r.resolveDue(context.Background(), now.Add(2*time.Hour))
+	is.True(!ok)                       // no lookups should be due without subscribers
+	is.Equal(lookups["shared.com"], 2) // hostnames without subscribers should not be resolved
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/florianl/go-nfqueue"
+)
+
+// callbackProgress counts how many packets nfqueue callbacks started
+// and finished processing, so callbacks that are stuck can be found.
+type callbackProgress struct {
+	// accessed atomically, kept first to ensure 64-bit alignment
+	started  int64
+	finished int64
+
+	// lastFinished and lastPending are what finished was and whether
+	// packets were being processed when stalled was last called, they
+	// are only accessed by the watchdog
+	lastFinished int64
+	lastPending  bool
+}
+
+// track returns a hook that calls hook and counts the packets it
+// processes.
+func (p *callbackProgress) track(hook nfqueue.HookFunc) nfqueue.HookFunc {
+	return func(attr nfqueue.Attribute) int {
+		atomic.AddInt64(&p.started, 1)
+		defer atomic.AddInt64(&p.finished, 1)
+
+		return hook(attr)
+	}
+}
+
+// stalled returns true if packets were being processed when stalled
+// was last called, and no packet finished processing since. It must
+// not be called concurrently.
+func (p *callbackProgress) stalled() bool {
+	if p == nil {
+		return false
+	}
+
+	// load finished first so packets that start processing in
+	// between are counted as pending
+	finished := atomic.LoadInt64(&p.finished)
+	started := atomic.LoadInt64(&p.started)
+	stalled := p.lastPending && finished == p.lastFinished
+	p.lastFinished = finished
+	p.lastPending = started > finished
+
+	return stalled
+}
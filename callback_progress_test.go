@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/florianl/go-nfqueue"
+	"github.com/matryer/is"
+)
+
+func TestCallbackProgress(t *testing.T) {
+	is := is.New(t)
+
+	var p callbackProgress
+	release := make(chan struct{})
+	entered := make(chan struct{})
+	done := make(chan struct{})
+	hook := p.track(func(nfqueue.Attribute) int {
+		close(entered)
+		<-release
+		return 0
+	})
+
+	is.True(!p.stalled()) // no packets should not be stalled
+
+	go func() {
+		defer close(done)
+		hook(nfqueue.Attribute{})
+	}()
+	<-entered
+
+	is.True(!p.stalled()) // newly pending packets should not be stalled yet
+	is.True(p.stalled())  // packets pending since the last check should be stalled
+
+	close(release)
+	<-done
+	is.True(!p.stalled()) // finishing a packet should not be stalled
+	is.True(!p.stalled()) // no pending packets should not be stalled
+
+	var nilProgress *callbackProgress
+	is.True(!nilProgress.stalled()) // untracked callbacks should never be stalled
+}
@@ -0,0 +1,851 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/florianl/go-nfqueue"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/matryer/is"
+	"github.com/mdlayher/netlink"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// fakeQueue records the verdicts set on it instead of sending them to
+// the kernel.
+type fakeQueue struct {
+	mtx      sync.Mutex
+	verdicts map[uint32]int
+	messages []netlink.Message
+}
+
+func newFakeQueue() *fakeQueue {
+	return &fakeQueue{verdicts: make(map[uint32]int)}
+}
+
+func (q *fakeQueue) SetVerdict(id uint32, verdict int) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	q.verdicts[id] = verdict
+	return nil
+}
+
+func (q *fakeQueue) sendVerdict(msg netlink.Message) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	q.messages = append(q.messages, msg)
+	return nil
+}
+
+func (q *fakeQueue) Close() error {
+	return nil
+}
+
+// verdict returns the verdict set for packet id.
+func (q *fakeQueue) verdict(id uint32) (int, bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	verdict, ok := q.verdicts[id]
+	return verdict, ok
+}
+
+// newCallbackTestFilter returns a filter whose callbacks set verdicts
+// on fake queues.
+func newCallbackTestFilter(t *testing.T, opts *FilterOptions) (*filter, *fakeQueue, *fakeQueue) {
+	f := newTestFilter(opts)
+	dnsReqQueue, genericQueue := newFakeQueue(), newFakeQueue()
+	f.dnsReqNF = dnsReqQueue
+	f.genericNF = genericQueue
+	f.dnsReqNFReady = make(chan struct{})
+	close(f.dnsReqNFReady)
+	f.genericNFReady = make(chan struct{})
+	close(f.genericNFReady)
+	f.deadLetters = newDeadLetterQueue(zap.NewNop())
+	t.Cleanup(f.close)
+
+	return f, dnsReqQueue, genericQueue
+}
+
+// newCallbackTestManager returns a filter manager of filters whose
+// DNS response callback sets verdicts on a fake queue.
+func newCallbackTestManager(filters ...*filter) (*FilterManager, *fakeQueue) {
+	respQueue := newFakeQueue()
+	f := &FilterManager{
+		ready:       make(chan struct{}),
+		logger:      zap.NewNop(),
+		dnsRespNF:   respQueue,
+		deadLetters: newDeadLetterQueue(zap.NewNop()),
+		resolver:    newCachedResolver(zap.NewNop()),
+		filters:     filters,
+	}
+	close(f.ready)
+
+	return f, respQueue
+}
+
+// newPacketAttribute returns the attributes of a queued packet.
+func newPacketAttribute(packetID uint32, ctInfo uint32, payload []byte) nfqueue.Attribute {
+	return nfqueue.Attribute{
+		PacketID: &packetID,
+		CtInfo:   &ctInfo,
+		Payload:  &payload,
+	}
+}
+
+func newTestDNSRequest(hostname string) *layers.DNS {
+	return &layers.DNS{
+		ID:     1,
+		RD:     true,
+		OpCode: layers.DNSOpCodeQuery,
+		Questions: []layers.DNSQuestion{
+			{
+				Name:  []byte(hostname),
+				Type:  layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+			},
+		},
+	}
+}
+
+func TestLoopbackDNSFiltered(t *testing.T) {
+	is := is.New(t)
+
+	f, dnsReqQueue, _ := newCallbackTestFilter(t, &FilterOptions{
+		Name:             "foo",
+		DNSQueue:         1000,
+		TrafficQueue:     1001,
+		IPVersion:        4,
+		AllowAnswersFor:  duration(time.Minute),
+		AllowedHostnames: []string{"example.com"},
+	})
+	manager, respQueue := newCallbackTestManager(f)
+	reqCallback := newDNSRequestCallback(f)
+	respCallback := newDNSResponseCallback(manager)
+
+	client := netip.MustParseAddrPort("127.0.0.1:40000")
+	stub := netip.MustParseAddrPort("127.0.0.53:53")
+
+	reqCallback(newPacketAttribute(1, stateNew, newDNSPacketBetween(t, client, stub, newTestDNSRequest("evil.com"))))
+	verdict, ok := dnsReqQueue.verdict(1)
+	is.True(ok)                       // verdict should be set
+	is.Equal(verdict, nfqueue.NfDrop) // request to loopback stub resolver for disallowed hostname should be dropped
+
+	reqCallback(newPacketAttribute(2, stateNew, newDNSPacketBetween(t, client, stub, newTestDNSRequest("example.com"))))
+	verdict, ok = dnsReqQueue.verdict(2)
+	is.True(ok)                                                                           // verdict should be set
+	is.Equal(verdict, nfqueue.NfAccept)                                                   // request to loopback stub resolver for allowed hostname should be accepted
+	is.True(f.connections.EntryExists(connectionID{isUDP: true, src: client, dst: stub})) // request to loopback stub resolver should be tracked
+
+	response := newTestDNSRequest("example.com")
+	response.QR = true
+	response.Answers = []layers.DNSResourceRecord{
+		{
+			Name:  []byte("example.com"),
+			Type:  layers.DNSTypeA,
+			Class: layers.DNSClassIN,
+			TTL:   60,
+			IP:    net.IPv4(192, 0, 2, 1),
+		},
+	}
+	respCallback(newPacketAttribute(3, stateEstablishedReply, newDNSPacketBetween(t, stub, client, response)))
+	verdict, ok = respQueue.verdict(3)
+	is.True(ok)                                                             // verdict should be set
+	is.Equal(verdict, nfqueue.NfAccept)                                     // response from loopback stub resolver should be accepted
+	is.True(f.allowedBy(netip.MustParseAddr("192.0.2.1")) != allowedByNone) // answers from loopback stub resolver should be allowed
+
+	respCallback(newPacketAttribute(4, stateEstablishedReply, newDNSPacketBetween(t, stub, client, response)))
+	verdict, ok = respQueue.verdict(4)
+	is.True(ok)                       // verdict should be set
+	is.Equal(verdict, nfqueue.NfDrop) // untracked response from loopback stub resolver should be dropped
+}
+
+func TestDNSResponseIPVersionDetected(t *testing.T) {
+	is := is.New(t)
+
+	f, dnsReqQueue, _ := newCallbackTestFilter(t, &FilterOptions{
+		Name:             "foo",
+		DNSQueue:         1000,
+		TrafficQueue:     1001,
+		IPVersion:        0,
+		AllowAnswersFor:  duration(time.Minute),
+		AllowedHostnames: []string{"example.com"},
+	})
+	manager, respQueue := newCallbackTestManager(f)
+	reqCallback := newDNSRequestCallback(f)
+	respCallback := newDNSResponseCallback(manager)
+
+	client := netip.MustParseAddrPort("[2001:db8::2]:40000")
+	resolver := netip.MustParseAddrPort("[2001:db8::53]:53")
+
+	request := newTestDNSRequest("example.com")
+	request.Questions[0].Type = layers.DNSTypeAAAA
+	reqCallback(newPacketAttribute(1, stateNew, newDNSPacketBetween(t, client, resolver, request)))
+	verdict, ok := dnsReqQueue.verdict(1)
+	is.True(ok)                         // verdict should be set
+	is.Equal(verdict, nfqueue.NfAccept) // IPv6 request for allowed hostname should be accepted
+
+	response := *request
+	response.QR = true
+	response.Answers = []layers.DNSResourceRecord{
+		{
+			Name:  []byte("example.com"),
+			Type:  layers.DNSTypeAAAA,
+			Class: layers.DNSClassIN,
+			TTL:   60,
+			IP:    net.ParseIP("2001:db8::1"),
+		},
+	}
+	respCallback(newPacketAttribute(2, stateEstablishedReply, newDNSPacketBetween(t, resolver, client, &response)))
+	verdict, ok = respQueue.verdict(2)
+	is.True(ok)                                                               // verdict should be set
+	is.Equal(verdict, nfqueue.NfAccept)                                       // IPv6 response should be parsed although the inbound DNS queue is IPv4
+	is.True(f.allowedBy(netip.MustParseAddr("2001:db8::1")) != allowedByNone) // answers of IPv6 responses should be allowed
+}
+
+func TestUntrackedConnectionsPerFilter(t *testing.T) {
+	is := is.New(t)
+
+	untracked, untrackedReqQueue, _ := newCallbackTestFilter(t, &FilterOptions{
+		Name:                 "untracked",
+		DNSQueue:             1000,
+		AllowAllHostnames:    true,
+		UntrackedConnections: true,
+	})
+	untracked.untrackedConnections = NewTimedCache[connectionID](zap.NewNop(), false)
+	tracked, _, _ := newCallbackTestFilter(t, &FilterOptions{
+		Name:             "tracked",
+		DNSQueue:         1002,
+		TrafficQueue:     1003,
+		AllowAnswersFor:  duration(time.Minute),
+		AllowedHostnames: []string{"example.com"},
+	})
+	manager, respQueue := newCallbackTestManager(untracked, tracked)
+	respCallback := newDNSResponseCallback(manager)
+
+	resolver := netip.MustParseAddrPort("192.168.1.1:53")
+	untrackedClient := netip.MustParseAddrPort("192.168.1.2:40000")
+	request := newTestDNSRequest("example.org")
+	newDNSRequestCallback(untracked)(newPacketAttribute(1, stateNew, newDNSPacketBetween(t, untrackedClient, resolver, request)))
+	verdict, ok := untrackedReqQueue.verdict(1)
+	is.True(ok)                         // verdict should be set
+	is.Equal(verdict, nfqueue.NfAccept) // request of allow-all filter should be accepted
+
+	response := *request
+	response.QR = true
+	response.Answers = []layers.DNSResourceRecord{
+		{
+			Name:  []byte("example.org"),
+			Type:  layers.DNSTypeA,
+			Class: layers.DNSClassIN,
+			TTL:   60,
+			IP:    net.ParseIP("198.51.100.1"),
+		},
+	}
+	respCallback(newPacketAttribute(2, stateEstablishedReply, newDNSPacketBetween(t, resolver, untrackedClient, &response)))
+	verdict, ok = respQueue.verdict(2)
+	is.True(ok)                                                                     // verdict should be set
+	is.Equal(verdict, nfqueue.NfAccept)                                             // response to request of untracked filter should be accepted
+	is.Equal(tracked.allowedBy(netip.MustParseAddr("198.51.100.1")), allowedByNone) // answers of untracked responses should not be allowed
+
+	// a response the untracked filter never saw a request for must
+	// still be matched to a request
+	unknownClient := netip.MustParseAddrPort("192.168.1.3:40000")
+	respCallback(newPacketAttribute(3, stateEstablishedReply, newDNSPacketBetween(t, resolver, unknownClient, &response)))
+	verdict, ok = respQueue.verdict(3)
+	is.True(ok)                       // verdict should be set
+	is.Equal(verdict, nfqueue.NfDrop) // response from unknown connection should be dropped
+	is.Equal(tracked.allowedBy(netip.MustParseAddr("198.51.100.1")), allowedByNone)
+}
+
+// newTCPPacketBetween serializes an IPv4 TCP packet from src to dst
+// with payload starting at sequence number seq. The packet is a SYN
+// if payload is empty.
+func newTCPPacketBetween(t testing.TB, src, dst netip.AddrPort, seq uint32, payload []byte) []byte {
+	ip := layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    src.Addr().AsSlice(),
+		DstIP:    dst.Addr().AsSlice(),
+	}
+	tcp := layers.TCP{
+		SrcPort: layers.TCPPort(src.Port()),
+		DstPort: layers.TCPPort(dst.Port()),
+		Seq:     seq,
+		SYN:     len(payload) == 0,
+		ACK:     len(payload) != 0,
+		PSH:     len(payload) != 0,
+		Window:  64240,
+	}
+	if err := tcp.SetNetworkLayerForChecksum(&ip); err != nil {
+		t.Fatalf("error setting network layer: %v", err)
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	if err := gopacket.SerializeLayers(buf, opts, &ip, &tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatalf("error serializing packet: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestMissingConntrackDropped(t *testing.T) {
+	is := is.New(t)
+
+	f, _, genericQueue := newCallbackTestFilter(t, &FilterOptions{
+		Name:               "foo",
+		TrafficQueue:       1001,
+		IPVersion:          4,
+		AllowAnswersFor:    duration(time.Minute),
+		AllowedHostnames:   []string{"example.com"},
+		OnMissingConntrack: missingConntrackDrop,
+	})
+	callback := newGenericCallback(f)
+
+	src := netip.MustParseAddrPort("192.168.1.2:40000")
+	dst := netip.MustParseAddrPort("192.0.2.1:443")
+	f.allowIPBy(dst.Addr(), allowedByDNSAnswer, time.Minute)
+
+	attr := newPacketAttribute(1, stateEstablished, newTCPPacketBetween(t, src, dst, 1, nil))
+	callback(attr)
+	verdict, ok := genericQueue.verdict(1)
+	is.True(ok)                         // verdict should be set
+	is.Equal(verdict, nfqueue.NfAccept) // packet to allowed IP with conntrack state should be accepted
+
+	// the kernel doesn't attach conntrack state to INVALID packets
+	attr = newPacketAttribute(2, 0, newTCPPacketBetween(t, src, dst, 2, nil))
+	attr.CtInfo = nil
+	callback(attr)
+	verdict, ok = genericQueue.verdict(2)
+	is.True(ok)                       // verdict should be set
+	is.Equal(verdict, nfqueue.NfDrop) // packet without conntrack state should be dropped regardless of IP
+}
+
+func TestUnknownOpcodeResponses(t *testing.T) {
+	tests := []struct {
+		testName             string
+		rejectUnknownOpcodes bool
+		verdict              int
+	}{
+		{
+			testName:             "accepted by default",
+			rejectUnknownOpcodes: false,
+			verdict:              nfqueue.NfAccept,
+		},
+		{
+			testName:             "dropped when rejected",
+			rejectUnknownOpcodes: true,
+			verdict:              nfqueue.NfDrop,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.testName, func(t *testing.T) {
+			is := is.New(t)
+
+			f, dnsReqQueue, _ := newCallbackTestFilter(t, &FilterOptions{
+				Name:                 "foo",
+				DNSQueue:             1000,
+				TrafficQueue:         1001,
+				IPVersion:            4,
+				AllowAnswersFor:      duration(time.Minute),
+				AllowedHostnames:     []string{"example.com"},
+				RejectUnknownOpcodes: tt.rejectUnknownOpcodes,
+			})
+			manager, respQueue := newCallbackTestManager(f)
+			reqCallback := newDNSRequestCallback(f)
+			respCallback := newDNSResponseCallback(manager)
+
+			client := netip.MustParseAddrPort("192.168.1.2:40000")
+			resolver := netip.MustParseAddrPort("192.168.1.1:53")
+
+			request := newTestDNSRequest("example.com")
+			reqCallback(newPacketAttribute(1, stateNew, newDNSPacketBetween(t, client, resolver, request)))
+			verdict, ok := dnsReqQueue.verdict(1)
+			is.True(ok)                         // verdict should be set
+			is.Equal(verdict, nfqueue.NfAccept) // request for allowed hostname should be accepted
+
+			response := *request
+			response.QR = true
+			response.OpCode = layers.DNSOpCodeIQuery
+			respCallback(newPacketAttribute(2, stateEstablishedReply, newDNSPacketBetween(t, resolver, client, &response)))
+			verdict, ok = respQueue.verdict(2)
+			is.True(ok)                   // verdict should be set
+			is.Equal(verdict, tt.verdict) // responses with unknown opcodes should only be dropped when configured to
+		})
+	}
+}
+
+// queuedVerdict returns the packet and next queue of a verdict message
+// built by queueVerdictMessage.
+func queuedVerdict(t *testing.T, msg netlink.Message) (uint32, uint16) {
+	t.Helper()
+
+	attrs, err := netlink.UnmarshalAttributes(msg.Data[4:])
+	if err != nil || len(attrs) != 1 || attrs[0].Type != nfqaVerdictHdr {
+		t.Fatalf("invalid verdict message: %v", err)
+	}
+	verdict := binary.BigEndian.Uint32(attrs[0].Data[:4])
+	if verdict&0xffff != nfQueue {
+		t.Fatalf("verdict %d is not NF_QUEUE", verdict&0xffff)
+	}
+
+	return binary.BigEndian.Uint32(attrs[0].Data[4:]), uint16(verdict >> 16)
+}
+
+func TestNextQueueVerdict(t *testing.T) {
+	is := is.New(t)
+
+	const breakGlassMark = 0x1234
+	f, _, genericQueue := newCallbackTestFilter(t, &FilterOptions{
+		Name:             "foo",
+		TrafficQueue:     1001,
+		NextQueue:        2000,
+		IPVersion:        4,
+		AllowAnswersFor:  duration(time.Minute),
+		AllowedHostnames: []string{"example.com"},
+	})
+	f.breakGlassMark = breakGlassMark
+	callback := newGenericCallback(f)
+
+	src := netip.MustParseAddrPort("192.168.1.2:40000")
+	allowed := netip.MustParseAddrPort("192.0.2.1:443")
+	denied := netip.MustParseAddrPort("192.0.2.2:443")
+	f.allowIPBy(allowed.Addr(), allowedByDNSAnswer, time.Minute)
+
+	callback(newPacketAttribute(1, stateNew, newTCPPacketBetween(t, src, allowed, 1, nil)))
+	_, ok := genericQueue.verdict(1)
+	is.True(!ok)                            // allowed packet should not be accepted directly
+	is.Equal(len(genericQueue.messages), 1) // allowed packet should be passed to the next queue
+	id, queue := queuedVerdict(t, genericQueue.messages[0])
+	is.Equal(id, uint32(1))       // verdict should be set for the allowed packet
+	is.Equal(queue, uint16(2000)) // allowed packet should be passed to the next queue
+
+	callback(newPacketAttribute(2, stateNew, newTCPPacketBetween(t, src, denied, 1, nil)))
+	verdict, ok := genericQueue.verdict(2)
+	is.True(ok)                             // denied packet should have a verdict
+	is.Equal(verdict, nfqueue.NfDrop)       // denied packet should be dropped
+	is.Equal(len(genericQueue.messages), 1) // denied packet should not be passed to the next queue
+
+	mark := uint32(breakGlassMark)
+	attr := newPacketAttribute(3, stateNew, newTCPPacketBetween(t, src, denied, 1, nil))
+	attr.Mark = &mark
+	callback(attr)
+	_, ok = genericQueue.verdict(3)
+	is.True(!ok)                            // break-glass packet should not be accepted directly
+	is.Equal(len(genericQueue.messages), 2) // break-glass packet should be passed to the next queue
+	id, queue = queuedVerdict(t, genericQueue.messages[1])
+	is.Equal(id, uint32(3))       // verdict should be set for the break-glass packet
+	is.Equal(queue, uint16(2000)) // break-glass packet should be passed to the next queue
+}
+
+func TestNoDataResponseCallback(t *testing.T) {
+	is := is.New(t)
+
+	f, dnsReqQueue, _ := newCallbackTestFilter(t, &FilterOptions{
+		Name:             "foo",
+		DNSQueue:         1000,
+		TrafficQueue:     1001,
+		IPVersion:        4,
+		AllowAnswersFor:  duration(time.Minute),
+		AllowedHostnames: []string{"example.com"},
+	})
+	manager, respQueue := newCallbackTestManager(f)
+	core, logs := observer.New(zap.DebugLevel)
+	manager.logger = zap.New(core)
+	reqCallback := newDNSRequestCallback(f)
+	respCallback := newDNSResponseCallback(manager)
+
+	client := netip.MustParseAddrPort("192.168.1.2:40000")
+	resolver := netip.MustParseAddrPort("192.168.1.1:53")
+
+	request := newTestDNSRequest("example.com")
+	request.Questions[0].Type = layers.DNSTypeAAAA
+	reqCallback(newPacketAttribute(1, stateNew, newDNSPacketBetween(t, client, resolver, request)))
+	verdict, _ := dnsReqQueue.verdict(1)
+	is.Equal(verdict, nfqueue.NfAccept) // request for allowed hostname should be accepted
+
+	response := *request
+	response.QR = true
+	response.RA = true
+	respCallback(newPacketAttribute(2, stateEstablishedReply, newDNSPacketBetween(t, resolver, client, &response)))
+	verdict, ok := respQueue.verdict(2)
+	is.True(ok)                                                                    // verdict should be set
+	is.Equal(verdict, nfqueue.NfAccept)                                            // NODATA response should be accepted
+	is.Equal(f.status().NoDataResponses, int64(1))                                 // NODATA response should be counted
+	is.Equal(logs.FilterMessage("allowing DNS response with no answers").Len(), 1) // NODATA response should be logged
+	is.Equal(f.allowedIPs.Len(), 0)                                                // NODATA response should not allow IPs
+
+	request.ID = 2
+	reqCallback(newPacketAttribute(3, stateNew, newDNSPacketBetween(t, client, resolver, request)))
+	response = *request
+	response.QR = true
+	response.RA = true
+	response.ResponseCode = layers.DNSResponseCodeNXDomain
+	respCallback(newPacketAttribute(4, stateEstablishedReply, newDNSPacketBetween(t, resolver, client, &response)))
+	verdict, ok = respQueue.verdict(4)
+	is.True(ok)                                    // verdict should be set
+	is.Equal(verdict, nfqueue.NfAccept)            // NXDOMAIN response should be accepted
+	is.Equal(f.status().NoDataResponses, int64(1)) // NXDOMAIN response should not be counted as NODATA
+}
+
+func TestDNSBLResponseCallback(t *testing.T) {
+	is := is.New(t)
+
+	f, dnsReqQueue, _ := newCallbackTestFilter(t, &FilterOptions{
+		Name:             "foo",
+		DNSQueue:         1000,
+		TrafficQueue:     1001,
+		IPVersion:        4,
+		AllowAnswersFor:  duration(time.Minute),
+		AllowedHostnames: []string{"example.com"},
+		DNSBLZones:       []string{"dnsbl.example"},
+	})
+	f.dnsblListed = NewTimedCache[netip.Addr](zap.NewNop(), false)
+	f.dnsblUnlisted = NewTimedCache[netip.Addr](zap.NewNop(), false)
+	f.dnsblSem = make(chan struct{}, 1)
+	var queries int
+	f.lookupNetIP = func(_ context.Context, _, host string) ([]netip.Addr, error) {
+		queries++
+		if host == "1.2.0.192.dnsbl.example" {
+			return []netip.Addr{netip.MustParseAddr("127.0.0.2")}, nil
+		}
+		return nil, &net.DNSError{IsNotFound: true}
+	}
+	manager, respQueue := newCallbackTestManager(f)
+	reqCallback := newDNSRequestCallback(f)
+	respCallback := newDNSResponseCallback(manager)
+
+	client := netip.MustParseAddrPort("192.168.1.2:40000")
+	resolver := netip.MustParseAddrPort("192.168.1.1:53")
+	listed := netip.MustParseAddr("192.0.2.1")
+	unlisted := netip.MustParseAddr("192.0.2.2")
+
+	request := newTestDNSRequest("example.com")
+	reqCallback(newPacketAttribute(1, stateNew, newDNSPacketBetween(t, client, resolver, request)))
+	verdict, _ := dnsReqQueue.verdict(1)
+	is.Equal(verdict, nfqueue.NfAccept) // request for allowed hostname should be accepted
+
+	response := *request
+	response.QR = true
+	response.RA = true
+	for _, ip := range []netip.Addr{listed, unlisted} {
+		response.Answers = append(response.Answers, layers.DNSResourceRecord{
+			Name:  []byte("example.com"),
+			Type:  layers.DNSTypeA,
+			Class: layers.DNSClassIN,
+			TTL:   60,
+			IP:    ip.AsSlice(),
+		})
+	}
+	respCallback(newPacketAttribute(2, stateEstablishedReply, newDNSPacketBetween(t, resolver, client, &response)))
+	manager.dnsblChecks.Wait()
+	verdict, ok := respQueue.verdict(2)
+	is.True(ok)                                    // verdict should be set
+	is.Equal(verdict, nfqueue.NfAccept)            // response should be accepted
+	is.True(!f.allowedIPs.EntryExists(listed))     // listed IP should not be allowed
+	is.True(f.allowedIPs.EntryExists(unlisted))    // unlisted IP should be allowed
+	is.True(f.dnsblListed.EntryExists(listed))     // listed IP should be cached
+	is.True(f.dnsblUnlisted.EntryExists(unlisted)) // unlisted IP should be cached
+	is.Equal(queries, 2)                           // each IP should be queried once
+
+	is.True(f.ipBlocklisted(zap.NewNop(), listed))    // listed IP should stay blocklisted
+	is.True(!f.ipBlocklisted(zap.NewNop(), unlisted)) // unlisted IP should stay unlisted
+	is.Equal(queries, 2)                              // cached results should not be queried again
+
+	// fill the semaphore so the next response can't be checked
+	f.dnsblSem <- struct{}{}
+	request.ID = 2
+	reqCallback(newPacketAttribute(3, stateNew, newDNSPacketBetween(t, client, resolver, request)))
+	response.ID = 2
+	respCallback(newPacketAttribute(4, stateEstablishedReply, newDNSPacketBetween(t, resolver, client, &response)))
+	verdict, ok = respQueue.verdict(4)
+	is.True(ok)                       // verdict should be set
+	is.Equal(verdict, nfqueue.NfDrop) // response should be dropped when too many are being checked
+
+	// no checks should be started once stopping
+	<-f.dnsblSem
+	manager.dnsblMtx.Lock()
+	manager.dnsblStopped = true
+	manager.dnsblMtx.Unlock()
+	request.ID = 3
+	reqCallback(newPacketAttribute(5, stateNew, newDNSPacketBetween(t, client, resolver, request)))
+	response.ID = 3
+	respCallback(newPacketAttribute(6, stateEstablishedReply, newDNSPacketBetween(t, resolver, client, &response)))
+	verdict, ok = respQueue.verdict(6)
+	is.True(ok)                       // verdict should be set
+	is.Equal(verdict, nfqueue.NfDrop) // response should be dropped when stopping
+	is.Equal(len(f.dnsblSem), 0)      // semaphore should be released when stopping
+}
+
+func TestPortRestrictionCallback(t *testing.T) {
+	f, _, genericQueue := newCallbackTestFilter(t, &FilterOptions{
+		Name:             "foo",
+		TrafficQueue:     1001,
+		IPVersion:        4,
+		AllowAnswersFor:  duration(time.Minute),
+		AllowedHostnames: []string{"example.com"},
+		AllowedSrcPorts:  []uint16{40000},
+		AllowedDstPorts:  []uint16{443},
+	})
+	callback := newGenericCallback(f)
+
+	client := netip.MustParseAddr("192.168.1.2")
+	remote := netip.MustParseAddr("192.0.2.1")
+	f.allowIPBy(remote, allowedByDNSAnswer, time.Minute)
+
+	serialize := func(ls ...gopacket.SerializableLayer) []byte {
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{
+			FixLengths:       true,
+			ComputeChecksums: true,
+		}
+		if err := gopacket.SerializeLayers(buf, opts, ls...); err != nil {
+			t.Fatalf("error serializing packet: %v", err)
+		}
+		return buf.Bytes()
+	}
+	icmpPacket := serialize(
+		&layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolICMPv4,
+			SrcIP:    remote.AsSlice(),
+			DstIP:    client.AsSlice(),
+		},
+		&layers.ICMPv4{
+			TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded),
+		},
+	)
+	fragmentPacket := serialize(
+		&layers.IPv4{
+			Version:    4,
+			TTL:        64,
+			Protocol:   layers.IPProtocolTCP,
+			FragOffset: 185,
+			SrcIP:      client.AsSlice(),
+			DstIP:      remote.AsSlice(),
+		},
+		gopacket.Payload(make([]byte, 64)),
+	)
+
+	tests := []struct {
+		testName string
+		ctInfo   uint32
+		packet   []byte
+		verdict  int
+	}{
+		{
+			testName: "allowed ports",
+			ctInfo:   stateNew,
+			packet:   newTCPPacketBetween(t, netip.AddrPortFrom(client, 40000), netip.AddrPortFrom(remote, 443), 1, nil),
+			verdict:  nfqueue.NfAccept,
+		},
+		{
+			testName: "disallowed destination port",
+			ctInfo:   stateNew,
+			packet:   newTCPPacketBetween(t, netip.AddrPortFrom(client, 40000), netip.AddrPortFrom(remote, 22), 1, nil),
+			verdict:  nfqueue.NfDrop,
+		},
+		{
+			testName: "disallowed source port",
+			ctInfo:   stateNew,
+			packet:   newTCPPacketBetween(t, netip.AddrPortFrom(client, 50000), netip.AddrPortFrom(remote, 443), 1, nil),
+			verdict:  nfqueue.NfDrop,
+		},
+		{
+			testName: "reply of allowed connection",
+			ctInfo:   stateEstablishedReply,
+			packet:   newTCPPacketBetween(t, netip.AddrPortFrom(remote, 443), netip.AddrPortFrom(client, 40000), 1, nil),
+			verdict:  nfqueue.NfAccept,
+		},
+		{
+			testName: "reply of disallowed connection",
+			ctInfo:   stateEstablishedReply,
+			packet:   newTCPPacketBetween(t, netip.AddrPortFrom(remote, 22), netip.AddrPortFrom(client, 40000), 1, nil),
+			verdict:  nfqueue.NfDrop,
+		},
+		{
+			testName: "ICMP error",
+			ctInfo:   stateRelatedReply,
+			packet:   icmpPacket,
+			verdict:  nfqueue.NfAccept,
+		},
+		{
+			testName: "IP fragment",
+			ctInfo:   stateEstablished,
+			packet:   fragmentPacket,
+			verdict:  nfqueue.NfAccept,
+		},
+	}
+
+	for i, tt := range tests {
+		packetID := uint32(i + 1)
+		t.Run(tt.testName, func(t *testing.T) {
+			is := is.New(t)
+
+			callback(newPacketAttribute(packetID, tt.ctInfo, tt.packet))
+			verdict, ok := genericQueue.verdict(packetID)
+			is.True(ok)                   // verdict should be set
+			is.Equal(verdict, tt.verdict) // packet should get the expected verdict
+		})
+	}
+}
+
+func TestUDPRetransmissionCallback(t *testing.T) {
+	is := is.New(t)
+
+	f, dnsReqQueue, _ := newCallbackTestFilter(t, &FilterOptions{
+		Name:             "foo",
+		DNSQueue:         1000,
+		TrafficQueue:     1001,
+		IPVersion:        4,
+		AllowAnswersFor:  duration(time.Minute),
+		AllowedHostnames: []string{"example.com"},
+	})
+	core, logs := observer.New(zap.DebugLevel)
+	f.logger = zap.New(core)
+	manager, respQueue := newCallbackTestManager(f)
+	reqCallback := newDNSRequestCallback(f)
+	respCallback := newDNSResponseCallback(manager)
+
+	client := netip.MustParseAddrPort("192.168.1.2:40000")
+	resolver := netip.MustParseAddrPort("192.168.1.1:53")
+	connID := connectionID{isUDP: true, src: client, dst: resolver}
+
+	request := newTestDNSRequest("example.com")
+	requestPacket := newDNSPacketBetween(t, client, resolver, request)
+	response := *request
+	response.QR = true
+	response.RA = true
+	response.Answers = []layers.DNSResourceRecord{
+		{
+			Name:  []byte("example.com"),
+			Type:  layers.DNSTypeA,
+			Class: layers.DNSClassIN,
+			TTL:   60,
+			IP:    net.IPv4(192, 0, 2, 1),
+		},
+	}
+	responsePacket := newDNSPacketBetween(t, resolver, client, &response)
+
+	reqCallback(newPacketAttribute(1, stateNew, requestPacket))
+	verdict, _ := dnsReqQueue.verdict(1)
+	is.Equal(verdict, nfqueue.NfAccept) // request should be accepted
+
+	// the request is retransmitted before the response arrives
+	reqCallback(newPacketAttribute(2, stateEstablished, requestPacket))
+	verdict, ok := dnsReqQueue.verdict(2)
+	is.True(ok)                                                                 // verdict should be set
+	is.Equal(verdict, nfqueue.NfAccept)                                         // retransmitted request should be accepted
+	is.Equal(logs.FilterMessage("allowing retransmitted DNS request").Len(), 1) // retransmission should be detected
+	is.Equal(f.connections.Stats().Len, 1)                                      // retransmission should not be tracked again
+
+	respCallback(newPacketAttribute(3, stateEstablishedReply, responsePacket))
+	verdict, _ = respQueue.verdict(3)
+	is.Equal(verdict, nfqueue.NfAccept)                                 // response should be accepted
+	is.True(f.allowedIPs.EntryExists(netip.MustParseAddr("192.0.2.1"))) // answer should be allowed
+	is.True(!f.connections.EntryExists(connID))                         // response should remove the connection
+
+	// a late retransmission arrives after the response
+	reqCallback(newPacketAttribute(4, stateEstablished, requestPacket))
+	verdict, ok = dnsReqQueue.verdict(4)
+	is.True(ok)                                                                 // verdict should be set
+	is.Equal(verdict, nfqueue.NfAccept)                                         // late retransmission should be accepted
+	is.Equal(logs.FilterMessage("allowing retransmitted DNS request").Len(), 2) // late retransmission should be detected
+	is.True(!f.connections.EntryExists(connID))                                 // late retransmission should not recreate the connection
+
+	// the resolver answers the late retransmission too
+	respCallback(newPacketAttribute(5, stateEstablishedReply, responsePacket))
+	verdict, ok = respQueue.verdict(5)
+	is.True(ok)                       // verdict should be set
+	is.Equal(verdict, nfqueue.NfDrop) // duplicate response should be dropped
+
+	// a new request on the same connection is validated again
+	request.ID = 2
+	reqCallback(newPacketAttribute(6, stateEstablished, newDNSPacketBetween(t, client, resolver, request)))
+	verdict, _ = dnsReqQueue.verdict(6)
+	is.Equal(verdict, nfqueue.NfAccept)                                         // new request should be accepted
+	is.Equal(logs.FilterMessage("allowing retransmitted DNS request").Len(), 2) // new request should not be a retransmission
+	is.True(f.connections.EntryExists(connID))                                  // new request should be tracked
+}
+
+func TestSelfFilterExchange(t *testing.T) {
+	is := is.New(t)
+
+	config, err := parseConfigBytes(zap.NewNop(), []byte(`
+inboundDNSQueue = 1
+selfDNSQueue = 100
+
+[[filters]]
+name = "foo"
+dnsQueue = 1000
+trafficQueue = 1001
+allowAnswersFor = "10s"
+allowedHostnames = ["foo"]
+lookupUnknownIPs = true`))
+	is.NoErr(err)                                    // parsing config should succeed
+	is.Equal(config.Filters[0].Name, selfFilterName) // self filter should be created
+
+	selfFilter, selfReqQueue, _ := newCallbackTestFilter(t, &config.Filters[0])
+	selfFilter.isSelfFilter = true
+	foo, fooReqQueue, _ := newCallbackTestFilter(t, &config.Filters[1])
+	manager, respQueue := newCallbackTestManager(foo, selfFilter)
+	selfReqCallback := newDNSRequestCallback(selfFilter)
+	fooReqCallback := newDNSRequestCallback(foo)
+	respCallback := newDNSResponseCallback(manager)
+
+	client := netip.MustParseAddrPort("192.168.1.2:40000")
+	resolver := netip.MustParseAddrPort("192.168.1.1:53")
+
+	packetID := uint32(0)
+	exchange := func(reqCallback nfqueue.HookFunc, reqQueue *fakeQueue, hostname string, qtype layers.DNSType, rcode layers.DNSResponseCode) int {
+		t.Helper()
+
+		packetID++
+		request := newTestDNSRequest(hostname)
+		request.ID = uint16(packetID)
+		request.Questions[0].Type = qtype
+		reqCallback(newPacketAttribute(packetID, stateNew, newDNSPacketBetween(t, client, resolver, request)))
+		verdict, ok := reqQueue.verdict(packetID)
+		is.True(ok)                         // verdict should be set
+		is.Equal(verdict, nfqueue.NfAccept) // request should be accepted
+
+		packetID++
+		response := *request
+		response.QR = true
+		response.RA = true
+		response.ResponseCode = rcode
+		respCallback(newPacketAttribute(packetID, stateEstablishedReply, newDNSPacketBetween(t, resolver, client, &response)))
+		verdict, ok = respQueue.verdict(packetID)
+		is.True(ok) // verdict should be set
+
+		return verdict
+	}
+
+	// Egress Eddie's own reverse lookups are allowed by the self
+	// filter and their responses matched to it
+	for _, rcode := range []layers.DNSResponseCode{layers.DNSResponseCodeNoErr, layers.DNSResponseCodeNXDomain, layers.DNSResponseCodeServFail} {
+		verdict := exchange(selfReqCallback, selfReqQueue, "1.2.0.192.in-addr.arpa", layers.DNSTypePTR, rcode)
+		is.Equal(verdict, nfqueue.NfAccept) // responses to Egress Eddie's lookups should be accepted regardless of response code
+	}
+	is.Equal(selfFilter.connections.Stats().Len, 0) // responses should remove the self filter's connections
+
+	verdict := exchange(fooReqCallback, fooReqQueue, "foo", layers.DNSTypeA, layers.DNSResponseCodeServFail)
+	is.Equal(verdict, nfqueue.NfDrop) // other filters should still drop SERVFAIL responses
+}
@@ -3,13 +3,36 @@ package main
 import (
 	"errors"
 	"fmt"
+	"net/netip"
+	"net/url"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"go.uber.org/zap"
 )
 
-const selfFilterName = "self-filter"
+const (
+	selfFilterName = "self-filter"
+
+	encapsulatedDrop        = "drop"
+	encapsulatedDecapsulate = "decapsulate"
+
+	dnsTransportAny = "any"
+	dnsTransportTCP = "tcp"
+	dnsTransportUDP = "udp"
+
+	missingConntrackValidate = "validate"
+	missingConntrackDrop     = "drop"
+
+	// DNS over UDP must support messages of at least 512 bytes, and
+	// a UDP payload can't be larger than 65507 bytes
+	minUDPResponseSize = 512
+	maxUDPResponseSize = 65507
+)
 
 type duration time.Duration
 
@@ -23,117 +46,546 @@ func (d *duration) UnmarshalText(text []byte) error {
 	return nil
 }
 
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
 type Config struct {
-	InboundDNSQueue uint16
-	SelfDNSQueue    uint16
-	IPv6            bool
-	Filters         []FilterOptions
+	InboundDNSQueue   uint16
+	SelfDNSQueue      uint16
+	IPv6              bool
+	OnEncapsulated    string
+	DiagnosticDumpDir string
+	ShutdownTimeout   duration
+	TextfilePath      string
+	TextfileInterval  duration
+	// StateDBPath is the path of a bbolt database the allowed IPs and
+	// hostnames of filters are mirrored to
+	StateDBPath string
+	// BreakGlassMark is the mark of packets that are accepted without
+	// being filtered, so egress can be unblocked during incidents.
+	// It is disabled if 0.
+	BreakGlassMark uint32
+	// AdminSocketPath is the path of a unix socket HTTP requests to
+	// manage Egress Eddie are served on
+	AdminSocketPath string
+	// VerdictFile is the path of a file the verdicts filters make on
+	// packets of their traffic queues are appended to as JSON lines
+	VerdictFile string
+	// VerdictQueueSize is how many verdict decisions are buffered
+	// before new decisions are dropped
+	VerdictQueueSize int
+	Filters          []FilterOptions
+	// LoggerFactory returns the logger of the filter named filterName,
+	// the logger passed to StartFilters with a "filter.name" field is
+	// used if it is nil
+	LoggerFactory func(filterName string) *zap.Logger `toml:"-" json:"-"`
 }
 
 type FilterOptions struct {
-	Name              string
-	DNSQueue          uint16
-	TrafficQueue      uint16
-	IPv6              bool
-	AllowAllHostnames bool
-	LookupUnknownIPs  bool
-	AllowAnswersFor   duration
-	ReCacheEvery      duration
-	AllowedHostnames  []string
-	CachedHostnames   []string
+	Name         string
+	DNSQueue     uint16
+	TrafficQueue uint16
+	// NextQueue is the nfqueue allowed packets of the traffic queue
+	// are passed to instead of being accepted
+	NextQueue uint16
+	// IPVersion is the IP version of packets the filter will
+	// process, 4 or 6, or 0 to process both
+	IPVersion                int
+	AllowAllHostnames        bool
+	LookupUnknownIPs         bool
+	AllowDNSUpdate           bool
+	AllowDNSNotify           bool
+	OnEncapsulated           string
+	DNSTransport             string
+	OnMissingConntrack       string
+	DropIPOptions            bool
+	UseMarkInheritance       bool
+	RejectSuspiciousNames    bool
+	RejectSuspiciousFlags    bool
+	RejectUnknownOpcodes     bool
+	DisableDynamicHostnames  bool
+	ValidateConntrackIDs     bool
+	LogMatchedRules          bool
+	ValidateCNAMETargets     bool
+	BailiwickCheck           bool
+	FailOpenOnResolverOutage bool
+	ConntrackEvict           bool
+	VerifyForward            bool
+	MatchSNI                 bool
+	UntrackedConnections     bool
+	// CorrelateParallelRequests allows responses to requests that
+	// were sent to multiple resolvers in parallel to be matched by
+	// their transaction ID if their connection isn't tracked
+	CorrelateParallelRequests bool
+	// MatchAnswerTypeToQuestion ignores answers of DNS responses whose
+	// types weren't asked for by the questions of the request
+	MatchAnswerTypeToQuestion bool
+	// AllowSRVPorts allows the ports of SRV answers for the IPs their
+	// targets resolve to, in addition to AllowedDstPorts
+	AllowSRVPorts bool
+	// DropFlowLabels drops IPv6 packets of new connections that have
+	// a flow label set
+	DropFlowLabels bool
+	// BlockDoH drops plaintext DNS over HTTPS requests to hosts that
+	// aren't in AllowedDoHHostnames
+	BlockDoH bool
+	// FCrDNS only allows IPs from reverse lookups if a forward lookup
+	// of the allowed hostname resolves to the IP
+	FCrDNS bool
+	// DNSParseFailFallback allows DNS requests that can't be parsed
+	// if their source or destination IP is allowed, instead of
+	// dropping them
+	DNSParseFailFallback bool
+	// ExcludeLoopback is a pointer so it can default to true
+	ExcludeLoopback    *bool
+	AllowAnswersFor    duration
+	ReCacheEvery       duration
+	ReapIdleConnsEvery duration
+	MaxUDPResponseSize int
+	// MaxQuestionsPerRequest is how many questions a DNS request can
+	// have
+	MaxQuestionsPerRequest int
+	// MaxAnswersPerQuestion is how many answers a DNS response can
+	// have for each of its questions
+	MaxAnswersPerQuestion int
+	RecentDeniesSize      int
+	// MinLabels is how many labels a hostname must have to be
+	// allowed, so overly broad allowed hostnames such as "co.uk"
+	// don't allow too much
+	MinLabels int
+	// TrafficConntrack is whether packets of the traffic queue are
+	// queued with their conntrack state, it is a pointer so it can
+	// default to true
+	TrafficConntrack *bool
+	// MaxConcurrentLookups is how many reverse lookups can be made at
+	// once if LookupUnknownIPs is set, there is no limit if it is 0
+	MaxConcurrentLookups int
+	// MaxReassemblyBytes is how many bytes of a TCP connection can be
+	// buffered to reassemble data spanning multiple segments
+	MaxReassemblyBytes int
+	// MaxReassemblyConns is how many TCP connections can be
+	// reassembled at once, for ClientHellos and HTTP requests each
+	MaxReassemblyConns int
+	// TrafficWorkers is how many goroutines process packets of the
+	// traffic queue concurrently, packets are processed by the
+	// nfqueue callback if it is 0 or 1
+	TrafficWorkers int
+	// MaxDedupPackets is how many packets verdicts are cached for if
+	// DedupWindow is set, defaultMaxDedupPackets is used if it is 0
+	MaxDedupPackets int
+	// AnswerDedupWindow is how soon an allowed IP must expire for a
+	// DNS answer with the IP to allow it again, IPs are always
+	// allowed again if it is 0
+	AnswerDedupWindow duration
+	// WarnAllowedIPsThreshold is how many allowed IPs a filter can
+	// have before a warning is logged
+	WarnAllowedIPsThreshold uint
+	AllowedHostnames        []string
+	CachedHostnames         []string
+	QuietHostnames          []string
+	DNSBLZones              []string
+	// AllowedRcodes are the names of DNS response codes, such as
+	// "NOERROR", of responses that are accepted
+	AllowedRcodes   []string
+	AllowedSrcPorts []uint16
+	AllowedDstPorts []uint16
+	CPUAffinity     []int
+	// AllowedEDNSOptions are the names of EDNS options, such as
+	// "COOKIE", that DNS requests can have, requests with other
+	// options are dropped
+	AllowedEDNSOptions []string
+	// DNSAllowedSources are CIDRs of the source IPs DNS requests can
+	// be sent from, requests from other IPs are dropped
+	DNSAllowedSources []string
+	// AllowedProtocols are the names of transport protocols, such as
+	// "tcp", packets of the traffic queue can have, packets of other
+	// protocols are dropped
+	AllowedProtocols []string
+	// AllowedTrafficClasses are the IPv6 traffic classes packets of
+	// the traffic queue can have, packets with other traffic classes
+	// are dropped
+	AllowedTrafficClasses []int
+	// AllowedDoHHostnames are the hosts DNS over HTTPS requests can
+	// be sent to if BlockDoH is set
+	AllowedDoHHostnames []string
+
+	// MatchExpression is a CEL expression that allows DNS questions
+	// in addition to AllowedHostnames
+	MatchExpression              string
+	AllowedHostnamesURL          string
+	AllowedHostnamesSyncInterval duration
+	AllowedHostnamesEnvVar       string
+	ResolverOutageWindow         duration
+	// SlowDNSResponseThreshold is how long a resolver can take to
+	// respond to a DNS request before the response is logged as slow,
+	// slow responses aren't logged if it is 0
+	SlowDNSResponseThreshold duration
+	// PostResponseGrace is how long new connections from the source
+	// of a DNS request are allowed after its response is processed,
+	// no connections are allowed this way if it is 0
+	PostResponseGrace duration
+	// ExpiryNotifyWindow is how recently a hostname allowed from an
+	// answer must have been matched for its expiry to be reported,
+	// expiries aren't reported if it is 0
+	ExpiryNotifyWindow duration
+	// DedupWindow is how long the verdict of a packet of the traffic
+	// queue is reused for identical packets, packets aren't
+	// deduplicated if it is 0
+	DedupWindow duration
+
+	// Line is the line of the config file the filter is defined on,
+	// or 0 if it is unknown
+	Line int `toml:"-" json:"-"`
+}
+
+// ConfigTransformation is a change made to a config while parsing it.
+type ConfigTransformation struct {
+	// Filter is the name of the filter that was changed
+	Filter      string
+	Description string
+}
+
+func (c ConfigTransformation) String() string {
+	return fmt.Sprintf("filter %q: %s", c.Filter, c.Description)
 }
 
-func ParseConfig(confPath string) (*Config, error) {
+func ParseConfig(logger *zap.Logger, confPath string) (*Config, error) {
+	config, _, err := ExplainConfig(logger, confPath)
+	return config, err
+}
+
+// ExplainConfig parses a config file and returns the changes that
+// were made to it while parsing.
+func ExplainConfig(logger *zap.Logger, confPath string) (*Config, []ConfigTransformation, error) {
 	data, err := os.ReadFile(confPath)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return parseConfigBytes(data)
+	config, transformations, err := explainConfigBytes(logger, data)
+	lines := filterLines(data)
+	if err != nil {
+		var filterErr *filterConfigError
+		if errors.As(err, &filterErr) && filterErr.index < len(lines) {
+			return nil, nil, fmt.Errorf("%s:%d: %v", confPath, lines[filterErr.index], err)
+		}
+		return nil, nil, err
+	}
+	// the self filter isn't defined in the config file, it is
+	// prepended to the filters that are
+	filters := config.Filters
+	if len(filters) > 0 && filters[0].Name == selfFilterName {
+		filters = filters[1:]
+	}
+	for i := range filters {
+		if i < len(lines) {
+			filters[i].Line = lines[i]
+		}
+	}
+
+	return config, transformations, nil
 }
 
-func parseConfigBytes(cb []byte) (*Config, error) {
-	var config Config
+// ConfigErrors are the errors of invalid options of a config.
+type ConfigErrors struct {
+	Errors []*ConfigError
+}
 
-	if err := toml.Unmarshal(cb, &config); err != nil {
-		return nil, err
+func (c *ConfigErrors) Error() string {
+	msgs := make([]string, len(c.Errors))
+	for i, err := range c.Errors {
+		msgs[i] = err.Error()
 	}
 
-	if len(config.Filters) == 0 {
-		return nil, errors.New("at least one filter must be specified")
+	return strings.Join(msgs, "; ")
+}
+
+// ConfigError is an error of an option of a config.
+type ConfigError struct {
+	// Filter is the name of the filter the option belongs to, or
+	// empty if it is a top level option
+	Filter string
+	// Field is the name of the option in the config file
+	Field string
+	Err   error
+}
+
+func (c *ConfigError) Error() string {
+	return c.Err.Error()
+}
+
+func (c *ConfigError) Unwrap() error {
+	return c.Err
+}
+
+// optionError returns an error of the option field.
+func optionError(field string, err error) error {
+	return &ConfigError{Field: field, Err: err}
+}
+
+// filterConfigError is an error of a filter of a config, it is used
+// to find out where in the config file the filter is defined.
+type filterConfigError struct {
+	// index is the index of the filter in the config
+	index int
+	err   error
+}
+
+func (f *filterConfigError) Error() string {
+	return f.err.Error()
+}
+
+func (f *filterConfigError) Unwrap() error {
+	return f.err
+}
+
+// filterLines returns the line numbers of the "[[filters]]" table
+// headers of a config in order. The TOML decoder doesn't expose where
+// keys are defined, so the config is scanned for them instead.
+func filterLines(cb []byte) []int {
+	var (
+		lines []int
+		// delimiter of the multi-line string the current line is in
+		inString string
+	)
+	for i, line := range strings.Split(string(cb), "\n") {
+		if inString != "" {
+			if strings.Count(line, inString)%2 == 1 {
+				inString = ""
+			}
+			continue
+		}
+		for _, delim := range []string{`"""`, `'''`} {
+			if strings.Count(line, delim)%2 == 1 {
+				inString = delim
+				break
+			}
+		}
+
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "[[") {
+			continue
+		}
+		end := strings.Index(line, "]]")
+		if end == -1 {
+			continue
+		}
+		if strings.TrimSpace(line[2:end]) == "filters" {
+			lines = append(lines, i+1)
+		}
 	}
-	if config.InboundDNSQueue == 0 {
-		return nil, errors.New(`"inboundDNSQueue" must be set`)
+
+	return lines
+}
+
+func parseConfigBytes(logger *zap.Logger, cb []byte) (*Config, error) {
+	config, _, err := explainConfigBytes(logger, cb)
+	return config, err
+}
+
+// validateFilterOptions validates opts the same way filters of a
+// config file are validated, and returns the resulting options. opts
+// isn't modified. hasSelfFilter is whether a self-filter can make the
+// DNS requests opts may need.
+func validateFilterOptions(logger *zap.Logger, hasSelfFilter bool, opts *FilterOptions) (*FilterOptions, error) {
+	if opts.Name == "" {
+		return nil, &ConfigErrors{Errors: []*ConfigError{{Field: "name", Err: errors.New(`"name" must be set`)}}}
 	}
 
-	var (
-		preformReverseLookups bool
-		allCachedHostnames    []string
+	filterOpts := *opts
+	transform := func(filterName, description string) {
+		logger.Debug("transformed filter options", zap.String("filter.name", filterName), zap.String("transformation", description))
+	}
+	if err := filterOpts.validate(logger, transform); err != nil {
+		var optErr *ConfigError
+		if errors.As(err, &optErr) {
+			optErr.Filter = filterOpts.Name
+			return nil, &ConfigErrors{Errors: []*ConfigError{optErr}}
+		}
+		return nil, err
+	}
+	if filterOpts.needsSelfFilter() && !hasSelfFilter {
+		return nil, &ConfigErrors{Errors: []*ConfigError{{
+			Field: "selfDNSQueue",
+			Err:   fmt.Errorf(`filter %q: "selfDNSQueue" must be set when "lookupUnknownIPs" or "verifyForward" is true, "cachedHostnames" or "dnsblZones" is not empty or "allowedHostnamesURL" has a hostname`, filterOpts.Name),
+		}}}
+	}
+
+	return &filterOpts, nil
+}
 
-		filterNames  = make(map[string]int)
-		filterQueues = make(map[uint16]string)
+// explainConfigBytes parses a config and returns the changes that
+// were made to it while parsing. Errors of specific filters are
+// returned as *filterConfigError.
+func explainConfigBytes(logger *zap.Logger, cb []byte) (_ *Config, _ []ConfigTransformation, err error) {
+	var (
+		config          Config
+		transformations []ConfigTransformation
+		// filterIdx is the index of the filter being validated
+		filterIdx = -1
 	)
-	for i, filterOpt := range config.Filters {
+	defer func() {
+		var optErr *ConfigError
+		if errors.As(err, &optErr) {
+			if filterIdx != -1 {
+				optErr.Filter = config.Filters[filterIdx].Name
+			}
+			err = &ConfigErrors{Errors: []*ConfigError{optErr}}
+		}
+		if err != nil && filterIdx != -1 {
+			err = &filterConfigError{index: filterIdx, err: err}
+		}
+	}()
+	transform := func(filterName, description string) {
+		logger.Debug("transformed config", zap.String("filter.name", filterName), zap.String("transformation", description))
+		transformations = append(transformations, ConfigTransformation{
+			Filter:      filterName,
+			Description: description,
+		})
+	}
 
-		if filterOpt.Name == "" {
-			return nil, fmt.Errorf(`filter #%d: "name" must be set`, i)
+	if err := toml.Unmarshal(cb, &config); err != nil {
+		return nil, nil, err
+	}
+	// decode the filters again to find out which keys were set, as
+	// 0 is a valid "ipVersion" and "ipv6" is deprecated
+	var rawConfig struct {
+		Filters []map[string]interface{}
+	}
+	if err := toml.Unmarshal(cb, &rawConfig); err != nil {
+		return nil, nil, err
+	}
+
+	if len(config.Filters) == 0 {
+		return nil, nil, optionError("filters", errors.New("at least one filter must be specified"))
+	}
+	if config.InboundDNSQueue == 0 {
+		return nil, nil, optionError("inboundDNSQueue", errors.New(`"inboundDNSQueue" must be set`))
+	}
+	if !validOnEncapsulated(config.OnEncapsulated) {
+		return nil, nil, optionError("onEncapsulated", errors.New(`"onEncapsulated" must be "drop" or "decapsulate"`))
+	}
+	if config.ShutdownTimeout < 0 {
+		return nil, nil, optionError("shutdownTimeout", errors.New(`"shutdownTimeout" must not be negative`))
+	}
+	if config.AdminSocketPath != "" {
+		info, err := os.Stat(filepath.Dir(config.AdminSocketPath))
+		if err != nil {
+			return nil, nil, optionError("adminSocketPath", fmt.Errorf(`error checking directory of "adminSocketPath": %v`, err))
 		}
-		if filterOpt.DNSQueue == 0 && len(filterOpt.CachedHostnames) == 0 && !filterOpt.LookupUnknownIPs {
-			return nil, fmt.Errorf(`filter %q: "dnsQueue" must be set`, filterOpt.Name)
+		if !info.IsDir() {
+			return nil, nil, optionError("adminSocketPath", errors.New(`directory of "adminSocketPath" must be a directory`))
 		}
-		if filterOpt.TrafficQueue == 0 && !filterOpt.AllowAllHostnames {
-			return nil, fmt.Errorf(`filter %q: "trafficQueue" must be set`, filterOpt.Name)
+	}
+	if config.VerdictFile != "" {
+		info, err := os.Stat(filepath.Dir(config.VerdictFile))
+		if err != nil {
+			return nil, nil, optionError("verdictFile", fmt.Errorf(`error checking directory of "verdictFile": %v`, err))
 		}
-		if filterOpt.TrafficQueue > 0 && filterOpt.AllowAllHostnames {
-			return nil, fmt.Errorf(`filter %q: "trafficQueue" must not be set when "allowAllHostnames" is true`, filterOpt.Name)
+		if !info.IsDir() {
+			return nil, nil, optionError("verdictFile", errors.New(`directory of "verdictFile" must be a directory`))
 		}
-		if filterOpt.DNSQueue == filterOpt.TrafficQueue {
-			return nil, fmt.Errorf(`filter %q: "dnsQueue" and "trafficQueue" must be different`, filterOpt.Name)
+	} else if config.VerdictQueueSize != 0 {
+		return nil, nil, optionError("verdictQueueSize", errors.New(`"verdictQueueSize" must not be set when "verdictFile" is not set`))
+	}
+	if config.VerdictQueueSize < 0 {
+		return nil, nil, optionError("verdictQueueSize", errors.New(`"verdictQueueSize" must not be negative`))
+	}
+	if config.TextfilePath != "" {
+		info, err := os.Stat(filepath.Dir(config.TextfilePath))
+		if err != nil {
+			return nil, nil, optionError("textfilePath", fmt.Errorf(`error checking directory of "textfilePath": %v`, err))
 		}
-		if len(filterOpt.AllowedHostnames) == 0 && !filterOpt.AllowAllHostnames && len(filterOpt.CachedHostnames) == 0 && !filterOpt.LookupUnknownIPs {
-			return nil, fmt.Errorf(`filter %q: "allowedHostnames" must not be empty`, filterOpt.Name)
+		if !info.IsDir() {
+			return nil, nil, optionError("textfilePath", errors.New(`directory of "textfilePath" must be a directory`))
 		}
-		if len(filterOpt.AllowedHostnames) > 0 && filterOpt.AllowAllHostnames {
-			return nil, fmt.Errorf(`filter %q: "allowedHostnames" must be empty when "allowAllHostnames" is true`, filterOpt.Name)
+		if !strings.HasSuffix(config.TextfilePath, ".prom") {
+			return nil, nil, optionError("textfilePath", errors.New(`"textfilePath" must end with ".prom"`))
 		}
-		if filterOpt.AllowAnswersFor == 0 && len(filterOpt.AllowedHostnames) > 0 {
-			return nil, fmt.Errorf(`filter %q: "allowAnswersFor" must be set when "allowedHostnames" is not empty`, filterOpt.Name)
+	} else if config.TextfileInterval != 0 {
+		return nil, nil, optionError("textfileInterval", errors.New(`"textfileInterval" must not be set when "textfilePath" is not set`))
+	}
+	if config.TextfileInterval < 0 {
+		return nil, nil, optionError("textfileInterval", errors.New(`"textfileInterval" must not be negative`))
+	}
+	if config.StateDBPath != "" {
+		info, err := os.Stat(filepath.Dir(config.StateDBPath))
+		if err != nil {
+			return nil, nil, optionError("stateDBPath", fmt.Errorf(`error checking directory of "stateDBPath": %v`, err))
 		}
-		if filterOpt.AllowAnswersFor != 0 && filterOpt.AllowAllHostnames {
-			return nil, fmt.Errorf(`filter %q: "allowAnswersFor" must not be set when "allowAllHostnames" is true`, filterOpt.Name)
+		if !info.IsDir() {
+			return nil, nil, optionError("stateDBPath", errors.New(`directory of "stateDBPath" must be a directory`))
 		}
-		if len(filterOpt.CachedHostnames) > 0 && filterOpt.AllowAllHostnames {
-			return nil, fmt.Errorf(`filter %q: "cachedHostnames" must be empty when "allowAllHostnames" is true`, filterOpt.Name)
+	}
+	if config.DiagnosticDumpDir != "" {
+		info, err := os.Stat(config.DiagnosticDumpDir)
+		if err != nil {
+			return nil, nil, optionError("diagnosticDumpDir", fmt.Errorf(`error checking "diagnosticDumpDir": %v`, err))
 		}
-		if filterOpt.ReCacheEvery == 0 && len(filterOpt.CachedHostnames) > 0 {
-			return nil, fmt.Errorf(`filter %q: "reCacheEvery" must be set when "cachedHostnames" is not empty`, filterOpt.Name)
+		if !info.IsDir() {
+			return nil, nil, optionError("diagnosticDumpDir", errors.New(`"diagnosticDumpDir" must be a directory`))
 		}
-		if filterOpt.ReCacheEvery > 0 && len(filterOpt.CachedHostnames) == 0 {
-			return nil, fmt.Errorf(`filter %q: "reCacheEvery" must not be set when "cachedHostnames" is empty`, filterOpt.Name)
+	}
+
+	var (
+		needsSelfFilter bool
+		filterNames     = make(map[string]int)
+		filterQueues    = make(map[uint16]string)
+	)
+	for i := range config.Filters {
+		filterIdx = i
+		filterOpt := &config.Filters[i]
+
+		if filterOpt.Name == "" {
+			return nil, nil, optionError("name", fmt.Errorf(`filter #%d: "name" must be set`, i))
 		}
-		if filterOpt.DNSQueue != 0 && len(filterOpt.AllowedHostnames) == 0 && (len(filterOpt.CachedHostnames) > 0 || filterOpt.LookupUnknownIPs) {
-			return nil, fmt.Errorf(`filter %q: "dnsQueue" must not be set when "allowedHostnames" is empty and either "cachedHostames" is not empty or "lookupUnknownIPs" is true`, filterOpt.Name)
+		ipVersion, err := filterIPVersion(rawConfig.Filters[i], filterOpt.IPVersion)
+		if err != nil {
+			return nil, nil, optionError("ipVersion", fmt.Errorf(`filter %q: %v`, filterOpt.Name, err))
+		}
+		if ipVersion == 6 && filterOpt.IPVersion != 6 {
+			transform(filterOpt.Name, `replaced deprecated "ipv6 = true" with "ipVersion = 6"`)
+		}
+		filterOpt.IPVersion = ipVersion
+
+		if err := filterOpt.validate(logger, transform); err != nil {
+			return nil, nil, err
 		}
 
 		if idx, ok := filterNames[filterOpt.Name]; ok {
-			return nil, fmt.Errorf(`filter #%d: filter name %q is already used by filter #%d`, i, filterOpt.Name, idx)
+			return nil, nil, optionError("name", fmt.Errorf(`filter #%d: filter name %q is already used by filter #%d`, i, filterOpt.Name, idx))
+		}
+		for _, queue := range []struct {
+			name string
+			num  uint16
+		}{
+			{name: "dnsQueue", num: filterOpt.DNSQueue},
+			{name: "trafficQueue", num: filterOpt.TrafficQueue},
+		} {
+			if queue.num == 0 {
+				continue
+			}
+			if queue.num == config.InboundDNSQueue {
+				return nil, nil, optionError(queue.name, fmt.Errorf(`filter %q: %s %d is already used by "inboundDNSQueue"`, filterOpt.Name, queue.name, queue.num))
+			}
+			if queue.num == config.SelfDNSQueue {
+				return nil, nil, optionError(queue.name, fmt.Errorf(`filter %q: %s %d is already used by "selfDNSQueue"`, filterOpt.Name, queue.name, queue.num))
+			}
 		}
 		if filterOpt.DNSQueue != 0 {
 			if name, ok := filterQueues[filterOpt.DNSQueue]; ok {
-				return nil, fmt.Errorf(`filter %q: dnsQueue %d is already used by filter %q`, filterOpt.Name, filterOpt.DNSQueue, name)
+				return nil, nil, optionError("dnsQueue", fmt.Errorf(`filter %q: dnsQueue %d is already used by filter %q`, filterOpt.Name, filterOpt.DNSQueue, name))
 			}
 		}
 		if filterOpt.TrafficQueue != 0 {
 			if name, ok := filterQueues[filterOpt.TrafficQueue]; ok {
-				return nil, fmt.Errorf(`filter %q: trafficQueue %d is already used by filter %q`, filterOpt.Name, filterOpt.TrafficQueue, name)
+				return nil, nil, optionError("trafficQueue", fmt.Errorf(`filter %q: trafficQueue %d is already used by filter %q`, filterOpt.Name, filterOpt.TrafficQueue, name))
 			}
 		}
 
-		if filterOpt.LookupUnknownIPs {
-			preformReverseLookups = true
-		}
-		if len(filterOpt.CachedHostnames) > 0 {
-			allCachedHostnames = append(allCachedHostnames, filterOpt.CachedHostnames...)
+		if filterOpt.needsSelfFilter() {
+			needsSelfFilter = true
 		}
 
 		filterNames[filterOpt.Name] = i
@@ -144,38 +596,631 @@ func parseConfigBytes(cb []byte) (*Config, error) {
 			filterQueues[filterOpt.TrafficQueue] = filterOpt.Name
 		}
 	}
+	filterIdx = -1
 
-	if config.SelfDNSQueue == 0 && (preformReverseLookups || len(allCachedHostnames) > 0) {
-		return nil, errors.New(`"selfDNSQueue" must be set when at least one filter either sets "lookupUnknownIPs" to true or "cachedHostnames" is not empty`)
+	if config.SelfDNSQueue == 0 && needsSelfFilter {
+		return nil, nil, optionError("selfDNSQueue", errors.New(`"selfDNSQueue" must be set when at least one filter either sets "lookupUnknownIPs" or "verifyForward" to true, "cachedHostnames" or "dnsblZones" is not empty or "allowedHostnamesURL" has a hostname`))
 	}
-	if config.SelfDNSQueue > 0 && !preformReverseLookups && len(allCachedHostnames) == 0 {
-		return nil, errors.New(`"selfDNSQueue" must only be set when at least one filter either sets "lookupUnknownIPs" to true or "cachedHostnames" is not empty`)
+	if config.SelfDNSQueue > 0 && !needsSelfFilter {
+		return nil, nil, optionError("selfDNSQueue", errors.New(`"selfDNSQueue" must only be set when at least one filter either sets "lookupUnknownIPs" or "verifyForward" to true, "cachedHostnames" or "dnsblZones" is not empty or "allowedHostnamesURL" has a hostname`))
 	}
 	if config.InboundDNSQueue == config.SelfDNSQueue {
-		return nil, errors.New(`"inboundDNSQueue" and "selfDNSQueue" must be different`)
+		return nil, nil, optionError("inboundDNSQueue", errors.New(`"inboundDNSQueue" and "selfDNSQueue" must be different`))
 	}
 
 	// if 'selfDNSQueue' is specified, create a filter that will allow
 	// Egress Eddie to only make required DNS queries
 	if config.SelfDNSQueue > 0 {
 		selfFilter := FilterOptions{
-			Name:     selfFilterName,
-			DNSQueue: config.SelfDNSQueue,
-			IPv6:     config.IPv6,
+			Name:           selfFilterName,
+			DNSQueue:       config.SelfDNSQueue,
+			IPVersion:      4,
+			OnEncapsulated: config.OnEncapsulated,
 		}
+		if config.IPv6 {
+			selfFilter.IPVersion = 6
+		}
+		transform(selfFilter.Name, `created filter from "selfDNSQueue"`)
 
-		if preformReverseLookups {
-			selfFilter.AllowedHostnames = []string{
-				"in-addr.arpa",
-				"ip6.arpa",
+		for _, group := range selfHostnames(config.Filters) {
+			selfFilter.AllowedHostnames = append(selfFilter.AllowedHostnames, group.hostnames...)
+			for _, hostname := range group.hostnames {
+				transform(selfFilter.Name, fmt.Sprintf("injected %q into allowedHostnames %s", hostname, group.reason))
 			}
 		}
-		if len(allCachedHostnames) > 0 {
-			selfFilter.AllowedHostnames = append(selfFilter.AllowedHostnames, allCachedHostnames...)
-		}
+		selfFilter.AllowedHostnames = dedupTransformed(selfFilter.Name, selfFilter.AllowedHostnames, transform)
 
 		config.Filters = append([]FilterOptions{selfFilter}, config.Filters...)
 	}
 
-	return &config, nil
+	return &config, transformations, nil
+}
+
+// validate validates the options of a filter that don't depend on
+// other filters. The options are transformed the same way as options
+// of filters in config files: hostnames of "allowedHostnamesEnvVar"
+// are allowed, allowed hostnames that are already allowed by other
+// hostnames are removed and the names of response codes and EDNS
+// options are upper cased. Every change is passed to transform.
+func (f *FilterOptions) validate(logger *zap.Logger, transform func(filterName, description string)) error {
+	if f.IPVersion != 0 && f.IPVersion != 4 && f.IPVersion != 6 {
+		return optionError("ipVersion", fmt.Errorf(`filter %q: "ipVersion" must be 0, 4 or 6`, f.Name))
+	}
+	if f.AllowedHostnamesEnvVar != "" {
+		hostnames, err := envHostnames(f.AllowedHostnamesEnvVar)
+		if err != nil {
+			return optionError("allowedHostnamesEnvVar", fmt.Errorf(`filter %q: %v`, f.Name, err))
+		}
+		f.AllowedHostnames = append(f.AllowedHostnames, hostnames...)
+		for _, hostname := range hostnames {
+			transform(f.Name, fmt.Sprintf("added %q to allowedHostnames from environment variable %q", hostname, f.AllowedHostnamesEnvVar))
+		}
+	}
+	if f.DNSQueue == 0 && len(f.CachedHostnames) == 0 && !f.LookupUnknownIPs {
+		return optionError("dnsQueue", fmt.Errorf(`filter %q: "dnsQueue" must be set`, f.Name))
+	}
+	if f.TrafficQueue == 0 && !f.AllowAllHostnames {
+		return optionError("trafficQueue", fmt.Errorf(`filter %q: "trafficQueue" must be set`, f.Name))
+	}
+	if f.TrafficQueue > 0 && f.AllowAllHostnames {
+		return optionError("trafficQueue", fmt.Errorf(`filter %q: "trafficQueue" must not be set when "allowAllHostnames" is true`, f.Name))
+	}
+	if !validOnEncapsulated(f.OnEncapsulated) {
+		return optionError("onEncapsulated", fmt.Errorf(`filter %q: "onEncapsulated" must be "drop" or "decapsulate"`, f.Name))
+	}
+	switch f.DNSTransport {
+	case "", dnsTransportAny, dnsTransportTCP, dnsTransportUDP:
+	default:
+		return optionError("dnsTransport", fmt.Errorf(`filter %q: "dnsTransport" must be "any", "tcp" or "udp"`, f.Name))
+	}
+	switch f.OnMissingConntrack {
+	case "", missingConntrackValidate, missingConntrackDrop:
+	default:
+		return optionError("onMissingConntrack", fmt.Errorf(`filter %q: "onMissingConntrack" must be "validate" or "drop"`, f.Name))
+	}
+	if f.OnMissingConntrack != "" && f.TrafficQueue == 0 {
+		return optionError("onMissingConntrack", fmt.Errorf(`filter %q: "onMissingConntrack" must only be set when "trafficQueue" is set`, f.Name))
+	}
+	if f.OnMissingConntrack != "" && !f.trafficConntrack() {
+		return optionError("onMissingConntrack", fmt.Errorf(`filter %q: "onMissingConntrack" must not be set when "trafficConntrack" is false`, f.Name))
+	}
+	if f.DNSQueue == f.TrafficQueue {
+		return optionError("dnsQueue", fmt.Errorf(`filter %q: "dnsQueue" and "trafficQueue" must be different`, f.Name))
+	}
+	if len(f.AllowedHostnames) == 0 && !f.AllowAllHostnames && len(f.CachedHostnames) == 0 && !f.LookupUnknownIPs && f.AllowedHostnamesURL == "" && f.MatchExpression == "" {
+		return optionError("allowedHostnames", fmt.Errorf(`filter %q: "allowedHostnames" must not be empty`, f.Name))
+	}
+	if len(f.AllowedHostnames) > 0 && f.AllowAllHostnames {
+		return optionError("allowedHostnames", fmt.Errorf(`filter %q: "allowedHostnames" must be empty when "allowAllHostnames" is true`, f.Name))
+	}
+	if f.AllowAnswersFor == 0 && len(f.AllowedHostnames) > 0 {
+		return optionError("allowAnswersFor", fmt.Errorf(`filter %q: "allowAnswersFor" must be set when "allowedHostnames" is not empty`, f.Name))
+	}
+	if f.MatchExpression != "" {
+		if f.AllowAllHostnames {
+			return optionError("matchExpression", fmt.Errorf(`filter %q: "matchExpression" must not be set when "allowAllHostnames" is true`, f.Name))
+		}
+		if f.DNSQueue == 0 {
+			return optionError("matchExpression", fmt.Errorf(`filter %q: "matchExpression" must only be set when "dnsQueue" is set`, f.Name))
+		}
+		if f.AllowAnswersFor == 0 {
+			return optionError("allowAnswersFor", fmt.Errorf(`filter %q: "allowAnswersFor" must be set when "matchExpression" is set`, f.Name))
+		}
+		if _, err := compileMatchExpression(f.MatchExpression); err != nil {
+			return optionError("matchExpression", fmt.Errorf(`filter %q: "matchExpression" is invalid: %v`, f.Name, err))
+		}
+	}
+	if f.AllowAnswersFor != 0 && f.AllowAllHostnames {
+		return optionError("allowAnswersFor", fmt.Errorf(`filter %q: "allowAnswersFor" must not be set when "allowAllHostnames" is true`, f.Name))
+	}
+	if f.AllowedHostnamesURL != "" && f.AllowAllHostnames {
+		return optionError("allowedHostnamesURL", fmt.Errorf(`filter %q: "allowedHostnamesURL" must not be set when "allowAllHostnames" is true`, f.Name))
+	}
+	if f.AllowAnswersFor == 0 && f.AllowedHostnamesURL != "" {
+		return optionError("allowAnswersFor", fmt.Errorf(`filter %q: "allowAnswersFor" must be set when "allowedHostnamesURL" is set`, f.Name))
+	}
+	if f.AllowedHostnamesSyncInterval == 0 && f.AllowedHostnamesURL != "" {
+		return optionError("allowedHostnamesSyncInterval", fmt.Errorf(`filter %q: "allowedHostnamesSyncInterval" must be set when "allowedHostnamesURL" is set`, f.Name))
+	}
+	if f.AllowedHostnamesSyncInterval != 0 && f.AllowedHostnamesURL == "" {
+		return optionError("allowedHostnamesSyncInterval", fmt.Errorf(`filter %q: "allowedHostnamesSyncInterval" must not be set when "allowedHostnamesURL" is not set`, f.Name))
+	}
+	if f.AllowedHostnamesURL != "" {
+		u, err := url.Parse(f.AllowedHostnamesURL)
+		if err != nil {
+			return optionError("allowedHostnamesURL", fmt.Errorf(`filter %q: error parsing "allowedHostnamesURL": %v`, f.Name, err))
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return optionError("allowedHostnamesURL", fmt.Errorf(`filter %q: "allowedHostnamesURL" must be a HTTP or HTTPS URL`, f.Name))
+		}
+	}
+	if len(f.CachedHostnames) > 0 && f.AllowAllHostnames {
+		return optionError("cachedHostnames", fmt.Errorf(`filter %q: "cachedHostnames" must be empty when "allowAllHostnames" is true`, f.Name))
+	}
+	if f.ReapIdleConnsEvery != 0 && f.DNSQueue == 0 {
+		return optionError("reapIdleConnsEvery", fmt.Errorf(`filter %q: "reapIdleConnsEvery" must not be set when "dnsQueue" is not set`, f.Name))
+	}
+	if time.Duration(f.ReapIdleConnsEvery) >= dnsQueryTimeout {
+		return optionError("reapIdleConnsEvery", fmt.Errorf(`filter %q: "reapIdleConnsEvery" must be less than %s`, f.Name, dnsQueryTimeout))
+	}
+	if f.UseMarkInheritance && (f.DNSQueue == 0 || f.TrafficQueue == 0) {
+		return optionError("useMarkInheritance", fmt.Errorf(`filter %q: "useMarkInheritance" must only be set when "dnsQueue" and "trafficQueue" are set`, f.Name))
+	}
+	if f.MaxUDPResponseSize != 0 && (f.MaxUDPResponseSize < minUDPResponseSize || f.MaxUDPResponseSize > maxUDPResponseSize) {
+		return optionError("maxUDPResponseSize", fmt.Errorf(`filter %q: "maxUDPResponseSize" must be between %d and %d`, f.Name, minUDPResponseSize, maxUDPResponseSize))
+	}
+	for _, rcode := range f.AllowedRcodes {
+		if _, ok := dnsRcodes[strings.ToUpper(rcode)]; !ok {
+			return optionError("allowedRcodes", fmt.Errorf(`filter %q: "allowedRcodes" contains unknown response code %q`, f.Name, rcode))
+		}
+	}
+	for _, option := range f.AllowedEDNSOptions {
+		if _, ok := ednsOptionCodes[strings.ToUpper(option)]; !ok {
+			return optionError("allowedEDNSOptions", fmt.Errorf(`filter %q: "allowedEDNSOptions" contains unknown EDNS option %q`, f.Name, option))
+		}
+	}
+	if len(f.DNSAllowedSources) > 0 && f.DNSQueue == 0 {
+		return optionError("dnsAllowedSources", fmt.Errorf(`filter %q: "dnsAllowedSources" must only be set when "dnsQueue" is set`, f.Name))
+	}
+	for _, source := range f.DNSAllowedSources {
+		if _, err := netip.ParsePrefix(source); err != nil {
+			return optionError("dnsAllowedSources", fmt.Errorf(`filter %q: "dnsAllowedSources" contains invalid CIDR %q: %v`, f.Name, source, err))
+		}
+	}
+	if f.TrafficConntrack != nil && f.TrafficQueue == 0 {
+		return optionError("trafficConntrack", fmt.Errorf(`filter %q: "trafficConntrack" must only be set when "trafficQueue" is set`, f.Name))
+	}
+	if f.DropIPOptions && f.TrafficQueue == 0 {
+		return optionError("dropIPOptions", fmt.Errorf(`filter %q: "dropIPOptions" must only be set when "trafficQueue" is set`, f.Name))
+	}
+	if len(f.AllowedProtocols) > 0 && f.TrafficQueue == 0 {
+		return optionError("allowedProtocols", fmt.Errorf(`filter %q: "allowedProtocols" must only be set when "trafficQueue" is set`, f.Name))
+	}
+	if (len(f.AllowedTrafficClasses) > 0 || f.DropFlowLabels) && f.TrafficQueue == 0 {
+		return optionError("allowedTrafficClasses", fmt.Errorf(`filter %q: "allowedTrafficClasses" and "dropFlowLabels" must only be set when "trafficQueue" is set`, f.Name))
+	}
+	if f.DropFlowLabels && !f.trafficConntrack() {
+		return optionError("dropFlowLabels", fmt.Errorf(`filter %q: "dropFlowLabels" must not be set when "trafficConntrack" is false`, f.Name))
+	}
+	for _, class := range f.AllowedTrafficClasses {
+		if class < 0 || class > 255 {
+			return optionError("allowedTrafficClasses", fmt.Errorf(`filter %q: "allowedTrafficClasses" must only contain values between 0 and 255`, f.Name))
+		}
+	}
+	if _, err := parseIPProtocols(f.AllowedProtocols); err != nil {
+		return optionError("allowedProtocols", fmt.Errorf(`filter %q: "allowedProtocols" contains %v`, f.Name, err))
+	}
+	if f.MaxQuestionsPerRequest < 0 {
+		return optionError("maxQuestionsPerRequest", fmt.Errorf(`filter %q: "maxQuestionsPerRequest" must not be negative`, f.Name))
+	}
+	if f.MaxAnswersPerQuestion < 0 {
+		return optionError("maxAnswersPerQuestion", fmt.Errorf(`filter %q: "maxAnswersPerQuestion" must not be negative`, f.Name))
+	}
+	if f.MinLabels < 0 {
+		return optionError("minLabels", fmt.Errorf(`filter %q: "minLabels" must not be negative`, f.Name))
+	}
+	if f.MinLabels != 0 && f.AllowAllHostnames {
+		return optionError("minLabels", fmt.Errorf(`filter %q: "minLabels" must not be set when "allowAllHostnames" is true`, f.Name))
+	}
+	if f.RejectSuspiciousNames && f.AllowAllHostnames {
+		return optionError("rejectSuspiciousNames", fmt.Errorf(`filter %q: "rejectSuspiciousNames" must not be set when "allowAllHostnames" is true`, f.Name))
+	}
+	if f.MatchAnswerTypeToQuestion && (f.DNSQueue == 0 || f.TrafficQueue == 0) {
+		return optionError("matchAnswerTypeToQuestion", fmt.Errorf(`filter %q: "matchAnswerTypeToQuestion" must only be set when "dnsQueue" and "trafficQueue" are set`, f.Name))
+	}
+	if f.RejectSuspiciousFlags && f.DNSQueue == 0 {
+		return optionError("rejectSuspiciousFlags", fmt.Errorf(`filter %q: "rejectSuspiciousFlags" must only be set when "dnsQueue" is set`, f.Name))
+	}
+	if f.RejectUnknownOpcodes && f.DNSQueue == 0 {
+		return optionError("rejectUnknownOpcodes", fmt.Errorf(`filter %q: "rejectUnknownOpcodes" must only be set when "dnsQueue" is set`, f.Name))
+	}
+	if (len(f.AllowedSrcPorts) > 0 || len(f.AllowedDstPorts) > 0) && f.TrafficQueue == 0 {
+		return optionError("allowedSrcPorts", fmt.Errorf(`filter %q: "allowedSrcPorts" and "allowedDstPorts" must only be set when "trafficQueue" is set`, f.Name))
+	}
+	if f.BlockDoH && f.TrafficQueue == 0 {
+		return optionError("blockDoH", fmt.Errorf(`filter %q: "blockDoH" must only be set when "trafficQueue" is set`, f.Name))
+	}
+	if len(f.AllowedDoHHostnames) > 0 && !f.BlockDoH {
+		return optionError("allowedDoHHostnames", fmt.Errorf(`filter %q: "allowedDoHHostnames" must only be set when "blockDoH" is true`, f.Name))
+	}
+	if f.AllowSRVPorts && len(f.AllowedDstPorts) == 0 {
+		return optionError("allowSRVPorts", fmt.Errorf(`filter %q: "allowSRVPorts" must only be set when "allowedDstPorts" is set`, f.Name))
+	}
+	if containsPort(f.AllowedSrcPorts, 0) {
+		return optionError("allowedSrcPorts", fmt.Errorf(`filter %q: "allowedSrcPorts" must not contain 0`, f.Name))
+	}
+	if containsPort(f.AllowedDstPorts, 0) {
+		return optionError("allowedDstPorts", fmt.Errorf(`filter %q: "allowedDstPorts" must not contain 0`, f.Name))
+	}
+	if f.MaxConcurrentLookups < 0 {
+		return optionError("maxConcurrentLookups", fmt.Errorf(`filter %q: "maxConcurrentLookups" must not be negative`, f.Name))
+	}
+	if f.MaxConcurrentLookups != 0 && !f.LookupUnknownIPs {
+		return optionError("maxConcurrentLookups", fmt.Errorf(`filter %q: "maxConcurrentLookups" must only be set when "lookupUnknownIPs" is true`, f.Name))
+	}
+	if f.MaxReassemblyBytes < 0 {
+		return optionError("maxReassemblyBytes", fmt.Errorf(`filter %q: "maxReassemblyBytes" must not be negative`, f.Name))
+	}
+	if f.MaxReassemblyConns < 0 {
+		return optionError("maxReassemblyConns", fmt.Errorf(`filter %q: "maxReassemblyConns" must not be negative`, f.Name))
+	}
+	if (f.MaxReassemblyBytes != 0 || f.MaxReassemblyConns != 0) && !f.MatchSNI && !f.BlockDoH {
+		return optionError("maxReassemblyBytes", fmt.Errorf(`filter %q: "maxReassemblyBytes" and "maxReassemblyConns" must only be set when "matchSNI" or "blockDoH" is true`, f.Name))
+	}
+	if f.DedupWindow < 0 || time.Duration(f.DedupWindow) > maxDedupWindow {
+		return optionError("dedupWindow", fmt.Errorf(`filter %q: "dedupWindow" must be between 0 and %s`, f.Name, maxDedupWindow))
+	}
+	if f.DedupWindow != 0 && f.TrafficQueue == 0 {
+		return optionError("dedupWindow", fmt.Errorf(`filter %q: "dedupWindow" must only be set when "trafficQueue" is set`, f.Name))
+	}
+	if f.MaxDedupPackets < 0 {
+		return optionError("maxDedupPackets", fmt.Errorf(`filter %q: "maxDedupPackets" must not be negative`, f.Name))
+	}
+	if f.MaxDedupPackets != 0 && f.DedupWindow == 0 {
+		return optionError("maxDedupPackets", fmt.Errorf(`filter %q: "maxDedupPackets" must only be set when "dedupWindow" is set`, f.Name))
+	}
+	if f.AnswerDedupWindow < 0 {
+		return optionError("answerDedupWindow", fmt.Errorf(`filter %q: "answerDedupWindow" must not be negative`, f.Name))
+	}
+	if f.AnswerDedupWindow != 0 && f.AnswerDedupWindow >= f.AllowAnswersFor {
+		return optionError("answerDedupWindow", fmt.Errorf(`filter %q: "answerDedupWindow" must be less than "allowAnswersFor"`, f.Name))
+	}
+	if f.SlowDNSResponseThreshold < 0 {
+		return optionError("slowDNSResponseThreshold", fmt.Errorf(`filter %q: "slowDNSResponseThreshold" must not be negative`, f.Name))
+	}
+	if f.SlowDNSResponseThreshold != 0 && f.DNSQueue == 0 {
+		return optionError("slowDNSResponseThreshold", fmt.Errorf(`filter %q: "slowDNSResponseThreshold" must only be set when "dnsQueue" is set`, f.Name))
+	}
+	if f.ExpiryNotifyWindow < 0 {
+		return optionError("expiryNotifyWindow", fmt.Errorf(`filter %q: "expiryNotifyWindow" must not be negative`, f.Name))
+	}
+	if f.ExpiryNotifyWindow != 0 && (f.TrafficQueue == 0 || f.DisableDynamicHostnames) {
+		return optionError("expiryNotifyWindow", fmt.Errorf(`filter %q: "expiryNotifyWindow" must only be set when "trafficQueue" is set and "disableDynamicHostnames" is false`, f.Name))
+	}
+	if f.DNSParseFailFallback && (f.DNSQueue == 0 || f.TrafficQueue == 0) {
+		return optionError("dnsParseFailFallback", fmt.Errorf(`filter %q: "dnsParseFailFallback" must only be set when "dnsQueue" and "trafficQueue" are set`, f.Name))
+	}
+	if f.PostResponseGrace < 0 || time.Duration(f.PostResponseGrace) > maxPostResponseGrace {
+		return optionError("postResponseGrace", fmt.Errorf(`filter %q: "postResponseGrace" must be between 0 and %s`, f.Name, maxPostResponseGrace))
+	}
+	if f.PostResponseGrace != 0 && (f.DNSQueue == 0 || f.TrafficQueue == 0) {
+		return optionError("postResponseGrace", fmt.Errorf(`filter %q: "postResponseGrace" must only be set when "dnsQueue" and "trafficQueue" are set`, f.Name))
+	}
+	// new connections can't be told apart from others without
+	// their conntrack state
+	if f.PostResponseGrace != 0 && !f.trafficConntrack() {
+		return optionError("postResponseGrace", fmt.Errorf(`filter %q: "postResponseGrace" must not be set when "trafficConntrack" is false`, f.Name))
+	}
+	if f.TrafficWorkers < 0 {
+		return optionError("trafficWorkers", fmt.Errorf(`filter %q: "trafficWorkers" must not be negative`, f.Name))
+	}
+	if f.TrafficWorkers != 0 && f.TrafficQueue == 0 {
+		return optionError("trafficWorkers", fmt.Errorf(`filter %q: "trafficWorkers" must only be set when "trafficQueue" is set`, f.Name))
+	}
+	for _, cpu := range f.CPUAffinity {
+		if cpu < 0 || cpu > runtime.NumCPU()-1 {
+			return optionError("cpuAffinity", fmt.Errorf(`filter %q: "cpuAffinity" must only contain CPUs between 0 and %d`, f.Name, runtime.NumCPU()-1))
+		}
+	}
+	if f.DisableDynamicHostnames && f.AllowAllHostnames {
+		return optionError("disableDynamicHostnames", fmt.Errorf(`filter %q: "disableDynamicHostnames" must not be set when "allowAllHostnames" is true`, f.Name))
+	}
+	if !f.excludeLoopback() {
+		logger.Warn(`"excludeLoopback" is false, loopback traffic will be filtered which is usually unintended`, zap.String("filter.name", f.Name))
+	}
+	if f.UntrackedConnections && !f.AllowAllHostnames {
+		return optionError("untrackedConnections", fmt.Errorf(`filter %q: "untrackedConnections" must only be set when "allowAllHostnames" is true`, f.Name))
+	}
+	if f.UntrackedConnections && f.ValidateConntrackIDs {
+		return optionError("untrackedConnections", fmt.Errorf(`filter %q: "untrackedConnections" and "validateConntrackIDs" must not both be set`, f.Name))
+	}
+	if f.CorrelateParallelRequests && f.DNSQueue == 0 {
+		return optionError("correlateParallelRequests", fmt.Errorf(`filter %q: "correlateParallelRequests" must only be set when "dnsQueue" is set`, f.Name))
+	}
+	if f.CorrelateParallelRequests && f.UntrackedConnections {
+		return optionError("untrackedConnections", fmt.Errorf(`filter %q: "untrackedConnections" and "correlateParallelRequests" must not both be set`, f.Name))
+	}
+	if f.FCrDNS && !f.LookupUnknownIPs {
+		return optionError("fcrDNS", fmt.Errorf(`filter %q: "fcrDNS" must only be set when "lookupUnknownIPs" is true`, f.Name))
+	}
+	if f.VerifyForward && f.TrafficQueue == 0 {
+		return optionError("verifyForward", fmt.Errorf(`filter %q: "verifyForward" must only be set when "trafficQueue" is set`, f.Name))
+	}
+	if f.VerifyForward && f.AllowedHostnamesURL != "" {
+		return optionError("verifyForward", fmt.Errorf(`filter %q: "verifyForward" must not be set when "allowedHostnamesURL" is set`, f.Name))
+	}
+	if f.NextQueue != 0 && f.TrafficQueue == 0 {
+		return optionError("nextQueue", fmt.Errorf(`filter %q: "nextQueue" must only be set when "trafficQueue" is set`, f.Name))
+	}
+	if f.NextQueue != 0 && (f.NextQueue == f.TrafficQueue || f.NextQueue == f.DNSQueue) {
+		return optionError("nextQueue", fmt.Errorf(`filter %q: "nextQueue" must not be a queue of the filter`, f.Name))
+	}
+	if f.WarnAllowedIPsThreshold != 0 && f.TrafficQueue == 0 {
+		return optionError("warnAllowedIPsThreshold", fmt.Errorf(`filter %q: "warnAllowedIPsThreshold" must only be set when "trafficQueue" is set`, f.Name))
+	}
+	if f.MatchSNI && f.TrafficQueue == 0 {
+		return optionError("matchSNI", fmt.Errorf(`filter %q: "matchSNI" must only be set when "trafficQueue" is set`, f.Name))
+	}
+	if f.MatchSNI && f.VerifyForward {
+		return optionError("matchSNI", fmt.Errorf(`filter %q: "matchSNI" must not be set when "verifyForward" is true`, f.Name))
+	}
+	if f.ConntrackEvict && f.TrafficQueue == 0 {
+		return optionError("conntrackEvict", fmt.Errorf(`filter %q: "conntrackEvict" must only be set when "trafficQueue" is set`, f.Name))
+	}
+	if f.FailOpenOnResolverOutage && f.AllowAllHostnames {
+		return optionError("failOpenOnResolverOutage", fmt.Errorf(`filter %q: "failOpenOnResolverOutage" must not be set when "allowAllHostnames" is true`, f.Name))
+	}
+	if f.FailOpenOnResolverOutage && f.ResolverOutageWindow == 0 {
+		return optionError("resolverOutageWindow", fmt.Errorf(`filter %q: "resolverOutageWindow" must be set when "failOpenOnResolverOutage" is true`, f.Name))
+	}
+	if !f.FailOpenOnResolverOutage && f.ResolverOutageWindow != 0 {
+		return optionError("resolverOutageWindow", fmt.Errorf(`filter %q: "resolverOutageWindow" must not be set when "failOpenOnResolverOutage" is false`, f.Name))
+	}
+	if f.ValidateCNAMETargets && f.AllowAllHostnames {
+		return optionError("validateCNAMETargets", fmt.Errorf(`filter %q: "validateCNAMETargets" must not be set when "allowAllHostnames" is true`, f.Name))
+	}
+	if f.BailiwickCheck && f.AllowAllHostnames {
+		return optionError("bailiwickCheck", fmt.Errorf(`filter %q: "bailiwickCheck" must not be set when "allowAllHostnames" is true`, f.Name))
+	}
+	if f.LogMatchedRules && f.AllowAllHostnames {
+		return optionError("logMatchedRules", fmt.Errorf(`filter %q: "logMatchedRules" must not be set when "allowAllHostnames" is true`, f.Name))
+	}
+	if f.ValidateConntrackIDs && f.DNSQueue == 0 {
+		return optionError("validateConntrackIDs", fmt.Errorf(`filter %q: "validateConntrackIDs" must only be set when "dnsQueue" is set`, f.Name))
+	}
+	if f.RecentDeniesSize < 0 {
+		return optionError("recentDeniesSize", fmt.Errorf(`filter %q: "recentDeniesSize" must not be negative`, f.Name))
+	}
+	if len(f.DNSBLZones) > 0 && f.AllowAllHostnames {
+		return optionError("dnsblZones", fmt.Errorf(`filter %q: "dnsblZones" must be empty when "allowAllHostnames" is true`, f.Name))
+	}
+	if f.ReCacheEvery == 0 && len(f.CachedHostnames) > 0 {
+		return optionError("reCacheEvery", fmt.Errorf(`filter %q: "reCacheEvery" must be set when "cachedHostnames" is not empty`, f.Name))
+	}
+	if f.ReCacheEvery > 0 && len(f.CachedHostnames) == 0 {
+		return optionError("reCacheEvery", fmt.Errorf(`filter %q: "reCacheEvery" must not be set when "cachedHostnames" is empty`, f.Name))
+	}
+	if f.DNSQueue != 0 && len(f.AllowedHostnames) == 0 && f.AllowedHostnamesURL == "" && (len(f.CachedHostnames) > 0 || f.LookupUnknownIPs) {
+		return optionError("dnsQueue", fmt.Errorf(`filter %q: "dnsQueue" must not be set when "allowedHostnames" is empty and either "cachedHostames" is not empty or "lookupUnknownIPs" is true`, f.Name))
+	}
+
+	f.AllowedHostnames = dedupTransformed(f.Name, f.AllowedHostnames, transform)
+	// names are matched case insensitively, upper case them once so
+	// packets can be checked against them directly
+	f.AllowedRcodes = upperNames(f.AllowedRcodes)
+	f.AllowedEDNSOptions = upperNames(f.AllowedEDNSOptions)
+
+	return nil
+}
+
+// selfFilterHostnames are hostnames the self-filter has to allow so
+// filters can make their DNS requests, and why they are allowed.
+type selfFilterHostnames struct {
+	reason    string
+	hostnames []string
+}
+
+// selfHostnames returns the hostnames the self-filter has to allow
+// for the DNS requests of filters, grouped by the option that needs
+// them.
+func selfHostnames(filters []FilterOptions) []selfFilterHostnames {
+	var (
+		reverseLookups bool
+		cached         []string
+		verify         []string
+		fcrDNS         []string
+		dnsblZones     []string
+		urlHostnames   []string
+	)
+	for i := range filters {
+		if filters[i].LookupUnknownIPs {
+			reverseLookups = true
+		}
+		cached = append(cached, filters[i].CachedHostnames...)
+		if filters[i].VerifyForward {
+			verify = append(verify, filters[i].AllowedHostnames...)
+		}
+		if filters[i].FCrDNS {
+			fcrDNS = append(fcrDNS, filters[i].AllowedHostnames...)
+		}
+		dnsblZones = append(dnsblZones, filters[i].DNSBLZones...)
+		// allow Egress Eddie to resolve the hosts of allowed hostname
+		// URLs so the lists can be fetched
+		if hostname := urlHostname(filters[i].AllowedHostnamesURL); hostname != "" {
+			urlHostnames = append(urlHostnames, hostname)
+		}
+	}
+
+	var groups []selfFilterHostnames
+	add := func(reason string, hostnames []string) {
+		if len(hostnames) > 0 {
+			groups = append(groups, selfFilterHostnames{reason: reason, hostnames: hostnames})
+		}
+	}
+	if reverseLookups {
+		add(`for "lookupUnknownIPs"`, []string{"in-addr.arpa", "ip6.arpa"})
+	}
+	add(`from "cachedHostnames"`, cached)
+	add(`for "verifyForward"`, verify)
+	add(`for "fcrDNS"`, fcrDNS)
+	add(`from "dnsblZones"`, dnsblZones)
+	add(`from "allowedHostnamesURL"`, urlHostnames)
+
+	return groups
+}
+
+// dedupTransformed removes allowed hostnames that are already allowed
+// by other hostnames in the list, and passes every removal to
+// transform.
+func dedupTransformed(filterName string, hostnames []string, transform func(filterName, description string)) []string {
+	if len(hostnames) == 0 {
+		return hostnames
+	}
+
+	deduped, removed := dedupHostnames(hostnames)
+	for _, hostname := range removed {
+		transform(filterName, fmt.Sprintf("removed %q from allowedHostnames as it is already allowed by another hostname", hostname))
+	}
+
+	return deduped
+}
+
+// urlHostname returns the hostname of rawURL that has to be resolved
+// to connect to it, or an empty string if its host is an IP address.
+func urlHostname(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	hostname := u.Hostname()
+	if _, err := netip.ParseAddr(hostname); err == nil {
+		return ""
+	}
+
+	return hostname
+}
+
+// filterIPVersion returns the IP version of a filter. If "ipVersion"
+// isn't set, the deprecated "ipv6" is used to choose between IPv4 and
+// IPv6.
+func filterIPVersion(rawFilter map[string]interface{}, ipVersion int) (int, error) {
+	rawIPv6, ipv6Set := lookupKey(rawFilter, "ipv6")
+	ipv6, ok := rawIPv6.(bool)
+	if ipv6Set && !ok {
+		return 0, errors.New(`"ipv6" must be true or false`)
+	}
+
+	if _, ok := lookupKey(rawFilter, "ipVersion"); ok {
+		if ipVersion != 0 && ipVersion != 4 && ipVersion != 6 {
+			return 0, errors.New(`"ipVersion" must be 0, 4 or 6`)
+		}
+		if ipv6Set {
+			return 0, errors.New(`"ipv6" must not be set when "ipVersion" is set`)
+		}
+		return ipVersion, nil
+	}
+
+	if ipv6 {
+		return 6, nil
+	}
+	return 4, nil
+}
+
+// lookupKey returns the value of key in a decoded TOML table. Keys
+// are matched case-insensitively like when decoding into structs.
+func lookupKey(table map[string]interface{}, key string) (interface{}, bool) {
+	for k, v := range table {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+
+	return nil, false
+}
+
+// excludeLoopback returns true if packets of the traffic queue on the
+// loopback interface should be allowed without filtering, which is
+// the default. DNS requests to loopback resolvers are always filtered.
+func (f *FilterOptions) excludeLoopback() bool {
+	return f.ExcludeLoopback == nil || *f.ExcludeLoopback
+}
+
+// trafficConntrack returns true if packets of the traffic queue
+// should be queued with their conntrack state, which is the default.
+func (f *FilterOptions) trafficConntrack() bool {
+	return f.TrafficConntrack == nil || *f.TrafficConntrack
+}
+
+// envHostnames returns the comma-separated hostnames in the
+// environment variable envVar. An unset or empty environment variable
+// contains no hostnames.
+func envHostnames(envVar string) ([]string, error) {
+	value := os.Getenv(envVar)
+	if value == "" {
+		return nil, nil
+	}
+
+	var hostnames []string
+	for _, hostname := range strings.Split(value, ",") {
+		hostname = strings.TrimSpace(hostname)
+		if hostname == "" {
+			continue
+		}
+		if !saneHostname(hostname) {
+			return nil, fmt.Errorf("environment variable %q contains invalid hostname %q", envVar, hostname)
+		}
+		hostnames = append(hostnames, hostname)
+	}
+
+	return hostnames, nil
+}
+
+// dedupAllowedHostnames removes allowed hostnames that are already
+// allowed by other hostnames in the list.
+func dedupAllowedHostnames(logger *zap.Logger, filterName string, hostnames []string) []string {
+	if len(hostnames) == 0 {
+		return hostnames
+	}
+
+	deduped, removed := dedupHostnames(hostnames)
+	for _, hostname := range removed {
+		logger.Debug("removing redundant allowed hostname", zap.String("filter.name", filterName), zap.String("hostname", hostname))
+	}
+
+	return deduped
+}
+
+// upperNames returns a copy of names in upper case.
+func upperNames(names []string) []string {
+	if names == nil {
+		return nil
+	}
+
+	upper := make([]string, len(names))
+	for i := range names {
+		upper[i] = strings.ToUpper(names[i])
+	}
+
+	return upper
+}
+
+func containsPort(ports []uint16, port uint16) bool {
+	for i := range ports {
+		if ports[i] == port {
+			return true
+		}
+	}
+
+	return false
+}
+
+func validOnEncapsulated(action string) bool {
+	return action == "" || action == encapsulatedDrop || action == encapsulatedDecapsulate
+}
+
+// pinsCPUs returns true if any filters will be pinned to specific
+// CPUs.
+func (c *Config) pinsCPUs() bool {
+	for i := range c.Filters {
+		if len(c.Filters[i].CPUAffinity) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// needsNetworking returns true if Egress Eddie will need to make
+// network connections itself.
+func (c *Config) needsNetworking() bool {
+	if c.SelfDNSQueue != 0 {
+		return true
+	}
+	for i := range c.Filters {
+		if c.Filters[i].AllowedHostnamesURL != "" {
+			return true
+		}
+	}
+
+	return false
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// connectionMark is the mark of a DNS request's connection.
+type connectionMark struct {
+	connID connectionID
+	mark   uint32
+}
+
+// connectionMarks holds the marks of DNS requests' connections so
+// they can be looked up by connection when the DNS response arrives.
+type connectionMarks struct {
+	mtx   sync.Mutex
+	marks map[connectionID]uint32
+	// expiry removes the marks of connections that never got a
+	// response
+	expiry *TimedCache[connectionMark]
+}
+
+func newConnectionMarks(logger *zap.Logger) *connectionMarks {
+	c := &connectionMarks{
+		marks:  make(map[connectionID]uint32),
+		expiry: NewTimedCache[connectionMark](logger, false),
+	}
+	c.expiry.OnExpire(func(cm connectionMark) {
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+
+		// the connection may have been marked again since
+		if mark, ok := c.marks[cm.connID]; ok && mark == cm.mark {
+			delete(c.marks, cm.connID)
+		}
+	})
+
+	return c
+}
+
+// add stores the mark of connID for ttl.
+func (c *connectionMarks) add(connID connectionID, mark uint32, ttl time.Duration) {
+	c.mtx.Lock()
+	oldMark, ok := c.marks[connID]
+	c.marks[connID] = mark
+	c.mtx.Unlock()
+
+	if ok && oldMark != mark {
+		c.expiry.RemoveEntry(connectionMark{connID: connID, mark: oldMark})
+	}
+	c.expiry.AddEntry(connectionMark{connID: connID, mark: mark}, ttl)
+}
+
+// take removes and returns the mark of connID, or false if connID
+// isn't marked.
+func (c *connectionMarks) take(connID connectionID) (uint32, bool) {
+	c.mtx.Lock()
+	mark, ok := c.marks[connID]
+	delete(c.marks, connID)
+	c.mtx.Unlock()
+
+	if ok {
+		c.expiry.RemoveEntry(connectionMark{connID: connID, mark: mark})
+	}
+
+	return mark, ok
+}
+
+// len returns the number of marked connections.
+func (c *connectionMarks) len() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return len(c.marks)
+}
+
+func (c *connectionMarks) stop() {
+	c.expiry.Stop()
+}
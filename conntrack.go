@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/florianl/go-nfqueue"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// from github.com/torvalds/linux/tree/master/include/uapi/linux/netfilter/nfnetlink.h
+	nfnlSubsysCTNetlink = 1
+	nfnetlinkV0         = 0
+
+	// from github.com/torvalds/linux/tree/master/include/uapi/linux/netfilter/nfnetlink.h
+	nfnlgrpConntrackNew     = 1
+	nfnlgrpConntrackDestroy = 3
+
+	// from github.com/torvalds/linux/tree/master/include/uapi/linux/netfilter/nfnetlink_conntrack.h
+	ipctnlMsgCTNew    = 0
+	ipctnlMsgCTGet    = 1
+	ipctnlMsgCTDelete = 2
+
+	ctaTupleOrig  = 1
+	ctaTupleIP    = 1
+	ctaTupleProto = 2
+
+	ctaIPv4Src = 1
+	ctaIPv4Dst = 2
+	ctaIPv6Src = 3
+	ctaIPv6Dst = 4
+
+	ctaID = 12
+
+	ctaProtoNum     = 1
+	ctaProtoSrcPort = 2
+	ctaProtoDstPort = 3
+)
+
+// flowChecker checks if connections are present in the kernel's
+// connection tracking table.
+type flowChecker interface {
+	flowExists(connID connectionID) (bool, error)
+}
+
+// conntrackConn queries conntrack over netlink.
+type conntrackConn struct {
+	conn *netlink.Conn
+}
+
+func dialConntrack() (*conntrackConn, error) {
+	conn, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error opening conntrack netlink socket: %v", err)
+	}
+
+	return &conntrackConn{conn: conn}, nil
+}
+
+func (c *conntrackConn) flowExists(connID connectionID) (bool, error) {
+	family := uint8(unix.AF_INET)
+	srcType, dstType := uint16(ctaIPv4Src), uint16(ctaIPv4Dst)
+	if connID.src.Addr().Is6() {
+		family = unix.AF_INET6
+		srcType, dstType = ctaIPv6Src, ctaIPv6Dst
+	}
+	proto := uint8(unix.IPPROTO_TCP)
+	if connID.isUDP {
+		proto = unix.IPPROTO_UDP
+	}
+
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	ae.Nested(ctaTupleOrig, func(nae *netlink.AttributeEncoder) error {
+		nae.Nested(ctaTupleIP, func(nae *netlink.AttributeEncoder) error {
+			nae.Bytes(srcType, connID.src.Addr().AsSlice())
+			nae.Bytes(dstType, connID.dst.Addr().AsSlice())
+			return nil
+		})
+		nae.Nested(ctaTupleProto, func(nae *netlink.AttributeEncoder) error {
+			nae.Uint8(ctaProtoNum, proto)
+			nae.Uint16(ctaProtoSrcPort, connID.src.Port())
+			nae.Uint16(ctaProtoDstPort, connID.dst.Port())
+			return nil
+		})
+		return nil
+	})
+	attrs, err := ae.Encode()
+	if err != nil {
+		return false, fmt.Errorf("error encoding conntrack tuple: %v", err)
+	}
+
+	// the nfgenmsg header precedes the attributes
+	data := append([]byte{family, nfnetlinkV0, 0, 0}, attrs...)
+	msg := netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(nfnlSubsysCTNetlink<<8 | ipctnlMsgCTGet),
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		Data: data,
+	}
+
+	if _, err := c.conn.Execute(msg); err != nil {
+		if errors.Is(err, unix.ENOENT) {
+			return false, nil
+		}
+		return false, fmt.Errorf("error querying conntrack: %v", err)
+	}
+
+	return true, nil
+}
+
+func (c *conntrackConn) Close() error {
+	return c.conn.Close()
+}
+
+// attrConntrackID returns the ID of the conntrack entry of a queued
+// packet, if nfqueue included conntrack information.
+func attrConntrackID(attr nfqueue.Attribute) (uint32, bool) {
+	if attr.Ct == nil {
+		return 0, false
+	}
+
+	ad, err := netlink.NewAttributeDecoder(*attr.Ct)
+	if err != nil {
+		return 0, false
+	}
+	ad.ByteOrder = binary.BigEndian
+
+	for ad.Next() {
+		if ad.Type() == ctaID {
+			return ad.Uint32(), true
+		}
+	}
+
+	return 0, false
+}
+
+// conntrackEvent is a new or destroyed conntrack entry.
+type conntrackEvent struct {
+	destroy bool
+	proto   uint8
+	dst     netip.Addr
+}
+
+// dialConntrackEvents opens a netlink socket that receives an event
+// every time a conntrack entry is created or destroyed.
+func dialConntrackEvents() (*netlink.Conn, error) {
+	conn, err := netlink.Dial(unix.NETLINK_NETFILTER, &netlink.Config{
+		Groups: 1<<(nfnlgrpConntrackNew-1) | 1<<(nfnlgrpConntrackDestroy-1),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error opening conntrack events netlink socket: %v", err)
+	}
+
+	return conn, nil
+}
+
+// parseConntrackEvent parses the protocol and original destination IP
+// of a conntrack event message.
+func parseConntrackEvent(msg netlink.Message) (conntrackEvent, error) {
+	var event conntrackEvent
+
+	switch msg.Header.Type {
+	case netlink.HeaderType(nfnlSubsysCTNetlink<<8 | ipctnlMsgCTNew):
+	case netlink.HeaderType(nfnlSubsysCTNetlink<<8 | ipctnlMsgCTDelete):
+		event.destroy = true
+	default:
+		return event, fmt.Errorf("unknown message type %d", msg.Header.Type)
+	}
+
+	// skip the nfgenmsg header
+	if len(msg.Data) < 4 {
+		return event, errors.New("message too short")
+	}
+	ad, err := netlink.NewAttributeDecoder(msg.Data[4:])
+	if err != nil {
+		return event, fmt.Errorf("error decoding attributes: %v", err)
+	}
+	ad.ByteOrder = binary.BigEndian
+
+	for ad.Next() {
+		if ad.Type() != ctaTupleOrig {
+			continue
+		}
+		ad.Nested(func(nad *netlink.AttributeDecoder) error {
+			for nad.Next() {
+				switch nad.Type() {
+				case ctaTupleIP:
+					nad.Nested(func(nad *netlink.AttributeDecoder) error {
+						for nad.Next() {
+							if nad.Type() == ctaIPv4Dst || nad.Type() == ctaIPv6Dst {
+								event.dst, _ = netip.AddrFromSlice(nad.Bytes())
+							}
+						}
+						return nil
+					})
+				case ctaTupleProto:
+					nad.Nested(func(nad *netlink.AttributeDecoder) error {
+						for nad.Next() {
+							if nad.Type() == ctaProtoNum {
+								event.proto = nad.Uint8()
+							}
+						}
+						return nil
+					})
+				}
+			}
+			return nil
+		})
+	}
+	if err := ad.Err(); err != nil {
+		return event, fmt.Errorf("error decoding attributes: %v", err)
+	}
+	if !event.dst.IsValid() {
+		return event, errors.New("missing destination IP")
+	}
+
+	return event, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/florianl/go-nfqueue"
+	"go.uber.org/zap"
+)
+
+const (
+	deadLetterQueueLen   = 256
+	deadLetterRetries    = 3
+	deadLetterRetryDelay = 100 * time.Millisecond
+	// deadLetterWorkers is how many packets are retried concurrently.
+	// Each packet is retried for up to deadLetterRetries *
+	// deadLetterRetryDelay, so retrying them one at a time would let
+	// a few failing packets hold up the whole queue.
+	deadLetterWorkers = 8
+)
+
+// deadLetterQueue retries dropping packets whose verdicts could not
+// be set. Otherwise the packets would be held in their nfqueue until
+// the kernel times them out.
+type deadLetterQueue struct {
+	// added is how many packets could not have their verdicts set,
+	// accessed atomically and kept first to ensure 64-bit alignment
+	added int64
+
+	logger  *zap.Logger
+	packets chan deadLetter
+}
+
+type deadLetter struct {
+	nf       packetQueue
+	packetID uint32
+}
+
+func newDeadLetterQueue(logger *zap.Logger) *deadLetterQueue {
+	return &deadLetterQueue{
+		logger:  logger,
+		packets: make(chan deadLetter, deadLetterQueueLen),
+	}
+}
+
+// add queues a packet to be dropped. It never blocks so it is safe
+// to call from nfqueue callbacks.
+func (d *deadLetterQueue) add(nf packetQueue, packetID uint32) {
+	atomic.AddInt64(&d.added, 1)
+
+	select {
+	case d.packets <- deadLetter{nf: nf, packetID: packetID}:
+	default:
+		d.logger.Error("dead letter queue is full, abandoning packet", zap.Uint32("packet.id", packetID))
+	}
+}
+
+// setVerdict sets the verdict of packet id of nf. If the verdict
+// can't be set, the error is logged, the packet is queued to be
+// dropped and false is returned.
+func (d *deadLetterQueue) setVerdict(logger *zap.Logger, nf packetQueue, id uint32, verdict int) bool {
+	if err := nf.SetVerdict(id, verdict); err != nil {
+		logger.Error("error setting verdict", zap.NamedError("error", err))
+		d.add(nf, id)
+		return false
+	}
+
+	return true
+}
+
+// total returns how many packets could not have their verdicts
+// set.
+func (d *deadLetterQueue) total() int64 {
+	if d == nil {
+		return 0
+	}
+
+	return atomic.LoadInt64(&d.added)
+}
+
+// run drops queued packets on deadLetterWorkers goroutines until ctx
+// is canceled.
+func (d *deadLetterQueue) run(ctx context.Context) {
+	var wg sync.WaitGroup
+	wg.Add(deadLetterWorkers)
+	for i := 0; i < deadLetterWorkers; i++ {
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case dl := <-d.packets:
+					d.drop(ctx, dl)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (d *deadLetterQueue) drop(ctx context.Context, dl deadLetter) {
+	timer := time.NewTimer(deadLetterRetryDelay)
+	defer timer.Stop()
+
+	var err error
+	for i := 0; i < deadLetterRetries; i++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		if err = dl.nf.SetVerdict(dl.packetID, nfqueue.NfDrop); err == nil {
+			d.logger.Debug("dropped dead letter packet", zap.Uint32("packet.id", dl.packetID))
+			return
+		}
+		timer.Reset(deadLetterRetryDelay)
+	}
+
+	d.logger.Error("error dropping dead letter packet, abandoning packet", zap.Uint32("packet.id", dl.packetID), zap.NamedError("error", err))
+}
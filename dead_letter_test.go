@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/florianl/go-nfqueue"
+	"github.com/matryer/is"
+	"go.uber.org/zap"
+)
+
+// failingQueue fails to set the first failures verdicts.
+type failingQueue struct {
+	*fakeQueue
+	failures int
+	attempts int
+}
+
+func (q *failingQueue) SetVerdict(id uint32, verdict int) error {
+	q.mtx.Lock()
+	q.attempts++
+	fail := q.attempts <= q.failures
+	q.mtx.Unlock()
+
+	if fail {
+		return errors.New("netlink receive: no buffer space available")
+	}
+	return q.fakeQueue.SetVerdict(id, verdict)
+}
+
+func TestDeadLetterQueue(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		dropped  bool
+	}{
+		{
+			name:     "first retry succeeds",
+			failures: 0,
+			dropped:  true,
+		},
+		{
+			name:     "last retry succeeds",
+			failures: deadLetterRetries - 1,
+			dropped:  true,
+		},
+		{
+			name:     "abandoned",
+			failures: deadLetterRetries,
+			dropped:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+
+			d := newDeadLetterQueue(zap.NewNop())
+			nf := &failingQueue{fakeQueue: newFakeQueue(), failures: tt.failures}
+			d.add(nf, 1)
+			is.Equal(d.total(), int64(1)) // dead letters should be counted when added
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			d.drop(ctx, <-d.packets)
+
+			verdict, ok := nf.verdict(1)
+			is.Equal(ok, tt.dropped) // packet should only be dropped if a retry succeeded
+			if tt.dropped {
+				is.Equal(verdict, nfqueue.NfDrop) // dead letters should be dropped
+			}
+			attempts := tt.failures + 1
+			if attempts > deadLetterRetries {
+				attempts = deadLetterRetries
+			}
+			is.Equal(nf.attempts, attempts) // verdicts should be retried until one succeeds
+		})
+	}
+}
+
+func TestDeadLetterQueueConcurrentRetries(t *testing.T) {
+	is := is.New(t)
+
+	d := newDeadLetterQueue(zap.NewNop())
+	nf := newFakeQueue()
+	for i := 0; i < deadLetterWorkers; i++ {
+		d.add(nf, uint32(i))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.run(ctx)
+
+	// the first retry of each packet is delayed by
+	// deadLetterRetryDelay, retrying packets one at a time would take
+	// deadLetterWorkers times as long
+	time.Sleep(deadLetterRetryDelay * deadLetterWorkers / 2)
+	for i := 0; i < deadLetterWorkers; i++ {
+		verdict, ok := nf.verdict(uint32(i))
+		is.True(ok)                       // dead letters should be retried concurrently
+		is.Equal(verdict, nfqueue.NfDrop) // dead letters should be dropped
+	}
+}
+
+func TestDeadLetterQueueFull(t *testing.T) {
+	is := is.New(t)
+
+	d := newDeadLetterQueue(zap.NewNop())
+	nf := newFakeQueue()
+	for i := 0; i < deadLetterQueueLen+1; i++ {
+		d.add(nf, uint32(i))
+	}
+
+	is.Equal(len(d.packets), deadLetterQueueLen)        // dead letters should not be queued once the queue is full
+	is.Equal(d.total(), int64(deadLetterQueueLen+1))    // abandoned dead letters should still be counted
+	is.Equal((*deadLetterQueue)(nil).total(), int64(0)) // filters without dead letter queues should have no dead letters
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// defaultRecentDeniesSize is how many denied DNS questions are kept
+// per filter by default.
+const defaultRecentDeniesSize = 100
+
+// DeniedQuestion is a DNS question that a filter denied.
+type DeniedQuestion struct {
+	Hostname string
+	// Type is the name of the type of the question, such as "A"
+	Type string
+	Time time.Time
+}
+
+// denyRing keeps the most recently denied DNS questions of a filter.
+type denyRing struct {
+	ring *ringBuffer[DeniedQuestion]
+}
+
+func newDenyRing(size int) *denyRing {
+	return &denyRing{
+		ring: newRingBuffer[DeniedQuestion](size),
+	}
+}
+
+// add records a denied DNS question.
+func (d *denyRing) add(question layers.DNSQuestion) {
+	d.ring.add(DeniedQuestion{
+		Hostname: string(question.Name),
+		Type:     question.Type.String(),
+		Time:     time.Now(),
+	})
+}
+
+// recent returns the recorded denied DNS questions from oldest to
+// newest.
+func (d *denyRing) recent() []DeniedQuestion {
+	return d.ring.items()
+}
+
+// RecentDenies returns the DNS questions a filter most recently
+// denied from oldest to newest.
+func (f *FilterManager) RecentDenies(filterName string) ([]DeniedQuestion, error) {
+	for _, filter := range f.currentFilters() {
+		if filter.opts.Name == filterName {
+			return filter.recentDenies.recent(), nil
+		}
+	}
+
+	return nil, fmt.Errorf("filter %q: %w", filterName, ErrFilterNotFound)
+}
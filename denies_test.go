@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/gopacket/layers"
+	"github.com/matryer/is"
+	"go.uber.org/zap"
+)
+
+func TestRecentDenies(t *testing.T) {
+	is := is.New(t)
+
+	f := newTestFilter(&FilterOptions{
+		AllowedHostnames: []string{"example.com"},
+	})
+	f.recentDenies = newDenyRing(3)
+	is.Equal(len(f.recentDenies.recent()), 0) // no questions should be recorded yet
+
+	for _, hostname := range []string{"one.com", "example.com", "two.com", "three.com", "four.com"} {
+		dns := &layers.DNS{
+			QDCount: 1,
+			Questions: []layers.DNSQuestion{
+				{
+					Name:  []byte(hostname),
+					Type:  layers.DNSTypeA,
+					Class: layers.DNSClassIN,
+				},
+			},
+		}
+		f.validateDNSQuestions(zap.NewNop(), dns, connectionID{})
+	}
+
+	denies := f.recentDenies.recent()
+	hostnames := make([]string, len(denies))
+	for i := range denies {
+		hostnames[i] = denies[i].Hostname
+		is.Equal(denies[i].Type, "A")     // question type should be recorded
+		is.True(!denies[i].Time.IsZero()) // time of deny should be recorded
+	}
+	is.Equal(hostnames, []string{"two.com", "three.com", "four.com"}) // only the most recent denies should be kept in order
+}
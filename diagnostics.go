@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"runtime"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// recentLogsSize is how many log entries of each filter are kept to be
+// included in diagnostic reports.
+const recentLogsSize = 10
+
+// DiagnosticReport describes the state of a filter when it panicked.
+type DiagnosticReport struct {
+	Time        time.Time
+	GoVersion   string
+	Panic       string
+	FilterName  string
+	Options     FilterOptions
+	Connections CacheStats
+	AllowedIPs  CacheStats
+	RecentLogs  []loggedEntry
+}
+
+// loggedEntry is a log entry kept for diagnostic reports.
+type loggedEntry struct {
+	Time    time.Time
+	Level   string
+	Message string
+	Fields  map[string]interface{}
+}
+
+// logRingCore is a zapcore.Core that keeps the most recent log entries.
+type logRingCore struct {
+	zapcore.LevelEnabler
+
+	ring   *ringBuffer[loggedEntry]
+	fields []zapcore.Field
+}
+
+func newLogRingCore(enab zapcore.LevelEnabler, size int) *logRingCore {
+	return &logRingCore{
+		LevelEnabler: enab,
+		ring:         newRingBuffer[loggedEntry](size),
+	}
+}
+
+func (l *logRingCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := *l
+	clone.fields = make([]zapcore.Field, 0, len(l.fields)+len(fields))
+	clone.fields = append(clone.fields, l.fields...)
+	clone.fields = append(clone.fields, fields...)
+
+	return &clone
+}
+
+func (l *logRingCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if l.Enabled(ent.Level) {
+		return ce.AddCore(ent, l)
+	}
+	return ce
+}
+
+func (l *logRingCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	enc := zapcore.NewMapObjectEncoder()
+	for _, field := range l.fields {
+		field.AddTo(enc)
+	}
+	for _, field := range fields {
+		field.AddTo(enc)
+	}
+
+	l.ring.add(loggedEntry{
+		Time:    ent.Time,
+		Level:   ent.Level.String(),
+		Message: ent.Message,
+		Fields:  enc.Fields,
+	})
+
+	return nil
+}
+
+func (l *logRingCore) Sync() error {
+	return nil
+}
+
+// diagnosticDump returns a report of the filter's current state.
+func (f *filter) diagnosticDump() DiagnosticReport {
+	report := DiagnosticReport{
+		Time:       time.Now(),
+		GoVersion:  runtime.Version(),
+		FilterName: f.opts.Name,
+		RecentLogs: f.recentLogs.ring.items(),
+	}
+
+	f.hostnamesMtx.RLock()
+	report.Options = *f.opts
+	report.Options.AllowedHostnames = append([]string(nil), f.opts.AllowedHostnames...)
+	f.hostnamesMtx.RUnlock()
+	// don't leak credentials into reports
+	if u, err := url.Parse(report.Options.AllowedHostnamesURL); err == nil {
+		report.Options.AllowedHostnamesURL = u.Redacted()
+	}
+
+	report.Connections = f.connections.Stats()
+	if f.allowedIPs != nil {
+		report.AllowedIPs = f.allowedIPs.Stats()
+	}
+
+	return report
+}
+
+// recoverPanic writes a diagnostic report if a panic occurred and
+// then continues panicking. It must be deferred.
+func (f *filter) recoverPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	f.writeDiagnosticReport(r)
+	panic(r)
+}
+
+func (f *filter) writeDiagnosticReport(r interface{}) {
+	if f.diagnosticDumpDir == "" {
+		return
+	}
+
+	report := f.diagnosticDump()
+	report.Panic = fmt.Sprint(r)
+
+	file, err := os.CreateTemp(f.diagnosticDumpDir, "egress-eddie-*.json")
+	if err != nil {
+		f.logger.Error("error creating diagnostic report", zap.NamedError("error", err))
+		return
+	}
+	defer file.Close()
+
+	enc := json.NewEncoder(file)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(report); err != nil {
+		f.logger.Error("error writing diagnostic report", zap.NamedError("error", err))
+		return
+	}
+
+	f.logger.Error("wrote diagnostic report", zap.String("report.path", file.Name()))
+}
+
+// recoverPanic writes a diagnostic report for every filter if a panic
+// occurred and then continues panicking. It must be deferred.
+func (f *FilterManager) recoverPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	for _, filter := range f.currentFilters() {
+		filter.writeDiagnosticReport(r)
+	}
+	panic(r)
+}
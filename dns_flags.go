@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/google/gopacket/layers"
+)
+
+// gopacket decodes the Z, AD and CD header bits together into
+// layers.DNS.Z.
+const (
+	dnsZBitZ  = 0x4
+	dnsZBitAD = 0x2
+	dnsZBitCD = 0x1
+)
+
+// dnsFlags returns the names of the header flags that are set in a
+// DNS message.
+func dnsFlags(dns *layers.DNS) []string {
+	flags := make([]string, 0, 7)
+	for _, flag := range []struct {
+		name string
+		set  bool
+	}{
+		{"AA", dns.AA},
+		{"TC", dns.TC},
+		{"RD", dns.RD},
+		{"RA", dns.RA},
+		{"Z", dns.Z&dnsZBitZ != 0},
+		{"AD", dns.Z&dnsZBitAD != 0},
+		{"CD", dns.Z&dnsZBitCD != 0},
+	} {
+		if flag.set {
+			flags = append(flags, flag.name)
+		}
+	}
+
+	return flags
+}
+
+// opcodeAllowed returns true if DNS messages with opcode are allowed.
+// Opcodes other than QUERY, UPDATE and NOTIFY are only disallowed if
+// opts.RejectUnknownOpcodes is set.
+func (f *filter) opcodeAllowed(opcode layers.DNSOpCode) bool {
+	switch opcode {
+	case layers.DNSOpCodeQuery:
+		return true
+	case layers.DNSOpCodeUpdate:
+		return f.opts.AllowDNSUpdate
+	case layers.DNSOpCodeNotify:
+		return f.opts.AllowDNSNotify
+	default:
+		return !f.opts.RejectUnknownOpcodes
+	}
+}
+
+// suspiciousRequestFlags returns why the header flags of a DNS request
+// are suspicious, or an empty string if they aren't. Flags that only
+// have meaning in responses are suspicious in requests, and may be
+// used to smuggle data.
+func suspiciousRequestFlags(dns *layers.DNS) string {
+	switch {
+	case dns.Z&dnsZBitZ != 0:
+		return "reserved Z bit is set"
+	case dns.AA:
+		return "AA is set"
+	case dns.RA:
+		return "RA is set"
+	case dns.ResponseCode != layers.DNSResponseCodeNoErr:
+		return "response code is set"
+	default:
+		return ""
+	}
+}
+
+// suspiciousResponseFlags returns why the header flags of a DNS
+// response are suspicious, or an empty string if they aren't.
+func suspiciousResponseFlags(dns *layers.DNS) string {
+	switch {
+	case dns.Z&dnsZBitZ != 0:
+		return "reserved Z bit is set"
+	case dns.AA && dns.RA:
+		// resolvers answering recursive queries are rarely
+		// authoritative for the answers, which may be forged
+		return "AA is set on a recursive response"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"go.uber.org/zap"
+)
+
+// maxLatencyHostnames is how many hostnames DNS response latencies
+// are recorded for separately, latencies of other hostnames are
+// recorded together under an empty hostname so a client can't make
+// a filter use unbounded memory.
+const maxLatencyHostnames = 1000
+
+// dnsLatencyBuckets are the upper bounds of the buckets DNS response
+// latencies are counted in.
+var dnsLatencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+// DNSLatency is a histogram of how long a resolver took to respond
+// to DNS requests for a hostname.
+type DNSLatency struct {
+	Hostname string
+	Count    int64
+	Sum      time.Duration
+	// Buckets is how many responses took at most the upper bound of
+	// each bucket, in the order of dnsLatencyBuckets
+	Buckets []int64
+}
+
+// latencyRecorder records DNS response latencies of hostnames. The
+// zero value is ready to use.
+type latencyRecorder struct {
+	mtx       sync.Mutex
+	latencies map[string]*DNSLatency
+}
+
+// record records the latency of a response for hostname. Hostnames
+// are normalized so differently cased questions of the same hostname
+// are recorded together.
+func (l *latencyRecorder) record(hostname string, latency time.Duration) {
+	hostname = normalizeHostname(hostname)
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.latencies == nil {
+		l.latencies = make(map[string]*DNSLatency)
+	}
+	hist, ok := l.latencies[hostname]
+	if !ok {
+		if len(l.latencies) >= maxLatencyHostnames {
+			hostname = ""
+			hist, ok = l.latencies[hostname]
+		}
+		if !ok {
+			hist = &DNSLatency{
+				Hostname: hostname,
+				Buckets:  make([]int64, len(dnsLatencyBuckets)),
+			}
+			l.latencies[hostname] = hist
+		}
+	}
+
+	hist.Count++
+	hist.Sum += latency
+	for i, bound := range dnsLatencyBuckets {
+		if latency <= bound {
+			hist.Buckets[i]++
+		}
+	}
+}
+
+// snapshot returns copies of the recorded latencies sorted by
+// hostname, or nil if none were recorded.
+func (l *latencyRecorder) snapshot() []DNSLatency {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if len(l.latencies) == 0 {
+		return nil
+	}
+
+	latencies := make([]DNSLatency, 0, len(l.latencies))
+	for _, hist := range l.latencies {
+		latency := *hist
+		latency.Buckets = make([]int64, len(hist.Buckets))
+		copy(latency.Buckets, hist.Buckets)
+		latencies = append(latencies, latency)
+	}
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i].Hostname < latencies[j].Hostname
+	})
+
+	return latencies
+}
+
+// recordResponseLatency records how long the resolver took to respond
+// to the request of connID for each question of a DNS response. It
+// must be called before the connection is removed.
+func (f *filter) recordResponseLatency(logger *zap.Logger, connID connectionID, dns *layers.DNS) {
+	requested, ok := f.connections.Added(connID)
+	if !ok {
+		return
+	}
+	latency := time.Since(requested)
+
+	for i := range dns.Questions {
+		f.dnsLatencies.record(string(dns.Questions[i].Name), latency)
+	}
+	if f.opts.SlowDNSResponseThreshold != 0 && latency >= time.Duration(f.opts.SlowDNSResponseThreshold) {
+		logger.Warn("slow DNS response", zap.Strings("questions", questionStrings(dns.Questions)), zap.Duration("dns.latency", latency))
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/matryer/is"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestResponseLatency(t *testing.T) {
+	is := is.New(t)
+
+	const delay = 50 * time.Millisecond
+
+	f := newTestFilter(&FilterOptions{
+		SlowDNSResponseThreshold: duration(delay),
+	})
+	t.Cleanup(f.close)
+	core, logs := observer.New(zap.InfoLevel)
+
+	connID := connectionID{
+		isUDP: true,
+		src:   netip.MustParseAddrPort("192.168.1.2:40000"),
+		dst:   netip.MustParseAddrPort("192.168.1.1:53"),
+	}
+	dns := &layers.DNS{
+		QR: true,
+		Questions: []layers.DNSQuestion{
+			{Name: []byte("example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN},
+		},
+	}
+
+	// responses to untracked connections should not be recorded
+	f.recordResponseLatency(zap.New(core), connID, dns)
+	is.Equal(f.dnsLatencies.snapshot(), nil) // latency should not be recorded without a request
+
+	f.connections.AddEntry(connID, dnsQueryTimeout)
+	time.Sleep(delay)
+	f.recordResponseLatency(zap.New(core), connID, dns)
+
+	latencies := f.dnsLatencies.snapshot()
+	is.Equal(len(latencies), 1)
+	is.Equal(latencies[0].Hostname, "example.com")
+	is.Equal(latencies[0].Count, int64(1))                             // latency should be recorded
+	is.True(latencies[0].Sum >= delay)                                 // latency should include the delay
+	is.True(latencies[0].Sum < dnsQueryTimeout)                        // latency should be measured from the request
+	is.Equal(latencies[0].Buckets[0], int64(0))                        // latency should not be counted in smaller buckets
+	is.Equal(latencies[0].Buckets[len(dnsLatencyBuckets)-1], int64(1)) // latency should be counted in larger buckets
+	is.Equal(logs.FilterMessage("slow DNS response").Len(), 1)         // slow response should be logged
+}
+
+func TestLatencyRecorderLimit(t *testing.T) {
+	is := is.New(t)
+
+	var l latencyRecorder
+	for i := 0; i < maxLatencyHostnames+10; i++ {
+		l.record(fmt.Sprintf("%d.example.com", i), time.Millisecond)
+	}
+
+	latencies := l.snapshot()
+	is.Equal(len(latencies), maxLatencyHostnames+1) // hostnames over the limit should be recorded together
+	is.Equal(latencies[0].Hostname, "")
+	is.Equal(latencies[0].Count, int64(10))
+}
+
+func TestLatencyRecorderNormalizesHostnames(t *testing.T) {
+	is := is.New(t)
+
+	var l latencyRecorder
+	for _, hostname := range []string{"example.com", "EXAMPLE.com", "Example.Com."} {
+		l.record(hostname, time.Millisecond)
+	}
+
+	latencies := l.snapshot()
+	is.Equal(len(latencies), 1)                    // differently cased questions should be recorded together
+	is.Equal(latencies[0].Hostname, "example.com") // hostnames should be normalized
+	is.Equal(latencies[0].Count, int64(3))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+
+	"github.com/google/gopacket/layers"
+	"go.uber.org/zap"
+)
+
+// packetConnID returns the connection of a packet from its IP and
+// transport headers, without parsing its payload. ok is false if the
+// headers can't be parsed.
+func packetConnID(packet []byte, ipv6, inbound bool) (connectionID, bool) {
+	p := newTrafficParser(ipv6, true)
+	// the payload isn't decoded, so only errors decoding the
+	// headers are returned
+	if err := p.decode(packet); err != nil || len(p.decoded) != 2 {
+		return connectionID{}, false
+	}
+
+	var (
+		src, dst         netip.Addr
+		srcPort, dstPort uint16
+		srcOK, dstOK     bool
+	)
+	if !ipv6 {
+		src, srcOK = netip.AddrFromSlice(p.ip4.SrcIP)
+		dst, dstOK = netip.AddrFromSlice(p.ip4.DstIP)
+	} else {
+		src, srcOK = netip.AddrFromSlice(p.ip6.SrcIP)
+		dst, dstOK = netip.AddrFromSlice(p.ip6.DstIP)
+	}
+	if !srcOK || !dstOK {
+		return connectionID{}, false
+	}
+
+	isUDP := p.decoded[1] == layers.LayerTypeUDP
+	if isUDP {
+		srcPort = uint16(p.udp.SrcPort)
+		dstPort = uint16(p.udp.DstPort)
+	} else {
+		srcPort = uint16(p.tcp.SrcPort)
+		dstPort = uint16(p.tcp.DstPort)
+	}
+
+	connID := connectionID{
+		isUDP: isUDP,
+		src:   netip.AddrPortFrom(src, srcPort),
+		dst:   netip.AddrPortFrom(dst, dstPort),
+	}
+	if inbound {
+		connID.src, connID.dst = connID.dst, connID.src
+	}
+
+	return connID, true
+}
+
+// dnsParseFallbackAllowed returns true if a DNS request that failed
+// to be parsed with parseErr should be allowed because its source or
+// destination IP is allowed, as if it were generic traffic. Requests
+// are only allowed if opts.DNSParseFailFallback is set, and
+// encapsulated requests are never allowed as they are handled by
+// opts.OnEncapsulated. The connections of allowed requests are
+// tracked so their responses are allowed.
+func (f *filter) dnsParseFallbackAllowed(logger *zap.Logger, packet []byte, parseErr error) bool {
+	if f.unparsedConnections == nil {
+		return false
+	}
+	var encapErr *encapsulatedError
+	if errors.As(parseErr, &encapErr) {
+		return false
+	}
+
+	connID, ok := packetConnID(packet, packetIsIPv6(packet, f.opts.IPVersion), false)
+	if !ok {
+		return false
+	}
+	// only workloads the filter is scoped to may use it, even if
+	// their requests can't be inspected
+	if !f.validDNSSource(connID.src.Addr()) {
+		return false
+	}
+
+	mechanism, err := f.validateIPs(logger, connID.src.Addr(), connID.dst.Addr())
+	if err != nil {
+		logger.Error("error validating IPs", zap.NamedError("error", err))
+		return false
+	}
+	if mechanism == allowedByNone {
+		return false
+	}
+
+	logger.Warn("allowing unparsable DNS request to allowed IP", zap.Stringer("conn.id", connID), zap.Stringer("allowed.by", mechanism))
+	f.unparsedConnections.AddEntry(connID, dnsQueryTimeout)
+
+	return true
+}
+
+// unparsedRequestFilter returns the filter that allowed an unparsable
+// DNS request on connID, or nil if no filter did.
+func unparsedRequestFilter(filters []*filter, connID connectionID) *filter {
+	for _, filter := range filters {
+		if filter.unparsedConnections != nil && filter.unparsedConnections.EntryExists(connID) {
+			return filter
+		}
+	}
+
+	return nil
+}
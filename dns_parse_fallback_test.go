@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/matryer/is"
+	"go.uber.org/zap"
+)
+
+func TestDNSParseFailFallback(t *testing.T) {
+	is := is.New(t)
+
+	request := &layers.DNS{
+		ID: 1,
+		Questions: []layers.DNSQuestion{
+			{
+				Name:  []byte("example.com"),
+				Type:  layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+			},
+		},
+	}
+	resolver := netip.MustParseAddrPort("192.168.1.1:53")
+	packet := newDNSPacketBetween(t, netip.MustParseAddrPort("192.168.1.2:40000"), resolver, request)
+	// cut the question short so the DNS layer can't be decoded
+	malformed := packet[:len(packet)-6]
+	_, _, parseErr := parseDNSPacket(malformed, false, false, false)
+	is.True(parseErr != nil) // truncated request should fail to be parsed
+
+	f := newTestFilter(&FilterOptions{
+		IPVersion:        4,
+		AllowAnswersFor:  duration(time.Minute),
+		AllowedHostnames: []string{"example.com"},
+	})
+	t.Cleanup(f.close)
+	f.allowIPBy(resolver.Addr(), allowedByCachedLookup, time.Minute)
+
+	is.True(!f.dnsParseFallbackAllowed(zap.NewNop(), malformed, parseErr)) // request should be dropped when fallback is disabled
+
+	f.opts.DNSParseFailFallback = true
+	f.unparsedConnections = NewTimedCache[connectionID](zap.NewNop(), false)
+	is.True(f.dnsParseFallbackAllowed(zap.NewNop(), malformed, parseErr)) // request to allowed resolver should be allowed
+
+	connID := connectionID{
+		isUDP: true,
+		src:   netip.MustParseAddrPort("192.168.1.2:40000"),
+		dst:   resolver,
+	}
+	is.Equal(unparsedRequestFilter([]*filter{f}, connID), f) // response to allowed request should be allowed
+	connID.src = netip.MustParseAddrPort("192.168.1.2:40001")
+	is.Equal(unparsedRequestFilter([]*filter{f}, connID), nil) // response to unknown request should not be allowed
+
+	other := newDNSPacketBetween(t, netip.MustParseAddrPort("192.168.1.2:40000"), netip.MustParseAddrPort("192.168.1.3:53"), request)
+	is.True(!f.dnsParseFallbackAllowed(zap.NewNop(), other[:len(other)-6], parseErr)) // request to disallowed resolver should be dropped
+
+	encapErr := &encapsulatedError{proto: layers.IPProtocolGRE}
+	is.True(!f.dnsParseFallbackAllowed(zap.NewNop(), malformed, encapErr)) // encapsulated request should be dropped
+
+	f.dnsAllowedSources = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	is.True(!f.dnsParseFallbackAllowed(zap.NewNop(), malformed, parseErr)) // request from disallowed source should be dropped
+}
+
+func TestPacketConnID(t *testing.T) {
+	is := is.New(t)
+
+	src := netip.MustParseAddrPort("192.168.1.2:40000")
+	dst := netip.MustParseAddrPort("192.168.1.1:53")
+	packet := newDNSPacketBetween(t, src, dst, &layers.DNS{})
+	connID, ok := packetConnID(packet, false, false)
+	is.True(ok)                                                     // IPv4 headers should be parsed
+	is.Equal(connID, connectionID{isUDP: true, src: src, dst: dst}) // outbound connection should be from the source
+	connID, ok = packetConnID(packet, false, true)
+	is.True(ok)                                                     // IPv4 headers should be parsed
+	is.Equal(connID, connectionID{isUDP: true, src: dst, dst: src}) // inbound connection should be to the source
+
+	packet = newTCPv6DNSPacket(t, &layers.DNS{})
+	connID, ok = packetConnID(packet, true, true)
+	is.True(ok) // IPv6 headers should be parsed
+	is.Equal(connID, connectionID{
+		isUDP: false,
+		src:   netip.MustParseAddrPort("[2001:db8::2]:40000"),
+		dst:   netip.MustParseAddrPort("[2001:db8::53]:53"),
+	}) // inbound TCP connection should be to the source
+
+	_, ok = packetConnID(packet[:20], true, false)
+	is.True(!ok) // truncated IPv6 header should not be parsed
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/url"
+	"strings"
+)
+
+const (
+	// dohMediaType is the media type of DNS messages sent over HTTP
+	dohMediaType = "application/dns-message"
+	// dohPath is the path DNS over HTTPS servers conventionally
+	// serve requests on
+	dohPath = "/dns-query"
+)
+
+// dohMethods are the methods of HTTP requests that can be DNS over
+// HTTPS requests
+var dohMethods = [][]byte{[]byte("GET "), []byte("POST ")}
+
+// reassembleHTTPRequest returns the start of the stream of a TCP
+// connection once it is known whether it has a DNS over HTTPS request.
+// HTTP request headers that span multiple segments are reassembled,
+// and false is returned until the end of the headers is available so
+// the segments before it can be allowed.
+func (f *filter) reassembleHTTPRequest(connID connectionID, seq uint32, payload []byte) ([]byte, bool, error) {
+	return f.dohReassembly.add(connID, seq, payload, httpRequestHeadComplete)
+}
+
+// httpRequestHeadComplete returns true if the headers of the HTTP/1.x
+// request at the start of data are complete, or data doesn't start
+// with a request that could be a DNS over HTTPS request.
+func httpRequestHeadComplete(data []byte) bool {
+	if len(data) == 0 {
+		return true
+	}
+
+	for _, method := range dohMethods {
+		// the method itself may be split across segments
+		if len(data) < len(method) && bytes.HasPrefix(method, data) {
+			return false
+		}
+		if bytes.HasPrefix(data, method) {
+			return bytes.Contains(data, []byte("\r\n\r\n"))
+		}
+	}
+
+	return true
+}
+
+// parseDoHRequest returns the host of a plaintext HTTP/1.x request at
+// the start of payload, and true if it is a DNS over HTTPS request.
+// Requests are DoH requests if their path is dohPath or they send or
+// accept DNS messages. Headers of requests are reassembled before
+// they are parsed, but payload may still be truncated if reassembly
+// isn't used, so only the headers in payload are checked.
+func parseDoHRequest(payload []byte) (string, bool) {
+	if !bytes.HasPrefix(payload, dohMethods[0]) && !bytes.HasPrefix(payload, dohMethods[1]) {
+		return "", false
+	}
+	if end := bytes.Index(payload, []byte("\r\n\r\n")); end != -1 {
+		payload = payload[:end]
+	}
+
+	lines := strings.Split(string(payload), "\r\n")
+	requestLine := strings.Fields(lines[0])
+	if len(requestLine) != 3 || !strings.HasPrefix(requestLine[2], "HTTP/1.") {
+		return "", false
+	}
+	target, err := url.ParseRequestURI(requestLine[1])
+	if err != nil {
+		return "", false
+	}
+
+	isDoH := target.Path == dohPath
+	host := target.Host
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "host":
+			// the target takes precedence over the Host header if
+			// it is absolute
+			if host == "" {
+				host = value
+			}
+		case "content-type", "accept":
+			if strings.Contains(strings.ToLower(value), dohMediaType) {
+				isDoH = true
+			}
+		}
+	}
+	if !isDoH {
+		return "", false
+	}
+
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	return normalizeHostname(host), true
+}
+
+// dohBlocked returns the host of a plaintext DNS over HTTPS request at
+// the start of payload, and true if the host isn't an allowed DoH
+// endpoint.
+func (f *filter) dohBlocked(payload []byte) (string, bool) {
+	host, ok := parseDoHRequest(payload)
+	if !ok {
+		return "", false
+	}
+
+	return host, host == "" || !f.dohEndpoints.matches(host)
+}
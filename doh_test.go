@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/florianl/go-nfqueue"
+	"github.com/matryer/is"
+)
+
+func TestParseDoHRequest(t *testing.T) {
+	tests := []struct {
+		name         string
+		payload      string
+		expectedHost string
+		expectedDoH  bool
+	}{
+		{
+			name:         "GET request",
+			payload:      "GET /dns-query?dns=AAABAAABAAAAAAAAB2V4YW1wbGUDY29tAAABAAE HTTP/1.1\r\nHost: dns.example.com\r\nAccept: application/dns-message\r\n\r\n",
+			expectedHost: "dns.example.com",
+			expectedDoH:  true,
+		},
+		{
+			name:         "POST request",
+			payload:      "POST /resolve HTTP/1.1\r\nHost: DNS.Example.com:8080\r\nContent-Type: application/dns-message\r\nContent-Length: 33\r\n\r\n\x00\x00\x01\x00",
+			expectedHost: "dns.example.com",
+			expectedDoH:  true,
+		},
+		{
+			name:         "absolute target",
+			payload:      "GET http://dns.example.com/dns-query?dns=AAABAAABAAAAAAAAB2V4YW1wbGUDY29tAAABAAE HTTP/1.1\r\nHost: other.example.com\r\n\r\n",
+			expectedHost: "dns.example.com",
+			expectedDoH:  true,
+		},
+		{
+			name:         "truncated headers",
+			payload:      "GET /dns-query?dns=AAABAAABAAAAAAAAB2V4YW1wbGUDY29tAAABAAE HTTP/1.1\r\nHost: dns.example.com\r\nUser-Ag",
+			expectedHost: "dns.example.com",
+			expectedDoH:  true,
+		},
+		{
+			name:        "plain HTTP request",
+			payload:     "GET /index.html HTTP/1.1\r\nHost: www.example.com\r\nAccept: text/html\r\n\r\n",
+			expectedDoH: false,
+		},
+		{
+			name:        "TLS ClientHello",
+			payload:     "\x16\x03\x01\x00\x05\x01\x00\x00\x01\x00",
+			expectedDoH: false,
+		},
+		{
+			name:        "malformed request line",
+			payload:     "GET /dns-query\r\nHost: dns.example.com\r\n\r\n",
+			expectedDoH: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+
+			host, ok := parseDoHRequest([]byte(tt.payload))
+			is.Equal(ok, tt.expectedDoH)    // request should only be detected as DoH if it is
+			is.Equal(host, tt.expectedHost) // host of DoH request should be parsed
+		})
+	}
+}
+
+func TestBlockDoH(t *testing.T) {
+	is := is.New(t)
+
+	f := newTestFilter(&FilterOptions{
+		AllowedHostnames:    []string{"example.com"},
+		BlockDoH:            true,
+		AllowedDoHHostnames: []string{"dns.example.com"},
+	})
+	f.dohEndpoints = newHostnameTrie(f.opts.AllowedDoHHostnames)
+
+	host, blocked := f.dohBlocked([]byte("POST /dns-query HTTP/1.1\r\nHost: doh.example.net\r\nContent-Type: application/dns-message\r\n\r\n"))
+	is.True(blocked)                  // DoH request to host that isn't allowed should be blocked
+	is.Equal(host, "doh.example.net") // host of blocked request should be returned
+
+	_, blocked = f.dohBlocked([]byte("GET /dns-query?dns=AAABAAABAAAAAAAAB2V4YW1wbGUDY29tAAABAAE HTTP/1.1\r\nHost: dns.example.com\r\n\r\n"))
+	is.True(!blocked) // DoH request to allowed host should not be blocked
+
+	_, blocked = f.dohBlocked([]byte("POST /dns-query HTTP/1.1\r\nContent-Type: application/dns-message\r\n\r\n"))
+	is.True(blocked) // DoH request without a host should be blocked
+
+	_, blocked = f.dohBlocked([]byte("GET / HTTP/1.1\r\nHost: www.example.net\r\n\r\n"))
+	is.True(!blocked) // HTTP requests that aren't DoH should not be blocked
+}
+
+func TestHTTPRequestHeadComplete(t *testing.T) {
+	is := is.New(t)
+
+	is.True(!httpRequestHeadComplete([]byte("PO")))                                      // partial methods should be buffered
+	is.True(!httpRequestHeadComplete([]byte("GET /dns-query HTTP/1.1\r\nHost: a")))      // partial headers should be buffered
+	is.True(httpRequestHeadComplete([]byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n")))        // complete headers should not be buffered
+	is.True(httpRequestHeadComplete([]byte("PUT / HTTP/1.1\r\nHost: a")))                // requests that can't be DoH requests should not be buffered
+	is.True(httpRequestHeadComplete([]byte("\x16\x03\x01\x00\x05\x01\x00\x00\x01\x00"))) // non-HTTP data should not be buffered
+	is.True(httpRequestHeadComplete(nil))                                                // empty payloads should not be buffered
+}
+
+func TestBlockDoHCallback(t *testing.T) {
+	is := is.New(t)
+
+	f, _, genericQueue := newCallbackTestFilter(t, &FilterOptions{
+		Name:                "foo",
+		DNSQueue:            1000,
+		TrafficQueue:        1001,
+		IPVersion:           4,
+		AllowAnswersFor:     duration(time.Minute),
+		AllowedHostnames:    []string{"example.com"},
+		BlockDoH:            true,
+		AllowedDoHHostnames: []string{"dns.example.com"},
+	})
+	f.dohEndpoints = newHostnameTrie(f.opts.AllowedDoHHostnames)
+	f.dohReassembly = newReassembler(0, 0)
+	genericCallback := newGenericCallback(f)
+
+	server := netip.MustParseAddrPort("192.0.2.1:80")
+	f.allowIPBy(server.Addr(), allowedByDNSAnswer, time.Minute)
+
+	var packetID uint32
+	send := func(srcPort uint16, seq uint32, payload string) int {
+		packetID++
+		src := netip.AddrPortFrom(netip.MustParseAddr("192.168.1.2"), srcPort)
+		genericCallback(newPacketAttribute(packetID, stateEstablished, newTCPPacketBetween(t, src, server, seq, []byte(payload))))
+		verdict, ok := genericQueue.verdict(packetID)
+		is.True(ok) // verdict should be set
+		return verdict
+	}
+
+	is.Equal(send(50000, 1000, "POST /dns-query HTTP/1.1\r\nHost: doh.example.net\r\nContent-Type: application/dns-message\r\n\r\n"), nfqueue.NfDrop) // DoH requests to hosts that aren't allowed should be dropped
+	is.Equal(send(50001, 1000, "GET /dns-query?dns=AAAB HTTP/1.1\r\nHost: dns.example.com\r\n\r\n"), nfqueue.NfAccept)                                // DoH requests to allowed hosts should be accepted
+
+	is.Equal(send(50002, 1000, "PO"), nfqueue.NfAccept)                                                // segments of partial request lines should be buffered
+	is.Equal(send(50002, 1002, "ST /resolve HTTP/1.1\r\nHost: doh.example.net\r\n"), nfqueue.NfAccept) // segments of partial headers should be buffered
+	is.Equal(send(50002, 1047, "Accept: application/dns-message\r\n\r\n"), nfqueue.NfDrop)             // DoH requests split across segments should be dropped
+
+	request := "GET /index.html HTTP/1.1\r\nHost: www.example.com\r\n\r\n"
+	is.Equal(send(50003, 1000, request), nfqueue.NfAccept)                                                                                                                 // plain HTTP requests should be accepted
+	is.Equal(send(50003, 1000+uint32(len(request)), "POST /dns-query HTTP/1.1\r\nHost: doh.example.net\r\nContent-Type: application/dns-message\r\n\r\n"), nfqueue.NfDrop) // later DoH requests of keep-alive connections should be dropped
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// errorLogInterval is how often an error that keeps occurring is
+	// logged
+	errorLogInterval = time.Minute
+	// maxErrorSignatures is how many distinct errors are deduplicated
+	// at once, errors are always logged if more are occurring
+	maxErrorSignatures = 64
+)
+
+// errorLimiter deduplicates repeated identical errors so sustained
+// failures don't flood logs. The first occurrence of an error is
+// logged, and further occurrences are counted and summarized when the
+// error occurs again after the interval, or once the interval elapses
+// if the error stopped occurring.
+type errorLimiter struct {
+	mtx      sync.Mutex
+	interval time.Duration
+	now      func() time.Time
+	errors   map[string]*errorSignature
+	// flushTimer summarizes suppressed errors once their interval
+	// elapses, it is nil if no errors are suppressed
+	flushTimer *time.Timer
+}
+
+// errorSignature is when an error was last logged and how many times
+// it occurred since without being logged.
+type errorSignature struct {
+	logger     *zap.Logger
+	msg        string
+	logged     time.Time
+	suppressed int
+}
+
+func newErrorLimiter(interval time.Duration) *errorLimiter {
+	return &errorLimiter{
+		interval: interval,
+		now:      time.Now,
+		errors:   make(map[string]*errorSignature),
+	}
+}
+
+// log logs err with msg unless the same error was logged within the
+// interval.
+func (e *errorLimiter) log(logger *zap.Logger, msg string, err error) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	now := e.now()
+	key := err.Error()
+	sig, ok := e.errors[key]
+	if ok && now.Sub(sig.logged) < e.interval {
+		sig.suppressed++
+		e.scheduleFlush(e.interval - now.Sub(sig.logged))
+		return
+	}
+	if ok && sig.suppressed > 0 {
+		logRepeated(sig, key)
+	}
+
+	logger.Error(msg, zap.NamedError("error", err))
+	if ok {
+		sig.logger = logger
+		sig.msg = msg
+		sig.logged = now
+		sig.suppressed = 0
+		return
+	}
+
+	if len(e.errors) >= maxErrorSignatures {
+		e.prune(now)
+	}
+	if len(e.errors) < maxErrorSignatures {
+		e.errors[key] = &errorSignature{logger: logger, msg: msg, logged: now}
+	}
+}
+
+// scheduleFlush flushes suppressed errors after d unless a flush is
+// already scheduled. e.mtx must be held.
+func (e *errorLimiter) scheduleFlush(d time.Duration) {
+	if e.flushTimer != nil {
+		return
+	}
+	e.flushTimer = time.AfterFunc(d, e.flush)
+}
+
+// flush summarizes errors that were logged before the interval and
+// stopped occurring, so how often they occurred is logged even if
+// they never occur again.
+func (e *errorLimiter) flush() {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	e.flushTimer = nil
+	now := e.now()
+	e.prune(now)
+
+	// flush again once the next suppressed error's interval elapses
+	var next time.Duration
+	for _, sig := range e.errors {
+		if sig.suppressed == 0 {
+			continue
+		}
+		if remaining := e.interval - now.Sub(sig.logged); next == 0 || remaining < next {
+			next = remaining
+		}
+	}
+	if next > 0 {
+		e.scheduleFlush(next)
+	}
+}
+
+// prune removes errors that were logged before the interval, logging
+// how many times they were suppressed. e.mtx must be held.
+func (e *errorLimiter) prune(now time.Time) {
+	for key, sig := range e.errors {
+		if now.Sub(sig.logged) < e.interval {
+			continue
+		}
+		if sig.suppressed > 0 {
+			logRepeated(sig, key)
+		}
+		delete(e.errors, key)
+	}
+}
+
+func logRepeated(sig *errorSignature, err string) {
+	sig.logger.Error(sig.msg+" repeated", zap.String("error", err), zap.Int("errors.suppressed", sig.suppressed))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestErrorLimiter(t *testing.T) {
+	is := is.New(t)
+
+	core, logs := observer.New(zap.InfoLevel)
+	logger := zap.New(core)
+
+	now := time.Now()
+	limiter := newErrorLimiter(time.Minute)
+	limiter.now = func() time.Time { return now }
+
+	err := errors.New("netlink receive: no buffer space available")
+	for i := 0; i < 10; i++ {
+		limiter.log(logger, "netlink error", err)
+	}
+	is.Equal(logs.FilterMessage("netlink error").Len(), 1) // only the first occurrence should be logged
+	is.Equal(logs.FilterMessage("netlink error repeated").Len(), 0)
+
+	limiter.log(logger, "netlink error", errors.New("other error"))
+	is.Equal(logs.FilterMessage("netlink error").Len(), 2) // different errors should be logged
+
+	now = now.Add(time.Minute)
+	limiter.log(logger, "netlink error", err)
+	summaries := logs.FilterMessage("netlink error repeated").All()
+	is.Equal(len(summaries), 1)                                        // suppressed errors should be summarized
+	is.Equal(summaries[0].ContextMap()["errors.suppressed"], int64(9)) // summary should count suppressed errors
+	is.Equal(summaries[0].ContextMap()["error"], err.Error())          // summary should include the error
+	is.Equal(logs.FilterMessage("netlink error").Len(), 3)             // errors should be logged again after the interval
+
+	// errors that stopped occurring should be summarized when they
+	// are pruned
+	limiter.log(logger, "netlink error", err)
+	now = now.Add(time.Minute)
+	for i := 0; i < maxErrorSignatures; i++ {
+		limiter.log(logger, "netlink error", errors.New(time.Duration(i).String()))
+	}
+	is.Equal(logs.FilterMessage("netlink error repeated").Len(), 2) // pruned errors should be summarized
+}
+
+func TestErrorLimiterFlush(t *testing.T) {
+	is := is.New(t)
+
+	core, logs := observer.New(zap.InfoLevel)
+	logger := zap.New(core)
+
+	now := time.Now()
+	limiter := newErrorLimiter(time.Minute)
+	limiter.now = func() time.Time { return now }
+	t.Cleanup(func() {
+		limiter.mtx.Lock()
+		if limiter.flushTimer != nil {
+			limiter.flushTimer.Stop()
+		}
+		limiter.mtx.Unlock()
+	})
+
+	err := errors.New("netlink receive: no buffer space available")
+	limiter.log(logger, "netlink error", err)
+	is.True(limiter.flushTimer == nil) // flushing should not be scheduled without suppressed errors
+
+	for i := 0; i < 5; i++ {
+		limiter.log(logger, "netlink error", err)
+	}
+	is.True(limiter.flushTimer != nil) // suppressed errors should be flushed later
+
+	// errors that stopped occurring should be summarized once the
+	// interval elapses
+	limiter.flush()
+	is.Equal(logs.FilterMessage("netlink error repeated").Len(), 0) // errors should not be summarized before the interval
+	is.True(limiter.flushTimer != nil)                              // flushing should be scheduled again
+
+	now = now.Add(time.Minute)
+	limiter.flush()
+	summaries := logs.FilterMessage("netlink error repeated").All()
+	is.Equal(len(summaries), 1)                                        // suppressed errors should be summarized
+	is.Equal(summaries[0].ContextMap()["errors.suppressed"], int64(5)) // summary should count suppressed errors
+	is.True(limiter.flushTimer == nil)                                 // flushing should stop once no errors are suppressed
+
+	limiter.log(logger, "netlink error", err)
+	is.Equal(logs.FilterMessage("netlink error").Len(), 2) // errors should be logged again after being summarized
+}
+
+func TestErrorLimiterFlushTimer(t *testing.T) {
+	is := is.New(t)
+
+	core, logs := observer.New(zap.InfoLevel)
+	logger := zap.New(core)
+	limiter := newErrorLimiter(10 * time.Millisecond)
+
+	err := errors.New("netlink receive: no buffer space available")
+	limiter.log(logger, "netlink error", err)
+	limiter.log(logger, "netlink error", err)
+
+	deadline := time.Now().Add(time.Second)
+	for logs.FilterMessage("netlink error repeated").Len() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	is.Equal(logs.FilterMessage("netlink error repeated").Len(), 1) // suppressed errors should be summarized after they stop occurring
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/gopacket/layers"
+	"go.uber.org/zap"
+)
+
+// compileMatchExpression compiles a CEL expression that decides if a
+// DNS question is allowed. The expression can use the variables
+// hostname, qtype, qclass, srcIP, dstIP, opcode and flags, and must
+// evaluate to a bool.
+func compileMatchExpression(expr string) (cel.Program, error) {
+	env, err := cel.NewEnv(
+		cel.Variable("hostname", cel.StringType),
+		cel.Variable("qtype", cel.StringType),
+		cel.Variable("qclass", cel.StringType),
+		cel.Variable("srcIP", cel.StringType),
+		cel.Variable("dstIP", cel.StringType),
+		cel.Variable("opcode", cel.StringType),
+		cel.Variable("flags", cel.ListType(cel.StringType)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error creating CEL environment: %v", err)
+	}
+
+	ast, issues := env.Compile(expr)
+	if issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, errors.New("expression must evaluate to a bool")
+	}
+
+	return env.Program(ast)
+}
+
+// expressionAllows returns true if the filter's match expression
+// allows a DNS question of a message of a connection. Errors
+// evaluating the expression are logged and the question is not
+// allowed.
+func (f *filter) expressionAllows(logger *zap.Logger, dns *layers.DNS, question layers.DNSQuestion, connID connectionID) bool {
+	if f.matchProgram == nil {
+		return false
+	}
+
+	out, _, err := f.matchProgram.Eval(map[string]interface{}{
+		"hostname": string(question.Name),
+		"qtype":    question.Type.String(),
+		"qclass":   question.Class.String(),
+		"srcIP":    connID.src.Addr().String(),
+		"dstIP":    connID.dst.Addr().String(),
+		"opcode":   dns.OpCode.String(),
+		"flags":    dnsFlags(dns),
+	})
+	if err != nil {
+		logger.Warn("error evaluating match expression", zap.ByteString("question", question.Name), zap.NamedError("error", err))
+		return false
+	}
+
+	allowed, ok := out.Value().(bool)
+	return ok && allowed
+}
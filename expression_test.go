@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+	"github.com/matryer/is"
+	"go.uber.org/zap"
+)
+
+func TestMatchExpression(t *testing.T) {
+	f := newTestFilter(&FilterOptions{
+		AllowedHostnames: []string{"example.org"},
+	})
+	t.Cleanup(f.close)
+
+	prg, err := compileMatchExpression(`hostname.endsWith(".internal") || (hostname == "status.example.net" && opcode == "Query" && "RD" in flags) || (hostname.matches("^api[0-9]+\\.example\\.com$") && qtype == "A" && srcIP == "192.168.1.2")`)
+	if err != nil {
+		t.Fatalf("error compiling match expression: %v", err)
+	}
+	f.matchProgram = prg
+
+	connID := connectionID{
+		isUDP: true,
+		src:   netip.MustParseAddrPort("192.168.1.2:40000"),
+		dst:   netip.MustParseAddrPort("192.168.1.1:53"),
+	}
+	otherConnID := connectionID{
+		isUDP: true,
+		src:   netip.MustParseAddrPort("192.168.1.3:40000"),
+		dst:   netip.MustParseAddrPort("192.168.1.1:53"),
+	}
+
+	tests := []struct {
+		testName string
+		hostname string
+		qtype    layers.DNSType
+		connID   connectionID
+		allowed  bool
+	}{
+		{"suffix matched", "db.internal", layers.DNSTypeAAAA, connID, true},
+		{"regex and type matched", "api1.example.com", layers.DNSTypeA, connID, true},
+		{"regex matched wrong type", "api1.example.com", layers.DNSTypeAAAA, connID, false},
+		{"regex matched wrong source", "api1.example.com", layers.DNSTypeA, otherConnID, false},
+		{"nothing matched", "www.example.com", layers.DNSTypeA, connID, false},
+		{"allowed hostname", "www.example.org", layers.DNSTypeA, connID, true},
+		{"opcode and flags matched", "status.example.net", layers.DNSTypeA, connID, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			is := is.New(t)
+
+			dns := &layers.DNS{
+				OpCode:  layers.DNSOpCodeQuery,
+				RD:      true,
+				QDCount: 1,
+				Questions: []layers.DNSQuestion{
+					{
+						Name:  []byte(tt.hostname),
+						Type:  tt.qtype,
+						Class: layers.DNSClassIN,
+					},
+				},
+			}
+			is.Equal(f.validateDNSQuestions(zap.NewNop(), dns, tt.connID), tt.allowed) // question should only be allowed if matched
+		})
+	}
+}
+
+func TestCompileMatchExpression(t *testing.T) {
+	is := is.New(t)
+
+	_, err := compileMatchExpression(`hostname == "foo" &&`)
+	is.True(err != nil) // invalid syntax should be rejected
+
+	_, err = compileMatchExpression(`hostname + "."`)
+	is.True(err != nil)                                                          // non-bool expressions should be rejected
+	is.True(strings.Contains(err.Error(), "expression must evaluate to a bool")) // error should explain the expression's type is wrong
+
+	_, err = compileMatchExpression(`unknownVar == "foo"`)
+	is.True(err != nil) // undeclared variables should be rejected
+
+	_, err = compileMatchExpression(`qclass == "IN" && dstIP.startsWith("10.")`)
+	is.NoErr(err) // valid expression should compile
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// pendingLookups holds the IPs being looked up in the background, so
+// each IP is only looked up once at a time and the amount of lookups
+// is bounded.
+type pendingLookups struct {
+	max int
+
+	mtx sync.Mutex
+	ips map[netip.Addr]struct{}
+}
+
+func newPendingLookups(max int) *pendingLookups {
+	if max <= 0 {
+		max = maxPendingFCrDNSLookups
+	}
+
+	return &pendingLookups{
+		max: max,
+		ips: make(map[netip.Addr]struct{}),
+	}
+}
+
+// add returns true if ip should be looked up, meaning it isn't already
+// being looked up and there is room for another lookup.
+func (p *pendingLookups) add(ip netip.Addr) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if _, ok := p.ips[ip]; ok || len(p.ips) >= p.max {
+		return false
+	}
+	p.ips[ip] = struct{}{}
+
+	return true
+}
+
+func (p *pendingLookups) remove(ip netip.Addr) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	delete(p.ips, ip)
+}
+
+// lookupInBackground allows ip in the background if a reverse lookup
+// of it returns an allowed hostname that is forward confirmed. The
+// packet that caused the lookup is dropped, and a retransmission of it
+// will be allowed once ip is. Only allowed IPs are cached, so IPs that
+// weren't allowed are looked up again by the next packet.
+func (f *filter) lookupInBackground(logger *zap.Logger, ip netip.Addr) {
+	if !f.pendingLookups.add(ip) {
+		logger.Debug("not preforming reverse IP lookup in the background as it is already in progress or too many are", zap.Stringer("ip", ip))
+		return
+	}
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		defer f.pendingLookups.remove(ip)
+		defer f.recoverPanic()
+
+		if _, err := f.reverseLookup(logger, ip); err != nil {
+			logger.Error("error validating IP", zap.Stringer("ip", ip), zap.NamedError("error", err))
+		}
+	}()
+}
+
+// forwardConfirmed returns true if hostname, which a reverse lookup of
+// ip returned, resolves to ip. Only addresses of the same family as ip
+// are looked up, as reverse and forward records of dual-stack hosts
+// are often only consistent for one family. This prevents the owner of
+// an IP from setting its PTR record to an allowed hostname to get it
+// allowed.
+func (f *filter) forwardConfirmed(logger *zap.Logger, ip netip.Addr, hostname string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), verifyForwardTimeout)
+	defer cancel()
+
+	ip = ip.WithZone("").Unmap()
+	network := "ip6"
+	if ip.Is4() {
+		network = "ip4"
+	}
+
+	addrs, err := f.lookupNetIP(ctx, network, hostname)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			logger.Warn("error resolving hostname", zap.String("hostname", hostname), zap.NamedError("error", err))
+		}
+		return false
+	}
+
+	for _, addr := range addrs {
+		if addr.Unmap() == ip {
+			return true
+		}
+	}
+
+	return false
+}
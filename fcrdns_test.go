@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"go.uber.org/zap"
+)
+
+func TestFCrDNS(t *testing.T) {
+	is := is.New(t)
+
+	f := newTestFilter(&FilterOptions{
+		LookupUnknownIPs: true,
+		FCrDNS:           true,
+		AllowAnswersFor:  duration(time.Minute),
+		AllowedHostnames: []string{"example.com"},
+	})
+	t.Cleanup(f.close)
+
+	ptrs := map[string][]string{
+		"198.51.100.1": {"www.example.com."},
+		"198.51.100.2": {"spoofed.example.com."},
+		"2001:db8::1":  {"dual.example.com."},
+		"198.51.100.3": {"dual.example.com."},
+	}
+	f.lookupAddr = func(_ context.Context, addr string) ([]string, error) {
+		if names, ok := ptrs[addr]; ok {
+			return names, nil
+		}
+		return nil, &net.DNSError{IsNotFound: true}
+	}
+	var networks []string
+	f.lookupNetIP = func(_ context.Context, network, host string) ([]netip.Addr, error) {
+		networks = append(networks, network)
+		switch host {
+		case "www.example.com":
+			return []netip.Addr{netip.MustParseAddr("198.51.100.1")}, nil
+		case "spoofed.example.com":
+			return []netip.Addr{netip.MustParseAddr("192.0.2.1")}, nil
+		case "dual.example.com":
+			// only the IPv6 records are consistent
+			if network == "ip6" {
+				return []netip.Addr{netip.MustParseAddr("2001:db8::1")}, nil
+			}
+			return []netip.Addr{netip.MustParseAddr("192.0.2.2")}, nil
+		}
+		return nil, &net.DNSError{IsNotFound: true}
+	}
+
+	f.pendingLookups = newPendingLookups(0)
+
+	allowed, err := f.lookupAndValidateIP(zap.NewNop(), netip.MustParseAddr("198.51.100.1"))
+	is.NoErr(err)
+	is.True(!allowed) // packet should be dropped while its IP is looked up in the background
+	f.wg.Wait()
+	is.Equal(f.allowedBy(netip.MustParseAddr("198.51.100.1")), allowedByReverseLookup) // IP whose forward lookup includes it should be allowed
+	is.Equal(networks, []string{"ip4"})                                                // only addresses of the family of the IP should be looked up
+
+	allowed, err = f.reverseLookup(zap.NewNop(), netip.MustParseAddr("198.51.100.2"))
+	is.NoErr(err)
+	is.True(!allowed)                                                         // IP whose PTR matches but forward lookup doesn't include it should be rejected
+	is.Equal(f.allowedBy(netip.MustParseAddr("198.51.100.2")), allowedByNone) // rejected IP should not be allowed
+
+	allowed, err = f.reverseLookup(zap.NewNop(), netip.MustParseAddr("2001:db8::1"))
+	is.NoErr(err)
+	is.True(allowed) // IPv6 address whose forward lookup includes it should be allowed
+
+	allowed, err = f.reverseLookup(zap.NewNop(), netip.MustParseAddr("198.51.100.3"))
+	is.NoErr(err)
+	is.True(!allowed) // IPv4 address should not be confirmed by IPv6 records
+
+	f.opts.FCrDNS = false
+	allowed, err = f.lookupAndValidateIP(zap.NewNop(), netip.MustParseAddr("198.51.100.2"))
+	is.NoErr(err)
+	is.True(allowed) // IP should be allowed by its PTR alone when fcrDNS is disabled
+}
+
+func TestPendingLookups(t *testing.T) {
+	is := is.New(t)
+
+	p := newPendingLookups(2)
+	is.True(p.add(netip.MustParseAddr("192.0.2.1")))  // IP not being looked up should be added
+	is.True(!p.add(netip.MustParseAddr("192.0.2.1"))) // IP being looked up should not be added again
+	is.True(p.add(netip.MustParseAddr("192.0.2.2")))
+	is.True(!p.add(netip.MustParseAddr("192.0.2.3"))) // IPs should not be added once the limit is reached
+
+	p.remove(netip.MustParseAddr("192.0.2.1"))
+	is.True(p.add(netip.MustParseAddr("192.0.2.3"))) // IPs should be added once a lookup finishes
+
+	is.Equal(newPendingLookups(0).max, maxPendingFCrDNSLookups) // limit should default when unset
+}
@@ -1,20 +1,27 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"net/netip"
+	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/florianl/go-nfqueue"
+	"github.com/google/cel-go/cel"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/mdlayher/netlink"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"golang.org/x/sys/unix"
 )
 
@@ -29,38 +36,361 @@ const (
 	stateUntracked        = 7
 
 	dnsQueryTimeout = time.Minute
+
+	defaultShutdownTimeout = 30 * time.Second
+	// udpRetransmitWindow is how long retransmissions of a UDP DNS
+	// request are detected after the request was allowed or answered
+	udpRetransmitWindow = 5 * time.Second
+
+	defaultMaxUDPResponseSize = 4096
+	// defaultMaxAnswersPerQuestion is high enough that only responses
+	// crafted for amplification should exceed it
+	defaultMaxAnswersPerQuestion = 100
+	// most resolvers reject requests with multiple questions
+	defaultMaxQuestionsPerRequest = 1
+
+	dnsblQueryTimeout = 5 * time.Second
+	dnsblCacheTime    = time.Hour
+	// maxDNSBLChecks is the maximum number of DNS responses that can
+	// have their IPs checked against DNSBLs at once
+	maxDNSBLChecks = 64
+
+	verifyForwardTimeout   = 5 * time.Second
+	verifyForwardCacheTime = 30 * time.Second
+	// maxPendingFCrDNSLookups is how many IPs can be looked up in the
+	// background at once if opts.FCrDNS is set and
+	// opts.MaxConcurrentLookups isn't
+	maxPendingFCrDNSLookups = 64
 )
 
-type FilterManager struct {
-	ready chan struct{}
+var dnsblErrorPrefix = netip.MustParsePrefix("127.255.255.0/24")
+
+// dnsRcodes maps the names of DNS response codes that can be set in
+// "allowedRcodes" to their values.
+var dnsRcodes = map[string]layers.DNSResponseCode{
+	"NOERROR":  layers.DNSResponseCodeNoErr,
+	"FORMERR":  layers.DNSResponseCodeFormErr,
+	"SERVFAIL": layers.DNSResponseCodeServFail,
+	"NXDOMAIN": layers.DNSResponseCodeNXDomain,
+	"NOTIMP":   layers.DNSResponseCodeNotImp,
+	"REFUSED":  layers.DNSResponseCodeRefused,
+	"YXDOMAIN": layers.DNSResponseCodeYXDomain,
+	"YXRRSET":  layers.DNSResponseCodeYXRRSet,
+	"NXRRSET":  layers.DNSResponseCodeNXRRSet,
+	"NOTAUTH":  layers.DNSResponseCodeNotAuth,
+	"NOTZONE":  layers.DNSResponseCodeNotZone,
+}
 
-	queueNum uint16
-	ipv6     bool
+// ednsOptionCodes maps the names of EDNS options that can be set in
+// "allowedEDNSOptions" to their codes.
+var ednsOptionCodes = map[string]layers.DNSOptionCode{
+	"NSID":          layers.DNSOptionCodeNSID,
+	"DAU":           layers.DNSOptionCodeDAU,
+	"DHU":           layers.DNSOptionCodeDHU,
+	"N3U":           layers.DNSOptionCodeN3U,
+	"CLIENT-SUBNET": layers.DNSOptionCodeEDNSClientSubnet,
+	"EXPIRE":        layers.DNSOptionCodeEDNSExpire,
+	"COOKIE":        layers.DNSOptionCodeCookie,
+	"TCP-KEEPALIVE": layers.DNSOptionCodeEDNSKeepAlive,
+	"PADDING":       layers.DNSOptionCodePadding,
+	"CHAIN":         layers.DNSOptionCodeChain,
+	"KEY-TAG":       layers.DNSOptionCodeEDNSKeyTag,
+	"CLIENT-TAG":    layers.DNSOptionCodeEDNSClientTag,
+	"SERVER-TAG":    layers.DNSOptionCodeEDNSServerTag,
+	"DEVICEID":      layers.DNSOptionCodeDeviceID,
+}
 
-	logger *zap.Logger
+// defaultAllowedRcodes are the DNS response codes that are allowed
+// if "allowedRcodes" is not set.
+var defaultAllowedRcodes = []string{"NOERROR", "NXDOMAIN"}
+
+var (
+	// ErrQueueConflict is returned by FilterManager.AddFilter if the
+	// filter uses an nfqueue that is already used.
+	ErrQueueConflict = errors.New("nfqueue is already in use")
+	// ErrFilterNotFound is returned by FilterManager.RemoveFilter if
+	// no filter has the given name.
+	ErrFilterNotFound = errors.New("filter not found")
+	// ErrCannotRemoveSelfFilter is returned by
+	// FilterManager.RemoveFilter if the filter of Egress Eddie's own
+	// DNS requests would be removed.
+	ErrCannotRemoveSelfFilter = errors.New(`the filter created from "selfDNSQueue" can't be removed as Egress Eddie's own DNS requests depend on it`)
+)
 
-	dnsRespNF *nfqueue.Nfqueue
+type FilterManager struct {
+	ready     chan struct{}
+	startTime time.Time
+	cancel    context.CancelFunc
+	// stopping is closed when the FilterManager is stopped
+	stopping <-chan struct{}
+	wg       sync.WaitGroup
+	// dnsblChecks tracks DNS responses being checked against DNSBLs.
+	// Checks are started from the DNS response callback, which can
+	// still run while wg is being waited on, so they can't be tracked
+	// by wg. No checks are started once dnsblStopped is set.
+	dnsblMtx     sync.Mutex
+	dnsblStopped bool
+	dnsblChecks  sync.WaitGroup
 
-	filters []*filter
+	queueNum uint16
+	// selfDNSQueue is the DNS queue of the self-filter, or 0 if
+	// there is none
+	selfDNSQueue uint16
+	// configPath is the path of the config file filters are reloaded
+	// from by the admin socket
+	configPath  string
+	decapsulate bool
+	// shutdownTimeout is how long each filter has to stop before its
+	// nfqueues are forcibly closed
+	shutdownTimeout   time.Duration
+	diagnosticDumpDir string
+	// breakGlassMark is the mark of packets that are accepted without
+	// being filtered, or 0 if disabled
+	breakGlassMark uint32
+	// paused is shared with filters to drop all packets while egress
+	// is paused
+	paused *pauseSwitch
+	// progress tracks packets of the DNS response queue so the
+	// watchdog can tell if they stopped being processed
+	progress *callbackProgress
+	// verdicts publishes verdicts of filters if "verdictFile" is set
+	verdicts *verdictExporter
+
+	logger        *zap.Logger
+	loggerFactory func(filterName string) *zap.Logger
+
+	dnsRespNF   packetQueue
+	deadLetters *deadLetterQueue
+	// resolver resolves the cached hostnames of every filter
+	resolver *cachedResolver
+	// state mirrors the caches of filters if "stateDBPath" is set
+	state *stateDB
+
+	// filtersMtx protects filters once filters are started, as filters can be added at runtime.
+	// filters is never modified in place, a new slice is stored
+	// instead so it can be iterated without holding the lock.
+	filtersMtx sync.RWMutex
+	filters    []*filter
 }
 
 type filter struct {
+	// accessed atomically, kept first to ensure 64-bit alignment
+	packetsAllowed int64
+	packetsDropped int64
+	// packetsAllowedBy is how many packets of the traffic queue each
+	// allowMechanism allowed
+	packetsAllowedBy [numAllowMechanisms]int64
+	// noDataResponses is how many NOERROR responses without answers
+	// were accepted
+	noDataResponses int64
+	// hostnamesExpiredInUse is how many hostnames allowed from answers
+	// expired within opts.ExpiryNotifyWindow of being matched,
+	// accessed atomically
+	hostnamesExpiredInUse int64
+	// packetsDeduplicated is how many packets of the traffic queue
+	// got the verdict of an identical packet, accessed atomically
+	packetsDeduplicated int64
+	// allowedIPsNearLimit is 1 if the amount of allowed IPs exceeded
+	// opts.WarnAllowedIPsThreshold, accessed atomically
+	allowedIPsNearLimit int32
+
+	// ctx is the context the filter was started with, which it is
+	// restarted with if its nfqueues are changed
+	ctx context.Context
+	// cancel stops the goroutines of the filter
+	cancel context.CancelFunc
+	// done is closed when the filter is closed or the context it was
+	// started with is canceled
+	done           <-chan struct{}
+	closeOnce      sync.Once
 	dnsReqNFReady  chan struct{}
 	genericNFReady chan struct{}
 	wg             sync.WaitGroup
+	// progress tracks packets of the DNS request and traffic queues
+	// so the watchdog can tell if they stopped being processed
+	progress *callbackProgress
 
 	opts *FilterOptions
+	// protects opts.AllowedHostnames, which may be updated while the
+	// filter is running
+	hostnamesMtx sync.RWMutex
+	// allowedHostnames holds a *hostnameTrie of opts.AllowedHostnames
+	// so lookups don't depend on the amount of allowed hostnames. It
+	// is swapped atomically so lookups never have to wait on updates.
+	allowedHostnames atomic.Value
+	// sourcesMtx protects staticHostnames and syncedHostnames, and
+	// serializes updates of allowed hostnames from them
+	sourcesMtx sync.Mutex
+	// staticHostnames are the allowed hostnames set in the config,
+	// which may be changed by reloading the filter
+	staticHostnames []string
+	// syncedHostnames are the allowed hostnames last synced from
+	// opts.AllowedHostnamesURL
+	syncedHostnames []string
+	// quietHostnames matches opts.QuietHostnames
+	quietHostnames *hostnameTrie
+	// dedup holds the verdicts of recent packets of the traffic queue
+	// if opts.DedupWindow is set
+	dedup *packetDeduper
+	// hostnameUsage holds when additional hostnames were last matched
+	// if opts.ExpiryNotifyWindow is set
+	hostnameUsage *hostnameUsage
+	// dohEndpoints matches opts.AllowedDoHHostnames
+	dohEndpoints *hostnameTrie
+	// dnsAllowedSources are the parsed opts.DNSAllowedSources
+	dnsAllowedSources []netip.Prefix
+	// allowedProtocols are the parsed opts.AllowedProtocols
+	allowedProtocols []layers.IPProtocol
+	// matchProgram is the compiled opts.MatchExpression
+	matchProgram cel.Program
 
 	logger *zap.Logger
 
-	dnsReqNF  *nfqueue.Nfqueue
-	genericNF *nfqueue.Nfqueue
-
-	connections         *TimedCache[connectionID]
+	dnsReqNF    packetQueue
+	genericNF   packetQueue
+	deadLetters *deadLetterQueue
+	conntrack   *conntrackConn
+	// conntrackEvents receives conntrack events if
+	// opts.ConntrackEvict is set
+	conntrackEvents *netlink.Conn
+
+	recentDenies *denyRing
+	outage       *resolverOutage
+	recentLogs   *logRingCore
+	// dnsLatencies records how long resolvers took to respond to
+	// tracked DNS requests
+	dnsLatencies latencyRecorder
+	// directory diagnostic reports are written to if a callback
+	// panics, reports won't be written if empty
+	diagnosticDumpDir string
+
+	// trafficParsers pools parsers of packets of the traffic queue,
+	// the first pool holds parsers of IPv4 packets and the second of
+	// IPv6 packets
+	trafficParsers [2]sync.Pool
+
+	connections    *TimedCache[connectionID]
+	recentRequests *TimedCache[dnsRequestKey]
+	// parallelRequests holds requests that may have been sent to
+	// multiple resolvers if opts.CorrelateParallelRequests is set
+	parallelRequests    *TimedCache[parallelRequestKey]
 	allowedIPs          *TimedCache[netip.Addr]
 	additionalHostnames *TimedCache[string]
+	dnsblListed         *TimedCache[netip.Addr]
+	dnsblUnlisted       *TimedCache[netip.Addr]
+	connMarks           *connectionMarks
+	conntrackIDs        *TimedCache[conntrackFlow]
+	allowedMarks        *TimedCache[uint32]
+	// graceAnswers holds the answer IPs of recently processed DNS
+	// responses and the sources of their requests if
+	// opts.PostResponseGrace is set
+	graceAnswers *TimedCache[graceAnswer]
+	// untrackedConnections holds the connections of allowed DNS
+	// requests if opts.UntrackedConnections is set, so their responses
+	// can be allowed without being processed
+	untrackedConnections *TimedCache[connectionID]
+	// unparsedConnections holds the connections of DNS requests that
+	// couldn't be parsed but were allowed if opts.DNSParseFailFallback
+	// is set
+	unparsedConnections *TimedCache[connectionID]
+	// questionTypes holds the question types of tracked DNS requests
+	// if opts.MatchAnswerTypeToQuestion is set
+	questionTypes *TimedCache[connectionQuestionType]
+	// verifiedIPs holds the addresses allowed hostnames recently
+	// resolved to if opts.VerifyForward is set
+	verifiedIPs *TimedCache[netip.Addr]
+	// ipMechanisms holds which mechanisms allowed the IPs of
+	// allowedIPs
+	ipMechanisms *TimedCache[ipMechanism]
+	// srvTargets holds the ports SRV answers advertised for their
+	// targets if opts.AllowSRVPorts is set
+	srvTargets *TimedCache[hostnamePort]
+	// srvAddrs holds the addresses SRV targets resolved to with their
+	// advertised ports if opts.AllowSRVPorts is set
+	srvAddrs *TimedCache[netip.AddrPort]
+	// hostnameSources holds which answers caused the hostnames of
+	// additionalHostnames to be allowed
+	hostnameSources *TimedCache[sourcedHostname]
+	// ipHostnames holds which hostnames caused IPs to be allowed if
+	// opts.MatchSNI is set
+	ipHostnames *TimedCache[ipHostname]
+	// dohReassembly reassembles the headers of HTTP requests that
+	// span multiple segments if opts.BlockDoH is set
+	dohReassembly *reassembler
+	// responseProcessor allows IPs and hostnames from DNS responses,
+	// defaultResponseProcessor is used if it is nil
+	responseProcessor responseProcessor
+	// reassembly reassembles ClientHellos that span multiple segments
+	// if opts.MatchSNI is set
+	reassembly *reassembler
+	// resolvingForward is 1 while allowed hostnames are resolved in
+	// the background if opts.VerifyForward is set, accessed atomically
+	resolvingForward int32
+	// pendingLookups holds the IPs being looked up in the background
+	// if opts.FCrDNS is set
+	pendingLookups *pendingLookups
+	lookupNetIP    func(ctx context.Context, network, host string) ([]netip.Addr, error)
+	// lookupAddr makes reverse lookups if opts.LookupUnknownIPs is set
+	lookupAddr func(ctx context.Context, addr string) ([]string, error)
+	// lookupSem limits how many reverse lookups can be made at once
+	// if opts.MaxConcurrentLookups is set
+	lookupSem chan struct{}
+	// dnsblSem limits how many DNS responses can have their IPs
+	// checked against DNSBLs at once if opts.DNSBLZones is set
+	dnsblSem chan struct{}
 
 	isSelfFilter bool
+	// breakGlassMark is the mark of packets that are accepted without
+	// being filtered, or 0 if disabled
+	breakGlassMark uint32
+	// paused is set when all packets are dropped
+	paused *pauseSwitch
+	// verdicts publishes the verdicts of the traffic queue if set
+	verdicts *verdictExporter
+	// state mirrors allowedIPs and additionalHostnames, it is nil if
+	// "stateDBPath" is not set
+	state *stateDB
+}
+
+// conntrackFlow is the conntrack ID of a DNS request's connection.
+type conntrackFlow struct {
+	connID connectionID
+	ctID   uint32
+}
+
+// dnsRequestKey identifies a UDP DNS request so retransmissions of it
+// can be detected.
+type dnsRequestKey struct {
+	connID    connectionID
+	id        uint16
+	questions string
+}
+
+func newDNSRequestKey(connID connectionID, dns *layers.DNS) dnsRequestKey {
+	return dnsRequestKey{
+		connID:    connID,
+		id:        dns.ID,
+		questions: strings.Join(questionStrings(dns.Questions), ","),
+	}
+}
+
+// parallelRequestKey identifies a DNS request independently of the
+// resolver it was sent to, so responses from every resolver the same
+// request was sent to in parallel can be matched to it.
+type parallelRequestKey struct {
+	isUDP     bool
+	client    netip.AddrPort
+	id        uint16
+	questions string
+}
+
+func newParallelRequestKey(connID connectionID, dns *layers.DNS) parallelRequestKey {
+	return parallelRequestKey{
+		isUDP:     connID.isUDP,
+		client:    connID.src,
+		id:        dns.ID,
+		questions: strings.Join(questionStrings(dns.Questions), ","),
+	}
 }
 
 type connectionID struct {
@@ -86,29 +416,118 @@ func (c connectionID) String() string {
 }
 
 func StartFilters(ctx context.Context, logger *zap.Logger, config *Config) (*FilterManager, error) {
+	// Each FilterManager has its own context so all of its goroutines
+	// can be stopped without affecting other FilterManagers.
+	ctx, cancel := context.WithCancel(ctx)
+
 	f := FilterManager{
-		ready:    make(chan struct{}),
-		queueNum: config.InboundDNSQueue,
-		ipv6:     config.IPv6,
-		logger:   logger,
-		filters:  make([]*filter, len(config.Filters)),
+		ready:        make(chan struct{}),
+		startTime:    time.Now(),
+		progress:     &callbackProgress{},
+		cancel:       cancel,
+		stopping:     ctx.Done(),
+		queueNum:     config.InboundDNSQueue,
+		selfDNSQueue: config.SelfDNSQueue,
+		decapsulate:  config.OnEncapsulated == encapsulatedDecapsulate,
+		logger:       logger,
+		deadLetters:  newDeadLetterQueue(logger.With(zap.String("filter.type", "dns-resp"))),
+		filters:      make([]*filter, len(config.Filters)),
+		resolver:     newCachedResolver(logger),
+		paused:       newPauseSwitch(),
+	}
+	f.shutdownTimeout = time.Duration(config.ShutdownTimeout)
+	if f.shutdownTimeout == 0 {
+		f.shutdownTimeout = defaultShutdownTimeout
+	}
+	f.diagnosticDumpDir = config.DiagnosticDumpDir
+	f.loggerFactory = config.LoggerFactory
+	f.breakGlassMark = config.BreakGlassMark
+	if f.breakGlassMark != 0 {
+		logger.Warn("packets with the break-glass mark will be accepted without being filtered", zap.Uint32("breakGlassMark", f.breakGlassMark))
+	}
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+
+		f.deadLetters.run(ctx)
+	}()
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+
+		f.resolver.run(ctx)
+	}()
+
+	if config.VerdictFile != "" {
+		producer, err := newFileVerdictProducer(config.VerdictFile)
+		if err != nil {
+			cancel()
+			f.wg.Wait()
+			return nil, err
+		}
+		f.verdicts = newVerdictExporter(logger.With(zap.String("filter.type", "verdicts")), producer, config.VerdictQueueSize)
+
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+
+			f.verdicts.run(ctx)
+		}()
+	}
+
+	if config.StateDBPath != "" {
+		state, err := newStateDB(logger, config.StateDBPath)
+		if err != nil {
+			cancel()
+			f.wg.Wait()
+			return nil, err
+		}
+		f.state = state
+
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+
+			f.state.run(ctx)
+		}()
 	}
 
-	nf, err := startNfQueue(ctx, logger, config.InboundDNSQueue, config.IPv6, newDNSResponseCallback(&f))
+	nf, err := startNfQueue(ctx, logger, config.InboundDNSQueue, config.IPv6, true, f.progress.track(newDNSResponseCallback(&f)))
 	if err != nil {
+		cancel()
+		f.wg.Wait()
 		return nil, err
 	}
 	f.dnsRespNF = nf
 
 	for i := range config.Filters {
 		isSelfFilter := config.SelfDNSQueue == config.Filters[i].DNSQueue
-		filter, err := startFilter(ctx, logger, &config.Filters[i], isSelfFilter)
+		filter, err := startFilter(ctx, f.filterLogger(config.Filters[i].Name), &config.Filters[i], isSelfFilter, f.filterDeps())
 		if err != nil {
-			// TODO: stop other filters here
+			// stop the filters that were already started
+			f.filters = f.filters[:i]
+			f.Stop()
 			return nil, err
 		}
 
 		f.filters[i] = filter
+		f.resolver.subscribe(filter)
+	}
+
+	if config.TextfilePath != "" {
+		interval := time.Duration(config.TextfileInterval)
+		if interval == 0 {
+			interval = defaultTextfileInterval
+		}
+
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+
+			f.runTextfileWriter(ctx, config.TextfilePath, interval)
+		}()
 	}
 
 	// Let the DNS response callback know everything is setup. The
@@ -120,53 +539,620 @@ func StartFilters(ctx context.Context, logger *zap.Logger, config *Config) (*Fil
 	return &f, nil
 }
 
+// AddFilter validates and starts a filter without affecting the
+// filters that are already running. ErrQueueConflict is returned if
+// the filter uses an nfqueue that the FilterManager already uses. The
+// filter is stopped when the FilterManager is stopped, or stopped and
+// removed when ctx is canceled. If the filter fails to start, the
+// nfqueues it already opened are closed.
+func (f *FilterManager) AddFilter(ctx context.Context, opts *FilterOptions) error {
+	// hold the lock while starting the filter so filters using the
+	// same queues can't be added concurrently
+	f.filtersMtx.Lock()
+	defer f.filtersMtx.Unlock()
+
+	// check for conflicts before validating so conflicts with the
+	// inbound DNS queue are reported as ErrQueueConflict too
+	if err := f.queueConflict(opts, nil); err != nil {
+		return err
+	}
+	newFilter, err := f.startRuntimeFilter(ctx, opts)
+	if err != nil {
+		return err
+	}
+	f.logger.Info("added filter", zap.String("filter.name", newFilter.opts.Name))
+
+	return nil
+}
+
+// startRuntimeFilter validates and starts a filter while the
+// FilterManager is running, and adds it to the filters. filtersMtx
+// must be held.
+func (f *FilterManager) startRuntimeFilter(ctx context.Context, opts *FilterOptions) (*filter, error) {
+	opts, err := validateFilterOptions(f.logger, f.selfDNSQueue != 0, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	newFilter, err := startFilter(ctx, f.filterLogger(opts.Name), opts, false, f.filterDeps())
+	if err != nil {
+		return nil, err
+	}
+
+	// allow the self-filter to make the DNS requests of the new filter
+	if opts.needsSelfFilter() {
+		var selfAllowed []string
+		for _, group := range selfHostnames([]FilterOptions{*opts}) {
+			selfAllowed = append(selfAllowed, group.hostnames...)
+		}
+		for _, filter := range f.filters {
+			if !filter.isSelfFilter {
+				continue
+			}
+			if err := filter.addStaticHostnames(selfAllowed); err != nil {
+				newFilter.close()
+				return nil, fmt.Errorf("filter %q: %v", selfFilterName, err)
+			}
+		}
+	}
+
+	filters := make([]*filter, len(f.filters), len(f.filters)+1)
+	copy(filters, f.filters)
+	f.filters = append(filters, newFilter)
+	f.resolver.subscribe(newFilter)
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+
+		select {
+		case <-newFilter.done:
+			f.removeCanceledFilter(newFilter)
+		case <-f.stopping:
+		}
+	}()
+
+	return newFilter, nil
+}
+
+// removeCanceledFilter removes and closes a filter added with
+// AddFilter after the context it was added with is canceled. Nothing
+// is done if the filter was already removed.
+func (f *FilterManager) removeCanceledFilter(canceled *filter) {
+	f.filtersMtx.Lock()
+	i := -1
+	for j, filter := range f.filters {
+		if filter == canceled {
+			i = j
+			break
+		}
+	}
+	if i == -1 {
+		f.filtersMtx.Unlock()
+		return
+	}
+
+	filters := make([]*filter, 0, len(f.filters)-1)
+	filters = append(filters, f.filters[:i]...)
+	f.filters = append(filters, f.filters[i+1:]...)
+	f.filtersMtx.Unlock()
+
+	name := canceled.opts.Name
+	if !f.closeFilters([]*filter{canceled}, f.shutdownTimeout) {
+		f.logger.Warn("forced shutdown of filter whose context was canceled", zap.String("filter.name", name), zap.Duration("shutdown.timeout", f.shutdownTimeout))
+	}
+	if f.state != nil {
+		f.state.removeFilter(name)
+	}
+	f.logger.Info("filter removed as its context was canceled", zap.String("filter.name", name))
+}
+
+// RemoveFilter stops the filter named name and removes it from the
+// FilterManager, after which its nfqueues can be used by other
+// filters. The filter is given the shutdown timeout to finish pending
+// work before its nfqueues are forcibly closed.
+func (f *FilterManager) RemoveFilter(name string) error {
+	f.filtersMtx.Lock()
+	i := -1
+	for j, filter := range f.filters {
+		if filter.opts.Name == name {
+			i = j
+			break
+		}
+	}
+	if i == -1 {
+		f.filtersMtx.Unlock()
+		return fmt.Errorf("filter %q: %w", name, ErrFilterNotFound)
+	}
+	removed := f.filters[i]
+	if removed.isSelfFilter {
+		f.filtersMtx.Unlock()
+		return fmt.Errorf("filter %q: %w", name, ErrCannotRemoveSelfFilter)
+	}
+
+	filters := make([]*filter, 0, len(f.filters)-1)
+	filters = append(filters, f.filters[:i]...)
+	f.filters = append(filters, f.filters[i+1:]...)
+	f.filtersMtx.Unlock()
+
+	if !f.closeFilters([]*filter{removed}, f.shutdownTimeout) {
+		return fmt.Errorf("filter %q: forcibly closed after %s", name, f.shutdownTimeout)
+	}
+	if f.state != nil {
+		f.state.removeFilter(name)
+	}
+	f.logger.Info("filter removed", zap.String("filter.name", name))
+
+	return nil
+}
+
+// ReloadFilter applies the allowed hostnames of opts to the running
+// filter with the same name without restarting it, so other filters
+// and hostnames the filter allowed at runtime are not affected. Other
+// options are ignored. If opts uses different nfqueues than the
+// running filter, the filter is restarted with opts instead and keeps
+// its allowed IPs and tracked DNS connections.
+func (f *FilterManager) ReloadFilter(opts *FilterOptions) error {
+	var running *filter
+	for _, filter := range f.currentFilters() {
+		if filter.opts.Name == opts.Name {
+			running = filter
+			break
+		}
+	}
+	if running == nil {
+		return fmt.Errorf("filter %q: %w", opts.Name, ErrFilterNotFound)
+	}
+	if opts.DNSQueue != running.opts.DNSQueue || opts.TrafficQueue != running.opts.TrafficQueue {
+		return f.restartFilter(running, opts)
+	}
+
+	opts, err := validateFilterOptions(f.logger, f.selfDNSQueue != 0, opts)
+	if err != nil {
+		return err
+	}
+	// replace the allowed hostnames even if none are set now, as a
+	// nil slice would keep the previous ones
+	static := opts.AllowedHostnames
+	if static == nil {
+		static = []string{}
+	}
+	if err := running.updateHostnameSources(static, nil); err != nil {
+		return fmt.Errorf("filter %q: %v", opts.Name, err)
+	}
+	f.logger.Info("reloaded filter", zap.String("filter.name", opts.Name), zap.Int("hostnames.count", len(opts.AllowedHostnames)))
+
+	return nil
+}
+
+// restartFilter replaces running with a filter started with opts,
+// which has the same name. The allowed IPs and tracked DNS connections
+// of running are copied to the new filter so traffic running allowed
+// isn't dropped. running is closed first so the new filter can use
+// the same nfqueues.
+func (f *FilterManager) restartFilter(running *filter, opts *FilterOptions) error {
+	f.filtersMtx.Lock()
+	i := -1
+	for j, filter := range f.filters {
+		if filter == running {
+			i = j
+			break
+		}
+	}
+	if i == -1 {
+		f.filtersMtx.Unlock()
+		return fmt.Errorf("filter %q: %w", opts.Name, ErrFilterNotFound)
+	}
+	if err := f.queueConflict(opts, running); err != nil {
+		f.filtersMtx.Unlock()
+		return err
+	}
+	if _, err := validateFilterOptions(f.logger, f.selfDNSQueue != 0, opts); err != nil {
+		f.filtersMtx.Unlock()
+		return err
+	}
+
+	filters := make([]*filter, 0, len(f.filters)-1)
+	filters = append(filters, f.filters[:i]...)
+	f.filters = append(filters, f.filters[i+1:]...)
+	f.filtersMtx.Unlock()
+
+	if !f.closeFilters([]*filter{running}, f.shutdownTimeout) {
+		f.logger.Warn("forced shutdown of filter being restarted", zap.String("filter.name", opts.Name), zap.Duration("shutdown.timeout", f.shutdownTimeout))
+	}
+
+	f.filtersMtx.Lock()
+	defer f.filtersMtx.Unlock()
+
+	restarted, err := f.startRuntimeFilter(running.ctx, opts)
+	if err != nil {
+		return fmt.Errorf("filter %q: error restarting filter: %w", opts.Name, err)
+	}
+	restarted.takeOverCaches(running)
+	f.logger.Info("restarted filter", zap.String("filter.name", opts.Name), zap.Uint16("queue.dns", opts.DNSQueue), zap.Uint16("queue.traffic", opts.TrafficQueue))
+
+	return nil
+}
+
+// takeOverCaches copies the allowed IPs and tracked DNS connections
+// of old, which may already be closed, to f.
+func (f *filter) takeOverCaches(old *filter) {
+	old.connections.CopyTo(f.connections)
+	if old.allowedIPs != nil && f.allowedIPs != nil {
+		old.allowedIPs.CopyTo(f.allowedIPs)
+		old.ipMechanisms.CopyTo(f.ipMechanisms)
+	}
+}
+
+// queueConflict returns an error wrapping ErrQueueConflict if opts
+// uses an nfqueue that is already used by a filter other than except,
+// which may be nil. filtersMtx must be held.
+func (f *FilterManager) queueConflict(opts *FilterOptions, except *filter) error {
+	for _, queueNum := range []uint16{opts.DNSQueue, opts.TrafficQueue} {
+		if queueNum == 0 {
+			continue
+		}
+		if queueNum == f.queueNum {
+			return fmt.Errorf("filter %q: %w: queue %d", opts.Name, ErrQueueConflict, queueNum)
+		}
+		for _, filter := range f.filters {
+			if filter == except {
+				continue
+			}
+			if queueNum == filter.opts.DNSQueue || queueNum == filter.opts.TrafficQueue {
+				return fmt.Errorf("filter %q: %w: queue %d", opts.Name, ErrQueueConflict, queueNum)
+			}
+		}
+	}
+
+	return nil
+}
+
+// filterLogger returns the logger of the filter named name.
+func (f *FilterManager) filterLogger(name string) *zap.Logger {
+	if f.loggerFactory != nil {
+		return f.loggerFactory(name)
+	}
+	if name == "" {
+		return f.logger
+	}
+
+	return f.logger.With(zap.String("filter.name", name))
+}
+
+// currentFilters returns the filters of the FilterManager. The
+// returned slice must not be modified.
+func (f *FilterManager) currentFilters() []*filter {
+	f.filtersMtx.RLock()
+	defer f.filtersMtx.RUnlock()
+
+	return f.filters
+}
+
+// Stop stops the FilterManager and its filters. If they don't stop
+// within the shutdown timeout, nfqueues are forcibly closed and Stop
+// returns without waiting for in-flight callbacks to finish.
 func (f *FilterManager) Stop() {
-	f.dnsRespNF.Close()
+	f.cancel()
+	f.dnsblMtx.Lock()
+	f.dnsblStopped = true
+	f.dnsblMtx.Unlock()
+
+	deadline := time.Now().Add(f.shutdownTimeout)
+	clean := waitTimeout(&f.wg, f.shutdownTimeout)
+	// DNSBL checks set verdicts on the DNS response queue, so wait
+	// for them before closing it
+	if !waitTimeout(&f.dnsblChecks, time.Until(deadline)) {
+		clean = false
+	}
+	if f.dnsRespNF != nil {
+		f.dnsRespNF.Close()
+	}
+	if !f.closeFilters(f.currentFilters(), time.Until(deadline)) {
+		clean = false
+	}
+
+	if clean {
+		f.logger.Info("filters stopped cleanly")
+	} else {
+		f.logger.Warn("forced shutdown of filters due to timeout", zap.Duration("shutdown.timeout", f.shutdownTimeout))
+	}
+}
+
+// closeFilters closes filters concurrently. If a filter doesn't close
+// before timeout elapses, its nfqueues are forcibly closed to unblock
+// any pending work and closeFilters returns false without waiting for
+// it.
+func (f *FilterManager) closeFilters(filters []*filter, timeout time.Duration) bool {
+	closed := make([]chan struct{}, len(filters))
+	for i, filter := range filters {
+		i, filter := i, filter
+
+		closed[i] = make(chan struct{})
+		// stop caching hostnames first so cached addresses aren't
+		// added while the filter is closing
+		f.resolver.unsubscribe(filter)
+		go func() {
+			defer close(closed[i])
+
+			filter.close()
+		}()
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for i := range filters {
+		select {
+		case <-closed[i]:
+		case <-timer.C:
+			for j, filter := range filters {
+				if isClosed(closed[j]) {
+					continue
+				}
+
+				filter.logger.Warn("forced shutdown of filter due to timeout", zap.Duration("shutdown.timeout", f.shutdownTimeout))
+				filter.closeNfQueues()
+			}
+			return false
+		}
+	}
+
+	return true
+}
+
+// waitTimeout waits for wg until timeout elapses. It returns false if
+// wg wasn't done in time.
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// filterDeps is what filters share with the FilterManager that
+// started them.
+type filterDeps struct {
+	breakGlassMark    uint32
+	paused            *pauseSwitch
+	verdicts          *verdictExporter
+	state             *stateDB
+	diagnosticDumpDir string
+}
 
-	for i := range f.filters {
-		f.filters[i].close()
+// filterDeps returns what filters started by f share with it.
+func (f *FilterManager) filterDeps() filterDeps {
+	return filterDeps{
+		breakGlassMark:    f.breakGlassMark,
+		paused:            f.paused,
+		verdicts:          f.verdicts,
+		state:             f.state,
+		diagnosticDumpDir: f.diagnosticDumpDir,
 	}
 }
 
-func startFilter(ctx context.Context, logger *zap.Logger, opts *FilterOptions, isSelfFilter bool) (*filter, error) {
-	filterLogger := logger
-	if opts.Name != "" {
-		filterLogger = filterLogger.With(zap.String("filter.name", opts.Name))
+// startFilter starts a filter that logs to logger, which should
+// already identify the filter.
+func startFilter(ctx context.Context, logger *zap.Logger, opts *FilterOptions, isSelfFilter bool, deps filterDeps) (*filter, error) {
+	// keep the most recent log entries of the filter so they can be
+	// included in diagnostic reports
+	recentLogs := newLogRingCore(logger.Core(), recentLogsSize)
+	filterLogger := logger.WithOptions(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		return zapcore.NewTee(c, recentLogs)
+	}))
+
+	recentDeniesSize := opts.RecentDeniesSize
+	if recentDeniesSize == 0 {
+		recentDeniesSize = defaultRecentDeniesSize
+	}
+
+	var matchProgram cel.Program
+	if opts.MatchExpression != "" {
+		var err error
+		matchProgram, err = compileMatchExpression(opts.MatchExpression)
+		if err != nil {
+			return nil, fmt.Errorf("error compiling match expression: %v", err)
+		}
 	}
 
+	parentCtx := ctx
+	ctx, cancel := context.WithCancel(ctx)
 	f := filter{
-		dnsReqNFReady:  make(chan struct{}),
-		genericNFReady: make(chan struct{}),
-		opts:           opts,
-		logger:         filterLogger,
-		connections:    NewTimedCache[connectionID](logger, true),
-		isSelfFilter:   isSelfFilter,
+		ctx:               parentCtx,
+		cancel:            cancel,
+		done:              ctx.Done(),
+		dnsReqNFReady:     make(chan struct{}),
+		genericNFReady:    make(chan struct{}),
+		progress:          &callbackProgress{},
+		opts:              opts,
+		logger:            filterLogger,
+		deadLetters:       newDeadLetterQueue(filterLogger),
+		recentDenies:      newDenyRing(recentDeniesSize),
+		recentLogs:        recentLogs,
+		diagnosticDumpDir: deps.diagnosticDumpDir,
+		quietHostnames:    newHostnameTrie(opts.QuietHostnames),
+		dohEndpoints:      newHostnameTrie(opts.AllowedDoHHostnames),
+		matchProgram:      matchProgram,
+		connections:       NewTimedCache[connectionID](logger, true),
+		recentRequests:    NewTimedCache[dnsRequestKey](logger, false),
+		isSelfFilter:      isSelfFilter,
+		breakGlassMark:    deps.breakGlassMark,
+		paused:            deps.paused,
+		verdicts:          deps.verdicts,
+		state:             deps.state,
+		staticHostnames:   opts.AllowedHostnames,
+	}
+	for _, source := range opts.DNSAllowedSources {
+		// the CIDRs were validated when the config was parsed
+		prefix, _ := netip.ParsePrefix(source)
+		f.dnsAllowedSources = append(f.dnsAllowedSources, prefix)
+	}
+	// the protocols were validated when the config was parsed
+	f.allowedProtocols, _ = parseIPProtocols(opts.AllowedProtocols)
+	f.allowedHostnames.Store(newHostnameTrie(opts.AllowedHostnames))
+
+	// stop the goroutines and close the nfqueues that were already
+	// started if the filter fails to start
+	started := false
+	defer func() {
+		if !started {
+			f.close()
+		}
+	}()
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+
+		f.deadLetters.run(ctx)
+	}()
+
+	if opts.ValidateConntrackIDs {
+		f.conntrackIDs = NewTimedCache[conntrackFlow](filterLogger, true)
+	}
+	if opts.CorrelateParallelRequests {
+		f.parallelRequests = NewTimedCache[parallelRequestKey](filterLogger, false)
+	}
+	if opts.UntrackedConnections {
+		f.untrackedConnections = NewTimedCache[connectionID](filterLogger, false)
+	}
+	if opts.MatchAnswerTypeToQuestion {
+		f.questionTypes = NewTimedCache[connectionQuestionType](filterLogger, true)
+	}
+	if opts.FailOpenOnResolverOutage {
+		f.outage = newResolverOutage(time.Duration(opts.ResolverOutageWindow))
 	}
 
 	if opts.TrafficQueue != 0 {
 		f.allowedIPs = NewTimedCache[netip.Addr](f.logger, false)
-		f.additionalHostnames = NewTimedCache[string](filterLogger, false)
+		f.ipMechanisms = NewTimedCache[ipMechanism](f.logger, false)
+		if !opts.DisableDynamicHostnames {
+			f.additionalHostnames = NewTimedCache[string](filterLogger, false)
+			f.hostnameSources = NewTimedCache[sourcedHostname](filterLogger, false)
+			if opts.ExpiryNotifyWindow != 0 {
+				f.hostnameUsage = newHostnameUsage()
+				f.additionalHostnames.OnExpire(f.notifyHostnameExpired)
+			}
+		}
+		if len(opts.DNSBLZones) > 0 {
+			f.dnsblListed = NewTimedCache[netip.Addr](filterLogger, false)
+			f.dnsblUnlisted = NewTimedCache[netip.Addr](filterLogger, false)
+			f.dnsblSem = make(chan struct{}, maxDNSBLChecks)
+			f.lookupNetIP = new(net.Resolver).LookupNetIP
+		}
+		if opts.UseMarkInheritance {
+			f.connMarks = newConnectionMarks(filterLogger)
+			f.allowedMarks = NewTimedCache[uint32](filterLogger, false)
+		}
+		if opts.PostResponseGrace != 0 {
+			f.graceAnswers = NewTimedCache[graceAnswer](filterLogger, false)
+		}
+		if opts.DNSParseFailFallback {
+			f.unparsedConnections = NewTimedCache[connectionID](filterLogger, false)
+		}
+		if opts.DedupWindow != 0 {
+			f.dedup = newPacketDeduper(time.Duration(opts.DedupWindow), opts.MaxDedupPackets)
+		}
+		if opts.VerifyForward {
+			f.verifiedIPs = NewTimedCache[netip.Addr](filterLogger, false)
+			f.lookupNetIP = new(net.Resolver).LookupNetIP
+		}
+		if opts.LookupUnknownIPs {
+			f.lookupAddr = new(net.Resolver).LookupAddr
+			if opts.FCrDNS {
+				f.lookupNetIP = new(net.Resolver).LookupNetIP
+			}
+			if opts.MaxConcurrentLookups > 0 {
+				f.lookupSem = make(chan struct{}, opts.MaxConcurrentLookups)
+			}
+			if opts.FCrDNS {
+				f.pendingLookups = newPendingLookups(opts.MaxConcurrentLookups)
+			}
+		}
+		if opts.AllowSRVPorts {
+			f.srvTargets = NewTimedCache[hostnamePort](filterLogger, false)
+			f.srvAddrs = NewTimedCache[netip.AddrPort](filterLogger, false)
+		}
+		if opts.MatchSNI {
+			f.ipHostnames = NewTimedCache[ipHostname](filterLogger, false)
+			f.reassembly = newReassembler(opts.MaxReassemblyBytes, opts.MaxReassemblyConns)
+		}
+		if opts.BlockDoH {
+			f.dohReassembly = newReassembler(opts.MaxReassemblyBytes, opts.MaxReassemblyConns)
+		}
+
+		genericHook := f.progress.track(newGenericCallback(&f))
+		if opts.TrafficWorkers > 1 {
+			genericHook = startWorkerPool(ctx, &f.wg, filterLogger, opts.CPUAffinity, opts.TrafficWorkers, genericHook)
+		} else {
+			genericHook = pinHook(filterLogger, opts.CPUAffinity, genericHook)
+		}
 
-		genericNF, err := startNfQueue(ctx, filterLogger, opts.TrafficQueue, opts.IPv6, newGenericCallback(&f))
+		genericNF, err := startNfQueue(ctx, filterLogger, opts.TrafficQueue, opts.IPVersion == 6, opts.trafficConntrack(), genericHook)
 		if err != nil {
 			return nil, fmt.Errorf("error starting traffic nfqueue %d: %v", opts.TrafficQueue, err)
 		}
 		f.genericNF = genericNF
 		// let the generic packet callback know everything is setup
 		close(f.genericNFReady)
+	}
+
+	if opts.AllowedHostnamesURL != "" {
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+
+			f.syncHostnames(ctx, filterLogger)
+		}()
+	}
+
+	if opts.ReapIdleConnsEvery != 0 {
+		// open the conntrack socket now, seccomp filters won't allow
+		// it to be opened later
+		conntrack, err := dialConntrack()
+		if err != nil {
+			return nil, err
+		}
+		f.conntrack = conntrack
+
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
 
-		if len(f.opts.CachedHostnames) > 0 {
-			f.wg.Add(1)
-			go func() {
-				defer f.wg.Done()
+			f.reapIdleConnections(ctx, filterLogger, f.conntrack)
+		}()
+	}
 
-				f.cacheHostnames(ctx, filterLogger, opts.IPv6)
-			}()
+	if opts.ConntrackEvict {
+		// open the conntrack events socket now, seccomp filters won't
+		// allow it to be opened later
+		conntrackEvents, err := dialConntrackEvents()
+		if err != nil {
+			return nil, err
 		}
+		f.conntrackEvents = conntrackEvents
+
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+
+			f.evictClosedConnections(ctx, filterLogger)
+		}()
 	}
 
 	if opts.DNSQueue != 0 {
-		dnsNF, err := startNfQueue(ctx, filterLogger, opts.DNSQueue, opts.IPv6, newDNSRequestCallback(&f))
+		dnsNF, err := startNfQueue(ctx, filterLogger, opts.DNSQueue, opts.IPVersion == 6, true, pinHook(filterLogger, opts.CPUAffinity, f.progress.track(newDNSRequestCallback(&f))))
 		if err != nil {
 			return nil, fmt.Errorf("error starting DNS nfqueue %d: %v", opts.DNSQueue, err)
 		}
@@ -174,27 +1160,18 @@ func startFilter(ctx context.Context, logger *zap.Logger, opts *FilterOptions, i
 		// let the DNS request callback know everything is setup
 		close(f.dnsReqNFReady)
 	}
+	started = true
 
 	return &f, nil
 }
 
-func startNfQueue(ctx context.Context, logger *zap.Logger, queueNum uint16, ipv6 bool, hook nfqueue.HookFunc) (*nfqueue.Nfqueue, error) {
-	afFamily := unix.AF_INET
-	if ipv6 {
-		afFamily = unix.AF_INET6
-	}
-
-	nfqConf := nfqueue.Config{
-		NfQueue:      queueNum,
-		MaxPacketLen: 0xffff,
-		MaxQueueLen:  0xffff,
-		AfFamily:     uint8(afFamily),
-		Copymode:     nfqueue.NfQnlCopyPacket,
-		Flags:        nfqueue.NfQaCfgFlagConntrack,
-	}
-
+func startNfQueue(ctx context.Context, logger *zap.Logger, queueNum uint16, ipv6, conntrack bool, hook nfqueue.HookFunc) (packetQueue, error) {
+	nfqConf := nfqueueConfig(queueNum, ipv6, conntrack)
 	nf, err := nfqueue.Open(&nfqConf)
 	if err != nil {
+		if errors.Is(err, unix.EBUSY) {
+			return nil, fmt.Errorf("error opening nfqueue: queue is already in use, validate the config with -t to find available queues: %v", err)
+		}
 		return nil, fmt.Errorf("error opening nfqueue: %v", err)
 	}
 
@@ -225,82 +1202,396 @@ func startNfQueue(ctx context.Context, logger *zap.Logger, queueNum uint16, ipv6
 
 	ok = true
 
-	return nf, nil
+	return nfPacketQueue{nf}, nil
 }
 
-func (f *filter) cacheHostnames(ctx context.Context, logger *zap.Logger, ipv6 bool) {
-	logger.Debug("starting cache loop")
-
-	var (
-		network = "ip4"
-		res     = new(net.Resolver)
-		ttl     = time.Duration(f.opts.ReCacheEvery) + time.Minute
-		timer   = time.NewTimer(time.Duration(f.opts.ReCacheEvery))
-	)
-
+// nfqueueConfig returns the config of an nfqueue. If conntrack is
+// true, packets are queued with their conntrack state.
+func nfqueueConfig(queueNum uint16, ipv6, conntrack bool) nfqueue.Config {
+	afFamily := unix.AF_INET
 	if ipv6 {
-		network = "ip6"
+		afFamily = unix.AF_INET6
 	}
 
-	for {
-		for i := range f.opts.CachedHostnames {
-			logger.Info("caching lookup of hostname", zap.String("hostname", f.opts.CachedHostnames[i]))
-			addrs, err := res.LookupNetIP(ctx, network, f.opts.CachedHostnames[i])
-			if err != nil {
-				var dnsErr *net.DNSError
-				if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
-					logger.Warn("could not resolve hostname", zap.String("hostname", f.opts.CachedHostnames[i]))
-					continue
-				}
-				logger.Error("error resolving hostname", zap.String("hostname", f.opts.CachedHostnames[i]), zap.NamedError("error", err))
-				continue
-			}
+	var flags uint32
+	if conntrack {
+		flags = nfqueue.NfQaCfgFlagConntrack
+	}
+
+	return nfqueue.Config{
+		NfQueue:      queueNum,
+		MaxPacketLen: 0xffff,
+		MaxQueueLen:  0xffff,
+		AfFamily:     uint8(afFamily),
+		Copymode:     nfqueue.NfQnlCopyPacket,
+		Flags:        flags,
+	}
+}
 
-			for i := range addrs {
-				logger.Info("allowing IP from cached lookup", zap.Stringer("ip", addrs[i]), zap.Duration("ttl", ttl))
-				f.allowedIPs.AddEntry(addrs[i], ttl)
+func (f *filter) syncHostnames(ctx context.Context, logger *zap.Logger) {
+	// the URL was validated when the config was parsed
+	hostnamesURL, _ := url.Parse(f.opts.AllowedHostnamesURL)
+	logger = logger.With(zap.String("url", hostnamesURL.Redacted()))
+	logger.Debug("starting hostname sync loop")
 
-				// If the IP address is an IPv4-mapped IPv6 address,
-				// add the unwrapped IPv4 address too. That is what
-				// will most likely be used.
-				if addrs[i].Is4In6() {
-					addrs[i] = addrs[i].Unmap()
-					logger.Info("allowing IP from cached lookup", zap.Stringer("ip", addrs[i]), zap.Duration("ttl", ttl))
-					f.allowedIPs.AddEntry(addrs[i], ttl)
-				}
+	var (
+		client = &http.Client{Timeout: time.Minute}
+		etag   string
+		timer  = time.NewTimer(time.Duration(f.opts.AllowedHostnamesSyncInterval))
+	)
+
+	for {
+		logger.Info("syncing allowed hostnames")
+		hostnames, newETag, err := fetchHostnames(ctx, client, hostnamesURL.String(), etag)
+		if err != nil {
+			logger.Warn("error syncing allowed hostnames, keeping previous hostnames", zap.NamedError("error", err))
+		} else if hostnames == nil {
+			logger.Debug("allowed hostnames are unchanged")
+		} else {
+			etag = newETag
+			logger.Info("updating allowed hostnames", zap.Int("hostnames.count", len(hostnames)))
+			if err := f.updateHostnameSources(nil, hostnames); err != nil {
+				logger.Warn("error updating allowed hostnames, keeping previous hostnames", zap.NamedError("error", err))
 			}
 		}
 
-		timer.Reset(time.Duration(f.opts.ReCacheEvery))
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(time.Duration(f.opts.AllowedHostnamesSyncInterval))
 		select {
 		case <-ctx.Done():
 			if !timer.Stop() {
 				<-timer.C
 			}
-			logger.Debug("exiting cache loop")
+			logger.Debug("exiting hostname sync loop")
 			return
 		case <-timer.C:
 		}
 	}
 }
 
+// fetchHostnames downloads a list of hostnames from hostnamesURL. If
+// etag is not empty and the list has not changed, nil hostnames are
+// returned.
+func fetchHostnames(ctx context.Context, client *http.Client, hostnamesURL, etag string) ([]string, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, hostnamesURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, etag, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unexpected status %q", resp.Status)
+	}
+
+	hostnames := []string{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		hostname := strings.TrimSpace(scanner.Text())
+		// skip empty lines and comments
+		if hostname == "" || hostname[0] == '#' {
+			continue
+		}
+		hostnames = append(hostnames, hostname)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, "", fmt.Errorf("error reading response: %v", err)
+	}
+
+	return hostnames, resp.Header.Get("ETag"), nil
+}
+
+// updateAllowedHostnames replaces the allowed hostnames of a running
+// filter without restarting its nfqueues.
+func (f *filter) updateAllowedHostnames(hostnames []string) error {
+	for i := range hostnames {
+		if hostnames[i] == "" {
+			return fmt.Errorf("hostname #%d is empty", i)
+		}
+	}
+
+	hostnames = dedupAllowedHostnames(f.logger, f.opts.Name, hostnames)
+	trie := newHostnameTrie(hostnames)
+	trie.copyHits(f.allowedHostnames.Load().(*hostnameTrie), hostnames)
+	f.allowedHostnames.Store(trie)
+
+	f.hostnamesMtx.Lock()
+	f.opts.AllowedHostnames = hostnames
+	f.hostnamesMtx.Unlock()
+
+	return nil
+}
+
+// updateHostnameSources replaces the allowed hostnames set in the
+// config if static isn't nil and the allowed hostnames synced from
+// opts.AllowedHostnamesURL if synced isn't nil, and allows both.
+// Hostnames set in the config are always allowed, so syncing can't
+// remove them.
+func (f *filter) updateHostnameSources(static, synced []string) error {
+	f.sourcesMtx.Lock()
+	defer f.sourcesMtx.Unlock()
+
+	return f.setHostnameSources(static, synced)
+}
+
+// addStaticHostnames allows hostnames in addition to the allowed
+// hostnames set in the config.
+func (f *filter) addStaticHostnames(hostnames []string) error {
+	f.sourcesMtx.Lock()
+	defer f.sourcesMtx.Unlock()
+
+	static := make([]string, 0, len(f.staticHostnames)+len(hostnames))
+	static = append(static, f.staticHostnames...)
+	static = append(static, hostnames...)
+
+	return f.setHostnameSources(static, nil)
+}
+
+// setHostnameSources is updateHostnameSources, f.sourcesMtx must be
+// held.
+func (f *filter) setHostnameSources(static, synced []string) error {
+	if static == nil {
+		static = f.staticHostnames
+	}
+	if synced == nil {
+		synced = f.syncedHostnames
+	}
+
+	hostnames := make([]string, 0, len(static)+len(synced))
+	hostnames = append(hostnames, static...)
+	hostnames = append(hostnames, synced...)
+	if err := f.updateAllowedHostnames(hostnames); err != nil {
+		return err
+	}
+	f.staticHostnames = static
+	f.syncedHostnames = synced
+
+	return nil
+}
+
+func (f *filter) reapIdleConnections(ctx context.Context, logger *zap.Logger, flows flowChecker) {
+	logger.Debug("starting connection reaping loop")
+
+	var (
+		missing = make(map[connectionID]struct{})
+		ticker  = time.NewTicker(time.Duration(f.opts.ReapIdleConnsEvery))
+	)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Debug("exiting connection reaping loop")
+			return
+		case <-ticker.C:
+			missing = f.reapConnections(logger, flows, missing)
+		}
+	}
+}
+
+// evictClosedConnections removes allowed IPs once every TCP connection
+// to them has been closed.
+func (f *filter) evictClosedConnections(ctx context.Context, logger *zap.Logger) {
+	logger.Debug("starting conntrack eviction loop")
+
+	// unblock receiving events when exiting
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			f.conntrackEvents.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	// only this goroutine tracks active connections, so they don't
+	// need to be synchronized
+	activeConns := make(map[netip.Addr]int)
+	for {
+		msgs, err := f.conntrackEvents.Receive()
+		if err != nil {
+			if ctx.Err() != nil {
+				logger.Debug("exiting conntrack eviction loop")
+				return
+			}
+			logger.Error("error receiving conntrack events", zap.NamedError("error", err))
+			continue
+		}
+
+		for _, msg := range msgs {
+			event, err := parseConntrackEvent(msg)
+			if err != nil {
+				logger.Error("error parsing conntrack event", zap.NamedError("error", err))
+				continue
+			}
+			f.handleConntrackEvent(logger, activeConns, event)
+		}
+	}
+}
+
+// handleConntrackEvent counts the active TCP connections to allowed
+// IPs, and removes allowed IPs when their last connection is closed.
+func (f *filter) handleConntrackEvent(logger *zap.Logger, activeConns map[netip.Addr]int, event conntrackEvent) {
+	if event.proto != unix.IPPROTO_TCP {
+		return
+	}
+
+	if !event.destroy {
+		// connections are only created to IPs that are allowed
+		if f.allowedIPs.EntryExists(event.dst) {
+			activeConns[event.dst]++
+		}
+		return
+	}
+
+	count, ok := activeConns[event.dst]
+	if !ok {
+		return
+	}
+	if count > 1 {
+		activeConns[event.dst] = count - 1
+		return
+	}
+
+	delete(activeConns, event.dst)
+	if f.allowedIPs.EntryExists(event.dst) {
+		logger.Info("removing IP after last connection closed", zap.Stringer("ip", event.dst))
+		f.removeAllowedIP(event.dst)
+		f.mirrorRemovedIP(event.dst)
+	}
+}
+
+// reapConnections removes tracked DNS connections that are no longer
+// tracked by conntrack. Conntrack may not have confirmed a connection
+// that was just added yet, so connections are only removed if they
+// were also missing from conntrack the previous time they were
+// checked. The connections that were missing for the first time are
+// returned.
+func (f *filter) reapConnections(logger *zap.Logger, flows flowChecker, missing map[connectionID]struct{}) map[connectionID]struct{} {
+	var connIDs []connectionID
+	f.connections.Range(func(connID connectionID, _ time.Time) bool {
+		connIDs = append(connIDs, connID)
+		return true
+	})
+
+	newMissing := make(map[connectionID]struct{})
+	for _, connID := range connIDs {
+		exists, err := flows.flowExists(connID)
+		if err != nil {
+			logger.Error("error checking conntrack for connection", zap.Stringer("conn.id", connID), zap.NamedError("error", err))
+			continue
+		}
+		if exists {
+			continue
+		}
+		if _, ok := missing[connID]; !ok {
+			newMissing[connID] = struct{}{}
+			continue
+		}
+
+		logger.Debug("reaping idle connection", zap.Stringer("conn.id", connID))
+		// the connection may have been added multiple times
+		for f.connections.EntryExists(connID) {
+			f.connections.RemoveEntry(connID)
+		}
+	}
+
+	return newMissing
+}
+
+// close stops the filter and releases its resources. It may be
+// called more than once.
 func (f *filter) close() {
-	f.wg.Wait()
+	f.closeOnce.Do(func() {
+		if f.cancel != nil {
+			f.cancel()
+		}
+		f.wg.Wait()
+
+		f.closeNfQueues()
+
+		if f.conntrack != nil {
+			f.conntrack.Close()
+		}
+		if f.conntrackEvents != nil {
+			f.conntrackEvents.Close()
+		}
+
+		f.connections.Stop()
+		f.recentRequests.Stop()
+		if f.allowedIPs != nil {
+			f.allowedIPs.Stop()
+		}
+		if f.ipMechanisms != nil {
+			f.ipMechanisms.Stop()
+		}
+		if f.additionalHostnames != nil {
+			f.additionalHostnames.Stop()
+		}
+		if f.hostnameSources != nil {
+			f.hostnameSources.Stop()
+		}
+		if f.dnsblListed != nil {
+			f.dnsblListed.Stop()
+			f.dnsblUnlisted.Stop()
+		}
+		if f.connMarks != nil {
+			f.connMarks.stop()
+			f.allowedMarks.Stop()
+		}
+		if f.graceAnswers != nil {
+			f.graceAnswers.Stop()
+		}
+		if f.unparsedConnections != nil {
+			f.unparsedConnections.Stop()
+		}
+		if f.untrackedConnections != nil {
+			f.untrackedConnections.Stop()
+		}
+		if f.verifiedIPs != nil {
+			f.verifiedIPs.Stop()
+		}
+		if f.parallelRequests != nil {
+			f.parallelRequests.Stop()
+		}
+		if f.questionTypes != nil {
+			f.questionTypes.Stop()
+		}
+		if f.ipHostnames != nil {
+			f.ipHostnames.Stop()
+		}
+		if f.srvTargets != nil {
+			f.srvTargets.Stop()
+			f.srvAddrs.Stop()
+		}
+	})
+}
 
+// closeNfQueues closes the filter's nfqueues. It may be called more
+// than once.
+func (f *filter) closeNfQueues() {
 	if f.dnsReqNF != nil {
 		f.dnsReqNF.Close()
 	}
 	if f.genericNF != nil {
 		f.genericNF.Close()
 	}
-
-	f.connections.Stop()
-	if f.allowedIPs != nil {
-		f.allowedIPs.Stop()
-	}
-	if f.additionalHostnames != nil {
-		f.additionalHostnames.Stop()
-	}
 }
 
 func newDNSRequestCallback(f *filter) nfqueue.HookFunc {
@@ -309,12 +1600,26 @@ func newDNSRequestCallback(f *filter) nfqueue.HookFunc {
 	logger.Info("started nfqueue")
 
 	return func(attr nfqueue.Attribute) int {
+		defer f.recoverPanic()
+
 		// wait until the filter is setup to prevent race conditions
 		<-f.dnsReqNFReady
 
 		if attr.PacketID == nil {
 			return 0
 		}
+		if hasBreakGlassMark(attr, f.breakGlassMark) {
+			logger.Warn("accepting DNS request with break-glass mark without filtering it", zap.Uint32("packet.mark", *attr.Mark))
+
+			f.setVerdict(logger, f.dnsReqNF, *attr.PacketID, nfqueue.NfAccept)
+			return 0
+		}
+		if f.paused.isPaused() {
+			f.paused.logDrop(logger, "dropping DNS request while egress is paused")
+
+			f.setVerdict(logger, f.dnsReqNF, *attr.PacketID, nfqueue.NfDrop)
+			return 0
+		}
 		if attr.CtInfo == nil {
 			return 0
 		}
@@ -324,286 +1629,1235 @@ func newDNSRequestCallback(f *filter) nfqueue.HookFunc {
 
 		// verify DNS request is from a new or established connection
 		if *attr.CtInfo != stateNew && !connIsEstablished(*attr.CtInfo) {
-			logger.Warn("dropping DNS request with unknown state", zap.Uint32("conn.state", *attr.CtInfo))
+			logger.Warn("dropping DNS request with unknown state", zap.Uint32("conn.state", *attr.CtInfo), zap.String("conn.stateName", stateName(*attr.CtInfo)))
 
-			if err := f.dnsReqNF.SetVerdict(*attr.PacketID, nfqueue.NfDrop); err != nil {
-				logger.Error("error setting verdict", zap.String("error", err.Error()))
-			}
+			f.setVerdict(logger, f.dnsReqNF, *attr.PacketID, nfqueue.NfDrop)
 			return 0
 		}
 
-		dns, connID, err := parseDNSPacket(*attr.Payload, f.opts.IPv6, false)
+		dns, connID, err := parseDNSPacket(*attr.Payload, packetIsIPv6(*attr.Payload, f.opts.IPVersion), false, f.opts.OnEncapsulated == encapsulatedDecapsulate)
 		if err != nil {
-			logger.Error("error parsing DNS packet", zap.NamedError("error", err))
+			logParseError(logger, err)
+
+			if f.dnsParseFallbackAllowed(logger, *attr.Payload, err) {
+				f.setVerdict(logger, f.dnsReqNF, *attr.PacketID, nfqueue.NfAccept)
+				return 0
+			}
+
+			f.setVerdict(logger, f.dnsReqNF, *attr.PacketID, nfqueue.NfDrop)
 			return 0
 		}
 		logger := logger.With(zap.Stringer("conn.id", connID))
 
-		// drop DNS replies, they shouldn't be going to this filter
-		if dns.ANCount > 0 {
+		// drop DNS replies, they shouldn't be going to this filter;
+		// the answer section of UPDATE and NOTIFY requests may
+		// contain records so only the header can be relied upon
+		if dns.QR || (dns.OpCode == layers.DNSOpCodeQuery && dns.ANCount > 0) {
 			logger.Warn("dropping DNS reply sent to DNS request filter")
 
-			if err := f.dnsReqNF.SetVerdict(*attr.PacketID, nfqueue.NfDrop); err != nil {
-				logger.Error("error setting verdict", zap.String("error", err.Error()))
-			}
+			f.setVerdict(logger, f.dnsReqNF, *attr.PacketID, nfqueue.NfDrop)
+			return 0
+		}
+
+		// drop DNS requests that aren't using the required transport
+		if !f.validDNSTransport(connID) {
+			logger.Info("dropping DNS request with disallowed transport")
+
+			f.setVerdict(logger, f.dnsReqNF, *attr.PacketID, nfqueue.NfDrop)
+			return 0
+		}
+
+		// only workloads the filter is scoped to may use it
+		if !f.validDNSSource(connID.src.Addr()) {
+			logger.Info("dropping DNS request from disallowed source")
+
+			f.setVerdict(logger, f.dnsReqNF, *attr.PacketID, nfqueue.NfDrop)
+			return 0
+		}
+
+		// requests with multiple questions are unusual and may be
+		// used to sneak disallowed questions past resolvers
+		if !f.validQuestionCount(dns) {
+			logger.Warn("dropping DNS request with too many questions", zap.Strings("questions", questionStrings(dns.Questions)))
+
+			f.setVerdict(logger, f.dnsReqNF, *attr.PacketID, nfqueue.NfDrop)
+			return 0
+		}
+
+		// UDP DNS clients retransmit requests that aren't answered
+		// quickly; allow retransmissions of requests that were
+		// already allowed without tracking them again, otherwise a
+		// late retransmission would allow a duplicate response
+		if f.retransmission(connID, dns) {
+			logger.Debug("allowing retransmitted DNS request")
+
+			f.setVerdict(logger, f.dnsReqNF, *attr.PacketID, nfqueue.NfAccept)
 			return 0
 		}
 
 		// validate DNS request questions are for allowed
 		// hostnames, drop them otherwise
-		if !f.opts.AllowAllHostnames && !f.validateDNSQuestions(logger, dns) {
-			if err := f.dnsReqNF.SetVerdict(*attr.PacketID, nfqueue.NfDrop); err != nil {
-				logger.Error("error setting verdict", zap.NamedError("error", err))
-			}
+		if !f.validateDNSRequest(logger, dns, connID) {
+			f.setVerdict(logger, f.dnsReqNF, *attr.PacketID, nfqueue.NfDrop)
 			return 0
 		}
 
-		logger.Info("allowing DNS request", zap.Strings("questions", questionStrings(dns.Questions)))
+		// get the conntrack ID of the request's connection so the
+		// response can be verified to be from the same flow
+		var ctFlow conntrackFlow
+		if f.opts.ValidateConntrackIDs {
+			ctID, ok := attrConntrackID(attr)
+			if !ok {
+				logger.Warn("dropping DNS request without conntrack ID")
+
+				f.setVerdict(logger, f.dnsReqNF, *attr.PacketID, nfqueue.NfDrop)
+				return 0
+			}
+			ctFlow = conntrackFlow{connID: connID, ctID: ctID}
+		}
+
+		f.logAllowedRequest(logger, dns)
+
+		// responses to allow-all filters don't need to be processed,
+		// so only remember which filter allowed the request
+		if f.opts.UntrackedConnections {
+			f.untrackedConnections.AddEntry(connID, dnsQueryTimeout)
+
+			f.setVerdict(logger, f.dnsReqNF, *attr.PacketID, nfqueue.NfAccept)
+			return 0
+		}
 
 		// give DNS connections a minute to finish max
 		logger.Debug("adding connection")
 		f.connections.AddEntry(connID, dnsQueryTimeout)
+		f.trackRequest(connID, dns)
+		f.trackQuestionTypes(connID, dns)
+		if f.opts.CorrelateParallelRequests {
+			f.parallelRequests.AddEntry(newParallelRequestKey(connID, dns), dnsQueryTimeout)
+		}
+		if f.opts.UseMarkInheritance && attr.Mark != nil && *attr.Mark != 0 {
+			f.connMarks.add(connID, *attr.Mark, dnsQueryTimeout)
+		}
+		if f.opts.ValidateConntrackIDs {
+			f.conntrackIDs.AddEntry(ctFlow, dnsQueryTimeout)
+		}
 
-		if err := f.dnsReqNF.SetVerdict(*attr.PacketID, nfqueue.NfAccept); err != nil {
-			logger.Error("error setting verdict", zap.NamedError("error", err))
+		if !f.setVerdict(logger, f.dnsReqNF, *attr.PacketID, nfqueue.NfAccept) {
 			logger.Debug("removing connection")
 			f.connections.RemoveEntry(connID)
+			if connID.isUDP {
+				f.recentRequests.RemoveEntry(newDNSRequestKey(connID, dns))
+			}
+			if f.opts.ValidateConntrackIDs {
+				f.conntrackIDs.RemoveEntry(ctFlow)
+			}
+		} else if f.opts.FailOpenOnResolverOutage {
+			f.outage.requestSent(connID.dst, time.Now())
+		}
+
+		return 0
+	}
+}
+
+// retransmission returns true if a UDP DNS request is a
+// retransmission of a request that was recently allowed or answered.
+func (f *filter) retransmission(connID connectionID, dns *layers.DNS) bool {
+	return connID.isUDP && f.recentRequests.EntryExists(newDNSRequestKey(connID, dns))
+}
+
+// trackRequest records that a UDP DNS request was allowed or answered
+// so retransmissions of it can be detected.
+func (f *filter) trackRequest(connID connectionID, dns *layers.DNS) {
+	if connID.isUDP {
+		f.recentRequests.AddEntry(newDNSRequestKey(connID, dns), udpRetransmitWindow)
+	}
+}
+
+// packetIsIPv6 returns true if packet should be parsed as an IPv6
+// packet. Filters that process both IPv4 and IPv6 packets check the
+// version of each packet.
+func packetIsIPv6(packet []byte, ipVersion int) bool {
+	if ipVersion == 0 && len(packet) > 0 {
+		return packet[0]>>4 == 6
+	}
+	return ipVersion == 6
+}
+
+// lookupNetwork returns the network to resolve hostnames with for
+// filters of ipVersion.
+func lookupNetwork(ipVersion int) string {
+	switch ipVersion {
+	case 4:
+		return "ip4"
+	case 6:
+		return "ip6"
+	default:
+		return "ip"
+	}
+}
+
+// conntrackStateAllowed returns false if a packet should be dropped
+// because of its conntrack state. The kernel doesn't attach conntrack
+// info to packets it considers INVALID, so ctInfo is nil for them.
+func (f *filter) conntrackStateAllowed(ctInfo *uint32) bool {
+	return ctInfo != nil || f.opts.OnMissingConntrack != missingConntrackDrop
+}
+
+// trafficConntrackStateAllowed returns false if a packet of the
+// traffic queue should be dropped because of its conntrack state.
+// Packets aren't queued with their conntrack state if
+// opts.TrafficConntrack is false, so their state isn't checked.
+func (f *filter) trafficConntrackStateAllowed(ctInfo *uint32) bool {
+	if !f.opts.trafficConntrack() {
+		return true
+	}
+
+	return f.conntrackStateAllowed(ctInfo)
+}
+
+func connIsEstablished(state uint32) bool {
+	return state == stateEstablished || state == stateRelated || state == stateIsReply || state == stateRelatedReply
+}
+
+// isReply returns true if a packet's conntrack state is of the reply
+// direction of its connection.
+func isReply(ctInfo *uint32) bool {
+	return ctInfo != nil && (*ctInfo == stateEstablishedReply || *ctInfo == stateRelatedReply)
+}
+
+// stateName returns the name of a conntrack state as the kernel names
+// it, or "UNKNOWN" if state isn't a known conntrack state.
+func stateName(state uint32) string {
+	switch state {
+	case stateEstablished:
+		return "ESTABLISHED"
+	case stateRelated:
+		return "RELATED"
+	case stateNew:
+		return "NEW"
+	case stateEstablishedReply:
+		return "ESTABLISHED_REPLY"
+	case stateRelatedReply:
+		return "RELATED_REPLY"
+	case stateUntracked:
+		return "UNTRACKED"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// encapsulatedError is returned when a DNS packet is encapsulated
+// inside of another protocol.
+type encapsulatedError struct {
+	proto layers.IPProtocol
+}
+
+func (e *encapsulatedError) Error() string {
+	return fmt.Sprintf("packet is encapsulated with %s", e.proto)
+}
+
+func logParseError(logger *zap.Logger, err error) {
+	var encapErr *encapsulatedError
+	if errors.As(err, &encapErr) {
+		logger.Warn("dropping encapsulated DNS packet", zap.Stringer("encapsulation", encapErr.proto))
+		return
+	}
+
+	logger.Error("error parsing DNS packet", zap.NamedError("error", err))
+}
+
+func parseDNSPacket(packet []byte, ipv6, inbound, decapsulate bool) (*layers.DNS, connectionID, error) {
+	p := getDNSParser(ipv6)
+	defer putDNSParser(p)
+
+	// parse DNS packet
+	dns, err := p.decode(packet)
+	if err != nil || len(p.decoded) != 3 {
+		// if the packet is encapsulated, only attempt to parse the
+		// inner packet once to prevent recursing infinitely
+		if proto, inner, innerIPv6, ok := encapsulatedPacket(packet, ipv6); ok {
+			if !decapsulate || inner == nil {
+				return nil, connectionID{}, &encapsulatedError{proto: proto}
+			}
+			return parseDNSPacket(inner, innerIPv6, inbound, false)
+		}
+
+		if err != nil {
+			return nil, connectionID{}, err
+		}
+		return nil, connectionID{}, errors.New("not all layers were parsed")
+	}
+
+	// build connection ID so dns requests/responses can be correlated
+	var (
+		isUDP            bool
+		src, dst         netip.Addr
+		srcPort, dstPort uint16
+		srcOK, dstOK     bool
+	)
+
+	if p.decoded[0] == layers.LayerTypeIPv4 {
+		src, srcOK = netip.AddrFromSlice(p.ip4.SrcIP)
+		dst, dstOK = netip.AddrFromSlice(p.ip4.DstIP)
+	} else if p.decoded[0] == layers.LayerTypeIPv6 {
+		src, srcOK = netip.AddrFromSlice(p.ip6.SrcIP)
+		dst, dstOK = netip.AddrFromSlice(p.ip6.DstIP)
+	}
+	if !srcOK || !dstOK {
+		return nil, connectionID{}, errors.New("error converting IPs")
+	}
+
+	if p.decoded[1] == layers.LayerTypeUDP {
+		isUDP = true
+		srcPort = uint16(p.udp.SrcPort)
+		dstPort = uint16(p.udp.DstPort)
+	} else {
+		isUDP = false
+		srcPort = uint16(p.tcp.SrcPort)
+		dstPort = uint16(p.tcp.DstPort)
+	}
+
+	connID := connectionID{
+		isUDP: isUDP,
+	}
+	if inbound {
+		connID.src = netip.AddrPortFrom(dst, dstPort)
+		connID.dst = netip.AddrPortFrom(src, srcPort)
+	} else {
+		connID.src = netip.AddrPortFrom(src, srcPort)
+		connID.dst = netip.AddrPortFrom(dst, dstPort)
+	}
+
+	return dns, connID, nil
+}
+
+// validDNSTransport returns true if a DNS request is using the
+// transport the filter requires.
+func (f *filter) validDNSTransport(connID connectionID) bool {
+	switch f.opts.DNSTransport {
+	case dnsTransportTCP:
+		return !connID.isUDP
+	case dnsTransportUDP:
+		return connID.isUDP
+	}
+
+	return true
+}
+
+// validDNSSource returns true if a DNS request from src is allowed by
+// opts.DNSAllowedSources. Requests from any IP are allowed if it is
+// empty.
+func (f *filter) validDNSSource(src netip.Addr) bool {
+	if len(f.dnsAllowedSources) == 0 {
+		return true
+	}
+
+	// prefixes never contain zoned or IPv4-mapped IPv6 addresses
+	src = src.WithZone("").Unmap()
+	for _, prefix := range f.dnsAllowedSources {
+		if prefix.Contains(src) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validResponseSize returns true if a DNS response isn't larger than
+// the filter allows. Only UDP responses are limited.
+func (f *filter) validResponseSize(connID connectionID, dns *layers.DNS) bool {
+	if !connID.isUDP {
+		return true
+	}
+
+	maxSize := f.opts.MaxUDPResponseSize
+	if maxSize == 0 {
+		maxSize = defaultMaxUDPResponseSize
+	}
+
+	return len(dns.Contents) <= maxSize
+}
+
+// validQuestionCount returns true if a DNS request doesn't have more
+// questions than the filter allows.
+func (f *filter) validQuestionCount(dns *layers.DNS) bool {
+	maxQuestions := f.opts.MaxQuestionsPerRequest
+	if maxQuestions == 0 {
+		maxQuestions = defaultMaxQuestionsPerRequest
+	}
+
+	return int(dns.QDCount) <= maxQuestions
+}
+
+// rcodeAllowed returns true if the response code of a DNS response
+// is allowed by the filter. The names of allowed response codes must
+// be upper case.
+func (f *filter) rcodeAllowed(rcode layers.DNSResponseCode) bool {
+	// Egress Eddie handles errors of its own lookups, dropping the
+	// responses would only make the lookups time out
+	if f.isSelfFilter {
+		return true
+	}
+
+	allowedRcodes := f.opts.AllowedRcodes
+	if len(allowedRcodes) == 0 {
+		allowedRcodes = defaultAllowedRcodes
+	}
+
+	for _, name := range allowedRcodes {
+		if dnsRcodes[name] == rcode {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ednsOptionsAllowed returns true if every EDNS option of a DNS
+// request is allowed by the filter. All options are allowed if
+// "allowedEDNSOptions" is not set.
+func (f *filter) ednsOptionsAllowed(logger *zap.Logger, dns *layers.DNS) bool {
+	if len(f.opts.AllowedEDNSOptions) == 0 {
+		return true
+	}
+
+	for _, rr := range dns.Additionals {
+		if rr.Type != layers.DNSTypeOPT {
+			continue
+		}
+		for _, opt := range rr.OPT {
+			if !f.ednsOptionAllowed(opt.Code) {
+				logger.Info("dropping DNS request with disallowed EDNS option", zap.Stringer("edns.option", opt.Code), zap.Uint16("edns.option.code", uint16(opt.Code)))
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// ednsOptionAllowed returns true if an EDNS option is allowed by the
+// filter. The names of allowed options must be upper case.
+func (f *filter) ednsOptionAllowed(code layers.DNSOptionCode) bool {
+	for _, name := range f.opts.AllowedEDNSOptions {
+		if allowed, ok := ednsOptionCodes[name]; ok && allowed == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validAnswerRatio returns true if a DNS response doesn't have more
+// answers per question than the filter allows. Responses without
+// questions are treated as having one question.
+func (f *filter) validAnswerRatio(dns *layers.DNS) bool {
+	maxRatio := f.opts.MaxAnswersPerQuestion
+	if maxRatio == 0 {
+		maxRatio = defaultMaxAnswersPerQuestion
+	}
+
+	questions := int(dns.QDCount)
+	if questions == 0 {
+		questions = 1
+	}
+
+	return int(dns.ANCount) <= questions*maxRatio
+}
+
+// encapsulatedPacket returns the encapsulation protocol if packet
+// is encapsulating another packet. If the encapsulated packet is an
+// IPv4 or IPv6 packet, it is returned as well.
+func encapsulatedPacket(packet []byte, ipv6 bool) (layers.IPProtocol, []byte, bool, bool) {
+	var (
+		proto   layers.IPProtocol
+		payload []byte
+	)
+
+	if !ipv6 {
+		var ip4 layers.IPv4
+		if err := ip4.DecodeFromBytes(packet, gopacket.NilDecodeFeedback); err != nil {
+			return 0, nil, false, false
+		}
+		proto = ip4.Protocol
+		payload = ip4.Payload
+	} else {
+		var ip6 layers.IPv6
+		if err := ip6.DecodeFromBytes(packet, gopacket.NilDecodeFeedback); err != nil {
+			return 0, nil, false, false
+		}
+		proto = ip6.NextHeader
+		payload = ip6.Payload
+	}
+
+	switch proto {
+	case layers.IPProtocolIPv4, layers.IPProtocolIPIP:
+		return proto, payload, false, true
+	case layers.IPProtocolIPv6:
+		return proto, payload, true, true
+	case layers.IPProtocolGRE:
+		var gre layers.GRE
+		if err := decodeGRE(&gre, payload); err != nil {
+			return proto, nil, false, true
+		}
+
+		switch gre.Protocol {
+		case layers.EthernetTypeIPv4:
+			return proto, gre.Payload, false, true
+		case layers.EthernetTypeIPv6:
+			return proto, gre.Payload, true, true
+		}
+		return proto, nil, false, true
+	}
+
+	return 0, nil, false, false
+}
+
+// decodeGRE decodes a GRE header. gopacket doesn't check the length
+// of GRE headers before decoding them, so malformed headers would
+// otherwise cause a panic.
+func decodeGRE(gre *layers.GRE, data []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed GRE header: %v", r)
+		}
+	}()
+
+	return gre.DecodeFromBytes(data, gopacket.NilDecodeFeedback)
+}
+
+// validateDNSRequest returns true if the opcode of a DNS request is
+// allowed and all hostnames it references are allowed.
+func (f *filter) validateDNSRequest(logger *zap.Logger, dns *layers.DNS, connID connectionID) bool {
+	if !f.opcodeAllowed(dns.OpCode) {
+		logger.Info("dropping DNS request with disallowed opcode", zap.Stringer("opcode", dns.OpCode))
+		return false
+	}
+	if f.opts.RejectSuspiciousFlags {
+		if reason := suspiciousRequestFlags(dns); reason != "" {
+			logger.Info("dropping DNS request with suspicious flags", zap.String("reason", reason), zap.Strings("flags", dnsFlags(dns)), zap.Stringer("rcode", dns.ResponseCode))
+			return false
+		}
+	}
+
+	if !f.ednsOptionsAllowed(logger, dns) {
+		return false
+	}
+	if f.opts.AllowAllHostnames {
+		return true
+	}
+	if !f.validateDNSQuestions(logger, dns, connID) {
+		return false
+	}
+
+	// the prerequisite and update sections of UPDATE requests are
+	// stored as answers and authorities respectively; make sure
+	// records for disallowed hostnames aren't being changed
+	if dns.OpCode == layers.DNSOpCodeUpdate {
+		records := make([]layers.DNSResourceRecord, 0, len(dns.Answers)+len(dns.Authorities))
+		records = append(records, dns.Answers...)
+		records = append(records, dns.Authorities...)
+		for i := range records {
+			if !f.hostnameAllowed(string(records[i].Name)) {
+				logger.Info("dropping DNS update request", zap.ByteString("record", records[i].Name))
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// validateDNSQuestions returns true if all questions of a DNS message
+// are for allowed hostnames or are allowed by the match expression.
+func (f *filter) validateDNSQuestions(logger *zap.Logger, dns *layers.DNS, connID connectionID) bool {
+	if dns.QDCount == 0 {
+		// drop DNS requests with no questions; this probably
+		// doesn't happen in practice but doesn't hurt to
+		// handle this case
+		logger.Info("dropping DNS request with no questions")
+		return false
+	}
+
+	for i := range dns.Questions {
+		// bail out if any of the questions don't contain an allowed
+		// hostname
+		qName := string(dns.Questions[i].Name)
+		if f.opts.RejectSuspiciousNames && !saneHostname(qName) {
+			logger.Info("dropping DNS request with suspicious question", zap.ByteString("question", dns.Questions[i].Name))
+			f.recentDenies.add(dns.Questions[i])
+			return false
+		}
+		if !f.hostnameAllowed(qName) && !f.expressionAllows(logger, dns, dns.Questions[i], connID) {
+			logger.Info("dropping DNS request", zap.ByteString("question", dns.Questions[i].Name))
+			f.recentDenies.add(dns.Questions[i])
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f *filter) hostnameAllowed(hostname string) bool {
+	allowedHostnames := f.allowedHostnames.Load().(*hostnameTrie)
+	if rule, ok := allowedHostnames.match(hostname); ok && f.enoughLabels(rule) {
+		// count which allowed hostname matched so unused allowed
+		// hostnames can be found
+		allowedHostnames.countMatch(hostname)
+		return true
+	}
+
+	// hostnames allowed from answers are only allowed themselves
+	return f.enoughLabels(hostname) && f.allowedFromAnswer(hostname)
+}
+
+// enoughLabels returns true if the allowed hostname rule has at least
+// opts.MinLabels labels, so overly broad allowed hostnames don't
+// allow anything.
+func (f *filter) enoughLabels(rule string) bool {
+	return labelCount(rule) >= f.opts.MinLabels
+}
+
+// matchedRule returns the allowed hostname that allows hostname. If
+// hostname was allowed from a CNAME or SRV answer, it is returned.
+func (f *filter) matchedRule(hostname string) (string, bool) {
+	if rule, ok := f.allowedHostnames.Load().(*hostnameTrie).match(hostname); ok {
+		return rule, true
+	}
+
+	if f.allowedFromAnswer(hostname) {
+		return hostname, true
+	}
+
+	return "", false
+}
+
+// allowedFromAnswer returns true if hostname was allowed from a CNAME
+// or SRV answer.
+func (f *filter) allowedFromAnswer(hostname string) bool {
+	// the self-filter doesn't have a nfqueue for generic traffic, and
+	// therefore won't have a cache for additional hostnames
+	if f.isSelfFilter || f.opts.DisableDynamicHostnames {
+		return false
+	}
+
+	if !f.additionalHostnames.EntryExists(hostname) {
+		return false
+	}
+	f.recordHostnameMatch(hostname)
+
+	return true
+}
+
+// logAllowedRequest logs that a DNS request was allowed, along with
+// the allowed hostnames that matched its questions if configured.
+// Requests only for quiet hostnames are logged at debug level.
+func (f *filter) logAllowedRequest(logger *zap.Logger, dns *layers.DNS) {
+	fields := []zap.Field{zap.Strings("questions", questionStrings(dns.Questions))}
+	if f.opts.LogMatchedRules {
+		rules := make([]string, len(dns.Questions))
+		for i := range dns.Questions {
+			rules[i], _ = f.matchedRule(string(dns.Questions[i].Name))
+		}
+		fields = append(fields, zap.Strings("matched_rule", rules))
+	}
+
+	if f.quietRequest(dns) {
+		logger.Debug("allowing DNS request", fields...)
+		return
+	}
+	logger.Info("allowing DNS request", fields...)
+}
+
+// quietRequest returns true if every question of a DNS request is for
+// a quiet hostname.
+func (f *filter) quietRequest(dns *layers.DNS) bool {
+	if len(f.opts.QuietHostnames) == 0 || len(dns.Questions) == 0 {
+		return false
+	}
+
+	for i := range dns.Questions {
+		if !f.quietHostnames.matches(string(dns.Questions[i].Name)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// saneHostname returns true if hostname has a valid length, only
+// contains valid labels and ends with a plausible TLD.
+func saneHostname(hostname string) bool {
+	if len(hostname) == 0 || len(hostname) > 253 {
+		return false
+	}
+
+	labels := strings.Split(hostname, ".")
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			// underscores are used by SRV and TXT records
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+
+	// TLDs are at least 2 letters, or are internationalized
+	tld := labels[len(labels)-1]
+	if strings.HasPrefix(strings.ToLower(tld), "xn--") {
+		return true
+	}
+	if len(tld) < 2 {
+		return false
+	}
+	for i := 0; i < len(tld); i++ {
+		c := tld[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') {
+			return false
+		}
+	}
+
+	return true
+}
+
+func questionStrings(dnsQs []layers.DNSQuestion) []string {
+	questions := make([]string, len(dnsQs))
+	for i := range dnsQs {
+		questions[i] = string(dnsQs[i].Name) + ": " + dnsQs[i].Type.String()
+	}
+
+	return questions
+}
+
+func newDNSResponseCallback(f *FilterManager) nfqueue.HookFunc {
+	logger := f.logger.With(zap.String("filter.type", "dns-resp"))
+	logger = logger.With(zap.Uint16("queue.num", f.queueNum))
+	logger.Info("started nfqueue")
+
+	return func(attr nfqueue.Attribute) int {
+		defer f.recoverPanic()
+
+		// wait until the filter manager is setup to prevent race conditions
+		<-f.ready
+
+		if attr.PacketID == nil {
+			return 0
+		}
+		if hasBreakGlassMark(attr, f.breakGlassMark) {
+			logger.Warn("accepting DNS response with break-glass mark without filtering it", zap.Uint32("packet.mark", *attr.Mark))
+
+			f.setVerdict(logger, nil, *attr.PacketID, nfqueue.NfAccept)
+			return 0
+		}
+		if f.paused.isPaused() {
+			f.paused.logDrop(logger, "dropping DNS response while egress is paused")
+
+			f.setVerdict(logger, nil, *attr.PacketID, nfqueue.NfDrop)
+			return 0
+		}
+		if attr.CtInfo == nil {
+			return 0
+		}
+		if attr.Payload == nil {
+			return 0
+		}
+
+		// since DNS requests are filtered above, we only process
+		// DNS responses of established packets to make sure a
+		// local attacker can't connect to disallowed IPs by
+		// sending a DNS response with an attacker specified IP
+		// as an answer, thereby allowing that IP
+		if !connIsEstablished(*attr.CtInfo) {
+			logger.Warn("dropping DNS response with that is not from an established connection", zap.Uint32("conn.state", *attr.CtInfo), zap.String("conn.stateName", stateName(*attr.CtInfo)))
+
+			f.setVerdict(logger, nil, *attr.PacketID, nfqueue.NfDrop)
+			return 0
+		}
+
+		// filters may process both IP versions, so the version of
+		// each response has to be detected
+		ipv6 := packetIsIPv6(*attr.Payload, 0)
+		dns, connID, err := parseDNSPacket(*attr.Payload, ipv6, true, f.decapsulate)
+		if err != nil {
+			logParseError(logger, err)
+
+			// responses to unparsable requests may be unparsable
+			// too, allow them if their request was allowed
+			if connID, ok := packetConnID(*attr.Payload, ipv6, true); ok {
+				f.filtersMtx.RLock()
+				connFilter := unparsedRequestFilter(f.filters, connID)
+				f.filtersMtx.RUnlock()
+				if connFilter != nil {
+					logger.Warn("allowing unparsable DNS response to unparsable request", zap.Stringer("conn.id", connID), zap.String("dns-req.filter.name", connFilter.opts.Name))
+
+					f.setVerdict(logger, nil, *attr.PacketID, nfqueue.NfAccept)
+					return 0
+				}
+			}
+
+			f.setVerdict(logger, nil, *attr.PacketID, nfqueue.NfDrop)
+			return 0
+		}
+		logger := logger.With(zap.Stringer("conn.id", connID))
+
+		f.filtersMtx.RLock()
+		filters := f.filters
+		f.filtersMtx.RUnlock()
+
+		connFilter := requestFilter(filters, connID)
+		if connFilter == nil {
+			// the response may be to a request the client sent to
+			// multiple resolvers, conntrack has already verified
+			// the client sent a request to this resolver
+			connFilter = parallelRequestFilter(filters, connID, dns)
+			if connFilter != nil {
+				logger.Info("accepting DNS response to parallel request", zap.String("dns-req.filter.name", connFilter.opts.Name))
+			}
+		}
+		if connFilter == nil {
+			// responses to allow-all filters that don't track
+			// connections don't need to be processed
+			if connFilter := untrackedRequestFilter(filters, connID); connFilter != nil {
+				logger.Debug("allowing DNS response from untracked connection", zap.String("dns-req.filter.name", connFilter.opts.Name))
+
+				f.setVerdict(logger, nil, *attr.PacketID, nfqueue.NfAccept)
+				return 0
+			}
+
+			// answers of responses to requests that couldn't be
+			// inspected aren't allowed, but the response is
+			if unparsedRequestFilter(filters, connID) != nil {
+				logger.Info("allowing DNS response to unparsable request without allowing its answers", zap.Strings("questions", questionStrings(dns.Questions)))
+
+				f.setVerdict(logger, nil, *attr.PacketID, nfqueue.NfAccept)
+				return 0
+			}
+
+			logger.Warn("dropping DNS response from unknown connection", zap.Strings("questions", questionStrings(dns.Questions)))
+
+			f.setVerdict(logger, nil, *attr.PacketID, nfqueue.NfDrop)
+			return 0
+		}
+		// verify the response is from the same conntrack flow as the
+		// request; the connection isn't removed so a legitimate
+		// response can still be accepted
+		if connFilter.opts.ValidateConntrackIDs && !connFilter.validConntrackID(connID, attr) {
+			logger.Warn("dropping DNS response with mismatched conntrack ID", zap.String("dns-req.filter.name", connFilter.opts.Name))
+
+			f.setVerdict(logger, connFilter, *attr.PacketID, nfqueue.NfDrop)
+			return 0
+		}
+		connFilter.recordResponseLatency(logger, connID, dns)
+		logger.Debug("removing connection")
+		connFilter.connections.RemoveEntry(connID)
+		// detect retransmissions of the request that arrive after
+		// the response
+		connFilter.trackRequest(connID, dns)
+
+		logger = logger.With(zap.String("dns-req.filter.name", connFilter.opts.Name))
+		if connFilter.opts.FailOpenOnResolverOutage {
+			connFilter.outage.responseReceived(logger, connID.dst)
+		}
+		// drop oversized UDP responses so large responses have to
+		// be retried over TCP instead of being fragmented
+		if !connFilter.validResponseSize(connID, dns) {
+			logger.Warn("dropping oversized UDP DNS response", zap.Int("response.size", len(dns.Contents)))
+
+			f.setVerdict(logger, connFilter, *attr.PacketID, nfqueue.NfDrop)
+			return 0
+		}
+		// drop responses with far more answers than questions, as
+		// they may be used for amplification
+		if !connFilter.validAnswerRatio(dns) {
+			logger.Warn("dropping DNS response with too many answers per question", zap.Uint16("response.questions", dns.QDCount), zap.Uint16("response.answers", dns.ANCount))
+
+			f.setVerdict(logger, connFilter, *attr.PacketID, nfqueue.NfDrop)
+			return 0
+		}
+		// unusual response codes may indicate a misbehaving or
+		// malicious resolver
+		if !connFilter.rcodeAllowed(dns.ResponseCode) {
+			logger.Warn("dropping DNS response with disallowed response code", zap.Stringer("response.rcode", dns.ResponseCode))
+
+			f.setVerdict(logger, connFilter, *attr.PacketID, nfqueue.NfDrop)
+			return 0
+		}
+
+		// responses to requests with opcodes that aren't allowed
+		// should never happen, as the requests are dropped
+		if connFilter.opts.RejectUnknownOpcodes && !connFilter.opcodeAllowed(dns.OpCode) {
+			logger.Warn("dropping DNS response with disallowed opcode", zap.Stringer("opcode", dns.OpCode))
+
+			f.setVerdict(logger, connFilter, *attr.PacketID, nfqueue.NfDrop)
+			return 0
+		}
+		if connFilter.opts.RejectSuspiciousFlags {
+			if reason := suspiciousResponseFlags(dns); reason != "" {
+				logger.Warn("dropping DNS response with suspicious flags", zap.String("reason", reason), zap.Strings("flags", dnsFlags(dns)))
+
+				f.setVerdict(logger, connFilter, *attr.PacketID, nfqueue.NfDrop)
+				return 0
+			}
+		}
+
+		// allow and don't process the DNS response if all hostnames
+		// are allowed
+		if !connFilter.opts.AllowAllHostnames {
+			// validate DNS response questions are for allowed
+			// hostnames, drop them otherwise; responses for disallowed
+			// hostnames should never happen in theory, because we
+			// block requests for disallowed hostnames but it doesn't
+			// hurt to check
+			if !connFilter.validateDNSQuestions(logger, dns, connID) {
+				f.setVerdict(logger, connFilter, *attr.PacketID, nfqueue.NfDrop)
+				return 0
+			}
+
+			// don't process the DNS response if the filter it came
+			// from is the self filter, or if it isn't a response to
+			// a query
+			if !connFilter.isSelfFilter && dns.OpCode == layers.DNSOpCodeQuery && dns.ANCount > 0 {
+				if connFilter.opts.ValidateCNAMETargets && !connFilter.validateCNAMEs(logger, dns) {
+					f.setVerdict(logger, connFilter, *attr.PacketID, nfqueue.NfDrop)
+					return 0
+				}
+				if connFilter.opts.UseMarkInheritance {
+					connFilter.allowConnMark(logger, connID)
+				}
+
+				// Check IPs against DNSBLs on another goroutine and
+				// set the verdict there, as the responses to the DNSBL
+				// queries will need to be processed by this callback.
+				if len(connFilter.opts.DNSBLZones) > 0 {
+					packetID := *attr.PacketID
+					select {
+					case connFilter.dnsblSem <- struct{}{}:
+					default:
+						logger.Warn("dropping DNS response as too many are being checked against DNSBLs", zap.Int("dnsbl.checks.max", cap(connFilter.dnsblSem)))
+						f.setVerdict(logger, connFilter, packetID, nfqueue.NfDrop)
+						return 0
+					}
+					if !f.startDNSBLCheck() {
+						<-connFilter.dnsblSem
+						logger.Debug("dropping DNS response as filters are stopping")
+						f.setVerdict(logger, connFilter, packetID, nfqueue.NfDrop)
+						return 0
+					}
+					go func() {
+						defer f.dnsblChecks.Done()
+						defer func() { <-connFilter.dnsblSem }()
+						defer connFilter.recoverPanic()
+
+						connFilter.allowAnswers(logger, dns, connID, attr.InDev)
+						f.setVerdict(logger, connFilter, packetID, nfqueue.NfAccept)
+					}()
+					return 0
+				}
+
+				connFilter.allowAnswers(logger, dns, connID, attr.InDev)
+			}
+		}
+		if !connFilter.isSelfFilter {
+			connFilter.countNoData(logger, dns)
+		}
+
+		f.setVerdict(logger, connFilter, *attr.PacketID, nfqueue.NfAccept)
+
+		return 0
+	}
+}
+
+// startDNSBLCheck tracks a DNS response being checked against DNSBLs
+// and returns true, or returns false if the FilterManager is stopping
+// and no new checks should be started.
+func (f *FilterManager) startDNSBLCheck() bool {
+	f.dnsblMtx.Lock()
+	defer f.dnsblMtx.Unlock()
+
+	if f.dnsblStopped {
+		return false
+	}
+	f.dnsblChecks.Add(1)
+
+	return true
+}
+
+// countNoData logs and counts a DNS response if it is a NOERROR
+// response to a query without answers (NODATA), and returns true if
+// it is. NODATA responses are legitimate, but clients that only got
+// NODATA for the IP version they need won't be able to connect, which
+// is otherwise hard to tell apart from being blocked.
+func (f *filter) countNoData(logger *zap.Logger, dns *layers.DNS) bool {
+	if dns.OpCode != layers.DNSOpCodeQuery || dns.ResponseCode != layers.DNSResponseCodeNoErr || dns.ANCount != 0 {
+		return false
+	}
+
+	logger.Debug("allowing DNS response with no answers", zap.Strings("response.questions", questionStrings(dns.Questions)))
+	atomic.AddInt64(&f.noDataResponses, 1)
+
+	return true
+}
+
+// requestFilter returns the filter that allowed the DNS request of a
+// response's connection, or nil if no filter did. Only the connection
+// cache of the returned filter counts the lookup as a hit, a miss
+// can't be attributed to a filter.
+func requestFilter(filters []*filter, connID connectionID) *filter {
+	for _, filter := range filters {
+		if filter.connections.EntryExists(connID) {
+			filter.connections.countLookup(true)
+			return filter
+		}
+	}
+
+	return nil
+}
+
+// untrackedRequestFilter returns the filter that allowed a DNS request
+// on connID without tracking it, or nil if no filter did.
+func untrackedRequestFilter(filters []*filter, connID connectionID) *filter {
+	for _, filter := range filters {
+		if filter.untrackedConnections != nil && filter.untrackedConnections.EntryExists(connID) {
+			return filter
+		}
+	}
+
+	return nil
+}
+
+// parallelRequestFilter returns the filter that allowed a request with
+// the same client, transaction ID and questions as a response if the
+// filter correlates requests sent to multiple resolvers, or nil if no
+// filter did.
+func parallelRequestFilter(filters []*filter, connID connectionID, dns *layers.DNS) *filter {
+	key := newParallelRequestKey(connID, dns)
+	for _, filter := range filters {
+		if filter.opts.CorrelateParallelRequests && filter.parallelRequests.EntryExists(key) {
+			return filter
+		}
+	}
+
+	return nil
+}
+
+// validateCNAMEs returns true if the targets of all CNAME answers
+// are already allowed, either explicitly or by following a chain of
+// CNAMEs that were previously allowed.
+func (f *filter) validateCNAMEs(logger *zap.Logger, dns *layers.DNS) bool {
+	for _, answer := range dns.Answers {
+		if answer.Type != layers.DNSTypeCNAME {
+			continue
+		}
+
+		target := string(answer.CNAME)
+		if f.hostnameAllowed(target) || f.additionalHostnameAllowed(target) {
+			continue
 		}
 
-		return 0
+		logger.Warn("CNAME points to non-allowed hostname", zap.ByteString("answer.name", answer.Name), zap.String("answer.cname", target))
+		return false
 	}
-}
 
-func connIsEstablished(state uint32) bool {
-	return state == stateEstablished || state == stateRelated || state == stateIsReply || state == stateRelatedReply
+	return true
 }
 
-func parseDNSPacket(packet []byte, ipv6, inbound bool) (*layers.DNS, connectionID, error) {
-	var (
-		ip4     layers.IPv4
-		ip6     layers.IPv6
-		udp     layers.UDP
-		tcp     layers.TCP
-		dns     layers.DNS
-		parser  *gopacket.DecodingLayerParser
-		decoded = make([]gopacket.LayerType, 0, 3)
-	)
-
-	// parse DNS packet
-	if !ipv6 {
-		parser = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4, &ip4, &udp, &tcp, &dns)
-	} else {
-		parser = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv6, &ip6, &udp, &tcp, &dns)
+// additionalHostnameAllowed returns true if hostname is a subdomain of
+// a hostname allowed from a previous CNAME or SRV answer.
+func (f *filter) additionalHostnameAllowed(hostname string) bool {
+	if f.additionalHostnames == nil {
+		return false
 	}
 
-	if err := parser.DecodeLayers(packet, &decoded); err != nil {
-		return nil, connectionID{}, err
-	}
-	if len(decoded) != 3 {
-		return nil, connectionID{}, errors.New("not all layers were parsed")
+	// check each parent domain of hostname instead of every
+	// additional hostname
+	for parent := hostname; ; {
+		_, rest, found := strings.Cut(parent, ".")
+		if !found || rest == "" {
+			return false
+		}
+		if f.additionalHostnames.EntryExists(rest) {
+			f.recordHostnameMatch(rest)
+			return true
+		}
+		parent = rest
 	}
+}
 
-	// build connection ID so dns requests/responses can be correlated
-	var (
-		isUDP            bool
-		src, dst         netip.Addr
-		srcPort, dstPort uint16
-		srcOK, dstOK     bool
-	)
+// allowAnswers temporarily allows IPs and hostnames from the answers
+// of a DNS response. ifIndex is the index of the interface the
+// response was received on.
+func (f *filter) allowAnswers(logger *zap.Logger, dns *layers.DNS, connID connectionID, ifIndex *uint32) {
+	processor := f.responseProcessor
+	if processor == nil {
+		processor = defaultResponseProcessor{}
+	}
 
-	if decoded[0] == layers.LayerTypeIPv4 {
-		src, srcOK = netip.AddrFromSlice(ip4.SrcIP)
-		dst, dstOK = netip.AddrFromSlice(ip4.DstIP)
-	} else if decoded[0] == layers.LayerTypeIPv6 {
-		src, srcOK = netip.AddrFromSlice(ip6.SrcIP)
-		dst, dstOK = netip.AddrFromSlice(ip6.DstIP)
+	if f.opts.MatchAnswerTypeToQuestion {
+		dns = f.matchAnswerTypes(logger, dns, connID)
 	}
-	if !srcOK || !dstOK {
-		return nil, connectionID{}, errors.New("error converting IPs")
+	processor.processResponse(logger, f, dns, connID, ifIndex)
+	f.addAnswerProvenance(dns, ifIndex)
+	if f.opts.PostResponseGrace != 0 {
+		f.startPostResponseGrace(logger, dns, connID, ifIndex)
 	}
+	f.checkAllowedIPsThreshold(logger)
+}
 
-	if decoded[1] == layers.LayerTypeUDP {
-		isUDP = true
-		srcPort = uint16(udp.SrcPort)
-		dstPort = uint16(udp.DstPort)
-	} else {
-		isUDP = false
-		srcPort = uint16(tcp.SrcPort)
-		dstPort = uint16(tcp.DstPort)
+// checkAllowedIPsThreshold logs a warning the first time the amount
+// of allowed IPs exceeds opts.WarnAllowedIPsThreshold. The warning
+// can be logged again once the amount drops below 90% of the
+// threshold.
+func (f *filter) checkAllowedIPsThreshold(logger *zap.Logger) {
+	threshold := f.opts.WarnAllowedIPsThreshold
+	if threshold == 0 || f.allowedIPs == nil {
+		return
 	}
 
-	connID := connectionID{
-		isUDP: isUDP,
-	}
-	if inbound {
-		connID.src = netip.AddrPortFrom(dst, dstPort)
-		connID.dst = netip.AddrPortFrom(src, srcPort)
-	} else {
-		connID.src = netip.AddrPortFrom(src, srcPort)
-		connID.dst = netip.AddrPortFrom(dst, dstPort)
+	numIPs := uint(f.allowedIPs.Len())
+	if numIPs > threshold {
+		if atomic.CompareAndSwapInt32(&f.allowedIPsNearLimit, 0, 1) {
+			logger.Warn("amount of allowed IPs exceeded threshold", zap.Uint("ips.count", numIPs), zap.Uint("ips.threshold", threshold))
+		}
+	} else if numIPs < threshold*9/10 {
+		atomic.StoreInt32(&f.allowedIPsNearLimit, 0)
 	}
-
-	return &dns, connID, nil
 }
 
-func (f *filter) validateDNSQuestions(logger *zap.Logger, dns *layers.DNS) bool {
-	if dns.QDCount == 0 {
-		// drop DNS requests with no questions; this probably
-		// doesn't happen in practice but doesn't hurt to
-		// handle this case
-		logger.Info("dropping DNS request with no questions")
+// allowedIPsNearLimitAt returns true if the filter would be near
+// opts.WarnAllowedIPsThreshold with numIPs allowed IPs, without
+// recording or warning about it.
+func (f *filter) allowedIPsNearLimitAt(numIPs uint) bool {
+	threshold := f.opts.WarnAllowedIPsThreshold
+	if threshold == 0 {
 		return false
 	}
-
-	for i := range dns.Questions {
-		// bail out if any of the questions don't contain an allowed
-		// hostname
-		qName := string(dns.Questions[i].Name)
-		if !f.hostnameAllowed(qName) {
-			logger.Info("dropping DNS request", zap.ByteString("question", dns.Questions[i].Name))
-			return false
-		}
+	if numIPs > threshold {
+		return true
 	}
 
-	return true
+	return numIPs >= threshold*9/10 && atomic.LoadInt32(&f.allowedIPsNearLimit) == 1
 }
 
-func (f *filter) hostnameAllowed(hostname string) bool {
-	for j := range f.opts.AllowedHostnames {
-		if hostname == f.opts.AllowedHostnames[j] || strings.HasSuffix(hostname, "."+f.opts.AllowedHostnames[j]) {
-			return true
-		}
+// validConntrackID returns true if the conntrack ID of a DNS response
+// matches the conntrack ID of the request with the same connection.
+func (f *filter) validConntrackID(connID connectionID, attr nfqueue.Attribute) bool {
+	ctID, ok := attrConntrackID(attr)
+	if !ok {
+		return false
 	}
 
-	// the self-filter doesn't have a nfqueue for generic traffic, and
-	// therefore won't have a cache for additional hostnames
-	if f.isSelfFilter {
+	ctFlow := conntrackFlow{connID: connID, ctID: ctID}
+	if !f.conntrackIDs.EntryExists(ctFlow) {
 		return false
 	}
+	f.conntrackIDs.RemoveEntry(ctFlow)
 
-	return f.additionalHostnames.EntryExists(hostname)
+	return true
 }
 
-func questionStrings(dnsQs []layers.DNSQuestion) []string {
-	questions := make([]string, len(dnsQs))
-	for i := range dnsQs {
-		questions[i] = string(dnsQs[i].Name) + ": " + dnsQs[i].Type.String()
+// allowConnMark temporarily allows traffic with the same mark as the
+// DNS request of connID, if the request was marked.
+func (f *filter) allowConnMark(logger *zap.Logger, connID connectionID) {
+	mark, ok := f.connMarks.take(connID)
+	if !ok {
+		return
 	}
 
-	return questions
+	ttl := time.Duration(f.opts.AllowAnswersFor)
+	logger.Info("allowing mark from DNS request", zap.Uint32("conn.mark", mark), zap.Duration("answer.ttl", ttl))
+	f.allowedMarks.AddEntry(mark, ttl)
 }
 
-func newDNSResponseCallback(f *FilterManager) nfqueue.HookFunc {
-	logger := f.logger.With(zap.String("filter.type", "dns-resp"))
-	logger = logger.With(zap.Uint16("queue.num", f.queueNum))
-	logger.Info("started nfqueue")
-
-	return func(attr nfqueue.Attribute) int {
-		// wait until the filter manager is setup to prevent race conditions
-		<-f.ready
-
-		if attr.PacketID == nil {
-			return 0
-		}
-		if attr.CtInfo == nil {
-			return 0
-		}
-		if attr.Payload == nil {
-			return 0
-		}
+// ipBlocklisted returns true if ip is listed by any of the filter's
+// DNSBLs. If a DNSBL can't be queried, the IP is treated as not listed.
+func (f *filter) ipBlocklisted(logger *zap.Logger, ip netip.Addr) bool {
+	if len(f.opts.DNSBLZones) == 0 {
+		return false
+	}
 
-		// since DNS requests are filtered above, we only process
-		// DNS responses of established packets to make sure a
-		// local attacker can't connect to disallowed IPs by
-		// sending a DNS response with an attacker specified IP
-		// as an answer, thereby allowing that IP
-		if !connIsEstablished(*attr.CtInfo) {
-			logger.Warn("dropping DNS response with that is not from an established connection", zap.Uint32("conn.state", *attr.CtInfo))
+	ip = ip.Unmap()
+	if f.dnsblListed.EntryExists(ip) {
+		logger.Warn("IP on blocklist", zap.Stringer("answer.ip", ip))
+		return true
+	}
+	if f.dnsblUnlisted.EntryExists(ip) {
+		return false
+	}
 
-			if err := f.dnsRespNF.SetVerdict(*attr.PacketID, nfqueue.NfDrop); err != nil {
-				logger.Error("error setting verdict", zap.NamedError("error", err))
+	ctx, cancel := context.WithTimeout(context.Background(), dnsblQueryTimeout)
+	defer cancel()
+
+	var queryFail bool
+	for _, zone := range f.opts.DNSBLZones {
+		addrs, err := f.lookupNetIP(ctx, "ip4", dnsblQueryName(ip, zone))
+		if err == nil {
+			// DNSBLs return addresses in 127.255.255.0/24 to
+			// signal errors, such as queries being refused
+			for _, addr := range addrs {
+				if dnsblErrorPrefix.Contains(addr.Unmap()) {
+					err = fmt.Errorf("DNSBL returned error code %s", addr.Unmap())
+					break
+				}
 			}
-			return 0
 		}
-
-		dns, connID, err := parseDNSPacket(*attr.Payload, f.ipv6, true)
 		if err != nil {
-			logger.Error("error parsing DNS packet", zap.NamedError("error", err))
-			return 0
-		}
-		logger := logger.With(zap.Stringer("conn.id", connID))
-
-		var connFilter *filter
-		for _, filter := range f.filters {
-			if filter.connections.EntryExists(connID) {
-				connFilter = filter
-				break
+			var dnsErr *net.DNSError
+			if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+				continue
 			}
+			logger.Warn("error querying DNSBL", zap.String("dnsbl.zone", zone), zap.NamedError("error", err))
+			queryFail = true
+			continue
 		}
-		if connFilter == nil {
-			logger.Warn("dropping DNS response from unknown connection", zap.Strings("questions", questionStrings(dns.Questions)))
 
-			if err := f.dnsRespNF.SetVerdict(*attr.PacketID, nfqueue.NfDrop); err != nil {
-				logger.Error("error setting verdict", zap.NamedError("error", err))
-			}
-			return 0
+		if len(addrs) > 0 {
+			logger.Warn("IP on blocklist", zap.Stringer("answer.ip", ip), zap.String("dnsbl.zone", zone))
+			f.dnsblListed.AddEntry(ip, dnsblCacheTime)
+			return true
 		}
-		logger.Debug("removing connection")
-		connFilter.connections.RemoveEntry(connID)
+	}
 
-		logger = logger.With(zap.String("dns-req.filter.name", connFilter.opts.Name))
-		// allow and don't process the DNS response if all hostnames
-		// are allowed
-		if !connFilter.opts.AllowAllHostnames {
-			// validate DNS response questions are for allowed
-			// hostnames, drop them otherwise; responses for disallowed
-			// hostnames should never happen in theory, because we
-			// block requests for disallowed hostnames but it doesn't
-			// hurt to check
-			if !connFilter.validateDNSQuestions(logger, dns) {
-				if err := f.dnsRespNF.SetVerdict(*attr.PacketID, nfqueue.NfDrop); err != nil {
-					logger.Error("error setting verdict", zap.NamedError("error", err))
-				}
-				return 0
-			}
+	// only remember that the IP isn't listed if all DNSBLs could be
+	// queried
+	if !queryFail {
+		f.dnsblUnlisted.AddEntry(ip, dnsblCacheTime)
+	}
 
-			// don't process the DNS response if the filter it came
-			// from is the self filter
-			if !connFilter.isSelfFilter && dns.ANCount > 0 {
-				ttl := time.Duration(connFilter.opts.AllowAnswersFor)
-				for _, answer := range dns.Answers {
-					if answer.Type == layers.DNSTypeA || answer.Type == layers.DNSTypeAAAA {
-						// temporarily add A and AAAA answers to
-						// allowed IP list
-						ip, ok := netip.AddrFromSlice(answer.IP)
-						if !ok {
-							logger.Error("error converting IP", zap.Stringer("answer.ip", answer.IP))
-							continue
-						}
-
-						logger.Info("allowing IP from DNS reply", zap.Stringer("answer.ip", ip), zap.Duration("answer.ttl", ttl))
-						connFilter.allowedIPs.AddEntry(ip, ttl)
-					} else if answer.Type == layers.DNSTypeCNAME {
-						// temporarily add CNAME answers to allowed
-						// hostnames list
-						logger.Info("allowing hostname from DNS reply", zap.ByteString("answer.name", answer.CNAME), zap.Duration("answer.ttl", ttl))
-						connFilter.additionalHostnames.AddEntry(string(answer.CNAME), ttl)
-					} else if answer.Type == layers.DNSTypeSRV {
-						// temporarily add SRV answers to allowed
-						// hostnames list
-						logger.Info("allowing hostname from DNS reply", zap.ByteString("answer.name", answer.SRV.Name), zap.Duration("answer.ttl", ttl))
-						connFilter.additionalHostnames.AddEntry(string(answer.SRV.Name), ttl)
-					}
-				}
-			}
-		}
+	return false
+}
 
-		if err := f.dnsRespNF.SetVerdict(*attr.PacketID, nfqueue.NfAccept); err != nil {
-			logger.Error("error setting verdict", zap.NamedError("error", err))
-		}
+// dnsblQueryName returns the name to query to check if ip is listed
+// in a DNSBL zone as described in RFC 5782.
+func dnsblQueryName(ip netip.Addr, zone string) string {
+	var b strings.Builder
 
-		return 0
+	if ip.Is4() {
+		ip4 := ip.As4()
+		for i := len(ip4) - 1; i >= 0; i-- {
+			b.WriteString(strconv.Itoa(int(ip4[i])))
+			b.WriteRune('.')
+		}
+	} else {
+		const hexDigits = "0123456789abcdef"
+
+		ip6 := ip.As16()
+		for i := len(ip6) - 1; i >= 0; i-- {
+			b.WriteByte(hexDigits[ip6[i]&0xf])
+			b.WriteRune('.')
+			b.WriteByte(hexDigits[ip6[i]>>4])
+			b.WriteRune('.')
+		}
 	}
+	b.WriteString(zone)
+
+	return b.String()
 }
 
 func newGenericCallback(f *filter) nfqueue.HookFunc {
@@ -612,38 +2866,48 @@ func newGenericCallback(f *filter) nfqueue.HookFunc {
 	logger.Info("started nfqueue")
 
 	return func(attr nfqueue.Attribute) int {
+		defer f.recoverPanic()
+
 		// wait until the filter is setup to prevent race conditions
 		<-f.genericNFReady
 
 		if attr.PacketID == nil {
 			return 0
 		}
-		if attr.Payload == nil {
+		if hasBreakGlassMark(attr, f.breakGlassMark) {
+			logger.Warn("accepting packet with break-glass mark without filtering it", zap.Uint32("packet.mark", *attr.Mark))
+
+			f.exportPacketVerdict(attr, nfqueue.NfAccept, "breakGlass")
+			f.setTrafficVerdict(logger, *attr.PacketID, nfqueue.NfAccept)
 			return 0
 		}
+		if f.paused.isPaused() {
+			f.paused.logDrop(logger, "dropping packet while egress is paused")
 
-		var (
-			ip4     layers.IPv4
-			ip6     layers.IPv6
-			parser  *gopacket.DecodingLayerParser
-			decoded = make([]gopacket.LayerType, 1)
-		)
+			f.exportPacketVerdict(attr, nfqueue.NfDrop, "paused")
+			f.setTrafficVerdict(logger, *attr.PacketID, nfqueue.NfDrop)
+			return 0
+		}
+		if attr.Payload == nil {
+			return 0
+		}
+		if verdict, ok := f.duplicateVerdict(*attr.Payload); ok {
+			f.exportPacketVerdict(attr, verdict, "duplicate")
+			// duplicates are counted as deduplicated instead of
+			// as verdicts
+			f.deadLetters.setVerdict(logger, f.trafficQueue(), *attr.PacketID, verdict)
+			return 0
+		}
 
 		// parse packet
-		if !f.opts.IPv6 {
-			parser = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4)
-			parser.IgnoreUnsupported = true
-			parser.SetDecodingLayerContainer(gopacket.DecodingLayerArray(nil))
-			parser.AddDecodingLayer(&ip4)
-		} else {
-			parser = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv6)
-			parser.IgnoreUnsupported = true
-			parser.SetDecodingLayerContainer(gopacket.DecodingLayerArray(nil))
-			parser.AddDecodingLayer(&ip6)
-		}
+		p := f.getTrafficParser(packetIsIPv6(*attr.Payload, f.opts.IPVersion))
+		defer f.putTrafficParser(p)
 
-		if err := parser.DecodeLayers(*attr.Payload, &decoded); err != nil {
+		if err := p.decode(*attr.Payload); err != nil {
 			logger.Error("error parsing packet", zap.NamedError("error", err))
+
+			f.exportPacketVerdict(attr, nfqueue.NfDrop, "parseError")
+			f.setTrafficVerdict(logger, *attr.PacketID, nfqueue.NfDrop)
 			return 0
 		}
 
@@ -652,58 +2916,239 @@ func newGenericCallback(f *filter) nfqueue.HookFunc {
 			src, dst     netip.Addr
 			srcOK, dstOK bool
 		)
-		if decoded[0] == layers.LayerTypeIPv4 {
-			src, srcOK = netip.AddrFromSlice(ip4.SrcIP)
-			dst, dstOK = netip.AddrFromSlice(ip4.DstIP)
+		if p.decoded[0] == layers.LayerTypeIPv4 {
+			src, srcOK = netip.AddrFromSlice(p.ip4.SrcIP)
+			dst, dstOK = netip.AddrFromSlice(p.ip4.DstIP)
 			if !srcOK || !dstOK {
-				logger.Error("error converting IPs", zap.Stringer("conn.src", ip4.SrcIP), zap.Stringer("conn.dst", ip4.DstIP))
+				logger.Error("error converting IPs", zap.Stringer("conn.src", p.ip4.SrcIP), zap.Stringer("conn.dst", p.ip4.DstIP))
 				return 0
 			}
-		} else if decoded[0] == layers.LayerTypeIPv6 {
-			src, srcOK = netip.AddrFromSlice(ip6.SrcIP)
-			dst, dstOK = netip.AddrFromSlice(ip6.DstIP)
+		} else if p.decoded[0] == layers.LayerTypeIPv6 {
+			src, srcOK = netip.AddrFromSlice(p.ip6.SrcIP)
+			dst, dstOK = netip.AddrFromSlice(p.ip6.DstIP)
 			if !srcOK || !dstOK {
-				logger.Error("error converting IPs", zap.Stringer("conn.src", ip6.SrcIP), zap.Stringer("conn.dst", ip6.DstIP))
+				logger.Error("error converting IPs", zap.Stringer("conn.src", p.ip6.SrcIP), zap.Stringer("conn.dst", p.ip6.DstIP))
 				return 0
 			}
+
+			// link-local addresses are only unique per interface
+			ifIndex := packetInterface(attr)
+			src = zoneLinkLocal(src, ifIndex)
+			dst = zoneLinkLocal(dst, ifIndex)
 		}
 
-		// validate that either the source or destination IP is allowed
-		var verdict int
-		allowed, err := f.validateIPs(logger, src, dst)
-		if err != nil {
-			logger.Error("error validating IPs", zap.Stringer("conn.src", src), zap.Stringer("conn.dst", dst), zap.NamedError("error", err))
-			verdict = nfqueue.NfDrop
-		} else {
-			if allowed {
-				logger.Info("allowing packet", zap.Stringer("conn.src", src), zap.Stringer("conn.dst", dst))
+		if f.loopbackExcluded(src, dst) {
+			logger.Debug("allowing loopback packet", zap.Stringer("conn.src", src), zap.Stringer("conn.dst", dst))
+
+			f.exportVerdict(src, dst, nfqueue.NfAccept, allowedByNone, "loopback")
+			f.setTrafficVerdict(logger, *attr.PacketID, nfqueue.NfAccept)
+			return 0
+		}
+
+		if reason := f.ipPolicyViolation(p, attr.CtInfo); reason != "" {
+			fields := []zap.Field{zap.String("reason", reason), zap.Stringer("conn.src", src), zap.Stringer("conn.dst", dst)}
+			if p.ipv6 {
+				fields = append(fields, zap.Uint8("ip.trafficClass", p.ip6.TrafficClass), zap.Uint32("ip.flowLabel", p.ip6.FlowLabel))
+			}
+			logger.Info("dropping packet with disallowed IP header", fields...)
+
+			f.exportVerdict(src, dst, nfqueue.NfDrop, allowedByNone, "ipPolicy")
+			f.setTrafficVerdict(logger, *attr.PacketID, nfqueue.NfDrop)
+			return 0
+		}
+
+		if !f.trafficConntrackStateAllowed(attr.CtInfo) {
+			// the kernel doesn't attach conntrack info to INVALID
+			// packets
+			ctName := "INVALID"
+			if attr.CtInfo != nil {
+				ctName = stateName(*attr.CtInfo)
+			}
+			logger.Info("dropping packet with invalid conntrack state", zap.Stringer("conn.src", src), zap.Stringer("conn.dst", dst), zap.Uint32p("conn.state", attr.CtInfo), zap.String("conn.stateName", ctName))
+
+			f.exportVerdict(src, dst, nfqueue.NfDrop, allowedByNone, "conntrackState")
+			f.setTrafficVerdict(logger, *attr.PacketID, nfqueue.NfDrop)
+			return 0
+		}
+
+		// packets without ports, such as ICMP errors and IP
+		// fragments, aren't restricted by port
+		if hasPorts := len(p.decoded) == 2; hasPorts && (len(f.opts.AllowedSrcPorts) > 0 || len(f.opts.AllowedDstPorts) > 0) {
+			var srcPort, dstPort uint16
+			if p.decoded[1] == layers.LayerTypeUDP {
+				srcPort, dstPort = uint16(p.udp.SrcPort), uint16(p.udp.DstPort)
+			} else {
+				srcPort, dstPort = uint16(p.tcp.SrcPort), uint16(p.tcp.DstPort)
+			}
+
+			// allowed ports are of the connection, so swap the ports
+			// and addresses of replies
+			connSrcPort, connDst := srcPort, netip.AddrPortFrom(dst, dstPort)
+			if isReply(attr.CtInfo) {
+				connSrcPort, connDst = dstPort, netip.AddrPortFrom(src, srcPort)
+			}
+
+			if !(f.validPorts(connSrcPort, connDst.Port()) || f.srvPortAllowed(connSrcPort, connDst)) {
+				logger.Info("dropping packet with disallowed ports", zap.Stringer("conn.src", netip.AddrPortFrom(src, srcPort)), zap.Stringer("conn.dst", netip.AddrPortFrom(dst, dstPort)))
+
+				f.exportVerdict(src, dst, nfqueue.NfDrop, allowedByNone, "ports")
+				f.setTrafficVerdict(logger, *attr.PacketID, nfqueue.NfDrop)
+				return 0
+			}
+		}
+
+		var (
+			verdict   int
+			mechanism = allowedByNone
+		)
+		if f.opts.FailOpenOnResolverOutage && f.outage.active(logger, time.Now()) {
+			logger.Warn("allowing packet during resolver outage", zap.Stringer("conn.src", src), zap.Stringer("conn.dst", dst))
+			verdict = nfqueue.NfAccept
+		} else if f.opts.UseMarkInheritance && attr.Mark != nil && f.allowedMarks.EntryExists(*attr.Mark) {
+			// packets with the same mark as an allowed DNS request
+			// are allowed regardless of their IPs
+			logger.Info("allowing packet with mark of DNS request", zap.Stringer("conn.src", src), zap.Stringer("conn.dst", dst), zap.Uint32("conn.mark", *attr.Mark))
+			verdict = nfqueue.NfAccept
+		} else if f.opts.VerifyForward {
+			// only trust current lookups of allowed hostnames
+			if f.verifyForward(logger, dst) {
+				logger.Info("allowing packet after forward lookup", zap.Stringer("conn.src", src), zap.Stringer("conn.dst", dst))
 				verdict = nfqueue.NfAccept
 			} else {
 				logger.Info("dropping packet", zap.Stringer("conn.src", src), zap.Stringer("conn.dst", dst))
 				verdict = nfqueue.NfDrop
 			}
-		}
+		} else {
+			// validate that either the source or destination IP is allowed
+			var err error
+			mechanism, err = f.validateIPs(logger, src, dst)
+			// new connections to answer IPs that expired right after
+			// their response are allowed for a short time
+			if err == nil && mechanism == allowedByNone && f.inPostResponseGrace(src, dst, attr.CtInfo) {
+				mechanism = allowedByPostResponseGrace
+			}
+			allowed := mechanism != allowedByNone
+			if err != nil {
+				logger.Error("error validating IPs", zap.Stringer("conn.src", src), zap.Stringer("conn.dst", dst), zap.NamedError("error", err))
+				verdict = nfqueue.NfDrop
+			} else {
+				var (
+					serverName       string
+					sniMismatch      bool
+					reassemblyErr    error
+					dohHost          string
+					dohBlocked       bool
+					dohReassemblyErr error
+				)
+				isTCP := len(p.decoded) == 2 && p.decoded[1] == layers.LayerTypeTCP
+				var connID connectionID
+				if isTCP {
+					connID = connectionID{
+						src: netip.AddrPortFrom(src, uint16(p.tcp.SrcPort)),
+						dst: netip.AddrPortFrom(dst, uint16(p.tcp.DstPort)),
+					}
+				}
+				if allowed && f.opts.MatchSNI && isTCP {
+					hello, ready, err := f.reassembleClientHello(connID, p.tcp.Seq, p.tcp.Payload)
+					if err != nil {
+						reassemblyErr = err
+					} else if ready {
+						serverName, sniMismatch = f.sniMismatch(dst, hello)
+					}
+				}
+				if allowed && f.opts.BlockDoH && isTCP {
+					head, ready, err := f.reassembleHTTPRequest(connID, p.tcp.Seq, p.tcp.Payload)
+					if err != nil {
+						dohReassemblyErr = err
+					} else if ready {
+						dohHost, dohBlocked = f.dohBlocked(head)
+					}
+				}
 
-		if err := f.genericNF.SetVerdict(*attr.PacketID, verdict); err != nil {
-			logger.Error("error setting verdict", zap.NamedError("error", err))
+				if reassemblyErr != nil {
+					logger.Info("dropping packet of TLS ClientHello that could not be reassembled", zap.Stringer("conn.src", src), zap.Stringer("conn.dst", dst), zap.NamedError("error", reassemblyErr))
+					verdict = nfqueue.NfDrop
+				} else if dohReassemblyErr != nil {
+					logger.Info("dropping packet of HTTP request that could not be reassembled", zap.Stringer("conn.src", src), zap.Stringer("conn.dst", dst), zap.NamedError("error", dohReassemblyErr))
+					verdict = nfqueue.NfDrop
+				} else if sniMismatch {
+					logger.Info("dropping packet with TLS server name that didn't cause its IP to be allowed", zap.Stringer("conn.src", src), zap.Stringer("conn.dst", dst), zap.String("tls.sni", serverName))
+					verdict = nfqueue.NfDrop
+				} else if dohBlocked {
+					logger.Info("dropping DNS over HTTPS request to host that isn't allowed", zap.Stringer("conn.src", src), zap.Stringer("conn.dst", dst), zap.String("http.host", dohHost))
+					verdict = nfqueue.NfDrop
+				} else if allowed {
+					logger.Info("allowing packet", zap.Stringer("conn.src", src), zap.Stringer("conn.dst", dst), zap.Stringer("allowed.by", mechanism))
+					f.countAllowedBy(mechanism)
+					verdict = nfqueue.NfAccept
+				} else {
+					logger.Info("dropping packet", zap.Stringer("conn.src", src), zap.Stringer("conn.dst", dst))
+					verdict = nfqueue.NfDrop
+				}
+			}
 		}
 
+		f.exportVerdict(src, dst, verdict, mechanism, "")
+		f.recordVerdict(*attr.Payload, verdict)
+		f.setTrafficVerdict(logger, *attr.PacketID, verdict)
+
 		return 0
 	}
 }
 
-func (f *filter) validateIPs(logger *zap.Logger, src, dst netip.Addr) (bool, error) {
+// loopbackExcluded returns true if traffic between src and dst is on
+// the loopback interface and should be allowed without filtering.
+func (f *filter) loopbackExcluded(src, dst netip.Addr) bool {
+	return f.opts.excludeLoopback() && src.IsLoopback() && dst.IsLoopback()
+}
+
+// packetInterface returns the index of the interface a packet is
+// being sent out of, or if it is being received the index of the
+// interface it was received on.
+func packetInterface(attr nfqueue.Attribute) *uint32 {
+	if attr.OutDev != nil {
+		return attr.OutDev
+	}
+	return attr.InDev
+}
+
+// zoneLinkLocal returns addr with its zone set to the interface index
+// ifIndex if addr is an IPv6 link-local address. Otherwise addr is
+// returned unchanged.
+func zoneLinkLocal(addr netip.Addr, ifIndex *uint32) netip.Addr {
+	if ifIndex == nil || !addr.Is6() || addr.Is4In6() {
+		return addr
+	}
+	if !addr.IsLinkLocalUnicast() && !addr.IsLinkLocalMulticast() {
+		return addr
+	}
+
+	return addr.WithZone(strconv.FormatUint(uint64(*ifIndex), 10))
+}
+
+// validPorts returns true if the source and destination ports are
+// allowed. An empty list of allowed ports allows any port.
+func (f *filter) validPorts(srcPort, dstPort uint16) bool {
+	srcAllowed := len(f.opts.AllowedSrcPorts) == 0 || containsPort(f.opts.AllowedSrcPorts, srcPort)
+	dstAllowed := len(f.opts.AllowedDstPorts) == 0 || containsPort(f.opts.AllowedDstPorts, dstPort)
+
+	return srcAllowed && dstAllowed
+}
+
+// validateIPs returns the mechanism that allowed either src or dst,
+// or allowedByNone if neither are allowed.
+func (f *filter) validateIPs(logger *zap.Logger, src, dst netip.Addr) (allowMechanism, error) {
 	// check if the destination IP is allowed first, as most likely
 	// we are validating an outbound connection
-	if f.allowedIPs.EntryExists(dst) {
-		return true, nil
+	if mechanism := f.allowedBy(dst); mechanism != allowedByNone {
+		return mechanism, nil
 	}
 
 	// check if source IP is allowed; if reverse IP lookups are
 	// disabled or the IP is allowed return early
-	allowed := f.allowedIPs.EntryExists(src)
-	if !f.opts.LookupUnknownIPs || allowed {
-		return allowed, nil
+	mechanism := f.allowedBy(src)
+	if !f.opts.LookupUnknownIPs || mechanism != allowedByNone {
+		return mechanism, nil
 	}
 
 	// preform reverse IP lookups on the destination and then source
@@ -711,23 +3156,109 @@ func (f *filter) validateIPs(logger *zap.Logger, src, dst netip.Addr) (bool, err
 	if !dst.IsPrivate() {
 		allowed, err := f.lookupAndValidateIP(logger, dst)
 		if err != nil {
-			return false, err
+			return allowedByNone, err
 		}
 		if allowed {
-			return true, nil
+			return allowedByReverseLookup, nil
 		}
 	}
 
 	if !src.IsPrivate() {
-		return f.lookupAndValidateIP(logger, src)
+		allowed, err := f.lookupAndValidateIP(logger, src)
+		if err != nil || !allowed {
+			return allowedByNone, err
+		}
+		return allowedByReverseLookup, nil
 	}
 
-	return false, nil
+	return allowedByNone, nil
+}
+
+// verifyForward returns true if ip is one of the addresses that an
+// allowed hostname resolves to. If ip isn't known, allowed hostnames
+// are resolved again in the background so the queue isn't blocked,
+// and false is returned. A retransmission of the packet will be
+// allowed once ip is known. Only verified IPs are cached, so misses
+// are resolved again once the previous lookups finish.
+func (f *filter) verifyForward(logger *zap.Logger, ip netip.Addr) bool {
+	if f.verifiedIPs.EntryExists(ip) {
+		return true
+	}
+
+	if atomic.CompareAndSwapInt32(&f.resolvingForward, 0, 1) {
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			defer atomic.StoreInt32(&f.resolvingForward, 0)
+			defer f.recoverPanic()
+
+			f.resolveAllowedHostnames(logger)
+		}()
+	}
+
+	return false
+}
+
+// resolveAllowedHostnames caches the addresses allowed hostnames
+// currently resolve to for verifyForwardCacheTime.
+func (f *filter) resolveAllowedHostnames(logger *zap.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), verifyForwardTimeout)
+	defer cancel()
+
+	network := lookupNetwork(f.opts.IPVersion)
+
+	f.hostnamesMtx.RLock()
+	hostnames := f.opts.AllowedHostnames
+	f.hostnamesMtx.RUnlock()
+
+	for _, hostname := range hostnames {
+		addrs, err := f.lookupNetIP(ctx, network, hostname)
+		if err != nil {
+			var dnsErr *net.DNSError
+			if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+				logger.Warn("error resolving hostname", zap.String("hostname", hostname), zap.NamedError("error", err))
+			}
+			continue
+		}
+
+		for _, addr := range addrs {
+			logger.Debug("verified IP from forward lookup", zap.String("hostname", hostname), zap.Stringer("ip", addr))
+			f.verifiedIPs.AddEntry(addr, verifyForwardCacheTime)
+			if addr.Is4In6() {
+				f.verifiedIPs.AddEntry(addr.Unmap(), verifyForwardCacheTime)
+			}
+		}
+	}
 }
 
 func (f *filter) lookupAndValidateIP(logger *zap.Logger, ip netip.Addr) (bool, error) {
+	// forward confirming a reverse lookup takes two lookups, make
+	// them in the background so the queue isn't blocked
+	if f.opts.FCrDNS {
+		f.lookupInBackground(logger, ip)
+		return false, nil
+	}
+
+	return f.reverseLookup(logger, ip)
+}
+
+// reverseLookup allows ip if a reverse lookup of it returns an allowed
+// hostname, and returns true if it does.
+func (f *filter) reverseLookup(logger *zap.Logger, ip netip.Addr) (bool, error) {
+	// don't queue lookups when the limit is reached, otherwise
+	// packets to many unknown IPs would tie up every lookup
+	if f.lookupSem != nil {
+		select {
+		case f.lookupSem <- struct{}{}:
+			defer func() { <-f.lookupSem }()
+		default:
+			logger.Warn("not preforming reverse IP lookup as too many are in progress", zap.Stringer("ip", ip), zap.Int("lookups.max", cap(f.lookupSem)))
+			return false, nil
+		}
+	}
+
 	logger.Info("preforming reverse IP lookup", zap.Stringer("ip", ip))
-	names, err := net.LookupAddr(ip.String())
+	names, err := f.lookupAddr(context.Background(), ip.String())
 	if err != nil {
 		// don't return error if IP simply couldn't be found
 		var dnsErr *net.DNSError
@@ -746,8 +3277,16 @@ func (f *filter) lookupAndValidateIP(logger *zap.Logger, ip netip.Addr) (bool, e
 		}
 
 		if f.hostnameAllowed(names[i]) {
+			if f.opts.FCrDNS && !f.forwardConfirmed(logger, ip, names[i]) {
+				logger.Info("not allowing IP whose reverse lookup wasn't forward confirmed", zap.Stringer("ip", ip), zap.String("hostname", names[i]))
+				continue
+			}
+
 			logger.Info("allowing IP after reverse lookup", zap.Stringer("ip", ip), zap.Duration("ttl", ttl))
-			f.allowedIPs.AddEntry(ip, ttl)
+			f.allowIPBy(ip, allowedByReverseLookup, ttl)
+			f.addProvenance(ip, names[i], ttl)
+			f.mirrorAllowedIP(ip, stateSourceReverseDNS, names[i], ttl)
+			f.checkAllowedIPsThreshold(logger)
 			return true, nil
 		}
 	}
@@ -755,7 +3294,17 @@ func (f *filter) lookupAndValidateIP(logger *zap.Logger, ip netip.Addr) (bool, e
 	return false, nil
 }
 
+// hasBreakGlassMark returns true if a packet has the break-glass mark
+// and should be accepted without being filtered. Packets are never
+// accepted if the break-glass mark is 0, as that is the mark of
+// unmarked packets.
+func hasBreakGlassMark(attr nfqueue.Attribute, breakGlassMark uint32) bool {
+	return breakGlassMark != 0 && attr.Mark != nil && *attr.Mark == breakGlassMark
+}
+
 func newErrorCallback(logger *zap.Logger) nfqueue.ErrorFunc {
+	limiter := newErrorLimiter(errorLogInterval)
+
 	return func(err error) int {
 		// skip noisy errors that aren't important when exiting
 		var nerr *netlink.OpError
@@ -766,7 +3315,7 @@ func newErrorCallback(logger *zap.Logger) nfqueue.ErrorFunc {
 			}
 		}
 
-		logger.Error("netlink error", zap.NamedError("error", err))
+		limiter.log(logger, "netlink error", err)
 
 		return 0
 	}
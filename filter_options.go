@@ -0,0 +1,108 @@
+package main
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// FilterOption sets options of a filter created by NewFilterOptions.
+type FilterOption func(*FilterOptions)
+
+// NewFilterOptions returns the options of a filter named name with
+// opts applied. The options are validated and transformed the same way
+// filters of config files are, so invalid combinations of options
+// return the same errors they would when parsing a config file.
+func NewFilterOptions(name string, opts ...FilterOption) (*FilterOptions, error) {
+	// filters of config files process only IPv4 by default
+	filterOpts := FilterOptions{Name: name, IPVersion: 4}
+	for _, opt := range opts {
+		opt(&filterOpts)
+	}
+
+	// a self-filter is created from the config of filters that need
+	// one, so the options can't be invalid because of it
+	return validateFilterOptions(zap.NewNop(), true, &filterOpts)
+}
+
+// needsSelfFilter returns true if the filter makes DNS requests that
+// must be allowed by a self-filter. It is used both when parsing
+// configs and when adding filters at runtime so they always agree.
+func (f *FilterOptions) needsSelfFilter() bool {
+	return f.LookupUnknownIPs || len(f.CachedHostnames) > 0 || (f.VerifyForward && len(f.AllowedHostnames) > 0) || len(f.DNSBLZones) > 0 || urlHostname(f.AllowedHostnamesURL) != ""
+}
+
+// WithDNSQueue sets the nfqueue DNS requests are filtered on.
+func WithDNSQueue(queue uint16) FilterOption {
+	return func(f *FilterOptions) {
+		f.DNSQueue = queue
+	}
+}
+
+// WithTrafficQueue sets the nfqueue traffic is filtered on.
+func WithTrafficQueue(queue uint16) FilterOption {
+	return func(f *FilterOptions) {
+		f.TrafficQueue = queue
+	}
+}
+
+// WithIPVersion sets the IP version of the filter, 0 filters both
+// IPv4 and IPv6.
+func WithIPVersion(version int) FilterOption {
+	return func(f *FilterOptions) {
+		f.IPVersion = version
+	}
+}
+
+// WithAllowedHostnames adds hostnames that DNS requests are allowed
+// for.
+func WithAllowedHostnames(hostnames ...string) FilterOption {
+	return func(f *FilterOptions) {
+		f.AllowedHostnames = append(f.AllowedHostnames, hostnames...)
+	}
+}
+
+// WithAllowAllHostnames allows DNS requests for any hostname.
+func WithAllowAllHostnames() FilterOption {
+	return func(f *FilterOptions) {
+		f.AllowAllHostnames = true
+	}
+}
+
+// WithAllowAnswersFor sets how long IPs from DNS answers are allowed.
+func WithAllowAnswersFor(d time.Duration) FilterOption {
+	return func(f *FilterOptions) {
+		f.AllowAnswersFor = duration(d)
+	}
+}
+
+// WithCachedHostnames adds hostnames that are resolved and whose IPs
+// are allowed, and sets how often they are resolved again.
+func WithCachedHostnames(reCacheEvery time.Duration, hostnames ...string) FilterOption {
+	return func(f *FilterOptions) {
+		f.CachedHostnames = append(f.CachedHostnames, hostnames...)
+		f.ReCacheEvery = duration(reCacheEvery)
+	}
+}
+
+// WithLookupUnknownIPs allows traffic to IPs whose reverse lookups
+// resolve to allowed hostnames.
+func WithLookupUnknownIPs() FilterOption {
+	return func(f *FilterOptions) {
+		f.LookupUnknownIPs = true
+	}
+}
+
+// WithAllowedSrcPorts adds source ports traffic is allowed from.
+func WithAllowedSrcPorts(ports ...uint16) FilterOption {
+	return func(f *FilterOptions) {
+		f.AllowedSrcPorts = append(f.AllowedSrcPorts, ports...)
+	}
+}
+
+// WithAllowedDstPorts adds destination ports traffic is allowed to.
+func WithAllowedDstPorts(ports ...uint16) FilterOption {
+	return func(f *FilterOptions) {
+		f.AllowedDstPorts = append(f.AllowedDstPorts, ports...)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"go.uber.org/zap"
+)
+
+func TestNewFilterOptions(t *testing.T) {
+	is := is.New(t)
+
+	opts, err := NewFilterOptions("foo",
+		WithDNSQueue(1),
+		WithTrafficQueue(2),
+		WithAllowAnswersFor(5*time.Second),
+		WithAllowedHostnames("foo.com", "www.foo.com"),
+		WithCachedHostnames(time.Minute, "bar.org"),
+		WithAllowedDstPorts(443),
+	)
+	is.NoErr(err)
+	is.Equal(opts.Name, "foo")                              // name should be set
+	is.Equal(opts.DNSQueue, uint16(1))                      // queues should be kept even if they are usually used by other queues
+	is.Equal(opts.AllowAnswersFor, duration(5*time.Second)) // durations should be kept
+	is.Equal(opts.ReCacheEvery, duration(time.Minute))      // durations should be kept
+	is.Equal(opts.AllowedHostnames, []string{"foo.com"})    // options should be transformed like filters in config files
+	is.Equal(opts.CachedHostnames, []string{"bar.org"})     // cached hostnames should be kept
+	is.Equal(opts.AllowedDstPorts, []uint16{443})           // ports should be kept
+	is.Equal(opts.IPVersion, 4)                             // IP version should default to IPv4
+	is.True(opts.needsSelfFilter())                         // cached hostnames need a self-filter
+}
+
+func TestNewFilterOptionsInvalid(t *testing.T) {
+	tests := []struct {
+		name      string
+		filterStr string
+		opts      []FilterOption
+	}{
+		{
+			name: "allowAnswersFor not set",
+			filterStr: `
+dnsQueue = 1000
+trafficQueue = 1001
+allowedHostnames = ["foo.com"]`,
+			opts: []FilterOption{
+				WithDNSQueue(1000),
+				WithTrafficQueue(1001),
+				WithAllowedHostnames("foo.com"),
+			},
+		},
+		{
+			name: "allowAllHostnames and allowedHostnames set",
+			filterStr: `
+dnsQueue = 1000
+allowAllHostnames = true
+allowedHostnames = ["foo.com"]`,
+			opts: []FilterOption{
+				WithDNSQueue(1000),
+				WithAllowAllHostnames(),
+				WithAllowedHostnames("foo.com"),
+			},
+		},
+		{
+			name: "allowedDstPorts set and trafficQueue not set",
+			filterStr: `
+dnsQueue = 1000
+allowAllHostnames = true
+allowedDstPorts = [443]`,
+			opts: []FilterOption{
+				WithDNSQueue(1000),
+				WithAllowAllHostnames(),
+				WithAllowedDstPorts(443),
+			},
+		},
+		{
+			name: "same queues",
+			filterStr: `
+dnsQueue = 1000
+trafficQueue = 1000
+allowAnswersFor = "5s"
+allowedHostnames = ["foo.com"]`,
+			opts: []FilterOption{
+				WithDNSQueue(1000),
+				WithTrafficQueue(1000),
+				WithAllowAnswersFor(5 * time.Second),
+				WithAllowedHostnames("foo.com"),
+			},
+		},
+		{
+			name: "invalid IP version",
+			filterStr: `
+dnsQueue = 1000
+ipVersion = 5
+allowAllHostnames = true`,
+			opts: []FilterOption{
+				WithDNSQueue(1000),
+				WithIPVersion(5),
+				WithAllowAllHostnames(),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+
+			_, configErr := parseConfigBytes(zap.NewNop(), []byte("inboundDNSQueue = 1\n\n[[filters]]\nname = \"foo\""+tt.filterStr))
+			is.True(configErr != nil) // config should be invalid
+
+			_, err := NewFilterOptions("foo", tt.opts...)
+			is.True(err != nil)                      // options should be invalid
+			is.Equal(err.Error(), configErr.Error()) // options should be rejected the same way as config files
+		})
+	}
+}
@@ -1,13 +1,29 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/florianl/go-nfqueue"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/matryer/is"
+	"github.com/mdlayher/netlink"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/sys/unix"
 )
 
 func TestFiltering(t *testing.T) {
@@ -71,6 +87,39 @@ allowedHostnames = [
 	is.True(reqFailed(err)) // request to expired IP should fail
 }
 
+func TestTrafficConntrackDisabled(t *testing.T) {
+	configStr := `
+inboundDNSQueue = 1
+ipv6 = false
+
+[[filters]]
+name = "test"
+dnsQueue = 1000
+trafficQueue = 1001
+trafficConntrack = false
+ipv6 = false
+allowAnswersFor = "3s"
+allowedHostnames = ["google.com"]`
+
+	client, stop := initFilters(
+		t,
+		configStr,
+		"-A INPUT -p udp --sport 53 -j NFQUEUE --queue-num 1",
+		"-A OUTPUT -p udp --dport 53 -j NFQUEUE --queue-num 1000",
+		"-A OUTPUT -p tcp --dport 443 -m state --state NEW -j NFQUEUE --queue-num 1001",
+	)
+	defer stop()
+
+	is := is.New(t)
+
+	resp, err := client.Get("https://google.com")
+	is.NoErr(err) // request to allowed hostname should succeed without conntrack state
+	resp.Body.Close()
+
+	_, err = client.Get("https://microsoft.com")
+	is.True(reqFailed(err)) // request to disallowed hostname should fail without conntrack state
+}
+
 func TestAllowAll(t *testing.T) {
 	configStr := `
 inboundDNSQueue = 1
@@ -97,6 +146,261 @@ allowAllHostnames = true`
 	resp.Body.Close()
 }
 
+func TestAllowAllUntracked(t *testing.T) {
+	configStr := `
+inboundDNSQueue = 1
+ipv6 = false
+
+[[filters]]
+name = "test"
+dnsQueue = 1000
+ipv6 = false
+allowAllHostnames = true
+untrackedConnections = true`
+
+	client, stop := initFilters(
+		t,
+		configStr,
+		"-A INPUT -p udp --sport 53 -j NFQUEUE --queue-num 1",
+		"-A OUTPUT -p udp --dport 53 -j NFQUEUE --queue-num 1000",
+	)
+	defer stop()
+
+	is := is.New(t)
+
+	resp, err := client.Get("https://harmony.shinesparkers.net")
+	is.NoErr(err) // request to hostname should succeed without tracking connections
+	resp.Body.Close()
+}
+
+func TestBreakGlassMark(t *testing.T) {
+	configStr := `
+inboundDNSQueue = 1
+breakGlassMark = 153
+ipv6 = false
+
+[[filters]]
+name = "test"
+dnsQueue = 1000
+trafficQueue = 1001
+ipv6 = false
+allowAnswersFor = "3s"
+allowedHostnames = ["google.com"]`
+
+	client, stop := initFilters(
+		t,
+		configStr,
+		"-A INPUT -p udp --sport 53 -j NFQUEUE --queue-num 1",
+		"-A OUTPUT -p udp --dport 53 -j NFQUEUE --queue-num 1000",
+		"-A OUTPUT -p tcp --dport 443 -m state --state NEW -j NFQUEUE --queue-num 1001",
+	)
+	defer stop()
+
+	is := is.New(t)
+
+	_, err := client.Get("https://microsoft.com")
+	is.True(reqFailed(err)) // request to disallowed hostname should fail
+
+	// mark all packets so they bypass filtering
+	iptablesCmd(t, "-I INPUT -j MARK --set-mark 153")
+	iptablesCmd(t, "-I OUTPUT -j MARK --set-mark 153")
+
+	resp, err := client.Get("https://microsoft.com")
+	is.NoErr(err) // request to disallowed hostname with break-glass mark should succeed
+	resp.Body.Close()
+}
+
+func TestPause(t *testing.T) {
+	configStr := `
+inboundDNSQueue = 1
+ipv6 = false
+
+[[filters]]
+name = "test"
+dnsQueue = 1000
+trafficQueue = 1001
+ipv6 = false
+allowAnswersFor = "3s"
+allowedHostnames = ["google.com"]`
+
+	iptablesCmd(t, "-F")
+	iptablesCmd(t, "-A INPUT -p udp --sport 53 -j NFQUEUE --queue-num 1")
+	iptablesCmd(t, "-A OUTPUT -p udp --dport 53 -j NFQUEUE --queue-num 1000")
+	iptablesCmd(t, "-A OUTPUT -p tcp --dport 443 -m state --state NEW -j NFQUEUE --queue-num 1001")
+	defer iptablesCmd(t, "-F")
+
+	is := is.New(t)
+
+	config, err := parseConfigBytes(zap.NewNop(), []byte(configStr))
+	is.NoErr(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	filters, err := StartFilters(ctx, zap.NewNop(), config)
+	is.NoErr(err)
+	defer filters.Stop()
+
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+		},
+	}
+
+	resp, err := client.Get("https://google.com")
+	is.NoErr(err) // request to allowed hostname should succeed
+	resp.Body.Close()
+
+	filters.Pause()
+	is.True(filters.Status().Paused) // egress should be paused
+
+	_, err = client.Get("https://google.com")
+	is.True(reqFailed(err)) // request to allowed hostname should fail while paused
+
+	filters.Resume()
+	is.True(!filters.Status().Paused) // egress should be resumed
+
+	resp, err = client.Get("https://google.com")
+	is.NoErr(err) // request to allowed hostname should succeed after resuming
+	resp.Body.Close()
+}
+
+func TestAddFilter(t *testing.T) {
+	configStr := `
+inboundDNSQueue = 1
+ipv6 = false
+
+[[filters]]
+name = "test"
+dnsQueue = 1000
+ipv6 = false
+allowAllHostnames = true`
+
+	iptablesCmd(t, "-F")
+	iptablesCmd(t, "-A INPUT -p udp --sport 53 -j NFQUEUE --queue-num 1")
+	iptablesCmd(t, "-A OUTPUT -p udp --dport 53 -j NFQUEUE --queue-num 1000")
+	defer iptablesCmd(t, "-F")
+
+	is := is.New(t)
+
+	config, err := parseConfigBytes(zap.NewNop(), []byte(configStr))
+	is.NoErr(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	filters, err := StartFilters(ctx, zap.NewNop(), config)
+	is.NoErr(err)
+	defer filters.Stop()
+
+	// keep DNS requests in flight while the filter is added
+	lookupErrs := make(chan error, 1)
+	stopLookups := make(chan struct{})
+	go func() {
+		defer close(lookupErrs)
+
+		for {
+			select {
+			case <-stopLookups:
+				return
+			default:
+			}
+
+			lookupCtx, lookupCancel := context.WithTimeout(ctx, 3*time.Second)
+			_, err := net.DefaultResolver.LookupNetIP(lookupCtx, "ip4", "harmony.shinesparkers.net")
+			lookupCancel()
+			if err != nil {
+				lookupErrs <- err
+				return
+			}
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	err = filters.AddFilter(ctx, &FilterOptions{
+		Name:              "added",
+		DNSQueue:          2000,
+		IPVersion:         4,
+		AllowAllHostnames: true,
+	})
+	is.NoErr(err) // filter should be added
+	time.Sleep(100 * time.Millisecond)
+	close(stopLookups)
+
+	is.NoErr(<-lookupErrs)                     // DNS requests in flight should not be affected
+	is.Equal(filters.Status().FiltersTotal, 2) // added filter should be running
+
+	err = filters.AddFilter(ctx, &FilterOptions{
+		Name:              "conflict",
+		DNSQueue:          1000,
+		IPVersion:         4,
+		AllowAllHostnames: true,
+	})
+	is.True(errors.Is(err, ErrQueueConflict)) // filters using queues that are in use should not be added
+
+	is.NoErr(filters.RemoveFilter("added")) // filter should be removed
+	err = filters.AddFilter(ctx, &FilterOptions{
+		Name:              "re-added",
+		DNSQueue:          2000,
+		IPVersion:         4,
+		AllowAllHostnames: true,
+	})
+	is.NoErr(err) // queue of removed filter should be reusable
+
+	// hold a queue with another FilterManager so starting a filter
+	// fails after its traffic queue was opened
+	otherConfig, err := parseConfigBytes(zap.NewNop(), []byte(`
+inboundDNSQueue = 3000
+ipv6 = false
+
+[[filters]]
+name = "other"
+dnsQueue = 3002
+ipv6 = false
+allowAllHostnames = true`))
+	is.NoErr(err)
+	other, err := StartFilters(ctx, zap.NewNop(), otherConfig)
+	is.NoErr(err)
+	defer other.Stop()
+
+	err = filters.AddFilter(ctx, &FilterOptions{
+		Name:             "failed",
+		DNSQueue:         3000,
+		TrafficQueue:     3001,
+		IPVersion:        4,
+		AllowedHostnames: []string{"example.com"},
+	})
+	is.True(err != nil)                        // filter using a queue of another process should fail to start
+	is.Equal(filters.Status().FiltersTotal, 2) // filter that failed to start should not be added
+	err = filters.AddFilter(ctx, &FilterOptions{
+		Name:             "after-failed",
+		DNSQueue:         3003,
+		TrafficQueue:     3001,
+		IPVersion:        4,
+		AllowedHostnames: []string{"example.com"},
+	})
+	is.NoErr(err) // queues opened by a filter that failed to start should be closed
+
+	addCtx, addCancel := context.WithCancel(ctx)
+	err = filters.AddFilter(addCtx, &FilterOptions{
+		Name:              "canceled",
+		DNSQueue:          4000,
+		IPVersion:         4,
+		AllowAllHostnames: true,
+	})
+	is.NoErr(err)
+	is.Equal(filters.Status().FiltersTotal, 4) // added filter should be running
+	addCancel()
+	for i := 0; i < 50 && filters.Status().FiltersTotal != 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	is.Equal(filters.Status().FiltersTotal, 3) // filter should be removed once its context is canceled
+	err = filters.AddFilter(ctx, &FilterOptions{
+		Name:              "canceled",
+		DNSQueue:          4000,
+		IPVersion:         4,
+		AllowAllHostnames: true,
+	})
+	is.NoErr(err) // queue of canceled filter should be reusable
+}
+
 func TestCaching(t *testing.T) {
 	configStr := `
 inboundDNSQueue = 1
@@ -144,15 +448,2066 @@ cachedHostnames = [
 	is.True(reqFailed(err)) // lookup of disallowed domain should fail
 }
 
-func reqFailed(err error) bool {
-	var dnsErr *net.DNSError
-	if errors.As(err, &dnsErr) {
-		return true
+func TestMultipleFilterManagers(t *testing.T) {
+	is := is.New(t)
+
+	newConfig := func(inboundQueue, dnsQueue, trafficQueue uint16) *Config {
+		config, err := parseConfigBytes(zap.NewNop(), []byte(fmt.Sprintf(`
+inboundDNSQueue = %d
+ipv6 = false
+
+[[filters]]
+name = "test"
+dnsQueue = %d
+trafficQueue = %d
+ipv6 = false
+allowAnswersFor = "10s"
+allowedHostnames = [
+	"example.com",
+]`, inboundQueue, dnsQueue, trafficQueue)))
+		is.NoErr(err) // config should be valid
+
+		return config
 	}
 
-	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-		return true
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f1, err := StartFilters(ctx, zap.NewNop(), newConfig(1, 1000, 1001))
+	is.NoErr(err) // first FilterManager should start
+	f2, err := StartFilters(ctx, zap.NewNop(), newConfig(2, 2000, 2001))
+	is.NoErr(err) // second FilterManager should start
+	defer f2.Stop()
+
+	addr := netip.MustParseAddr("192.0.2.1")
+	f1.filters[0].allowedIPs.AddEntry(addr, time.Minute)
+	is.True(f1.filters[0].allowedIPs.EntryExists(addr))  // IP should be allowed by first FilterManager
+	is.True(!f2.filters[0].allowedIPs.EntryExists(addr)) // IP should not be allowed by second FilterManager
+
+	// stopping one FilterManager should not affect the other
+	f1.Stop()
+	f2.filters[0].allowedIPs.AddEntry(addr, time.Minute)
+	is.True(f2.filters[0].allowedIPs.EntryExists(addr)) // second FilterManager should still be running
+}
+
+func TestDNSUpdate(t *testing.T) {
+	is := is.New(t)
+
+	update := &layers.DNS{
+		OpCode: layers.DNSOpCodeUpdate,
+		Questions: []layers.DNSQuestion{
+			{
+				Name:  []byte("example.com"),
+				Type:  layers.DNSTypeSOA,
+				Class: layers.DNSClassIN,
+			},
+		},
+		Authorities: []layers.DNSResourceRecord{
+			{
+				Name:  []byte("host.example.com"),
+				Type:  layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+				TTL:   300,
+				IP:    net.IPv4(192, 0, 2, 1),
+			},
+		},
 	}
 
-	return false
+	dns, _, err := parseDNSPacket(newDNSPacket(t, update), false, false, false)
+	is.NoErr(err)                                // parsing DNS update should succeed
+	is.Equal(dns.OpCode, layers.DNSOpCodeUpdate) // opcode should be parsed
+
+	f := newTestFilter(&FilterOptions{
+		AllowedHostnames: []string{"example.com"},
+	})
+	is.True(!f.validateDNSRequest(zap.NewNop(), dns, connectionID{})) // update should be dropped when updates aren't allowed
+
+	f.opts.AllowDNSUpdate = true
+	is.True(f.validateDNSRequest(zap.NewNop(), dns, connectionID{})) // update to allowed zone should be allowed
+
+	is.NoErr(f.updateAllowedHostnames([]string{"example.org"}))
+	is.True(!f.validateDNSRequest(zap.NewNop(), dns, connectionID{})) // update to disallowed zone should be dropped
+}
+
+func TestDNSOpcodeAndFlags(t *testing.T) {
+	is := is.New(t)
+
+	newRequest := func(opcode layers.DNSOpCode) *layers.DNS {
+		return &layers.DNS{
+			OpCode: opcode,
+			RD:     true,
+			Questions: []layers.DNSQuestion{
+				{
+					Name:  []byte("example.com"),
+					Type:  layers.DNSTypeA,
+					Class: layers.DNSClassIN,
+				},
+			},
+		}
+	}
+
+	f := newTestFilter(&FilterOptions{
+		AllowedHostnames: []string{"example.com"},
+	})
+
+	dns, _, err := parseDNSPacket(newDNSPacket(t, newRequest(layers.DNSOpCodeIQuery)), false, false, false)
+	is.NoErr(err)                                                    // parsing inverse query should succeed
+	is.Equal(dns.OpCode, layers.DNSOpCodeIQuery)                     // opcode should be parsed
+	is.True(f.validateDNSRequest(zap.NewNop(), dns, connectionID{})) // inverse query should be allowed by default
+	is.True(f.opcodeAllowed(layers.DNSOpCodeStatus))                 // status requests should be allowed by default
+
+	f.opts.RejectUnknownOpcodes = true
+	is.True(!f.validateDNSRequest(zap.NewNop(), dns, connectionID{})) // inverse query should be dropped when rejecting unknown opcodes
+	is.True(!f.opcodeAllowed(layers.DNSOpCodeStatus))                 // status requests should be dropped when rejecting unknown opcodes
+	is.True(f.opcodeAllowed(layers.DNSOpCodeQuery))                   // standard queries should always be allowed
+	f.opts.RejectUnknownOpcodes = false
+
+	request := newRequest(layers.DNSOpCodeQuery)
+	request.AA = true
+	request.Z = dnsZBitAD
+	dns, _, err = parseDNSPacket(newDNSPacket(t, request), false, false, false)
+	is.NoErr(err)
+	is.Equal(dnsFlags(dns), []string{"AA", "RD", "AD"})              // header flags should be parsed
+	is.True(f.validateDNSRequest(zap.NewNop(), dns, connectionID{})) // suspicious flags should be allowed by default
+
+	f.opts.RejectSuspiciousFlags = true
+	is.True(!f.validateDNSRequest(zap.NewNop(), dns, connectionID{})) // request with AA set should be dropped
+
+	dns.AA = false
+	is.True(f.validateDNSRequest(zap.NewNop(), dns, connectionID{})) // request with AD set should be allowed
+	dns.Z |= dnsZBitZ
+	is.True(!f.validateDNSRequest(zap.NewNop(), dns, connectionID{})) // request with reserved Z bit set should be dropped
+
+	response := &layers.DNS{QR: true, RD: true, RA: true}
+	is.Equal(suspiciousResponseFlags(response), "") // recursive response should be allowed
+	response.AA = true
+	is.True(suspiciousResponseFlags(response) != "") // authoritative recursive response should be dropped
+}
+
+func TestNoDataResponses(t *testing.T) {
+	is := is.New(t)
+
+	response := &layers.DNS{
+		QR:     true,
+		OpCode: layers.DNSOpCodeQuery,
+		RD:     true,
+		RA:     true,
+		Questions: []layers.DNSQuestion{
+			{
+				Name:  []byte("example.com"),
+				Type:  layers.DNSTypeAAAA,
+				Class: layers.DNSClassIN,
+			},
+		},
+	}
+	dns, connID, err := parseDNSPacket(newDNSPacket(t, response), false, true, false)
+	is.NoErr(err) // parsing NODATA response should succeed
+
+	f := newTestFilter(&FilterOptions{
+		AllowAnswersFor:  duration(time.Minute),
+		AllowedHostnames: []string{"example.com"},
+	})
+	t.Cleanup(f.close)
+
+	is.True(f.rcodeAllowed(dns.ResponseCode))                  // NODATA response should be accepted
+	is.True(f.validateDNSQuestions(zap.NewNop(), dns, connID)) // NODATA response should be accepted
+	is.True(f.countNoData(zap.NewNop(), dns))                  // NODATA response should be detected
+	is.Equal(f.status().NoDataResponses, int64(1))             // NODATA response should be counted
+	is.Equal(f.allowedIPs.Len(), 0)                            // NODATA response should not allow IPs
+
+	response.ResponseCode = layers.DNSResponseCodeNXDomain
+	dns, _, err = parseDNSPacket(newDNSPacket(t, response), false, true, false)
+	is.NoErr(err)
+	is.True(!f.countNoData(zap.NewNop(), dns))     // NXDOMAIN response should not be counted as NODATA
+	is.Equal(f.status().NoDataResponses, int64(1)) // only NODATA responses should be counted
+}
+
+func TestEDNSOptions(t *testing.T) {
+	is := is.New(t)
+
+	newRequest := func(options ...layers.DNSOPT) *layers.DNS {
+		return &layers.DNS{
+			OpCode: layers.DNSOpCodeQuery,
+			Questions: []layers.DNSQuestion{
+				{
+					Name:  []byte("example.com"),
+					Type:  layers.DNSTypeA,
+					Class: layers.DNSClassIN,
+				},
+			},
+			Additionals: []layers.DNSResourceRecord{
+				{
+					Type:  layers.DNSTypeOPT,
+					Class: 4096,
+					OPT:   options,
+				},
+			},
+		}
+	}
+	cookie := layers.DNSOPT{
+		Code: layers.DNSOptionCodeCookie,
+		Data: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	// a client subnet of 192.0.2.0/24
+	ecs := layers.DNSOPT{
+		Code: layers.DNSOptionCodeEDNSClientSubnet,
+		Data: []byte{0, 1, 24, 0, 192, 0, 2},
+	}
+
+	f := newTestFilter(&FilterOptions{
+		AllowedHostnames: []string{"example.com"},
+	})
+	dns, _, err := parseDNSPacket(newDNSPacket(t, newRequest(ecs)), false, false, false)
+	is.NoErr(err)                                                    // parsing DNS request should succeed
+	is.True(f.validateDNSRequest(zap.NewNop(), dns, connectionID{})) // all EDNS options should be allowed by default
+
+	f.opts.AllowedEDNSOptions = []string{"COOKIE"}
+	is.True(!f.validateDNSRequest(zap.NewNop(), dns, connectionID{})) // request with disallowed ECS option should be dropped
+
+	dns, _, err = parseDNSPacket(newDNSPacket(t, newRequest(cookie, ecs)), false, false, false)
+	is.NoErr(err)                                                     // parsing DNS request should succeed
+	is.True(!f.validateDNSRequest(zap.NewNop(), dns, connectionID{})) // request with any disallowed option should be dropped
+
+	dns, _, err = parseDNSPacket(newDNSPacket(t, newRequest(cookie)), false, false, false)
+	is.NoErr(err)                                                    // parsing DNS request should succeed
+	is.True(f.validateDNSRequest(zap.NewNop(), dns, connectionID{})) // request with only allowed options should be allowed
+
+	dns, _, err = parseDNSPacket(newDNSPacket(t, newRequest()), false, false, false)
+	is.NoErr(err)                                                    // parsing DNS request should succeed
+	is.True(f.validateDNSRequest(zap.NewNop(), dns, connectionID{})) // request without options should be allowed
+}
+
+func TestParseEncapsulatedDNS(t *testing.T) {
+	is := is.New(t)
+
+	query := &layers.DNS{
+		Questions: []layers.DNSQuestion{
+			{
+				Name:  []byte("example.com"),
+				Type:  layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+			},
+		},
+	}
+	packet := newDNSPacket(t, query,
+		&layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolGRE,
+			SrcIP:    net.IPv4(10, 0, 0, 1),
+			DstIP:    net.IPv4(10, 0, 0, 2),
+		},
+		&layers.GRE{
+			Protocol: layers.EthernetTypeIPv4,
+		},
+	)
+
+	_, _, err := parseDNSPacket(packet, false, false, false)
+	var encapErr *encapsulatedError
+	is.True(errors.As(err, &encapErr))             // GRE encapsulated packet should be rejected
+	is.Equal(encapErr.proto, layers.IPProtocolGRE) // encapsulation should be GRE
+
+	dns, connID, err := parseDNSPacket(packet, false, false, true)
+	is.NoErr(err)                                                                          // inner packet should be parsed
+	is.Equal(string(dns.Questions[0].Name), "example.com")                                 // question should be from inner packet
+	is.Equal(connID.dst, netip.AddrPortFrom(netip.AddrFrom4([4]byte{192, 168, 1, 1}), 53)) // connection should be from inner packet
+}
+
+func TestDNSTransport(t *testing.T) {
+	is := is.New(t)
+
+	query := &layers.DNS{
+		Questions: []layers.DNSQuestion{
+			{
+				Name:  []byte("example.com"),
+				Type:  layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+			},
+		},
+	}
+	_, connID, err := parseDNSPacket(newDNSPacket(t, query), false, false, false)
+	is.NoErr(err)         // parsing DNS query should succeed
+	is.True(connID.isUDP) // DNS query should be sent over UDP
+
+	f := newTestFilter(&FilterOptions{})
+	is.True(f.validDNSTransport(connID)) // UDP should be allowed by default
+
+	f.opts.DNSTransport = dnsTransportTCP
+	is.True(!f.validDNSTransport(connID)) // UDP should be dropped when TCP is required
+
+	f.opts.DNSTransport = dnsTransportUDP
+	is.True(f.validDNSTransport(connID)) // UDP should be allowed when UDP is required
+}
+
+func TestDNSAllowedSources(t *testing.T) {
+	is := is.New(t)
+
+	query := &layers.DNS{
+		OpCode: layers.DNSOpCodeQuery,
+		Questions: []layers.DNSQuestion{
+			{
+				Name:  []byte("example.com"),
+				Type:  layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+			},
+		},
+	}
+	_, connID, err := parseDNSPacket(newDNSPacket(t, query), false, false, false)
+	is.NoErr(err) // parsing DNS query should succeed
+
+	f := newTestFilter(&FilterOptions{})
+	is.True(f.validDNSSource(connID.src.Addr())) // requests from any source should be allowed by default
+
+	f.dnsAllowedSources = []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("fe80::/10"),
+	}
+	is.True(!f.validDNSSource(connID.src.Addr())) // request from out of scope source should be dropped
+
+	f.dnsAllowedSources = append(f.dnsAllowedSources, netip.MustParsePrefix("192.168.1.0/24"))
+	is.True(f.validDNSSource(connID.src.Addr()))                               // request from allowed source should be allowed
+	is.True(f.validDNSSource(netip.MustParseAddr("::ffff:10.1.2.3")))          // IPv4-mapped sources should be matched
+	is.True(f.validDNSSource(netip.MustParseAddr("fe80::1").WithZone("eth0"))) // zoned sources should be matched
+	is.True(!f.validDNSSource(netip.MustParseAddr("2001:db8::1")))             // IPv6 sources out of scope should be dropped
+}
+
+type fakeFlows map[connectionID]bool
+
+func (f fakeFlows) flowExists(connID connectionID) (bool, error) {
+	return f[connID], nil
+}
+
+func TestSaneHostname(t *testing.T) {
+	is := is.New(t)
+
+	for _, hostname := range []string{
+		"example.com",
+		"www.Example.COM",
+		"foo-bar.example.org",
+		"_sip._tcp.example.com",
+		"1.2.0.192.in-addr.arpa",
+		"localhost",
+		"xn--p1ai",
+		"example.xn--p1ai",
+	} {
+		is.True(saneHostname(hostname)) // valid hostname should be sane
+	}
+
+	for _, hostname := range []string{
+		"",
+		"example..com",
+		".example.com",
+		"example.com.",
+		"exa\x00mple.com",
+		"exa mple.com",
+		"ex\u00e4mple.com",
+		"-example.com",
+		"example-.com",
+		"example.c",
+		"example.123",
+		"example.c0m",
+		strings.Repeat("a", 64) + ".com",
+		strings.Repeat("a.", 127) + "com",
+	} {
+		is.True(!saneHostname(hostname)) // malformed hostname should not be sane
+	}
+
+	f := newTestFilter(&FilterOptions{
+		AllowedHostnames:      []string{"com"},
+		RejectSuspiciousNames: true,
+	})
+	dns := &layers.DNS{
+		QDCount: 1,
+		Questions: []layers.DNSQuestion{
+			{
+				Name:  []byte("bad\x01name.com"),
+				Type:  layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+			},
+		},
+	}
+	is.True(!f.validateDNSQuestions(zap.NewNop(), dns, connectionID{})) // suspicious question should be dropped even when allowed
+
+	f.opts.RejectSuspiciousNames = false
+	is.True(f.validateDNSQuestions(zap.NewNop(), dns, connectionID{})) // suspicious question should be allowed when not rejecting suspicious names
+}
+
+func TestHasBreakGlassMark(t *testing.T) {
+	is := is.New(t)
+
+	mark := func(m uint32) nfqueue.Attribute {
+		return nfqueue.Attribute{Mark: &m}
+	}
+
+	is.True(hasBreakGlassMark(mark(153), 153))            // packets with the break-glass mark should bypass filtering
+	is.True(!hasBreakGlassMark(mark(154), 153))           // packets with other marks should be filtered
+	is.True(!hasBreakGlassMark(nfqueue.Attribute{}, 153)) // packets without marks should be filtered
+	is.True(!hasBreakGlassMark(mark(0), 0))               // unmarked packets should be filtered if the break-glass mark is disabled
+}
+
+func TestValidPorts(t *testing.T) {
+	is := is.New(t)
+
+	f := newTestFilter(&FilterOptions{})
+	is.True(f.validPorts(40000, 443)) // any ports should be allowed when no ports are set
+
+	f.opts.AllowedDstPorts = []uint16{80, 443}
+	is.True(f.validPorts(40000, 443)) // allowed destination port should be allowed
+	is.True(!f.validPorts(40000, 22)) // disallowed destination port should be dropped
+
+	f.opts.AllowedSrcPorts = []uint16{40000}
+	is.True(f.validPorts(40000, 80)) // allowed source and destination ports should be allowed
+	is.True(!f.validPorts(1000, 80)) // disallowed source port should be dropped
+}
+
+func TestUDPResponseSize(t *testing.T) {
+	is := is.New(t)
+
+	resp := &layers.DNS{
+		QR:     true,
+		OpCode: layers.DNSOpCodeQuery,
+		Questions: []layers.DNSQuestion{
+			{
+				Name:  []byte("example.com"),
+				Type:  layers.DNSTypeTXT,
+				Class: layers.DNSClassIN,
+			},
+		},
+		Answers: []layers.DNSResourceRecord{
+			{
+				Name:  []byte("example.com"),
+				Type:  layers.DNSTypeTXT,
+				Class: layers.DNSClassIN,
+				TTL:   300,
+				TXTs:  [][]byte{bytes.Repeat([]byte("a"), 255), bytes.Repeat([]byte("b"), 255)},
+			},
+		},
+	}
+
+	dns, connID, err := parseDNSPacket(newDNSPacket(t, resp), false, true, false)
+	is.NoErr(err)                    // parsing DNS response should succeed
+	is.True(len(dns.Contents) > 512) // response should be larger than the limit
+
+	f := newTestFilter(&FilterOptions{})
+	is.True(f.validResponseSize(connID, dns)) // response smaller than the default limit should be allowed
+
+	f.opts.MaxUDPResponseSize = 512
+	is.True(!f.validResponseSize(connID, dns)) // oversized UDP response should be dropped
+
+	connID.isUDP = false
+	is.True(f.validResponseSize(connID, dns)) // TCP responses should not be limited
+}
+
+func TestQuestionCount(t *testing.T) {
+	is := is.New(t)
+
+	req := &layers.DNS{
+		OpCode: layers.DNSOpCodeQuery,
+		Questions: []layers.DNSQuestion{
+			{
+				Name:  []byte("example.com"),
+				Type:  layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+			},
+			{
+				Name:  []byte("example.com"),
+				Type:  layers.DNSTypeAAAA,
+				Class: layers.DNSClassIN,
+			},
+		},
+	}
+
+	dns, _, err := parseDNSPacket(newDNSPacket(t, req), false, false, false)
+	is.NoErr(err)                    // parsing DNS request should succeed
+	is.Equal(dns.QDCount, uint16(2)) // request should have 2 questions
+
+	f := newTestFilter(&FilterOptions{})
+	is.True(!f.validQuestionCount(dns)) // request with 2 questions should be dropped by default
+
+	f.opts.MaxQuestionsPerRequest = 1
+	is.True(!f.validQuestionCount(dns)) // request with more questions than the max should be dropped
+
+	f.opts.MaxQuestionsPerRequest = 2
+	is.True(f.validQuestionCount(dns)) // request should be allowed when the max is raised
+}
+
+func TestRcodeAllowed(t *testing.T) {
+	is := is.New(t)
+
+	resp := &layers.DNS{
+		QR:           true,
+		OpCode:       layers.DNSOpCodeQuery,
+		ResponseCode: layers.DNSResponseCodeServFail,
+		Questions: []layers.DNSQuestion{
+			{
+				Name:  []byte("example.com"),
+				Type:  layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+			},
+		},
+	}
+
+	dns, _, err := parseDNSPacket(newDNSPacket(t, resp), false, true, false)
+	is.NoErr(err) // parsing DNS response should succeed
+
+	f := newTestFilter(&FilterOptions{})
+	is.True(f.rcodeAllowed(layers.DNSResponseCodeNoErr))    // NOERROR should be allowed by default
+	is.True(f.rcodeAllowed(layers.DNSResponseCodeNXDomain)) // NXDOMAIN should be allowed by default
+	is.True(!f.rcodeAllowed(dns.ResponseCode))              // SERVFAIL should be dropped by default
+
+	f.opts.AllowedRcodes = []string{"NOERROR"}
+	is.True(f.rcodeAllowed(layers.DNSResponseCodeNoErr))     // response codes in the allowed set should be allowed
+	is.True(!f.rcodeAllowed(layers.DNSResponseCodeNXDomain)) // response codes not in the allowed set should be dropped
+
+	f.opts.AllowedRcodes = []string{"NOERROR", "SERVFAIL"}
+	is.True(f.rcodeAllowed(dns.ResponseCode)) // SERVFAIL should be allowed when in the allowed set
+}
+
+func TestAnswerRatio(t *testing.T) {
+	is := is.New(t)
+
+	resp := &layers.DNS{
+		QR:     true,
+		OpCode: layers.DNSOpCodeQuery,
+		Questions: []layers.DNSQuestion{
+			{
+				Name:  []byte("example.com"),
+				Type:  layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+			},
+		},
+	}
+	for i := 0; i < 100; i++ {
+		resp.Answers = append(resp.Answers, layers.DNSResourceRecord{
+			Name:  []byte("example.com"),
+			Type:  layers.DNSTypeA,
+			Class: layers.DNSClassIN,
+			TTL:   300,
+			IP:    net.IP{192, 0, 2, byte(i)},
+		})
+	}
+
+	dns, _, err := parseDNSPacket(newDNSPacket(t, resp), false, true, false)
+	is.NoErr(err)                      // parsing DNS response should succeed
+	is.Equal(dns.ANCount, uint16(100)) // response should have 100 answers
+
+	f := newTestFilter(&FilterOptions{})
+	is.True(f.validAnswerRatio(dns)) // response within the default limit should be allowed
+
+	f.opts.MaxAnswersPerQuestion = 10
+	is.True(!f.validAnswerRatio(dns)) // response exceeding the ratio should be dropped
+
+	dns.QDCount = 10
+	is.True(f.validAnswerRatio(dns)) // limit should scale with the amount of questions
+
+	dns.QDCount = 0
+	is.True(!f.validAnswerRatio(dns)) // responses without questions should be limited like one question
+}
+
+func TestRequestFilterStats(t *testing.T) {
+	is := is.New(t)
+
+	foo := newTestFilter(&FilterOptions{Name: "foo"})
+	t.Cleanup(foo.close)
+	bar := newTestFilter(&FilterOptions{Name: "bar"})
+	t.Cleanup(bar.close)
+	filters := []*filter{foo, bar}
+
+	connID := connectionID{
+		isUDP: true,
+		src:   netip.MustParseAddrPort("192.168.1.2:40000"),
+		dst:   netip.MustParseAddrPort("8.8.8.8:53"),
+	}
+	bar.connections.AddEntry(connID, dnsQueryTimeout)
+
+	is.Equal(requestFilter(filters, connID), bar) // filter that tracked the request should be matched
+	is.Equal(requestFilter(filters[:1], connID), nil)
+
+	fooStats := foo.connections.Stats()
+	barStats := bar.connections.Stats()
+	is.Equal(fooStats.Hits+fooStats.Misses, int64(0)) // scanning other filters should not count as lookups
+	is.Equal(barStats.Hits, int64(1))                 // matching filter should count a hit
+	is.Equal(barStats.Misses, int64(0))
+}
+
+func TestParallelRequests(t *testing.T) {
+	is := is.New(t)
+
+	foo := newTestFilter(&FilterOptions{Name: "foo", CorrelateParallelRequests: true})
+	foo.parallelRequests = NewTimedCache[parallelRequestKey](zap.NewNop(), false)
+	t.Cleanup(foo.close)
+	bar := newTestFilter(&FilterOptions{Name: "bar"})
+	t.Cleanup(bar.close)
+	filters := []*filter{bar, foo}
+
+	client := netip.MustParseAddrPort("192.168.1.2:40000")
+	firstConnID := connectionID{isUDP: true, src: client, dst: netip.MustParseAddrPort("8.8.8.8:53")}
+	secondConnID := connectionID{isUDP: true, src: client, dst: netip.MustParseAddrPort("8.8.4.4:53")}
+	dns := &layers.DNS{
+		ID:      1234,
+		QDCount: 1,
+		Questions: []layers.DNSQuestion{
+			{
+				Name:  []byte("example.com"),
+				Type:  layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+			},
+		},
+	}
+
+	// the client sends the same request to two resolvers, and the
+	// first response removes the first connection
+	for _, connID := range []connectionID{firstConnID, secondConnID} {
+		foo.connections.AddEntry(connID, dnsQueryTimeout)
+		foo.parallelRequests.AddEntry(newParallelRequestKey(connID, dns), dnsQueryTimeout)
+	}
+	foo.connections.RemoveEntry(firstConnID)
+	foo.connections.RemoveEntry(secondConnID)
+
+	is.Equal(requestFilter(filters, secondConnID), nil)                     // removed connection should not be matched
+	is.Equal(parallelRequestFilter(filters, secondConnID, dns), foo)        // response from other resolver should be matched by transaction
+	is.Equal(parallelRequestFilter(filters, firstConnID, dns), foo)         // responses from every resolver should be matched
+	is.Equal(parallelRequestFilter([]*filter{bar}, secondConnID, dns), nil) // filters not correlating requests should not match
+
+	otherID := *dns
+	otherID.ID = 4321
+	is.Equal(parallelRequestFilter(filters, secondConnID, &otherID), nil) // responses with other transaction IDs should not be matched
+
+	otherQuestion := *dns
+	otherQuestion.Questions = []layers.DNSQuestion{{Name: []byte("example.org"), Type: layers.DNSTypeA, Class: layers.DNSClassIN}}
+	is.Equal(parallelRequestFilter(filters, secondConnID, &otherQuestion), nil) // responses with other questions should not be matched
+
+	otherClient := secondConnID
+	otherClient.src = netip.MustParseAddrPort("192.168.1.3:40000")
+	is.Equal(parallelRequestFilter(filters, otherClient, dns), nil) // responses to other clients should not be matched
+
+	tcpConnID := secondConnID
+	tcpConnID.isUDP = false
+	is.Equal(parallelRequestFilter(filters, tcpConnID, dns), nil) // responses over other transports should not be matched
+}
+
+func TestReapConnections(t *testing.T) {
+	is := is.New(t)
+
+	f := newTestFilter(&FilterOptions{})
+	defer f.connections.Stop()
+
+	abandoned := connectionID{
+		isUDP: true,
+		src:   netip.MustParseAddrPort("192.168.1.2:40000"),
+		dst:   netip.MustParseAddrPort("192.168.1.1:53"),
+	}
+	active := connectionID{
+		isUDP: true,
+		src:   netip.MustParseAddrPort("192.168.1.2:40001"),
+		dst:   netip.MustParseAddrPort("192.168.1.1:53"),
+	}
+	f.connections.AddEntry(abandoned, dnsQueryTimeout)
+	f.connections.AddEntry(abandoned, dnsQueryTimeout)
+	f.connections.AddEntry(active, dnsQueryTimeout)
+	flows := fakeFlows{active: true}
+
+	missing := f.reapConnections(zap.NewNop(), flows, nil)
+	is.True(f.connections.EntryExists(abandoned)) // connection should not be reaped the first time it is missing
+
+	f.reapConnections(zap.NewNop(), flows, missing)
+	is.True(!f.connections.EntryExists(abandoned)) // abandoned connection should be reaped before timeout
+	is.True(f.connections.EntryExists(active))     // active connection should not be reaped
+}
+
+func TestAdditionalHostnames(t *testing.T) {
+	is := is.New(t)
+
+	f := newTestFilter(&FilterOptions{
+		AllowAnswersFor:  duration(time.Minute),
+		AllowedHostnames: []string{"example.com"},
+	})
+	defer f.additionalHostnames.Stop()
+
+	f.allowAnswers(zap.NewNop(), &layers.DNS{
+		Answers: []layers.DNSResourceRecord{
+			{
+				Name:  []byte("www.example.com"),
+				Type:  layers.DNSTypeCNAME,
+				Class: layers.DNSClassIN,
+				CNAME: []byte("cdn.example.net"),
+			},
+			{
+				Name:  []byte("_sip._tcp.example.com"),
+				Type:  layers.DNSTypeSRV,
+				Class: layers.DNSClassIN,
+				SRV: layers.DNSSRV{
+					Name: []byte("sip.example.org"),
+				},
+			},
+		},
+	}, connectionID{}, nil)
+	is.Equal(f.additionalHostnames.Stats().Len, 2) // CNAME and SRV hostnames should be added
+
+	hostnames := make(map[string]time.Time)
+	f.additionalHostnames.Range(func(hostname string, expires time.Time) bool {
+		hostnames[hostname] = expires
+		return true
+	})
+	is.Equal(len(hostnames), 2)                                        // all hostnames should be iterated over
+	is.True(time.Until(hostnames["cdn.example.net"]) > 50*time.Second) // CNAME hostname should expire after allowAnswersFor
+	is.True(!hostnames["sip.example.org"].IsZero())                    // SRV hostname should be iterated over
+	is.True(f.hostnameAllowed("cdn.example.net"))                      // CNAME hostname should be allowed
+	is.True(f.additionalHostnameAllowed("a.b.cdn.example.net"))        // subdomains of CNAME hostname should be allowed
+	is.True(!f.additionalHostnameAllowed("example.net"))               // parents of CNAME hostname should not be allowed
+	is.True(!f.additionalHostnameAllowed("othercdn.example.net"))      // hostnames only sharing a suffix should not be allowed
+
+	status := f.status()
+	is.Equal(status.AdditionalHostnames, 2) // status should count CNAME and SRV hostnames
+
+	var metrics strings.Builder
+	writeMetrics(&metrics, ManagerStatus{Filters: []FilterStatus{status}})
+	is.True(strings.Contains(metrics.String(), "\negress_eddie_additional_hostnames{filter=\"\"} 2\n")) // additional hostnames gauge should be written
+}
+
+func TestMinLabels(t *testing.T) {
+	is := is.New(t)
+
+	f := newTestFilter(&FilterOptions{
+		AllowedHostnames: []string{"co.uk", "www.example.com"},
+		MinLabels:        3,
+	})
+	is.True(!f.hostnameAllowed("co.uk"))                                        // allowed hostname with too few labels should not be allowed
+	is.True(!f.hostnameAllowed("example.co.uk"))                                // subdomain of allowed hostname with too few labels should not be allowed
+	is.True(f.hostnameAllowed("www.example.com"))                               // allowed hostname with enough labels should be allowed
+	is.True(f.hostnameAllowed("api.www.example.com"))                           // subdomain of allowed hostname with enough labels should be allowed
+	is.Equal(f.allowedHostnames.Load().(*hostnameTrie).hits("co.uk"), int64(0)) // allowed hostname with too few labels should not be counted as used
+
+	f.additionalHostnames.AddEntry("cdn.net", time.Minute)
+	f.additionalHostnames.AddEntry("eu.cdn.net", time.Minute)
+	is.True(!f.hostnameAllowed("cdn.net"))   // hostname from an answer with too few labels should not be allowed
+	is.True(f.hostnameAllowed("eu.cdn.net")) // hostname from an answer with enough labels should be allowed
+
+	is.Equal(labelCount(""), 0)
+	is.Equal(labelCount("."), 0)
+	is.Equal(labelCount("com"), 1)
+	is.Equal(labelCount("www.example.com."), 3)
+}
+
+func TestUpdateAllowedHostnames(t *testing.T) {
+	is := is.New(t)
+
+	f := newTestFilter(&FilterOptions{
+		AllowedHostnames: []string{"example.com"},
+	})
+	is.True(f.hostnameAllowed("www.example.com")) // initial hostname should be allowed
+
+	is.NoErr(f.updateAllowedHostnames([]string{"example.org", "www.example.org"}))
+	is.True(f.hostnameAllowed("www.example.org"))              // new hostname should be allowed immediately
+	is.True(!f.hostnameAllowed("www.example.com"))             // removed hostname should not be allowed
+	is.Equal(f.opts.AllowedHostnames, []string{"example.org"}) // redundant hostnames should be removed
+
+	err := f.updateAllowedHostnames([]string{"example.net", ""})
+	is.True(err != nil)                           // empty hostnames should not be allowed
+	is.True(f.hostnameAllowed("www.example.org")) // hostnames should not be updated on error
+}
+
+func TestValidateCNAMEs(t *testing.T) {
+	is := is.New(t)
+
+	f := newTestFilter(&FilterOptions{
+		AllowedHostnames:     []string{"example.com", "example.net"},
+		ValidateCNAMETargets: true,
+	})
+	f.additionalHostnames.AddEntry("cdn.example.org", time.Minute)
+	defer f.additionalHostnames.Stop()
+
+	cnameResp := func(target string) *layers.DNS {
+		return &layers.DNS{
+			Answers: []layers.DNSResourceRecord{
+				{
+					Name:  []byte("www.example.com"),
+					Type:  layers.DNSTypeCNAME,
+					Class: layers.DNSClassIN,
+					CNAME: []byte(target),
+				},
+			},
+		}
+	}
+
+	is.True(f.validateCNAMEs(zap.NewNop(), cnameResp("www.example.net")))    // CNAME to allowed hostname should be allowed
+	is.True(f.validateCNAMEs(zap.NewNop(), cnameResp("cdn.example.org")))    // CNAME to previously allowed CNAME should be allowed
+	is.True(f.validateCNAMEs(zap.NewNop(), cnameResp("a.cdn.example.org")))  // CNAME to subdomain of previously allowed CNAME should be allowed
+	is.True(!f.validateCNAMEs(zap.NewNop(), cnameResp("evil.attacker.com"))) // CNAME to non-allowed hostname should be dropped
+	is.True(!f.validateCNAMEs(zap.NewNop(), cnameResp("xcdn.example.org")))  // CNAME with suffix of previously allowed CNAME should be dropped
+}
+
+func TestAllowMappedIPs(t *testing.T) {
+	is := is.New(t)
+
+	f := newTestFilter(&FilterOptions{
+		AllowAnswersFor:  duration(time.Minute),
+		AllowedHostnames: []string{"example.com"},
+	})
+	defer f.allowedIPs.Stop()
+
+	f.allowAnswers(zap.NewNop(), &layers.DNS{
+		Answers: []layers.DNSResourceRecord{
+			{
+				Name:  []byte("example.com"),
+				Type:  layers.DNSTypeAAAA,
+				Class: layers.DNSClassIN,
+				IP:    net.ParseIP("::ffff:192.0.2.1"),
+			},
+		},
+	}, connectionID{}, nil)
+	is.True(f.allowedIPs.EntryExists(netip.MustParseAddr("::ffff:192.0.2.1"))) // IPv4-mapped IPv6 address should be allowed
+	is.True(f.allowedIPs.EntryExists(netip.MustParseAddr("192.0.2.1")))        // unmapped IPv4 address should be allowed
+}
+
+func TestZoneLinkLocal(t *testing.T) {
+	ifIndex := uint32(2)
+
+	tests := []struct {
+		addr     string
+		ifIndex  *uint32
+		expected string
+	}{
+		{"fe80::1", &ifIndex, "fe80::1%2"},
+		{"ff02::1", &ifIndex, "ff02::1%2"},
+		{"fe80::1", nil, "fe80::1"},
+		{"2001:db8::1", &ifIndex, "2001:db8::1"},
+		{"169.254.0.1", &ifIndex, "169.254.0.1"},
+		{"::ffff:169.254.0.1", &ifIndex, "::ffff:169.254.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			is := is.New(t)
+
+			addr := zoneLinkLocal(netip.MustParseAddr(tt.addr), tt.ifIndex)
+			is.Equal(addr, netip.MustParseAddr(tt.expected))
+		})
+	}
+}
+
+func TestLinkLocalPacket(t *testing.T) {
+	is := is.New(t)
+
+	f := newTestFilter(&FilterOptions{
+		AllowAnswersFor:  duration(time.Minute),
+		AllowedHostnames: []string{"example.com"},
+	})
+	defer f.allowedIPs.Stop()
+
+	// allow a link-local address from a DNS response received on
+	// interface 2
+	respIface := uint32(2)
+	f.allowAnswers(zap.NewNop(), &layers.DNS{
+		Answers: []layers.DNSResourceRecord{
+			{
+				Name:  []byte("example.com"),
+				Type:  layers.DNSTypeAAAA,
+				Class: layers.DNSClassIN,
+				IP:    net.ParseIP("fe80::1"),
+			},
+		},
+	}, connectionID{}, &respIface)
+
+	// build and parse an IPv6 packet to the link-local address the
+	// same way the generic callback does
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		&layers.IPv6{
+			Version:    6,
+			NextHeader: layers.IPProtocolUDP,
+			HopLimit:   64,
+			SrcIP:      net.ParseIP("fe80::2"),
+			DstIP:      net.ParseIP("fe80::1"),
+		},
+		&layers.UDP{
+			SrcPort: 1234,
+			DstPort: 5678,
+		},
+		gopacket.Payload("foo"),
+	)
+	is.NoErr(err) // error serializing packet
+
+	var ip6 layers.IPv6
+	err = ip6.DecodeFromBytes(buf.Bytes(), gopacket.NilDecodeFeedback)
+	is.NoErr(err) // error decoding packet
+	src, ok := netip.AddrFromSlice(ip6.SrcIP)
+	is.True(ok)
+	dst, ok := netip.AddrFromSlice(ip6.DstIP)
+	is.True(ok)
+
+	tests := []struct {
+		name     string
+		attr     nfqueue.Attribute
+		expected netip.Addr
+		allowed  bool
+	}{
+		{"same interface", nfqueue.Attribute{OutDev: &respIface}, netip.MustParseAddr("fe80::1%2"), true},
+		{"other interface", nfqueue.Attribute{OutDev: new(uint32)}, netip.MustParseAddr("fe80::1%0"), false},
+		{"inbound", nfqueue.Attribute{InDev: &respIface}, netip.MustParseAddr("fe80::1%2"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+
+			ifIndex := packetInterface(tt.attr)
+			zonedSrc := zoneLinkLocal(src, ifIndex)
+			zonedDst := zoneLinkLocal(dst, ifIndex)
+			is.Equal(zonedDst, tt.expected) // destination has the zone of the interface
+
+			mechanism, err := f.validateIPs(zap.NewNop(), zonedSrc, zonedDst)
+			is.NoErr(err)
+			is.Equal(mechanism != allowedByNone, tt.allowed) // link-local IP is only allowed on the interface the DNS response was received on
+		})
+	}
+}
+
+func TestLogMatchedRules(t *testing.T) {
+	is := is.New(t)
+
+	f := newTestFilter(&FilterOptions{
+		AllowedHostnames: []string{"example.com", "foo.example.org"},
+		LogMatchedRules:  true,
+	})
+	f.additionalHostnames.AddEntry("cdn.example.net", time.Minute)
+	defer f.additionalHostnames.Stop()
+
+	core, logs := observer.New(zap.InfoLevel)
+	f.logAllowedRequest(zap.New(core), &layers.DNS{
+		Questions: []layers.DNSQuestion{
+			{
+				Name:  []byte("www.example.com"),
+				Type:  layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+			},
+			{
+				Name:  []byte("bar.foo.example.org"),
+				Type:  layers.DNSTypeAAAA,
+				Class: layers.DNSClassIN,
+			},
+			{
+				Name:  []byte("cdn.example.net"),
+				Type:  layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+			},
+		},
+	})
+
+	entries := logs.FilterMessage("allowing DNS request").All()
+	is.Equal(len(entries), 1) // allowed request should be logged
+	is.Equal(entries[0].ContextMap()["matched_rule"], []interface{}{
+		"example.com",
+		"foo.example.org",
+		"cdn.example.net",
+	}) // allowed hostnames that matched should be logged
+}
+
+func TestQuietHostnames(t *testing.T) {
+	f := newTestFilter(&FilterOptions{
+		AllowedHostnames: []string{"example.com", "health.internal"},
+		QuietHostnames:   []string{"health.internal"},
+	})
+	defer f.additionalHostnames.Stop()
+
+	tests := []struct {
+		name      string
+		questions []string
+		quiet     bool
+	}{
+		{"quiet hostname", []string{"health.internal"}, true},
+		{"quiet subdomain", []string{"api.health.internal"}, true},
+		{"other hostname", []string{"example.com"}, false},
+		{"mixed hostnames", []string{"health.internal", "example.com"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+
+			dns := &layers.DNS{}
+			for _, question := range tt.questions {
+				dns.Questions = append(dns.Questions, layers.DNSQuestion{
+					Name:  []byte(question),
+					Type:  layers.DNSTypeA,
+					Class: layers.DNSClassIN,
+				})
+			}
+			dns.QDCount = uint16(len(dns.Questions))
+			is.True(f.validateDNSRequest(zap.NewNop(), dns, connectionID{})) // request should be allowed
+
+			core, logs := observer.New(zap.DebugLevel)
+			f.logAllowedRequest(zap.New(core), dns)
+
+			entries := logs.FilterMessage("allowing DNS request").All()
+			is.Equal(len(entries), 1) // allowed request should be logged
+			if tt.quiet {
+				is.Equal(entries[0].Level, zap.DebugLevel) // quiet request should be logged at debug level
+			} else {
+				is.Equal(entries[0].Level, zap.InfoLevel) // request should be logged at info level
+			}
+		})
+	}
+}
+
+func TestDisableDynamicHostnames(t *testing.T) {
+	is := is.New(t)
+
+	f := newTestFilter(&FilterOptions{
+		AllowAnswersFor:         duration(time.Minute),
+		AllowedHostnames:        []string{"example.com"},
+		DisableDynamicHostnames: true,
+	})
+	defer f.additionalHostnames.Stop()
+	defer f.allowedIPs.Stop()
+
+	f.allowAnswers(zap.NewNop(), &layers.DNS{
+		Answers: []layers.DNSResourceRecord{
+			{
+				Name:  []byte("www.example.com"),
+				Type:  layers.DNSTypeCNAME,
+				Class: layers.DNSClassIN,
+				CNAME: []byte("cdn.example.net"),
+			},
+			{
+				Name:  []byte("cdn.example.net"),
+				Type:  layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+				IP:    net.IPv4(192, 0, 2, 1).To4(),
+			},
+		},
+	}, connectionID{}, nil)
+	is.Equal(f.additionalHostnames.Stats().Len, 0)                      // CNAME hostname should not be added
+	is.True(!f.hostnameAllowed("cdn.example.net"))                      // CNAME hostname should not be allowed
+	is.True(f.hostnameAllowed("www.example.com"))                       // explicitly allowed hostname should be allowed
+	is.True(f.allowedIPs.EntryExists(netip.MustParseAddr("192.0.2.1"))) // IPs from answers should still be allowed
+}
+
+func TestMarkInheritance(t *testing.T) {
+	is := is.New(t)
+
+	f := newTestFilter(&FilterOptions{
+		AllowAnswersFor:    duration(time.Minute),
+		UseMarkInheritance: true,
+	})
+	f.connMarks = newConnectionMarks(zap.NewNop())
+	f.allowedMarks = NewTimedCache[uint32](zap.NewNop(), false)
+
+	connID := connectionID{
+		isUDP: true,
+		src:   netip.MustParseAddrPort("192.168.1.2:40000"),
+		dst:   netip.MustParseAddrPort("192.168.1.1:53"),
+	}
+	f.connMarks.add(connID, 0x20, time.Minute)
+	f.connMarks.add(connID, 0x10, time.Minute)
+	is.Equal(f.connMarks.len(), 1) // connection should only have its latest mark
+
+	f.allowConnMark(zap.NewNop(), connID)
+	is.True(f.allowedMarks.EntryExists(0x10))  // mark of DNS request should be allowed
+	is.Equal(f.connMarks.len(), 0)             // mark of connection should be removed
+	is.True(!f.allowedMarks.EntryExists(0x20)) // other marks should not be allowed
+}
+
+func TestValidateConntrackID(t *testing.T) {
+	is := is.New(t)
+
+	f := newTestFilter(&FilterOptions{
+		ValidateConntrackIDs: true,
+	})
+	f.conntrackIDs = NewTimedCache[conntrackFlow](zap.NewNop(), true)
+	defer f.conntrackIDs.Stop()
+
+	connID := connectionID{
+		isUDP: true,
+		src:   netip.MustParseAddrPort("192.168.1.2:40000"),
+		dst:   netip.MustParseAddrPort("192.168.1.1:53"),
+	}
+	f.conntrackIDs.AddEntry(conntrackFlow{connID: connID, ctID: 42}, time.Minute)
+
+	is.True(!f.validConntrackID(connID, nfqueue.Attribute{}))       // response without conntrack info should be dropped
+	is.True(!f.validConntrackID(connID, newConntrackAttr(t, 1337))) // response with mismatched conntrack ID should be dropped
+	is.True(f.validConntrackID(connID, newConntrackAttr(t, 42)))    // response with matching conntrack ID should be allowed
+	is.True(!f.validConntrackID(connID, newConntrackAttr(t, 42)))   // conntrack ID should only be valid for one response
+}
+
+// newConntrackAttr creates a nfqueue attribute with conntrack
+// information containing ctID.
+func newConntrackAttr(t *testing.T, ctID uint32) nfqueue.Attribute {
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	ae.Uint32(ctaID, ctID)
+	ct, err := ae.Encode()
+	if err != nil {
+		t.Fatalf("error encoding conntrack attributes: %v", err)
+	}
+
+	return nfqueue.Attribute{Ct: &ct}
+}
+
+func TestParseConntrackEvent(t *testing.T) {
+	is := is.New(t)
+
+	event, err := parseConntrackEvent(newConntrackEvent(t, ipctnlMsgCTNew, unix.IPPROTO_TCP, netip.MustParseAddr("192.0.2.1")))
+	is.NoErr(err)
+	is.Equal(event, conntrackEvent{proto: unix.IPPROTO_TCP, dst: netip.MustParseAddr("192.0.2.1")}) // new event should be parsed
+
+	event, err = parseConntrackEvent(newConntrackEvent(t, ipctnlMsgCTDelete, unix.IPPROTO_UDP, netip.MustParseAddr("2001:db8::1")))
+	is.NoErr(err)
+	is.Equal(event, conntrackEvent{destroy: true, proto: unix.IPPROTO_UDP, dst: netip.MustParseAddr("2001:db8::1")}) // destroy event should be parsed
+
+	_, err = parseConntrackEvent(netlink.Message{
+		Header: netlink.Header{Type: netlink.HeaderType(nfnlSubsysCTNetlink<<8 | ipctnlMsgCTGet)},
+	})
+	is.True(err != nil) // unknown message types should be rejected
+}
+
+func TestConntrackEvict(t *testing.T) {
+	is := is.New(t)
+
+	f := newTestFilter(&FilterOptions{
+		ConntrackEvict: true,
+	})
+	defer f.allowedIPs.Stop()
+
+	allowed := netip.MustParseAddr("192.0.2.1")
+	f.allowedIPs.AddEntry(allowed, time.Minute)
+	activeConns := make(map[netip.Addr]int)
+
+	newConn := conntrackEvent{proto: unix.IPPROTO_TCP, dst: allowed}
+	closedConn := conntrackEvent{destroy: true, proto: unix.IPPROTO_TCP, dst: allowed}
+
+	f.handleConntrackEvent(zap.NewNop(), activeConns, newConn)
+	f.handleConntrackEvent(zap.NewNop(), activeConns, newConn)
+	f.handleConntrackEvent(zap.NewNop(), activeConns, conntrackEvent{destroy: true, proto: unix.IPPROTO_UDP, dst: allowed})
+	is.Equal(activeConns[allowed], 2) // only TCP connections should be counted
+
+	f.handleConntrackEvent(zap.NewNop(), activeConns, closedConn)
+	is.True(f.allowedIPs.EntryExists(allowed)) // IP should be allowed while a connection is active
+
+	f.handleConntrackEvent(zap.NewNop(), activeConns, closedConn)
+	is.True(!f.allowedIPs.EntryExists(allowed)) // IP should be removed after its last connection closed
+	is.Equal(len(activeConns), 0)               // closed connections should not be tracked
+
+	// connections to IPs that weren't allowed shouldn't be tracked
+	f.handleConntrackEvent(zap.NewNop(), activeConns, conntrackEvent{proto: unix.IPPROTO_TCP, dst: netip.MustParseAddr("192.0.2.2")})
+	is.Equal(len(activeConns), 0)
+}
+
+// newConntrackEvent creates a conntrack event message for a connection
+// to dst.
+func newConntrackEvent(t *testing.T, msgType int, proto uint8, dst netip.Addr) netlink.Message {
+	family, srcType, dstType := uint8(unix.AF_INET), uint16(ctaIPv4Src), uint16(ctaIPv4Dst)
+	if dst.Is6() {
+		family, srcType, dstType = unix.AF_INET6, ctaIPv6Src, ctaIPv6Dst
+	}
+
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	ae.Nested(ctaTupleOrig, func(nae *netlink.AttributeEncoder) error {
+		nae.Nested(ctaTupleIP, func(nae *netlink.AttributeEncoder) error {
+			nae.Bytes(srcType, make([]byte, dst.BitLen()/8))
+			nae.Bytes(dstType, dst.AsSlice())
+			return nil
+		})
+		nae.Nested(ctaTupleProto, func(nae *netlink.AttributeEncoder) error {
+			nae.Uint8(ctaProtoNum, proto)
+			return nil
+		})
+		return nil
+	})
+	attrs, err := ae.Encode()
+	if err != nil {
+		t.Fatalf("error encoding conntrack attributes: %v", err)
+	}
+
+	return netlink.Message{
+		Header: netlink.Header{
+			Type: netlink.HeaderType(nfnlSubsysCTNetlink<<8 | msgType),
+		},
+		Data: append([]byte{family, nfnetlinkV0, 0, 0}, attrs...),
+	}
+}
+
+func TestUDPRetransmissions(t *testing.T) {
+	is := is.New(t)
+
+	f := newTestFilter(&FilterOptions{
+		AllowedHostnames: []string{"example.com"},
+	})
+	defer f.connections.Stop()
+	defer f.recentRequests.Stop()
+
+	connID := connectionID{
+		isUDP: true,
+		src:   netip.MustParseAddrPort("192.168.1.2:40000"),
+		dst:   netip.MustParseAddrPort("192.168.1.1:53"),
+	}
+	request := &layers.DNS{
+		ID: 1234,
+		Questions: []layers.DNSQuestion{
+			{
+				Name:  []byte("example.com"),
+				Type:  layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+			},
+		},
+	}
+
+	// the request callback allows the first request
+	is.True(!f.retransmission(connID, request)) // first request should not be a retransmission
+	f.connections.AddEntry(connID, dnsQueryTimeout)
+	f.trackRequest(connID, request)
+
+	// the request is retransmitted before a response arrives
+	is.True(f.retransmission(connID, request)) // retransmitted request should be detected
+
+	// the response callback removes the connection
+	is.True(f.connections.EntryExists(connID)) // response should match the request
+	f.connections.RemoveEntry(connID)
+	f.trackRequest(connID, request)
+
+	// a late retransmission arrives after the response
+	is.True(f.retransmission(connID, request))  // late retransmission should be detected
+	is.True(!f.connections.EntryExists(connID)) // duplicate response should not match a connection
+
+	// a request with a different ID or questions is a new request
+	newRequest := *request
+	newRequest.ID = 4321
+	is.True(!f.retransmission(connID, &newRequest)) // request with different ID should not be a retransmission
+	newRequest = *request
+	newRequest.Questions = []layers.DNSQuestion{
+		{
+			Name:  []byte("evil.com"),
+			Type:  layers.DNSTypeA,
+			Class: layers.DNSClassIN,
+		},
+	}
+	is.True(!f.retransmission(connID, &newRequest)) // request with different questions should not be a retransmission
+
+	// TCP requests are never retransmissions
+	tcpConnID := connID
+	tcpConnID.isUDP = false
+	f.trackRequest(tcpConnID, request)
+	is.True(!f.retransmission(tcpConnID, request)) // TCP request should not be a retransmission
+}
+
+func TestLoopbackExcluded(t *testing.T) {
+	disabled := false
+
+	tests := []struct {
+		name            string
+		excludeLoopback *bool
+		src             string
+		dst             string
+		excluded        bool
+	}{
+		{"IPv4 loopback", nil, "127.0.0.1", "127.0.0.53", true},
+		{"IPv6 loopback", nil, "::1", "::1", true},
+		{"loopback source", nil, "127.0.0.1", "192.0.2.1", false},
+		{"loopback destination", nil, "192.0.2.1", "127.0.0.1", false},
+		{"not loopback", nil, "192.0.2.1", "192.0.2.2", false},
+		{"disabled", &disabled, "127.0.0.1", "127.0.0.1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+
+			f := newTestFilter(&FilterOptions{
+				ExcludeLoopback: tt.excludeLoopback,
+			})
+			is.Equal(f.loopbackExcluded(netip.MustParseAddr(tt.src), netip.MustParseAddr(tt.dst)), tt.excluded)
+		})
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	is := is.New(t)
+
+	core, logs := observer.New(zap.InfoLevel)
+	stuck := newTestFilter(&FilterOptions{Name: "stuck"})
+	stuck.logger = zap.New(core)
+	stopped := newTestFilter(&FilterOptions{Name: "stopped"})
+
+	// simulate a callback of the filter that is stuck
+	unblock := make(chan struct{})
+	stuck.wg.Add(1)
+	go func() {
+		defer stuck.wg.Done()
+		<-unblock
+	}()
+	t.Cleanup(func() {
+		close(unblock)
+	})
+
+	f := FilterManager{
+		resolver:        newCachedResolver(zap.NewNop()),
+		cancel:          func() {},
+		shutdownTimeout: 50 * time.Millisecond,
+		logger:          zap.New(core),
+		filters:         []*filter{stuck, stopped},
+	}
+	start := time.Now()
+	f.Stop()
+	is.True(time.Since(start) < time.Second)                                           // Stop should return after the shutdown timeout even if a callback is stuck
+	is.Equal(logs.FilterMessage("forced shutdown of filter due to timeout").Len(), 1)  // only the stuck filter should be forcibly shutdown
+	is.Equal(logs.FilterMessage("forced shutdown of filters due to timeout").Len(), 1) // forced shutdown should be logged
+	is.Equal(logs.FilterMessage("filters stopped cleanly").Len(), 0)                   // shutdown should not be reported as clean
+}
+
+func TestShutdownTimeoutManagerStuck(t *testing.T) {
+	is := is.New(t)
+
+	core, logs := observer.New(zap.InfoLevel)
+	respNF := newFakeQueue()
+	f := FilterManager{
+		resolver:        newCachedResolver(zap.NewNop()),
+		cancel:          func() {},
+		shutdownTimeout: 50 * time.Millisecond,
+		logger:          zap.New(core),
+		dnsRespNF:       respNF,
+		filters:         []*filter{newTestFilter(&FilterOptions{Name: "foo"})},
+	}
+
+	// simulate a DNS response callback that is stuck
+	unblock := make(chan struct{})
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		<-unblock
+	}()
+	t.Cleanup(func() {
+		close(unblock)
+	})
+
+	start := time.Now()
+	f.Stop()
+	is.True(time.Since(start) < time.Second)                                           // Stop should return after the shutdown timeout even if the manager is stuck
+	is.Equal(logs.FilterMessage("forced shutdown of filters due to timeout").Len(), 1) // forced shutdown should be logged
+	is.Equal(logs.FilterMessage("filters stopped cleanly").Len(), 0)                   // shutdown should not be reported as clean
+}
+
+func TestCleanShutdown(t *testing.T) {
+	is := is.New(t)
+
+	core, logs := observer.New(zap.InfoLevel)
+	f := FilterManager{
+		resolver:        newCachedResolver(zap.NewNop()),
+		cancel:          func() {},
+		shutdownTimeout: time.Minute,
+		logger:          zap.New(core),
+		filters:         []*filter{newTestFilter(&FilterOptions{Name: "foo"})},
+	}
+	f.Stop()
+	is.Equal(logs.FilterMessage("filters stopped cleanly").Len(), 1) // clean shutdown should be logged
+	is.Equal(logs.Len(), 1)                                          // filters should not be forcibly shutdown
+}
+
+func TestVerifyForward(t *testing.T) {
+	is := is.New(t)
+
+	f := newTestFilter(&FilterOptions{
+		IPVersion:        4,
+		AllowedHostnames: []string{"example.com", "missing.example.org"},
+		VerifyForward:    true,
+	})
+	f.verifiedIPs = NewTimedCache[netip.Addr](zap.NewNop(), false)
+	defer f.verifiedIPs.Stop()
+
+	var lookups int
+	resolves := map[string][]netip.Addr{
+		"example.com": {netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("::ffff:192.0.2.2")},
+	}
+	f.lookupNetIP = func(_ context.Context, network, host string) ([]netip.Addr, error) {
+		lookups++
+		is.Equal(network, "ip4") // IPv4 addresses should be looked up
+
+		addrs, ok := resolves[host]
+		if !ok {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return addrs, nil
+	}
+
+	is.True(!f.verifyForward(zap.NewNop(), netip.MustParseAddr("192.0.2.1"))) // unknown IP should be dropped while it is looked up
+	f.wg.Wait()
+	is.Equal(lookups, 2)                                                     // every allowed hostname should be resolved
+	is.True(f.verifyForward(zap.NewNop(), netip.MustParseAddr("192.0.2.1"))) // IP an allowed hostname resolves to should be allowed
+	is.True(f.verifyForward(zap.NewNop(), netip.MustParseAddr("192.0.2.2"))) // unmapped IPv4 address should be allowed
+	is.Equal(lookups, 2)                                                     // verified IPs should be cached
+
+	is.True(!f.verifyForward(zap.NewNop(), netip.MustParseAddr("198.51.100.1"))) // IP no allowed hostname resolves to should be dropped
+	f.wg.Wait()
+	is.Equal(lookups, 4) // misses should not be cached
+
+	// a hostname that now resolves to a missed IP allows it right away
+	resolves["example.com"] = []netip.Addr{netip.MustParseAddr("198.51.100.1")}
+	is.True(!f.verifyForward(zap.NewNop(), netip.MustParseAddr("198.51.100.1")))
+	f.wg.Wait()
+	is.True(f.verifyForward(zap.NewNop(), netip.MustParseAddr("198.51.100.1"))) // IP an allowed hostname now resolves to should be allowed
+	is.Equal(lookups, 6)
+}
+
+func TestMaxConcurrentLookups(t *testing.T) {
+	is := is.New(t)
+
+	f := newTestFilter(&FilterOptions{
+		LookupUnknownIPs: true,
+		AllowAnswersFor:  duration(time.Minute),
+		AllowedHostnames: []string{"example.com"},
+	})
+	f.lookupSem = make(chan struct{}, 2)
+
+	var (
+		started = make(chan struct{}, 3)
+		release = make(chan struct{})
+		lookups int32
+	)
+	f.lookupAddr = func(_ context.Context, _ string) ([]string, error) {
+		atomic.AddInt32(&lookups, 1)
+		started <- struct{}{}
+		<-release
+		return []string{"example.com."}, nil
+	}
+
+	results := make(chan bool, 2)
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		ip := netip.MustParseAddr(ip)
+		go func() {
+			allowed, _ := f.lookupAndValidateIP(zap.NewNop(), ip)
+			results <- allowed
+		}()
+	}
+	<-started
+	<-started
+
+	allowed, err := f.lookupAndValidateIP(zap.NewNop(), netip.MustParseAddr("192.0.2.3"))
+	is.NoErr(err)
+	is.True(!allowed)                              // IPs should be dropped when too many lookups are in progress
+	is.Equal(atomic.LoadInt32(&lookups), int32(2)) // excess lookups should not be made
+
+	close(release)
+	is.True(<-results) // IPs being looked up should be allowed
+	is.True(<-results) // IPs being looked up should be allowed
+
+	allowed, err = f.lookupAndValidateIP(zap.NewNop(), netip.MustParseAddr("192.0.2.3"))
+	is.NoErr(err)
+	is.True(allowed) // IPs should be looked up once lookups finish
+}
+
+func TestAllowMechanism(t *testing.T) {
+	is := is.New(t)
+
+	f := newTestFilter(&FilterOptions{
+		LookupUnknownIPs: true,
+		AllowAnswersFor:  duration(time.Minute),
+		AllowedHostnames: []string{"example.com"},
+	})
+	f.lookupAddr = func(_ context.Context, addr string) ([]string, error) {
+		if addr == "198.51.100.1" {
+			return []string{"example.com."}, nil
+		}
+		return nil, &net.DNSError{IsNotFound: true}
+	}
+	t.Cleanup(func() {
+		f.allowedIPs.Stop()
+		f.ipMechanisms.Stop()
+	})
+
+	src := netip.MustParseAddr("192.168.1.2")
+	f.allowIP(zap.NewNop(), netip.MustParseAddr("192.0.2.1"), time.Minute)
+	f.cacheAddrs(zap.NewNop(), "example.com", []netip.Addr{netip.MustParseAddr("192.0.2.2")})
+
+	tests := []struct {
+		dst       string
+		mechanism allowMechanism
+	}{
+		{"192.0.2.1", allowedByDNSAnswer},
+		{"192.0.2.2", allowedByCachedLookup},
+		{"198.51.100.1", allowedByReverseLookup},
+		// the IP should stay allowed by the reverse lookup
+		{"198.51.100.1", allowedByReverseLookup},
+		{"198.51.100.2", allowedByNone},
+	}
+	for _, tt := range tests {
+		mechanism, err := f.validateIPs(zap.NewNop(), src, netip.MustParseAddr(tt.dst))
+		is.NoErr(err)
+		is.Equal(mechanism, tt.mechanism) // mechanism that allowed the IP should be reported
+	}
+
+	f.removeAllowedIP(netip.MustParseAddr("192.0.2.2"))
+	is.Equal(f.allowedBy(netip.MustParseAddr("192.0.2.2")), allowedByNone)                                                    // removed IPs should not be allowed
+	is.True(!f.ipMechanisms.EntryExists(ipMechanism{ip: netip.MustParseAddr("192.0.2.2"), mechanism: allowedByCachedLookup})) // mechanisms of removed IPs should be removed
+}
+
+func TestDNSBLQueryName(t *testing.T) {
+	is := is.New(t)
+
+	is.Equal(dnsblQueryName(netip.MustParseAddr("192.0.2.99"), "zen.spamhaus.org"), "99.2.0.192.zen.spamhaus.org") // IPv4 octets should be reversed
+	is.Equal(
+		dnsblQueryName(netip.MustParseAddr("2001:db8:1:2:3:4:567:89ab"), "dnsbl.example"),
+		"b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.8.b.d.0.1.0.0.2.dnsbl.example",
+	) // IPv6 nibbles should be reversed
+}
+
+func newTestFilter(opts *FilterOptions) *filter {
+	f := &filter{
+		opts:                opts,
+		recentDenies:        newDenyRing(defaultRecentDeniesSize),
+		recentLogs:          newLogRingCore(zapcore.DebugLevel, recentLogsSize),
+		logger:              zap.NewNop(),
+		connections:         NewTimedCache[connectionID](zap.NewNop(), true),
+		recentRequests:      NewTimedCache[dnsRequestKey](zap.NewNop(), false),
+		allowedIPs:          NewTimedCache[netip.Addr](zap.NewNop(), false),
+		ipMechanisms:        NewTimedCache[ipMechanism](zap.NewNop(), false),
+		additionalHostnames: NewTimedCache[string](zap.NewNop(), false),
+		hostnameSources:     NewTimedCache[sourcedHostname](zap.NewNop(), false),
+		quietHostnames:      newHostnameTrie(opts.QuietHostnames),
+		staticHostnames:     opts.AllowedHostnames,
+	}
+	f.allowedHostnames.Store(newHostnameTrie(opts.AllowedHostnames))
+
+	return f
+}
+
+// newDNSPacket serializes a UDP DNS packet, optionally encapsulated
+// by outer layers.
+func newDNSPacket(t testing.TB, dns *layers.DNS, outerLayers ...gopacket.SerializableLayer) []byte {
+	return newDNSPacketBetween(t, netip.MustParseAddrPort("192.168.1.2:40000"), netip.MustParseAddrPort("192.168.1.1:53"), dns, outerLayers...)
+}
+
+// newDNSPacketBetween serializes a UDP DNS packet from src to dst,
+// optionally encapsulated by outer layers. The packet is IPv6 if src
+// is an IPv6 address.
+func newDNSPacketBetween(t testing.TB, src, dst netip.AddrPort, dns *layers.DNS, outerLayers ...gopacket.SerializableLayer) []byte {
+	var ip interface {
+		gopacket.NetworkLayer
+		gopacket.SerializableLayer
+	}
+	if src.Addr().Is6() {
+		ip = &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: layers.IPProtocolUDP,
+			SrcIP:      src.Addr().AsSlice(),
+			DstIP:      dst.Addr().AsSlice(),
+		}
+	} else {
+		ip = &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolUDP,
+			SrcIP:    src.Addr().AsSlice(),
+			DstIP:    dst.Addr().AsSlice(),
+		}
+	}
+	udp := layers.UDP{
+		SrcPort: layers.UDPPort(src.Port()),
+		DstPort: layers.UDPPort(dst.Port()),
+	}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatalf("error setting network layer: %v", err)
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	pktLayers := append(outerLayers, ip, &udp, dns)
+	if err := gopacket.SerializeLayers(buf, opts, pktLayers...); err != nil {
+		t.Fatalf("error serializing packet: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+func reqFailed(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+
+	return false
+}
+
+func TestPacketIsIPv6(t *testing.T) {
+	is := is.New(t)
+
+	ipv4Packet := []byte{0x45, 0x00}
+	ipv6Packet := []byte{0x60, 0x00}
+
+	is.True(!packetIsIPv6(ipv6Packet, 4)) // IPv4 filters should always parse IPv4
+	is.True(packetIsIPv6(ipv4Packet, 6))  // IPv6 filters should always parse IPv6
+	is.True(!packetIsIPv6(ipv4Packet, 0)) // dual stack filters should detect IPv4
+	is.True(packetIsIPv6(ipv6Packet, 0))  // dual stack filters should detect IPv6
+	is.True(!packetIsIPv6(nil, 0))        // empty packets should not panic
+}
+
+func TestAllowedIPsThreshold(t *testing.T) {
+	is := is.New(t)
+
+	core, logs := observer.New(zap.WarnLevel)
+	logger := zap.New(core)
+	f := newTestFilter(&FilterOptions{
+		Name:                    "foo",
+		DNSQueue:                1000,
+		TrafficQueue:            1001,
+		WarnAllowedIPsThreshold: 10,
+	})
+	t.Cleanup(f.close)
+
+	addIPs := func(from, to int) {
+		for i := from; i < to; i++ {
+			f.allowedIPs.AddEntry(netip.AddrFrom4([4]byte{192, 0, 2, byte(i)}), time.Minute)
+		}
+		f.checkAllowedIPsThreshold(logger)
+	}
+	removeIPs := func(from, to int) {
+		for i := from; i < to; i++ {
+			f.allowedIPs.RemoveEntry(netip.AddrFrom4([4]byte{192, 0, 2, byte(i)}))
+		}
+		f.checkAllowedIPsThreshold(logger)
+	}
+
+	addIPs(0, 10)
+	is.Equal(logs.Len(), 0)                  // reaching the threshold should not be warned about
+	is.True(!f.status().AllowedIPsNearLimit) // filter should not be near the limit
+
+	addIPs(10, 11)
+	addIPs(11, 12)
+	is.Equal(logs.Len(), 1)                 // exceeding the threshold should only be warned about once
+	is.True(f.status().AllowedIPsNearLimit) // filter should be near the limit
+
+	removeIPs(9, 12)
+	is.True(f.status().AllowedIPsNearLimit) // filter should be near the limit until dropping below 90% of the threshold
+
+	removeIPs(8, 9)
+	is.True(!f.status().AllowedIPsNearLimit) // filter should no longer be near the limit
+
+	addIPs(8, 11)
+	is.Equal(logs.Len(), 2) // exceeding the threshold again should be warned about
+
+	// IPs expiring are only noticed by status until the threshold is
+	// checked again
+	for i := 0; i < 11; i++ {
+		f.allowedIPs.RemoveEntry(netip.AddrFrom4([4]byte{192, 0, 2, byte(i)}))
+	}
+	is.True(!f.status().AllowedIPsNearLimit)                     // status should account for IPs that expired
+	is.Equal(atomic.LoadInt32(&f.allowedIPsNearLimit), int32(1)) // status should not change the recorded state
+	is.Equal(logs.Len(), 2)                                      // status should not log
+}
+
+func TestConntrackStateAllowed(t *testing.T) {
+	state := func(s uint32) *uint32 {
+		return &s
+	}
+
+	tests := []struct {
+		testName string
+		opts     FilterOptions
+		ctInfo   *uint32
+		allowed  bool
+	}{
+		{
+			testName: "unknown state allowed",
+			ctInfo:   state(5),
+			allowed:  true,
+		},
+		{
+			testName: "missing state validated by default",
+			ctInfo:   nil,
+			allowed:  true,
+		},
+		{
+			testName: "missing state validated",
+			opts:     FilterOptions{OnMissingConntrack: missingConntrackValidate},
+			ctInfo:   nil,
+			allowed:  true,
+		},
+		{
+			testName: "missing state dropped",
+			opts:     FilterOptions{OnMissingConntrack: missingConntrackDrop},
+			ctInfo:   nil,
+			allowed:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			is := is.New(t)
+
+			f := newTestFilter(&tt.opts)
+			t.Cleanup(f.close)
+
+			is.Equal(f.conntrackStateAllowed(tt.ctInfo), tt.allowed) // packet should only be dropped because of its conntrack state when configured to
+		})
+	}
+}
+
+func TestStateName(t *testing.T) {
+	tests := []struct {
+		state uint32
+		name  string
+	}{
+		{state: stateEstablished, name: "ESTABLISHED"},
+		{state: stateRelated, name: "RELATED"},
+		{state: stateNew, name: "NEW"},
+		{state: stateEstablishedReply, name: "ESTABLISHED_REPLY"},
+		{state: stateRelatedReply, name: "RELATED_REPLY"},
+		{state: stateUntracked, name: "UNTRACKED"},
+		{state: 5, name: "UNKNOWN"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+
+			is.Equal(stateName(tt.state), tt.name) // conntrack state should be named like the kernel names it
+		})
+	}
+}
+
+func TestTrafficConntrack(t *testing.T) {
+	is := is.New(t)
+
+	conf := nfqueueConfig(1001, false, true)
+	is.Equal(conf.Flags, uint32(nfqueue.NfQaCfgFlagConntrack)) // conntrack flag should be set by default
+	conf = nfqueueConfig(1001, true, false)
+	is.Equal(conf.Flags, uint32(0)) // conntrack flag should be omitted when disabled
+	is.Equal(conf.AfFamily, uint8(unix.AF_INET6))
+
+	disabled := false
+	f := newTestFilter(&FilterOptions{
+		TrafficConntrack:   &disabled,
+		OnMissingConntrack: missingConntrackDrop,
+	})
+	is.True(f.trafficConntrackStateAllowed(nil)) // packets without conntrack state should be allowed when conntrack is disabled
+
+	f.opts.TrafficConntrack = nil
+	is.True(!f.trafficConntrackStateAllowed(nil)) // packets without conntrack state should be checked by default
+}
+
+func TestReloadFilterRestart(t *testing.T) {
+	is := is.New(t)
+
+	config, err := parseConfigBytes(zap.NewNop(), []byte(`
+inboundDNSQueue = 1
+ipv6 = false
+
+[[filters]]
+name = "test"
+dnsQueue = 1000
+trafficQueue = 1001
+ipv6 = false
+allowAnswersFor = "1m"
+allowedHostnames = ["example.com"]`))
+	is.NoErr(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	filters, err := StartFilters(ctx, zap.NewNop(), config)
+	is.NoErr(err)
+	defer filters.Stop()
+
+	running := filters.currentFilters()[0]
+	ip := netip.MustParseAddr("192.0.2.1")
+	running.allowIPBy(ip, allowedByCachedLookup, time.Minute)
+
+	err = filters.ReloadFilter(&FilterOptions{
+		Name:             "test",
+		DNSQueue:         1000,
+		TrafficQueue:     1002,
+		IPVersion:        4,
+		AllowAnswersFor:  duration(time.Minute),
+		AllowedHostnames: []string{"example.com"},
+	})
+	is.NoErr(err) // filter should be restarted with the new queue
+
+	current := filters.currentFilters()
+	is.Equal(len(current), 1) // restarted filter should replace the running filter
+	restarted := current[0]
+	is.True(restarted != running)                            // filter should be restarted
+	is.Equal(restarted.opts.TrafficQueue, uint16(1002))      // restarted filter should use the new queue
+	is.True(restarted.allowedIPs.EntryExists(ip))            // allowed IPs should be kept
+	is.Equal(restarted.allowedBy(ip), allowedByCachedLookup) // mechanisms of allowed IPs should be kept
+}
+
+func TestTakeOverCaches(t *testing.T) {
+	is := is.New(t)
+
+	old := newTestFilter(&FilterOptions{Name: "foo", TrafficQueue: 1001})
+	connID := connectionID{
+		isUDP: true,
+		src:   netip.MustParseAddrPort("192.168.1.2:40000"),
+		dst:   netip.MustParseAddrPort("192.168.1.1:53"),
+	}
+	old.connections.AddEntry(connID, time.Minute)
+	old.allowIPBy(netip.MustParseAddr("192.0.2.1"), allowedByCachedLookup, time.Minute)
+	old.allowIPBy(netip.MustParseAddr("192.0.2.2"), allowedByDNSAnswer, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond) // wait until the second IP should expire
+	// the caches of the restarted filter are copied after it is closed
+	old.close()
+
+	restarted := newTestFilter(&FilterOptions{Name: "foo", TrafficQueue: 1002})
+	t.Cleanup(restarted.close)
+	restarted.takeOverCaches(old)
+	is.True(restarted.connections.EntryExists(connID))                                     // tracked DNS connections should be copied
+	is.True(restarted.allowedIPs.EntryExists(netip.MustParseAddr("192.0.2.1")))            // allowed IPs should be copied
+	is.True(!restarted.allowedIPs.EntryExists(netip.MustParseAddr("192.0.2.2")))           // expired IPs should not be copied
+	is.Equal(restarted.allowedBy(netip.MustParseAddr("192.0.2.1")), allowedByCachedLookup) // mechanisms of allowed IPs should be copied
+}
+
+func TestAddFilterQueueConflict(t *testing.T) {
+	existing := newTestFilter(&FilterOptions{
+		Name:         "existing",
+		DNSQueue:     1000,
+		TrafficQueue: 1001,
+	})
+	t.Cleanup(existing.close)
+	f := FilterManager{
+		resolver: newCachedResolver(zap.NewNop()),
+		queueNum: 1,
+		logger:   zap.NewNop(),
+		filters:  []*filter{existing},
+	}
+
+	tests := []struct {
+		testName    string
+		opts        FilterOptions
+		expectedErr string
+	}{
+		{
+			testName:    "invalid options",
+			opts:        FilterOptions{DNSQueue: 2000, AllowAllHostnames: true},
+			expectedErr: `"name" must be set`,
+		},
+		{
+			testName:    "inbound DNS queue",
+			opts:        FilterOptions{Name: "foo", DNSQueue: 1, AllowAllHostnames: true},
+			expectedErr: `filter "foo": nfqueue is already in use: queue 1`,
+		},
+		{
+			testName:    "queue of existing filter",
+			opts:        FilterOptions{Name: "foo", DNSQueue: 1001, AllowAllHostnames: true},
+			expectedErr: `filter "foo": nfqueue is already in use: queue 1001`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			is := is.New(t)
+
+			err := f.AddFilter(context.Background(), &tt.opts)
+			is.Equal(err.Error(), tt.expectedErr) // filter should not be added
+			is.Equal(len(f.currentFilters()), 1)  // existing filters should not be changed
+		})
+	}
+}
+
+func TestRemoveFilter(t *testing.T) {
+	is := is.New(t)
+
+	selfFilter := newTestFilter(&FilterOptions{Name: selfFilterName, DNSQueue: 100})
+	selfFilter.isSelfFilter = true
+	t.Cleanup(selfFilter.close)
+	foo := newTestFilter(&FilterOptions{Name: "foo", DNSQueue: 1000, TrafficQueue: 1001})
+	bar := newTestFilter(&FilterOptions{Name: "bar", DNSQueue: 2000})
+	t.Cleanup(bar.close)
+
+	core, logs := observer.New(zap.InfoLevel)
+	f := FilterManager{
+		resolver:        newCachedResolver(zap.NewNop()),
+		queueNum:        1,
+		shutdownTimeout: time.Minute,
+		logger:          zap.New(core),
+		filters:         []*filter{selfFilter, foo, bar},
+	}
+	filters := f.currentFilters()
+
+	err := f.RemoveFilter("missing")
+	is.True(errors.Is(err, ErrFilterNotFound)) // unknown filters should not be removed
+
+	err = f.RemoveFilter(selfFilterName)
+	is.True(errors.Is(err, ErrCannotRemoveSelfFilter)) // self filter should not be removed
+
+	is.NoErr(f.RemoveFilter("foo"))
+	is.Equal(f.currentFilters(), []*filter{selfFilter, bar})                                        // filter should be removed
+	is.Equal(filters, []*filter{selfFilter, foo, bar})                                              // filters should not be modified in place
+	is.Equal(logs.FilterMessage("filter removed").Len(), 1)                                         // removing the filter should be logged
+	is.NoErr(f.queueConflict(&FilterOptions{Name: "new", DNSQueue: 1000, TrafficQueue: 1001}, nil)) // queues of the removed filter should be available
+}
+
+func TestReloadFilter(t *testing.T) {
+	is := is.New(t)
+
+	foo := newTestFilter(&FilterOptions{
+		Name:             "foo",
+		DNSQueue:         1000,
+		TrafficQueue:     1001,
+		AllowedHostnames: []string{"example.com"},
+	})
+	t.Cleanup(foo.close)
+	bar := newTestFilter(&FilterOptions{
+		Name:             "bar",
+		DNSQueue:         2000,
+		TrafficQueue:     2001,
+		AllowedHostnames: []string{"example.com"},
+	})
+	t.Cleanup(bar.close)
+	foo.additionalHostnames.AddEntry("foo.example.net", time.Minute)
+	is.NoErr(foo.updateHostnameSources(nil, []string{"synced.example.net"}))
+	bar.additionalHostnames.AddEntry("bar.example.net", time.Minute)
+
+	f := FilterManager{
+		resolver: newCachedResolver(zap.NewNop()),
+		queueNum: 1,
+		logger:   zap.NewNop(),
+		filters:  []*filter{foo, bar},
+	}
+
+	err := f.ReloadFilter(&FilterOptions{Name: "missing", DNSQueue: 3000, AllowAllHostnames: true})
+	is.True(errors.Is(err, ErrFilterNotFound)) // unknown filters should not be reloaded
+
+	err = f.ReloadFilter(&FilterOptions{
+		Name:             "foo",
+		DNSQueue:         1000,
+		TrafficQueue:     2001,
+		AllowAnswersFor:  duration(time.Minute),
+		AllowedHostnames: []string{"example.org"},
+	})
+	is.True(errors.Is(err, ErrQueueConflict))         // filters should not be restarted with queues of other filters
+	is.True(foo.hostnameAllowed("example.com"))       // hostnames should not be changed if reloading fails
+	is.Equal(f.currentFilters(), []*filter{foo, bar}) // filters should not be replaced if restarting fails
+
+	is.NoErr(f.ReloadFilter(&FilterOptions{
+		Name:             "foo",
+		DNSQueue:         1000,
+		TrafficQueue:     1001,
+		AllowAnswersFor:  duration(time.Minute),
+		AllowedHostnames: []string{"example.org"},
+	}))
+	is.True(foo.hostnameAllowed("example.org"))                     // reloaded hostnames should be allowed
+	is.True(!foo.hostnameAllowed("example.com"))                    // removed hostnames should not be allowed
+	is.True(foo.hostnameAllowed("synced.example.net"))              // synced hostnames should be kept
+	is.True(foo.additionalHostnames.EntryExists("foo.example.net")) // hostnames allowed at runtime should be kept
+	is.True(bar.hostnameAllowed("example.com"))                     // other filters should not be changed
+	is.True(bar.additionalHostnames.EntryExists("bar.example.net")) // hostnames other filters allowed at runtime should be kept
+	is.Equal(f.currentFilters(), []*filter{foo, bar})               // reloaded filters should not be replaced
+
+	f.selfDNSQueue = 100
+	is.NoErr(f.ReloadFilter(&FilterOptions{
+		Name:                         "foo",
+		DNSQueue:                     1000,
+		TrafficQueue:                 1001,
+		AllowAnswersFor:              duration(time.Minute),
+		AllowedHostnamesURL:          "https://lists.example.com/hostnames.txt",
+		AllowedHostnamesSyncInterval: duration(time.Minute),
+	}))
+	is.True(!foo.hostnameAllowed("example.org"))       // hostnames should be removed when reloading without hostnames
+	is.True(foo.hostnameAllowed("synced.example.net")) // synced hostnames should be kept when reloading without hostnames
+}
+
+func TestFilterLogger(t *testing.T) {
+	is := is.New(t)
+
+	core, logs := observer.New(zap.InfoLevel)
+	f := FilterManager{logger: zap.New(core)}
+
+	f.filterLogger("foo").Info("default")
+	f.filterLogger("").Info("unnamed")
+
+	factoryCore, factoryLogs := observer.New(zap.InfoLevel)
+	f.loggerFactory = func(filterName string) *zap.Logger {
+		return zap.New(factoryCore).With(zap.String("name", filterName))
+	}
+	f.filterLogger("foo").Info("factory")
+
+	is.Equal(logs.Len(), 2)                                                            // factory should be used once set
+	is.Equal(logs.All()[0].ContextMap(), map[string]interface{}{"filter.name": "foo"}) // default logger should name the filter
+	is.Equal(len(logs.All()[1].Context), 0)                                            // unnamed filters should not be named
+	is.Equal(factoryLogs.Len(), 1)                                                     // factory logger should be used
+	is.Equal(factoryLogs.All()[0].ContextMap(), map[string]interface{}{"name": "foo"}) // factory should be passed the filter name
+}
+
+func TestFetchHostnames(t *testing.T) {
+	is := is.New(t)
+
+	var failing int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, "# allowed hostnames\n\nfoo.com\n  bar.org  \n")
+	}))
+	t.Cleanup(srv.Close)
+
+	hostnames, etag, err := fetchHostnames(context.Background(), srv.Client(), srv.URL, "")
+	is.NoErr(err)
+	is.Equal(hostnames, []string{"foo.com", "bar.org"}) // comments and empty lines should be skipped
+	is.Equal(etag, `"v1"`)                              // ETag of the list should be returned
+
+	hostnames, etag, err = fetchHostnames(context.Background(), srv.Client(), srv.URL, etag)
+	is.NoErr(err)
+	is.Equal(hostnames, nil) // unchanged lists should not be returned
+	is.Equal(etag, `"v1"`)   // ETag should be kept when the list is unchanged
+
+	atomic.StoreInt32(&failing, 1)
+	_, _, err = fetchHostnames(context.Background(), srv.Client(), srv.URL, etag)
+	is.True(err != nil) // failed requests should return an error
+}
+
+func TestSyncHostnamesKeepsListOnFailure(t *testing.T) {
+	is := is.New(t)
+
+	var requests int32
+	failed := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			fmt.Fprint(w, "synced.com\n")
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		select {
+		case failed <- struct{}{}:
+		default:
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	f := newTestFilter(&FilterOptions{
+		AllowedHostnames:             []string{"static.com"},
+		AllowedHostnamesURL:          srv.URL,
+		AllowedHostnamesSyncInterval: duration(time.Millisecond),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f.syncHostnames(ctx, zap.NewNop())
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	// wait for a sync to fail after the list was synced
+	<-failed
+	<-failed
+
+	f.hostnamesMtx.RLock()
+	hostnames := f.opts.AllowedHostnames
+	f.hostnamesMtx.RUnlock()
+	is.Equal(hostnames, []string{"static.com", "synced.com"}) // synced hostnames should be kept when syncing fails
 }
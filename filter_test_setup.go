@@ -13,11 +13,6 @@ import (
 )
 
 func initFilters(t *testing.T, configStr string, iptablesRules ...string) (*http.Client, func()) {
-	config, err := parseConfigBytes([]byte(configStr))
-	if err != nil {
-		t.Fatalf("error parsing config: %v", err)
-	}
-
 	iptablesCmd(t, "-F")
 	for _, command := range iptablesRules {
 		iptablesCmd(t, command)
@@ -44,6 +39,11 @@ func initFilters(t *testing.T, configStr string, iptablesRules ...string) (*http
 		t.Fatalf("error creating logger: %v", err)
 	}
 
+	config, err := parseConfigBytes(logger, []byte(configStr))
+	if err != nil {
+		t.Fatalf("error parsing config: %v", err)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	filters, err := StartFilters(ctx, logger, config)
 	if err != nil {
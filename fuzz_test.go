@@ -1,7 +1,12 @@
 package main
 
 import (
+	"net"
 	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"go.uber.org/zap"
 )
 
 func FuzzConfig(f *testing.F) {
@@ -10,9 +15,97 @@ func FuzzConfig(f *testing.F) {
 	}
 
 	f.Fuzz(func(t *testing.T, cb []byte) {
-		_, err := parseConfigBytes(cb)
+		_, err := parseConfigBytes(zap.NewNop(), cb)
 		if err != nil {
 			return
 		}
 	})
 }
+
+func FuzzParseDNSPacket(f *testing.F) {
+	req := &layers.DNS{
+		ID:      1,
+		QDCount: 1,
+		Questions: []layers.DNSQuestion{
+			{
+				Name:  []byte("example.com"),
+				Type:  layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+			},
+		},
+	}
+	resp := &layers.DNS{
+		ID:      1,
+		QR:      true,
+		QDCount: 1,
+		ANCount: 1,
+		Questions: []layers.DNSQuestion{
+			{
+				Name:  []byte("example.com"),
+				Type:  layers.DNSTypeAAAA,
+				Class: layers.DNSClassIN,
+			},
+		},
+		Answers: []layers.DNSResourceRecord{
+			{
+				Name:  []byte("example.com"),
+				Type:  layers.DNSTypeAAAA,
+				Class: layers.DNSClassIN,
+				TTL:   60,
+				IP:    net.ParseIP("2001:db8::1"),
+			},
+		},
+	}
+
+	f.Add(newDNSPacket(f, req), false, false, false)
+	f.Add(newTCPv6DNSPacket(f, resp), true, true, false)
+	f.Add([]byte{}, false, false, false)
+	f.Add([]byte{0x45}, false, false, false)
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, true, false, true)
+
+	f.Fuzz(func(t *testing.T, packet []byte, ipv6, inbound, decapsulate bool) {
+		dns, _, err := parseDNSPacket(packet, ipv6, inbound, decapsulate)
+		if err == nil && dns == nil {
+			t.Fatal("no error was returned but the DNS layer is nil")
+		}
+	})
+}
+
+func newTCPv6DNSPacket(t testing.TB, dns *layers.DNS) []byte {
+	ip := layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolTCP,
+		SrcIP:      net.ParseIP("2001:db8::53"),
+		DstIP:      net.ParseIP("2001:db8::2"),
+	}
+	tcp := layers.TCP{
+		SrcPort: 53,
+		DstPort: 40000,
+		ACK:     true,
+		PSH:     true,
+		Window:  65535,
+	}
+	if err := tcp.SetNetworkLayerForChecksum(&ip); err != nil {
+		t.Fatalf("error setting network layer: %v", err)
+	}
+
+	// DNS over TCP is prefixed with the length of the message
+	dnsBuf := gopacket.NewSerializeBuffer()
+	if err := dns.SerializeTo(dnsBuf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		t.Fatalf("error serializing DNS message: %v", err)
+	}
+	msg := dnsBuf.Bytes()
+	payload := append([]byte{byte(len(msg) >> 8), byte(len(msg))}, msg...)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	if err := gopacket.SerializeLayers(buf, opts, &ip, &tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatalf("error serializing packet: %v", err)
+	}
+
+	return buf.Bytes()
+}
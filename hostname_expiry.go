@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// hostnameUsage records when hostnames allowed from answers were last
+// matched by DNS requests, so hostnames that expire while they are in
+// use can be reported.
+type hostnameUsage struct {
+	mtx         sync.Mutex
+	lastMatched map[string]time.Time
+}
+
+func newHostnameUsage() *hostnameUsage {
+	return &hostnameUsage{lastMatched: make(map[string]time.Time)}
+}
+
+func (h *hostnameUsage) matched(hostname string, now time.Time) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.lastMatched[hostname] = now
+}
+
+// expired stops tracking hostname and returns when it was last
+// matched, or false if it was never matched.
+func (h *hostnameUsage) expired(hostname string) (time.Time, bool) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	lastMatched, ok := h.lastMatched[hostname]
+	delete(h.lastMatched, hostname)
+
+	return lastMatched, ok
+}
+
+// recordHostnameMatch records that a DNS request matched a hostname
+// allowed from an answer, if expiry notifications are enabled.
+func (f *filter) recordHostnameMatch(hostname string) {
+	if f.hostnameUsage == nil {
+		return
+	}
+
+	f.hostnameUsage.matched(hostname, time.Now())
+}
+
+// notifyHostnameExpired logs and counts a hostname allowed from an
+// answer that expired if it was matched within
+// opts.ExpiryNotifyWindow, so operators can decide whether to allow
+// it permanently.
+func (f *filter) notifyHostnameExpired(hostname string) {
+	lastMatched, ok := f.hostnameUsage.expired(hostname)
+	if !ok || time.Since(lastMatched) > time.Duration(f.opts.ExpiryNotifyWindow) {
+		return
+	}
+
+	atomic.AddInt64(&f.hostnamesExpiredInUse, 1)
+	f.logger.Warn("allowed hostname expired while in use", zap.String("hostname", hostname), zap.Time("hostname.lastMatched", lastMatched))
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestHostnameExpiryNotification(t *testing.T) {
+	is := is.New(t)
+
+	core, logs := observer.New(zapcore.WarnLevel)
+	f := newTestFilter(&FilterOptions{
+		AllowAnswersFor:    duration(time.Minute),
+		AllowedHostnames:   []string{"example.com"},
+		ExpiryNotifyWindow: duration(time.Minute),
+	})
+	f.logger = zap.New(core)
+	f.hostnameUsage = newHostnameUsage()
+	f.additionalHostnames.OnExpire(f.notifyHostnameExpired)
+	t.Cleanup(f.close)
+
+	cnameSource := HostnameSource{Type: "CNAME", Name: "example.com"}
+	f.allowHostname(zap.NewNop(), "used.example.net", cnameSource, 50*time.Millisecond)
+	f.allowHostname(zap.NewNop(), "unused.example.net", cnameSource, 50*time.Millisecond)
+	f.allowHostname(zap.NewNop(), "parent.example.net", cnameSource, 50*time.Millisecond)
+	is.True(f.allowedFromAnswer("used.example.net"))               // hostname from answer should be allowed
+	is.True(f.additionalHostnameAllowed("www.parent.example.net")) // subdomain of hostname from answer should be allowed
+
+	deadline := time.Now().Add(5 * time.Second)
+	for f.additionalHostnames.Stats().Expirations < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// wait for expiry notifications to finish
+	f.additionalHostnames.Stop()
+
+	is.Equal(f.status().HostnamesExpiredInUse, int64(2)) // only hostnames that were matched should be reported
+	entries := logs.FilterMessage("allowed hostname expired while in use").AllUntimed()
+	is.Equal(len(entries), 2)
+	expired := map[interface{}]bool{
+		entries[0].ContextMap()["hostname"]: true,
+		entries[1].ContextMap()["hostname"]: true,
+	}
+	is.True(expired["used.example.net"])    // expiry of matched hostname should be reported
+	is.True(expired["parent.example.net"])  // expiry of hostname whose subdomain was matched should be reported
+	is.True(!expired["unused.example.net"]) // expiry of unused hostname should not be reported
+}
+
+func TestHostnameExpiryNotificationWindow(t *testing.T) {
+	is := is.New(t)
+
+	f := newTestFilter(&FilterOptions{
+		AllowAnswersFor:    duration(time.Minute),
+		AllowedHostnames:   []string{"example.com"},
+		ExpiryNotifyWindow: duration(time.Minute),
+	})
+	f.hostnameUsage = newHostnameUsage()
+	t.Cleanup(f.close)
+
+	f.hostnameUsage.matched("stale.example.net", time.Now().Add(-2*time.Minute))
+	f.notifyHostnameExpired("stale.example.net")
+	is.Equal(f.hostnamesExpiredInUse, int64(0)) // hostnames matched before the window should not be reported
+
+	f.hostnameUsage.matched("recent.example.net", time.Now())
+	f.notifyHostnameExpired("recent.example.net")
+	is.Equal(f.hostnamesExpiredInUse, int64(1)) // hostnames matched within the window should be reported
+
+	_, ok := f.hostnameUsage.expired("recent.example.net")
+	is.True(!ok) // expired hostnames should no longer be tracked
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// hostnameTrie stores hostnames by their labels in reverse order, so
+// checking if a hostname is a subdomain of any stored hostname only
+// depends on the number of labels in the hostname.
+type hostnameTrie struct {
+	root trieNode
+}
+
+type trieNode struct {
+	// hits is how many times the stored hostname ending at this node
+	// was matched, accessed atomically and kept first to ensure
+	// 64-bit alignment
+	hits     int64
+	children map[string]*trieNode
+	// terminal is true if a stored hostname ends at this node
+	terminal bool
+}
+
+// newHostnameTrie creates a trie that matches hostnames and their
+// subdomains.
+func newHostnameTrie(hostnames []string) *hostnameTrie {
+	var t hostnameTrie
+	for _, hostname := range hostnames {
+		t.add(hostname)
+	}
+
+	return &t
+}
+
+// add stores hostname in the trie. It returns false if hostname was
+// already matched by the trie, in which case the trie is unchanged.
+func (t *hostnameTrie) add(hostname string) bool {
+	node := &t.root
+	for rest := hostname; ; {
+		label, next, last := lastLabel(rest)
+		if node.terminal {
+			return false
+		}
+
+		child, ok := node.children[label]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[string]*trieNode)
+			}
+			child = new(trieNode)
+			node.children[label] = child
+		}
+		node = child
+
+		if last {
+			break
+		}
+		rest = next
+	}
+
+	if node.terminal {
+		return false
+	}
+	node.terminal = true
+
+	return true
+}
+
+// matches returns true if hostname or any of its parent domains are
+// stored in the trie.
+func (t *hostnameTrie) matches(hostname string) bool {
+	_, ok := t.match(hostname)
+	return ok
+}
+
+// match returns the stored hostname that hostname is equal to or a
+// subdomain of, if any.
+func (t *hostnameTrie) match(hostname string) (string, bool) {
+	_, rule, ok := t.matchNode(hostname)
+	return rule, ok
+}
+
+// countMatch is like match, but also counts the match towards the
+// stored hostname that matched.
+func (t *hostnameTrie) countMatch(hostname string) (string, bool) {
+	node, rule, ok := t.matchNode(hostname)
+	if ok {
+		atomic.AddInt64(&node.hits, 1)
+	}
+	return rule, ok
+}
+
+func (t *hostnameTrie) matchNode(hostname string) (*trieNode, string, bool) {
+	node := &t.root
+	for rest := hostname; ; {
+		label, next, last := lastLabel(rest)
+
+		child, ok := node.children[label]
+		if !ok {
+			return nil, "", false
+		}
+		if child.terminal {
+			if last {
+				return child, hostname, true
+			}
+			// the matched hostname is every label after next
+			return child, hostname[len(next)+1:], true
+		}
+		node = child
+
+		if last {
+			return nil, "", false
+		}
+		rest = next
+	}
+}
+
+// find returns the node hostname ends at if hostname is stored in the
+// trie, subdomains of stored hostnames are not found.
+func (t *hostnameTrie) find(hostname string) *trieNode {
+	node, rule, ok := t.matchNode(hostname)
+	if !ok || rule != hostname {
+		return nil
+	}
+	return node
+}
+
+// hits returns how many times hostname was matched by countMatch, or
+// 0 if it isn't stored in the trie.
+func (t *hostnameTrie) hits(hostname string) int64 {
+	node := t.find(hostname)
+	if node == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&node.hits)
+}
+
+// copyHits sets the hits of hostnames stored in t to their hits in
+// from, so counts aren't lost when the trie is replaced.
+func (t *hostnameTrie) copyHits(from *hostnameTrie, hostnames []string) {
+	for _, hostname := range hostnames {
+		if node := t.find(hostname); node != nil {
+			atomic.StoreInt64(&node.hits, from.hits(hostname))
+		}
+	}
+}
+
+// labelCount returns how many labels hostname has.
+func labelCount(hostname string) int {
+	hostname = strings.TrimSuffix(hostname, ".")
+	if hostname == "" {
+		return 0
+	}
+
+	return strings.Count(hostname, ".") + 1
+}
+
+// lastLabel splits the last label from hostname, and returns true if
+// it was the only label left.
+func lastLabel(hostname string) (string, string, bool) {
+	i := strings.LastIndexByte(hostname, '.')
+	if i == -1 {
+		return hostname, "", true
+	}
+
+	return hostname[i+1:], hostname[:i], false
+}
+
+// dedupHostnames removes hostnames that are subdomains of other
+// hostnames or are duplicates. The order of the remaining hostnames is
+// preserved. The removed hostnames are returned as well.
+func dedupHostnames(hostnames []string) ([]string, []string) {
+	// add hostnames with fewer labels first so parent domains are
+	// always added before their subdomains
+	idxs := make([]int, len(hostnames))
+	for i := range idxs {
+		idxs[i] = i
+	}
+	sort.SliceStable(idxs, func(i, j int) bool {
+		return strings.Count(hostnames[idxs[i]], ".") < strings.Count(hostnames[idxs[j]], ".")
+	})
+
+	var (
+		trie      hostnameTrie
+		redundant = make([]bool, len(hostnames))
+	)
+	for _, idx := range idxs {
+		redundant[idx] = !trie.add(hostnames[idx])
+	}
+
+	var deduped, removed []string
+	for i := range hostnames {
+		if redundant[i] {
+			removed = append(removed, hostnames[i])
+			continue
+		}
+		deduped = append(deduped, hostnames[i])
+	}
+
+	return deduped, removed
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestDedupHostnames(t *testing.T) {
+	is := is.New(t)
+
+	deduped, removed := dedupHostnames([]string{
+		"foo.example.com",
+		"example.com",
+		"example.org",
+		"bar.baz.example.com",
+		"golang.org",
+		"proxy.golang.org",
+		"github.com",
+		"example.net",
+		"gist.github.com.evil",
+		"ample.com",
+	})
+	is.Equal(deduped, []string{
+		"example.com",
+		"example.org",
+		"golang.org",
+		"github.com",
+		"example.net",
+		"gist.github.com.evil",
+		"ample.com",
+	}) // only redundant hostnames should be removed
+	is.Equal(removed, []string{
+		"foo.example.com",
+		"bar.baz.example.com",
+		"proxy.golang.org",
+	}) // subdomains should be removed
+}
+
+func TestHostnameTrie(t *testing.T) {
+	is := is.New(t)
+
+	var trie hostnameTrie
+	is.True(trie.add("google.com"))       // new hostname should be added
+	is.True(trie.add("gist.github.com"))  // new hostname should be added
+	is.True(!trie.add("news.google.com")) // subdomain of stored hostname should not be added
+
+	is.True(trie.matches("google.com"))        // stored hostname should match
+	is.True(trie.matches("news.google.com"))   // subdomain of stored hostname should match
+	is.True(!trie.matches("ggoogle.com"))      // hostname with stored suffix should not match
+	is.True(!trie.matches("github.com"))       // parent of stored hostname should not match
+	is.True(!trie.matches("com"))              // TLD should not match
+	is.True(trie.matches("a.gist.github.com")) // subdomain of stored hostname should match
+
+	rule, ok := trie.match("a.b.google.com")
+	is.True(ok)                  // subdomain of stored hostname should match
+	is.Equal(rule, "google.com") // stored hostname that matched should be returned
+	rule, ok = trie.match("gist.github.com")
+	is.True(ok)                       // stored hostname should match
+	is.Equal(rule, "gist.github.com") // stored hostname should be returned
+}
+
+func TestHostnameTrieMatchesLinear(t *testing.T) {
+	is := is.New(t)
+
+	allowed := []string{
+		"example.com",
+		"foo.example.org",
+		"github.com",
+		"a.b.c.d.example.net",
+		"localhost",
+	}
+	trie := newHostnameTrie(allowed)
+
+	for _, hostname := range []string{
+		"example.com",
+		"www.example.com",
+		"a.b.example.com",
+		"badexample.com",
+		"example.com.evil",
+		"com",
+		"example.org",
+		"foo.example.org",
+		"bar.foo.example.org",
+		"barfoo.example.org",
+		"gist.github.com",
+		"github.co",
+		"d.example.net",
+		"a.b.c.d.example.net",
+		"z.a.b.c.d.example.net",
+		"localhost",
+		"my.localhost",
+		"",
+	} {
+		is.Equal(trie.matches(hostname), linearHostnameAllowed(allowed, hostname)) // trie should match the same hostnames as a linear scan
+	}
+}
+
+func BenchmarkHostnameAllowed(b *testing.B) {
+	allowed := make([]string, 1000)
+	for i := range allowed {
+		allowed[i] = fmt.Sprintf("host%d.example%d.com", i, i%10)
+	}
+	// worst case for a linear scan, the hostname matches no entries
+	hostname := "www.unknown.example.org"
+
+	b.Run("linear", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			linearHostnameAllowed(allowed, hostname)
+		}
+	})
+
+	b.Run("trie", func(b *testing.B) {
+		trie := newHostnameTrie(allowed)
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			trie.matches(hostname)
+		}
+	})
+}
+
+// linearHostnameAllowed is how allowed hostnames were matched before
+// they were stored in a trie.
+func linearHostnameAllowed(allowed []string, hostname string) bool {
+	for i := range allowed {
+		if hostname == allowed[i] || strings.HasSuffix(hostname, "."+allowed[i]) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+// ipProtocols are the names of transport protocols that can be set in
+// "allowedProtocols".
+var ipProtocols = map[string]layers.IPProtocol{
+	"tcp":     layers.IPProtocolTCP,
+	"udp":     layers.IPProtocolUDP,
+	"icmp":    layers.IPProtocolICMPv4,
+	"icmpv6":  layers.IPProtocolICMPv6,
+	"sctp":    layers.IPProtocolSCTP,
+	"udplite": layers.IPProtocolUDPLite,
+	"gre":     layers.IPProtocolGRE,
+	"esp":     layers.IPProtocolESP,
+	"ah":      layers.IPProtocolAH,
+}
+
+// parseIPProtocols returns the protocols of names.
+func parseIPProtocols(names []string) ([]layers.IPProtocol, error) {
+	protocols := make([]layers.IPProtocol, len(names))
+	for i, name := range names {
+		protocol, ok := ipProtocols[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown protocol %q", name)
+		}
+		protocols[i] = protocol
+	}
+
+	return protocols, nil
+}
+
+// ipv6Protocol returns the transport protocol of an IPv6 packet after
+// any extension headers, and whether the packet has Hop-by-Hop or
+// Destination Options headers. ok is false if the extension headers
+// are truncated.
+func ipv6Protocol(ip6 *layers.IPv6) (protocol layers.IPProtocol, hasOptions, ok bool) {
+	protocol = ip6.NextHeader
+	payload := ip6.Payload
+	// gopacket decodes Hop-by-Hop headers as part of the IPv6 header
+	if ip6.HopByHop != nil {
+		protocol = ip6.HopByHop.NextHeader
+		hasOptions = true
+	}
+	for {
+		var hdrLen int
+		switch protocol {
+		case layers.IPProtocolIPv6HopByHop, layers.IPProtocolIPv6Destination:
+			hasOptions = true
+			fallthrough
+		case layers.IPProtocolIPv6Routing:
+			if len(payload) < 2 {
+				return protocol, hasOptions, false
+			}
+			hdrLen = (int(payload[1]) + 1) * 8
+		case layers.IPProtocolIPv6Fragment:
+			hdrLen = 8
+		default:
+			return protocol, hasOptions, true
+		}
+		if len(payload) < hdrLen {
+			return protocol, hasOptions, false
+		}
+
+		protocol = layers.IPProtocol(payload[0])
+		payload = payload[hdrLen:]
+	}
+}
+
+// ipPolicyViolation returns why the IP header of a decoded packet
+// isn't allowed by the filter, or an empty string if it is. ctInfo is
+// the conntrack state of the packet, if known.
+func (f *filter) ipPolicyViolation(p *trafficParser, ctInfo *uint32) string {
+	var (
+		protocol   layers.IPProtocol
+		hasOptions bool
+	)
+	if !p.ipv6 {
+		protocol = p.ip4.Protocol
+		// the header is longer than 5 words if it has options
+		hasOptions = p.ip4.IHL > 5
+	} else {
+		var ok bool
+		protocol, hasOptions, ok = ipv6Protocol(&p.ip6)
+		if !ok {
+			return "IPv6 extension headers are truncated"
+		}
+	}
+
+	if f.opts.DropIPOptions && hasOptions {
+		return "IP options are set"
+	}
+	if len(f.allowedProtocols) > 0 && !containsProtocol(f.allowedProtocols, protocol) {
+		return fmt.Sprintf("protocol %s isn't allowed", protocol)
+	}
+	if p.ipv6 {
+		if len(f.opts.AllowedTrafficClasses) > 0 && !containsInt(f.opts.AllowedTrafficClasses, int(p.ip6.TrafficClass)) {
+			return fmt.Sprintf("traffic class %d isn't allowed", p.ip6.TrafficClass)
+		}
+		// flow labels of established connections are set by the
+		// peers already allowed, so only new connections are
+		// checked to limit the flow label as a covert channel
+		if f.opts.DropFlowLabels && p.ip6.FlowLabel != 0 && ctInfo != nil && *ctInfo == stateNew {
+			return "flow label is set on new connection"
+		}
+	}
+
+	return ""
+}
+
+func containsProtocol(protocols []layers.IPProtocol, protocol layers.IPProtocol) bool {
+	for _, p := range protocols {
+		if p == protocol {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsInt(ints []int, i int) bool {
+	for _, n := range ints {
+		if n == i {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/matryer/is"
+)
+
+func TestIPPolicyViolation(t *testing.T) {
+	newIPv4Packet := func(t *testing.T, protocol layers.IPProtocol, options []layers.IPv4Option) []byte {
+		ip := layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: protocol,
+			SrcIP:    net.IPv4(192, 168, 1, 2),
+			DstIP:    net.IPv4(192, 0, 2, 1),
+			Options:  options,
+		}
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buf, opts, &ip, gopacket.Payload([]byte("payload!"))); err != nil {
+			t.Fatalf("error serializing packet: %v", err)
+		}
+		return buf.Bytes()
+	}
+	newIPv6Packet := func(t *testing.T, nextHeader layers.IPProtocol, extHeader []byte) []byte {
+		ip := layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: nextHeader,
+			SrcIP:      net.ParseIP("2001:db8::2"),
+			DstIP:      net.ParseIP("2001:db8::1"),
+		}
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true}
+		if err := gopacket.SerializeLayers(buf, opts, &ip, gopacket.Payload(append(extHeader, []byte("payload!")...))); err != nil {
+			t.Fatalf("error serializing packet: %v", err)
+		}
+		return buf.Bytes()
+	}
+	newIPv6FlowPacket := func(t *testing.T, trafficClass uint8, flowLabel uint32) []byte {
+		ip := layers.IPv6{
+			Version:      6,
+			TrafficClass: trafficClass,
+			FlowLabel:    flowLabel,
+			HopLimit:     64,
+			NextHeader:   layers.IPProtocolTCP,
+			SrcIP:        net.ParseIP("2001:db8::2"),
+			DstIP:        net.ParseIP("2001:db8::1"),
+		}
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true}
+		if err := gopacket.SerializeLayers(buf, opts, &ip, gopacket.Payload([]byte("payload!"))); err != nil {
+			t.Fatalf("error serializing packet: %v", err)
+		}
+		return buf.Bytes()
+	}
+	state := func(s uint32) *uint32 {
+		return &s
+	}
+	// router alert option padded to a multiple of 4 bytes
+	routerAlert := []layers.IPv4Option{
+		{OptionType: 148, OptionLength: 4, OptionData: []byte{0, 0}},
+	}
+	// Destination Options header with a PadN option followed by UDP
+	destOptions := []byte{byte(layers.IPProtocolUDP), 0, 1, 4, 0, 0, 0, 0}
+
+	tests := []struct {
+		name     string
+		opts     FilterOptions
+		ipv6     bool
+		ctInfo   *uint32
+		packet   func(t *testing.T) []byte
+		expected string
+	}{
+		{
+			name:     "IPv4 options allowed",
+			packet:   func(t *testing.T) []byte { return newIPv4Packet(t, layers.IPProtocolTCP, routerAlert) },
+			expected: "",
+		},
+		{
+			name:     "IPv4 options dropped",
+			opts:     FilterOptions{DropIPOptions: true},
+			packet:   func(t *testing.T) []byte { return newIPv4Packet(t, layers.IPProtocolTCP, routerAlert) },
+			expected: "IP options are set",
+		},
+		{
+			name:     "IPv4 without options",
+			opts:     FilterOptions{DropIPOptions: true},
+			packet:   func(t *testing.T) []byte { return newIPv4Packet(t, layers.IPProtocolTCP, nil) },
+			expected: "",
+		},
+		{
+			name:     "IPv4 protocol allowed",
+			opts:     FilterOptions{AllowedProtocols: []string{"tcp", "UDP"}},
+			packet:   func(t *testing.T) []byte { return newIPv4Packet(t, layers.IPProtocolUDP, nil) },
+			expected: "",
+		},
+		{
+			name:     "IPv4 protocol not allowed",
+			opts:     FilterOptions{AllowedProtocols: []string{"tcp", "udp"}},
+			packet:   func(t *testing.T) []byte { return newIPv4Packet(t, layers.IPProtocolGRE, nil) },
+			expected: "protocol GRE isn't allowed",
+		},
+		{
+			name:     "IPv6 destination options dropped",
+			opts:     FilterOptions{DropIPOptions: true},
+			ipv6:     true,
+			packet:   func(t *testing.T) []byte { return newIPv6Packet(t, layers.IPProtocolIPv6Destination, destOptions) },
+			expected: "IP options are set",
+		},
+		{
+			name:     "IPv6 protocol after extension header",
+			opts:     FilterOptions{AllowedProtocols: []string{"udp"}},
+			ipv6:     true,
+			packet:   func(t *testing.T) []byte { return newIPv6Packet(t, layers.IPProtocolIPv6Destination, destOptions) },
+			expected: "",
+		},
+		{
+			name: "IPv6 truncated extension header",
+			opts: FilterOptions{AllowedProtocols: []string{"udp"}},
+			ipv6: true,
+			packet: func(t *testing.T) []byte {
+				return newIPv6Packet(t, layers.IPProtocolIPv6Routing, []byte{byte(layers.IPProtocolUDP), 10})
+			},
+			expected: "IPv6 extension headers are truncated",
+		},
+		{
+			name:     "IPv6 traffic class allowed",
+			opts:     FilterOptions{AllowedTrafficClasses: []int{0, 184}},
+			ipv6:     true,
+			packet:   func(t *testing.T) []byte { return newIPv6FlowPacket(t, 184, 0) },
+			expected: "",
+		},
+		{
+			name:     "IPv6 traffic class not allowed",
+			opts:     FilterOptions{AllowedTrafficClasses: []int{0, 184}},
+			ipv6:     true,
+			packet:   func(t *testing.T) []byte { return newIPv6FlowPacket(t, 32, 0) },
+			expected: "traffic class 32 isn't allowed",
+		},
+		{
+			name:     "IPv6 flow label allowed",
+			ipv6:     true,
+			ctInfo:   state(stateNew),
+			packet:   func(t *testing.T) []byte { return newIPv6FlowPacket(t, 0, 0x12345) },
+			expected: "",
+		},
+		{
+			name:     "IPv6 flow label on new connection dropped",
+			opts:     FilterOptions{DropFlowLabels: true},
+			ipv6:     true,
+			ctInfo:   state(stateNew),
+			packet:   func(t *testing.T) []byte { return newIPv6FlowPacket(t, 0, 0x12345) },
+			expected: "flow label is set on new connection",
+		},
+		{
+			name:     "IPv6 flow label on established connection",
+			opts:     FilterOptions{DropFlowLabels: true},
+			ipv6:     true,
+			ctInfo:   state(stateEstablished),
+			packet:   func(t *testing.T) []byte { return newIPv6FlowPacket(t, 0, 0x12345) },
+			expected: "",
+		},
+		{
+			name:     "IPv6 without flow label",
+			opts:     FilterOptions{DropFlowLabels: true},
+			ipv6:     true,
+			ctInfo:   state(stateNew),
+			packet:   func(t *testing.T) []byte { return newIPv6FlowPacket(t, 0, 0) },
+			expected: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+
+			f := newTestFilter(&tt.opts)
+			f.allowedProtocols, _ = parseIPProtocols(tt.opts.AllowedProtocols)
+
+			p := newTrafficParser(tt.ipv6, false)
+			is.NoErr(p.decode(tt.packet(t)))
+			is.Equal(f.ipPolicyViolation(p, tt.ctInfo), tt.expected) // packet should only be dropped if its IP header violates the policy
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// longAllowAnswersFor is how long IPs from DNS answers can be allowed
+// for before it is linted as too long. The IPs of most hostnames change
+// well within a day, so IPs allowed longer may be reassigned to others.
+const longAllowAnswersFor = 24 * time.Hour
+
+// LintSeverity is how risky a linted setting is.
+type LintSeverity uint8
+
+const (
+	// LintInfo is for settings that are risky only in some
+	// circumstances
+	LintInfo LintSeverity = iota
+	// LintWarning is for settings that allow more than is likely
+	// intended
+	LintWarning
+)
+
+func (s LintSeverity) String() string {
+	if s == LintWarning {
+		return "warning"
+	}
+	return "info"
+}
+
+// LintResult is a risky but valid setting of a config.
+type LintResult struct {
+	Severity LintSeverity
+	// Filter is the name of the filter the setting is of, or empty
+	// if it is a top level setting
+	Filter  string
+	Message string
+}
+
+func (l LintResult) String() string {
+	if l.Filter == "" {
+		return fmt.Sprintf("%s: %s", l.Severity, l.Message)
+	}
+	return fmt.Sprintf("%s: filter %q: %s", l.Severity, l.Filter, l.Message)
+}
+
+// lint returns the settings of a parsed config that are valid, but are
+// likely to allow more traffic than intended.
+func (c *Config) lint() []LintResult {
+	var results []LintResult
+	add := func(severity LintSeverity, filter, format string, args ...interface{}) {
+		results = append(results, LintResult{
+			Severity: severity,
+			Filter:   filter,
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	if c.BreakGlassMark != 0 {
+		add(LintInfo, "", `"breakGlassMark" is set, packets with mark %d are accepted without being filtered`, c.BreakGlassMark)
+	}
+	for _, filterOpt := range c.Filters {
+		// the self-filter is created from "selfDNSQueue" with only
+		// the hostnames egress-eddie needs to resolve
+		if filterOpt.Name == selfFilterName {
+			continue
+		}
+		if filterOpt.AllowAllHostnames {
+			add(LintWarning, filterOpt.Name, `"allowAllHostnames" is true, DNS requests for any hostname are allowed`)
+		}
+		if time.Duration(filterOpt.AllowAnswersFor) > longAllowAnswersFor {
+			add(LintWarning, filterOpt.Name, `"allowAnswersFor" is longer than %s, IPs may be allowed after they are reassigned`, longAllowAnswersFor)
+		}
+		for _, hostname := range filterOpt.AllowedHostnames {
+			if isPublicSuffix(hostname) {
+				add(LintWarning, filterOpt.Name, `"allowedHostnames" contains public suffix %q, which allows hostnames of unrelated owners`, hostname)
+			}
+		}
+		if filterOpt.LookupUnknownIPs && filterOpt.MaxConcurrentLookups == 0 {
+			add(LintWarning, filterOpt.Name, `"lookupUnknownIPs" is true without "maxConcurrentLookups", unknown IPs can cause unlimited reverse lookups`)
+		}
+		if filterOpt.PostResponseGrace != 0 {
+			add(LintInfo, filterOpt.Name, `"postResponseGrace" is set, sources of DNS requests can connect to answer IPs for %s after responses even if the IPs expired`, time.Duration(filterOpt.PostResponseGrace))
+		}
+		if filterOpt.DNSParseFailFallback {
+			add(LintInfo, filterOpt.Name, `"dnsParseFailFallback" is true, DNS requests that can't be parsed are allowed to allowed IPs without being inspected`)
+		}
+		if filterOpt.FailOpenOnResolverOutage {
+			add(LintInfo, filterOpt.Name, `"failOpenOnResolverOutage" is true, all traffic is allowed while resolvers are unreachable`)
+		}
+	}
+
+	return results
+}
+
+// isPublicSuffix returns true if hostname is a public suffix, such as
+// "com" or "co.uk", under which domains are registered by unrelated
+// owners.
+func isPublicSuffix(hostname string) bool {
+	hostname = normalizeHostname(hostname)
+	suffix, icann := publicsuffix.PublicSuffix(hostname)
+	if suffix != hostname {
+		return false
+	}
+
+	// PublicSuffix returns the last label of hostnames with unlisted
+	// TLDs, so only listed single labels are public suffixes
+	return icann || strings.Contains(hostname, ".")
+}
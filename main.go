@@ -5,8 +5,11 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math"
+	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime/debug"
 	"strings"
 	"syscall"
@@ -22,6 +25,9 @@ var (
 	debugLogs    bool
 	logPath      string
 	testConfig   bool
+	explain      bool
+	lint         bool
+	queueBase    uint
 	printVersion bool
 )
 
@@ -30,6 +36,9 @@ func init() {
 	flag.BoolVar(&debugLogs, "d", false, "enable debug logging")
 	flag.StringVar(&logPath, "l", "egress-eddie.log", "path to log to")
 	flag.BoolVar(&testConfig, "t", false, "validate the config and exit")
+	flag.BoolVar(&explain, "explain", false, "with -t, print the changes made to the config while parsing it")
+	flag.BoolVar(&lint, "lint", false, "with -t, print settings of the config that are likely to allow more than intended")
+	flag.UintVar(&queueBase, "queue-base", 1, "first nfqueue number to suggest when configured nfqueues are in use")
 	flag.BoolVar(&printVersion, "version", false, "print version and build information and exit")
 }
 
@@ -66,17 +75,66 @@ func main() {
 		}
 	}
 
-	config, err := ParseConfig(configPath)
+	if queueBase == 0 || queueBase > math.MaxUint16 {
+		log.Fatalf("-queue-base must be between 1 and %d", math.MaxUint16)
+	}
+
+	config, transformations, err := ExplainConfig(logger, configPath)
 	if testConfig {
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "error parsing config: %v\n", err)
 			os.Exit(1)
 		}
+		if explain {
+			for _, transformation := range transformations {
+				fmt.Println(transformation)
+			}
+		}
+		if lint {
+			for _, result := range config.lint() {
+				fmt.Println(result)
+			}
+		}
+
+		// the queues may be in use by an already running instance
+		// of egress-eddie, so only warn about conflicts
+		conflicts, suggestions, err := config.queueConflicts(uint16(queueBase))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error checking nfqueues in use: %v\n", err)
+			os.Exit(1)
+		}
+		for i := range conflicts {
+			fmt.Fprintf(os.Stderr, "warning: nfqueue %d is already in use, nfqueue %d is available\n", conflicts[i], suggestions[i])
+		}
 		os.Exit(0)
 	}
 	if err != nil {
 		logger.Fatal("error parsing config", zap.NamedError("error", err))
 	}
+	for _, result := range config.lint() {
+		fields := []zap.Field{zap.String("filter.name", result.Filter), zap.String("lint.message", result.Message)}
+		if result.Severity == LintWarning {
+			logger.Warn("risky config setting", fields...)
+		} else {
+			logger.Info("risky config setting", fields...)
+		}
+	}
+
+	// connect to systemd's notify socket before landlock rules and
+	// seccomp filters are applied
+	notifier, err := newSDNotifier()
+	if err != nil {
+		logger.Fatal("error setting up systemd notifications", zap.NamedError("error", err))
+	}
+	// the admin socket can't be created once landlock rules are
+	// applied
+	var adminListener net.Listener
+	if config.AdminSocketPath != "" {
+		adminListener, err = listenAdminSocket(config.AdminSocketPath)
+		if err != nil {
+			logger.Fatal("error creating admin socket", zap.NamedError("error", err))
+		}
+	}
 
 	// Try and apply landlock rules, preventing access to non-essential
 	// files. Only recent versions of the kernel support landlock (5.13+),
@@ -84,13 +142,44 @@ func main() {
 	// These rules can only apply when egress-eddie does not need to make
 	// network connections, as currently it seems landlock does not support
 	// networking.
-	if config.SelfDNSQueue == 0 {
+	if !config.needsNetworking() {
 		var allowedPaths []landlock.PathOpt
 		if logPath != "stdout" && logPath != "stderr" {
 			allowedPaths = []landlock.PathOpt{
 				landlock.PathAccess(llsyscall.AccessFSWriteFile, logPath),
 			}
 		}
+		if config.TextfilePath != "" {
+			// metrics are written to a temporary file that is
+			// renamed over the textfile
+			allowedPaths = append(allowedPaths,
+				landlock.PathAccess(llsyscall.AccessFSWriteFile|llsyscall.AccessFSMakeReg|llsyscall.AccessFSRemoveFile, filepath.Dir(config.TextfilePath)),
+			)
+		}
+		if config.StateDBPath != "" {
+			// the state database is reopened every time changes
+			// are written to it
+			allowedPaths = append(allowedPaths,
+				landlock.PathAccess(llsyscall.AccessFSReadFile|llsyscall.AccessFSWriteFile|llsyscall.AccessFSMakeReg, filepath.Dir(config.StateDBPath)),
+			)
+		}
+		if config.AdminSocketPath != "" {
+			// filters are reloaded from the config file by the
+			// admin socket
+			allowedPaths = append(allowedPaths,
+				landlock.PathAccess(llsyscall.AccessFSReadFile, configPath),
+			)
+		}
+		if config.VerdictFile != "" {
+			allowedPaths = append(allowedPaths,
+				landlock.PathAccess(llsyscall.AccessFSWriteFile|llsyscall.AccessFSMakeReg, filepath.Dir(config.VerdictFile)),
+			)
+		}
+		if config.DiagnosticDumpDir != "" {
+			allowedPaths = append(allowedPaths,
+				landlock.PathAccess(llsyscall.AccessFSWriteFile|llsyscall.AccessFSMakeReg, config.DiagnosticDumpDir),
+			)
+		}
 
 		err = landlock.V1.RestrictPaths(
 			allowedPaths...,
@@ -110,11 +199,58 @@ func main() {
 		logger.Fatal("error starting filters", zap.NamedError("error", err))
 	}
 	logger.Info("started filtering")
+	if adminListener != nil {
+		filters.serveAdmin(adminListener, configPath)
+	}
+
+	// block all egress on SIGUSR1 until SIGUSR2 is received, so
+	// egress can be stopped during an incident without stopping
+	// filtering
+	pauseSignals := make(chan os.Signal, 1)
+	signal.Notify(pauseSignals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-pauseSignals:
+				if sig == syscall.SIGUSR1 {
+					filters.Pause()
+				} else {
+					filters.Resume()
+				}
+			}
+		}
+	}()
+
+	// all nfqueues are set up once StartFilters returns, so
+	// systemd can be told Egress Eddie is ready
+	if notifier != nil {
+		if err := notifier.notify(sdNotifyReady); err != nil {
+			logger.Error("error notifying systemd", zap.NamedError("error", err))
+		}
+
+		interval, ok, err := watchdogInterval()
+		if err != nil {
+			logger.Error("error enabling systemd watchdog", zap.NamedError("error", err))
+		} else if ok {
+			logger.Info("pinging systemd watchdog", zap.Duration("watchdog.interval", interval))
+			filters.startWatchdog(ctx, notifier, interval)
+		}
+	}
 
 	defer func() {
 		cancel()
 		logger.Info("stopping filters")
+		if notifier != nil {
+			if err := notifier.notify(sdNotifyStopping); err != nil {
+				logger.Error("error notifying systemd", zap.NamedError("error", err))
+			}
+		}
 		filters.Stop()
+		if notifier != nil {
+			notifier.close()
+		}
 	}()
 
 	// Install seccomp filters to severely limit what egress-eddie is
@@ -124,7 +260,7 @@ func main() {
 	// The seccomp filters are installed after nfqueues are opened so
 	// the related syscalls do not have to be allowed for the rest of
 	// the process's lifetime.
-	numAllowedSyscalls, err := installSeccompFilters(logger, config.SelfDNSQueue != 0)
+	numAllowedSyscalls, err := installSeccompFilters(logger, config)
 	if err != nil {
 		logger.Error("error setting seccomp rules", zap.NamedError("error", err))
 		return
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// resolverOutage tracks whether DNS requests of a filter are going
+// unanswered, which means the resolver or the path to it is down.
+type resolverOutage struct {
+	// accessed atomically, kept first to ensure 64-bit alignment
+	//
+	// oldestUnanswered is the time in Unix nanoseconds of the oldest
+	// DNS request sent since the last DNS response was received, or
+	// 0 if there is none
+	oldestUnanswered int64
+	failOpens        int64
+	failingOpen      int32
+
+	window time.Duration
+
+	// resolvers holds the addresses of resolvers that have sent DNS
+	// responses. Only requests sent to them are counted, otherwise a
+	// workload could trigger an outage by sending requests to an
+	// address that never responds.
+	resolversMtx sync.RWMutex
+	resolvers    map[netip.AddrPort]struct{}
+}
+
+func newResolverOutage(window time.Duration) *resolverOutage {
+	return &resolverOutage{
+		window:    window,
+		resolvers: make(map[netip.AddrPort]struct{}),
+	}
+}
+
+// requestSent records that a DNS request was sent to resolver.
+func (r *resolverOutage) requestSent(resolver netip.AddrPort, now time.Time) {
+	r.resolversMtx.RLock()
+	_, known := r.resolvers[resolver]
+	r.resolversMtx.RUnlock()
+	if !known {
+		return
+	}
+
+	atomic.CompareAndSwapInt64(&r.oldestUnanswered, 0, now.UnixNano())
+}
+
+// responseReceived records that a DNS response was received from
+// resolver, ending an outage if there was one.
+func (r *resolverOutage) responseReceived(logger *zap.Logger, resolver netip.AddrPort) {
+	r.resolversMtx.RLock()
+	_, known := r.resolvers[resolver]
+	r.resolversMtx.RUnlock()
+	if !known {
+		r.resolversMtx.Lock()
+		r.resolvers[resolver] = struct{}{}
+		r.resolversMtx.Unlock()
+	}
+
+	atomic.StoreInt64(&r.oldestUnanswered, 0)
+	if atomic.CompareAndSwapInt32(&r.failingOpen, 1, 0) {
+		logger.Warn("DNS responses are being received again, no longer failing open")
+	}
+}
+
+// active returns true if DNS requests have gone unanswered for longer
+// than the outage window, in which case traffic should be allowed.
+func (r *resolverOutage) active(logger *zap.Logger, now time.Time) bool {
+	oldest := atomic.LoadInt64(&r.oldestUnanswered)
+	if oldest == 0 || now.Sub(time.Unix(0, oldest)) < r.window {
+		return false
+	}
+
+	if atomic.CompareAndSwapInt32(&r.failingOpen, 0, 1) {
+		atomic.AddInt64(&r.failOpens, 1)
+		logger.Error("no DNS responses received, failing open and allowing all traffic", zap.Duration("outage.window", r.window))
+	}
+
+	return true
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestResolverOutage(t *testing.T) {
+	is := is.New(t)
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(core)
+	outage := newResolverOutage(30 * time.Second)
+	resolver := netip.MustParseAddrPort("192.168.1.1:53")
+	start := time.Now()
+
+	is.True(!outage.active(logger, start.Add(time.Hour))) // no requests have been sent
+
+	// requests to resolvers that never responded could be sent by a
+	// workload to force failing open
+	outage.requestSent(resolver, start)
+	is.True(!outage.active(logger, start.Add(time.Hour))) // requests to unknown resolvers should not be counted
+	outage.responseReceived(logger, resolver)
+	outage.requestSent(netip.MustParseAddrPort("192.168.1.1:5353"), start)
+	is.True(!outage.active(logger, start.Add(time.Hour))) // requests to other ports of known resolvers should not be counted
+
+	outage.requestSent(resolver, start)
+	outage.requestSent(resolver, start.Add(20*time.Second))
+	is.True(!outage.active(logger, start.Add(29*time.Second))) // window hasn't passed yet
+
+	// the window is measured from the oldest unanswered request
+	is.True(outage.active(logger, start.Add(30*time.Second)))
+	is.True(outage.active(logger, start.Add(time.Minute)))
+	is.Equal(outage.failOpens, int64(1))                         // only entering an outage is counted
+	is.Equal(logs.FilterLevelExact(zapcore.ErrorLevel).Len(), 1) // only entering an outage is logged
+
+	outage.responseReceived(logger, resolver)
+	is.True(!outage.active(logger, start.Add(time.Hour)))       // a response ends the outage
+	is.Equal(logs.FilterLevelExact(zapcore.WarnLevel).Len(), 1) // recovering is logged
+	is.Equal(outage.failingOpen, int32(0))                      // recovering is recorded
+
+	// a later outage is detected again
+	outage.requestSent(resolver, start.Add(time.Hour))
+	is.True(outage.active(logger, start.Add(time.Hour+30*time.Second)))
+	is.Equal(outage.failOpens, int64(2)) // the new outage is counted
+}
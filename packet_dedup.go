@@ -0,0 +1,134 @@
+package main
+
+import (
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultMaxDedupPackets is how many packets verdicts are cached
+	// for by default to deduplicate packets
+	defaultMaxDedupPackets = 4096
+	// maxDedupWindow is the longest a verdict can be reused for
+	// duplicate packets. Duplicates are delivered immediately after
+	// the original, and reusing verdicts for longer would delay
+	// changes of allowed IPs from applying to retransmissions.
+	maxDedupWindow = time.Second
+)
+
+// packetDeduper remembers the verdicts of recent packets so identical
+// packets received shortly after get the same verdict without being
+// inspected again. Packets are keyed by a hash with a random seed so
+// collisions can't be crafted to get a verdict of another packet.
+// Memory use is bounded by evicting the oldest packet once maxPackets
+// verdicts are cached.
+type packetDeduper struct {
+	window time.Duration
+	seed   maphash.Seed
+
+	mtx      sync.Mutex
+	verdicts map[uint64]dedupVerdict
+	// order holds the hashes of cached packets from oldest to newest
+	// as a ring, next is the index the next hash will be stored at
+	order []uint64
+	next  int
+	full  bool
+}
+
+type dedupVerdict struct {
+	verdict int
+	seen    time.Time
+}
+
+func newPacketDeduper(window time.Duration, maxPackets int) *packetDeduper {
+	if maxPackets == 0 {
+		maxPackets = defaultMaxDedupPackets
+	}
+
+	return &packetDeduper{
+		window:   window,
+		seed:     maphash.MakeSeed(),
+		verdicts: make(map[uint64]dedupVerdict, maxPackets),
+		order:    make([]uint64, maxPackets),
+	}
+}
+
+func (d *packetDeduper) hash(packet []byte) uint64 {
+	var h maphash.Hash
+	h.SetSeed(d.seed)
+	h.Write(packet)
+	return h.Sum64()
+}
+
+// verdict returns the verdict of an identical packet that was seen
+// within the window.
+func (d *packetDeduper) verdict(packet []byte, now time.Time) (int, bool) {
+	key := d.hash(packet)
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	v, ok := d.verdicts[key]
+	if !ok || now.Sub(v.seen) > d.window {
+		return 0, false
+	}
+
+	return v.verdict, true
+}
+
+// add records the verdict of packet.
+func (d *packetDeduper) add(packet []byte, verdict int, now time.Time) {
+	key := d.hash(packet)
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if _, ok := d.verdicts[key]; !ok {
+		if d.full {
+			delete(d.verdicts, d.order[d.next])
+		}
+		d.order[d.next] = key
+		d.next++
+		if d.next == len(d.order) {
+			d.next = 0
+			d.full = true
+		}
+	}
+	d.verdicts[key] = dedupVerdict{verdict: verdict, seen: now}
+}
+
+func (d *packetDeduper) len() int {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	return len(d.verdicts)
+}
+
+// duplicateVerdict returns the verdict of an identical packet if
+// packets are deduplicated and one was seen within opts.DedupWindow.
+// Duplicates are counted separately from packets that were allowed
+// or dropped so they don't inflate those metrics.
+func (f *filter) duplicateVerdict(packet []byte) (int, bool) {
+	if f.dedup == nil {
+		return 0, false
+	}
+
+	verdict, ok := f.dedup.verdict(packet, time.Now())
+	if ok {
+		atomic.AddInt64(&f.packetsDeduplicated, 1)
+	}
+
+	return verdict, ok
+}
+
+// recordVerdict records the verdict of an inspected packet so its
+// duplicates get the same verdict, if packets are deduplicated.
+func (f *filter) recordVerdict(packet []byte, verdict int) {
+	if f.dedup == nil {
+		return
+	}
+
+	f.dedup.add(packet, verdict, time.Now())
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/florianl/go-nfqueue"
+	"github.com/matryer/is"
+)
+
+func TestPacketDeduper(t *testing.T) {
+	is := is.New(t)
+
+	d := newPacketDeduper(100*time.Millisecond, 2)
+	now := time.Now()
+	first := []byte("first packet")
+
+	_, ok := d.verdict(first, now)
+	is.True(!ok) // unseen packet should not have a verdict
+
+	d.add(first, nfqueue.NfAccept, now)
+	verdict, ok := d.verdict([]byte("first packet"), now.Add(50*time.Millisecond))
+	is.True(ok)                         // identical packet within window should have a verdict
+	is.Equal(verdict, nfqueue.NfAccept) // verdict of original packet should be reused
+
+	_, ok = d.verdict(first, now.Add(200*time.Millisecond))
+	is.True(!ok) // identical packet after window should not have a verdict
+
+	_, ok = d.verdict([]byte("first packeT"), now)
+	is.True(!ok) // different packet should not have a verdict
+
+	d.add([]byte("second packet"), nfqueue.NfDrop, now)
+	d.add([]byte("third packet"), nfqueue.NfDrop, now)
+	is.Equal(d.len(), 2) // cache should not grow past its limit
+	_, ok = d.verdict(first, now)
+	is.True(!ok) // oldest packet should be evicted
+	verdict, ok = d.verdict([]byte("third packet"), now)
+	is.True(ok)                       // newest packet should be cached
+	is.Equal(verdict, nfqueue.NfDrop) // verdict of newest packet should be reused
+}
+
+func TestDuplicateVerdictCounting(t *testing.T) {
+	is := is.New(t)
+
+	f := newTestFilter(&FilterOptions{
+		AllowAnswersFor:  duration(time.Minute),
+		AllowedHostnames: []string{"example.com"},
+	})
+	t.Cleanup(f.close)
+	packet := []byte("packet")
+
+	f.recordVerdict(packet, nfqueue.NfAccept)
+	_, ok := f.duplicateVerdict(packet)
+	is.True(!ok) // packets should not be deduplicated by default
+
+	f.dedup = newPacketDeduper(time.Second, 0)
+	f.countVerdict(nfqueue.NfAccept)
+	f.recordVerdict(packet, nfqueue.NfAccept)
+	verdict, ok := f.duplicateVerdict(packet)
+	is.True(ok)                         // duplicate packet should get a cached verdict
+	is.Equal(verdict, nfqueue.NfAccept) // duplicate should get the verdict of the original
+
+	status := f.status()
+	is.Equal(status.PacketsAllowed, int64(1))      // duplicate should not be counted as allowed again
+	is.Equal(status.PacketsDeduplicated, int64(1)) // duplicate should be counted as deduplicated
+}
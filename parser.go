@@ -0,0 +1,139 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// dnsParsers pools DNS packet parsers, the first pool holds parsers
+// of IPv4 packets and the second of IPv6 packets.
+var dnsParsers = [2]sync.Pool{
+	{New: func() interface{} { return newDNSParser(false) }},
+	{New: func() interface{} { return newDNSParser(true) }},
+}
+
+// dnsParser decodes DNS packets of a single IP version. Parsers are
+// reused between packets so the parser and its layers only have to
+// be set up once.
+type dnsParser struct {
+	ipv6 bool
+
+	ip4 layers.IPv4
+	ip6 layers.IPv6
+	udp layers.UDP
+	tcp layers.TCP
+	// dns is replaced before every packet is decoded as decoded DNS
+	// layers are used after the parser is reused
+	dns dnsLayer
+
+	parser  *gopacket.DecodingLayerParser
+	decoded []gopacket.LayerType
+}
+
+// dnsLayer allows the DNS layer a parser decodes into to be replaced.
+type dnsLayer struct {
+	*layers.DNS
+}
+
+func newDNSParser(ipv6 bool) *dnsParser {
+	p := dnsParser{
+		ipv6:    ipv6,
+		dns:     dnsLayer{DNS: new(layers.DNS)},
+		decoded: make([]gopacket.LayerType, 0, 3),
+	}
+	if !ipv6 {
+		p.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4, &p.ip4, &p.udp, &p.tcp, &p.dns)
+	} else {
+		p.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv6, &p.ip6, &p.udp, &p.tcp, &p.dns)
+	}
+
+	return &p
+}
+
+func getDNSParser(ipv6 bool) *dnsParser {
+	return dnsParsers[familyIndex(ipv6)].Get().(*dnsParser)
+}
+
+func putDNSParser(p *dnsParser) {
+	dnsParsers[familyIndex(p.ipv6)].Put(p)
+}
+
+// decode decodes packet and returns the decoded DNS layer, which is
+// never reused by the parser.
+func (p *dnsParser) decode(packet []byte) (*layers.DNS, error) {
+	p.dns.DNS = new(layers.DNS)
+
+	return p.dns.DNS, p.parser.DecodeLayers(packet, &p.decoded)
+}
+
+// trafficParser decodes the network and optionally the transport
+// layers of packets of a single IP version.
+type trafficParser struct {
+	ipv6 bool
+
+	ip4 layers.IPv4
+	ip6 layers.IPv6
+	udp layers.UDP
+	tcp layers.TCP
+
+	parser  *gopacket.DecodingLayerParser
+	decoded []gopacket.LayerType
+}
+
+func newTrafficParser(ipv6, transport bool) *trafficParser {
+	p := trafficParser{
+		ipv6:    ipv6,
+		decoded: make([]gopacket.LayerType, 0, 2),
+	}
+	if !ipv6 {
+		p.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4)
+		p.parser.IgnoreUnsupported = true
+		p.parser.SetDecodingLayerContainer(gopacket.DecodingLayerArray(nil))
+		p.parser.AddDecodingLayer(&p.ip4)
+	} else {
+		p.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv6)
+		p.parser.IgnoreUnsupported = true
+		p.parser.SetDecodingLayerContainer(gopacket.DecodingLayerArray(nil))
+		p.parser.AddDecodingLayer(&p.ip6)
+	}
+	if transport {
+		p.parser.AddDecodingLayer(&p.udp)
+		p.parser.AddDecodingLayer(&p.tcp)
+	}
+
+	return &p
+}
+
+// getTrafficParser returns a parser of the traffic of the filter.
+// Transport layers are only decoded if the filter needs them.
+func (f *filter) getTrafficParser(ipv6 bool) *trafficParser {
+	if p, ok := f.trafficParsers[familyIndex(ipv6)].Get().(*trafficParser); ok {
+		return p
+	}
+
+	// only parse transport layers if ports, SNIs or HTTP requests
+	// need to be validated
+	transport := len(f.opts.AllowedSrcPorts) > 0 || len(f.opts.AllowedDstPorts) > 0 || f.opts.MatchSNI || f.opts.BlockDoH
+	return newTrafficParser(ipv6, transport)
+}
+
+func (f *filter) putTrafficParser(p *trafficParser) {
+	f.trafficParsers[familyIndex(p.ipv6)].Put(p)
+}
+
+// decode decodes packet, the decoded layers are only valid until the
+// parser is reused.
+func (p *trafficParser) decode(packet []byte) error {
+	return p.parser.DecodeLayers(packet, &p.decoded)
+}
+
+// familyIndex returns the index of parsers of an IP version in pools
+// of parsers.
+func familyIndex(ipv6 bool) int {
+	if ipv6 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/matryer/is"
+)
+
+func newTestDNSResponse(hostname string, ip net.IP) *layers.DNS {
+	return &layers.DNS{
+		QR:     true,
+		OpCode: layers.DNSOpCodeQuery,
+		Questions: []layers.DNSQuestion{
+			{
+				Name:  []byte(hostname),
+				Type:  layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+			},
+		},
+		Answers: []layers.DNSResourceRecord{
+			{
+				Name:  []byte(hostname),
+				Type:  layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+				TTL:   300,
+				IP:    ip,
+			},
+		},
+	}
+}
+
+func TestParseDNSPacketReusesParsers(t *testing.T) {
+	is := is.New(t)
+
+	foo, fooConnID, err := parseDNSPacket(newDNSPacket(t, newTestDNSResponse("foo.com", net.IP{192, 0, 2, 1})), false, true, false)
+	is.NoErr(err) // parsing DNS response should succeed
+	bar, _, err := parseDNSPacket(newDNSPacket(t, newTestDNSResponse("bar.com", net.IP{192, 0, 2, 2})), false, true, false)
+	is.NoErr(err) // parsing DNS response should succeed
+
+	is.True(foo != bar)                                   // parsed DNS layers should not be shared
+	is.Equal(string(foo.Questions[0].Name), "foo.com")    // earlier DNS layers should not be overwritten
+	is.Equal(foo.Answers[0].IP.String(), "192.0.2.1")     // earlier answers should not be overwritten
+	is.Equal(string(bar.Questions[0].Name), "bar.com")    // later DNS layers should be parsed
+	is.True(fooConnID.isUDP)                              // UDP connections should be detected
+	is.Equal(fooConnID.src.String(), "192.168.1.1:53")    // inbound source should be the destination
+	is.Equal(fooConnID.dst.String(), "192.168.1.2:40000") // inbound destination should be the source
+}
+
+func TestTrafficParser(t *testing.T) {
+	is := is.New(t)
+
+	packet := newDNSPacket(t, newTestDNSResponse("foo.com", net.IP{192, 0, 2, 1}))
+
+	f := newTestFilter(&FilterOptions{})
+	p := f.getTrafficParser(false)
+	is.NoErr(p.decode(packet))                                      // parsing packet should succeed
+	is.Equal(p.decoded, []gopacket.LayerType{layers.LayerTypeIPv4}) // transport layers should only be parsed if needed
+	f.putTrafficParser(p)
+
+	f = newTestFilter(&FilterOptions{AllowedDstPorts: []uint16{53}})
+	for i := 0; i < 2; i++ {
+		p = f.getTrafficParser(false)
+		is.NoErr(p.decode(packet))                                                           // parsing packet should succeed
+		is.Equal(p.decoded, []gopacket.LayerType{layers.LayerTypeIPv4, layers.LayerTypeUDP}) // transport layers should be parsed if ports are validated
+		is.Equal(p.ip4.DstIP.String(), "192.168.1.1")                                        // destination IP should be parsed
+		is.Equal(p.udp.DstPort, layers.UDPPort(53))                                          // destination port should be parsed
+		f.putTrafficParser(p)
+	}
+
+	p = f.getTrafficParser(true)
+	is.True(p.ipv6) // IPv6 parsers should be returned for IPv6 packets
+}
+
+func BenchmarkTrafficParser(b *testing.B) {
+	packet := newDNSPacket(b, newTestDNSResponse("example.com", net.IP{192, 0, 2, 1}))
+	f := newTestFilter(&FilterOptions{AllowedDstPorts: []uint16{53}})
+
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			p := newTrafficParser(false, true)
+			if err := p.decode(packet); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			p := f.getTrafficParser(false)
+			if err := p.decode(packet); err != nil {
+				b.Fatal(err)
+			}
+			f.putTrafficParser(p)
+		}
+	})
+}
+
+func BenchmarkParseDNSPacket(b *testing.B) {
+	packet := newDNSPacket(b, newTestDNSResponse("example.com", net.IP{192, 0, 2, 1}))
+
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			p := newDNSParser(false)
+			if _, err := p.decode(packet); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, _, err := parseDNSPacket(packet, false, true, false); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// pauseLogInterval is how often dropping packets while egress is
+// paused is logged.
+const pauseLogInterval = 10 * time.Second
+
+// pauseSwitch is shared by a filter manager and its filters so all
+// egress can be blocked at once without stopping filters. A nil
+// pauseSwitch is never paused.
+type pauseSwitch struct {
+	paused int32
+
+	mtx        sync.Mutex
+	now        func() time.Time
+	logged     time.Time
+	suppressed int
+}
+
+func newPauseSwitch() *pauseSwitch {
+	return &pauseSwitch{now: time.Now}
+}
+
+func (p *pauseSwitch) isPaused() bool {
+	return p != nil && atomic.LoadInt32(&p.paused) == 1
+}
+
+// set pauses or resumes egress, and returns true if it wasn't already
+// paused or resumed.
+func (p *pauseSwitch) set(paused bool) bool {
+	if paused {
+		return atomic.CompareAndSwapInt32(&p.paused, 0, 1)
+	}
+	return atomic.CompareAndSwapInt32(&p.paused, 1, 0)
+}
+
+// logDrop logs that a packet was dropped because egress is paused. It
+// is logged at most once per pauseLogInterval, with how many drops
+// weren't logged since.
+func (p *pauseSwitch) logDrop(logger *zap.Logger, msg string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	now := p.now()
+	if !p.logged.IsZero() && now.Sub(p.logged) < pauseLogInterval {
+		p.suppressed++
+		return
+	}
+
+	logger.Warn(msg, zap.String("reason", "egress paused"), zap.Int("packets.suppressed", p.suppressed))
+	p.logged = now
+	p.suppressed = 0
+}
+
+// Pause drops all packets of every filter, regardless of what they
+// allow, until Resume is called. Packets with the break-glass mark are
+// still accepted.
+func (f *FilterManager) Pause() {
+	if f.paused.set(true) {
+		f.logger.Warn("paused egress, all packets will be dropped")
+	}
+}
+
+// Resume stops dropping all packets after Pause was called, so filters
+// process packets normally again.
+func (f *FilterManager) Resume() {
+	if f.paused.set(false) {
+		f.logger.Info("resumed egress")
+	}
+}
+
+// Paused returns true if egress is paused.
+func (f *FilterManager) Paused() bool {
+	return f.paused.isPaused()
+}
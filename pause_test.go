@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestPauseSwitch(t *testing.T) {
+	is := is.New(t)
+
+	var nilSwitch *pauseSwitch
+	is.True(!nilSwitch.isPaused()) // nil switch should never be paused
+
+	f := FilterManager{
+		logger: zap.NewNop(),
+		paused: newPauseSwitch(),
+	}
+	is.True(!f.Paused()) // egress should not be paused initially
+
+	f.Pause()
+	is.True(f.Paused())          // egress should be paused
+	is.True(f.Status().Paused)   // status should show egress is paused
+	is.True(!f.paused.set(true)) // pausing again should not change anything
+
+	f.Resume()
+	is.True(!f.Paused())          // egress should be resumed
+	is.True(!f.paused.set(false)) // resuming again should not change anything
+}
+
+func TestPauseLogDrop(t *testing.T) {
+	is := is.New(t)
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	logger := zap.New(core)
+
+	now := time.Now()
+	p := newPauseSwitch()
+	p.now = func() time.Time { return now }
+
+	p.logDrop(logger, "dropping packet while egress is paused")
+	p.logDrop(logger, "dropping packet while egress is paused")
+	p.logDrop(logger, "dropping packet while egress is paused")
+	is.Equal(logs.Len(), 1) // drops within the interval should not be logged
+
+	now = now.Add(pauseLogInterval)
+	p.logDrop(logger, "dropping packet while egress is paused")
+	entries := logs.AllUntimed()
+	is.Equal(len(entries), 2)                                         // drops after the interval should be logged
+	is.Equal(entries[1].ContextMap()["reason"], "egress paused")      // drops should be logged with why they were dropped
+	is.Equal(entries[1].ContextMap()["packets.suppressed"], int64(2)) // drops that weren't logged should be counted
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"go.uber.org/zap"
+)
+
+// maxPostResponseGrace is the longest post-response grace window, so
+// answer IPs can't stay allowed past their expiry for long.
+const maxPostResponseGrace = 10 * time.Second
+
+// graceAnswer is an answer IP of a DNS response and the source of the
+// DNS request it answered.
+type graceAnswer struct {
+	src netip.Addr
+	ip  netip.Addr
+}
+
+// startPostResponseGrace allows new connections from the source of the
+// DNS request of connID to the answer IPs of dns that were allowed for
+// opts.PostResponseGrace, so a client can connect to an answer IP even
+// if it expires before the client does.
+func (f *filter) startPostResponseGrace(logger *zap.Logger, dns *layers.DNS, connID connectionID, ifIndex *uint32) {
+	src := connID.src.Addr()
+	window := time.Duration(f.opts.PostResponseGrace)
+	for _, answer := range dns.Answers {
+		if answer.Type != layers.DNSTypeA && answer.Type != layers.DNSTypeAAAA {
+			continue
+		}
+		ip, ok := netip.AddrFromSlice(answer.IP)
+		if !ok {
+			continue
+		}
+		ip = zoneLinkLocal(ip.Unmap(), ifIndex)
+		// answers that weren't allowed, for example because they
+		// are listed on a DNSBL, must not be allowed by the grace
+		// window either
+		if !f.allowedIPs.EntryExists(ip) {
+			continue
+		}
+
+		logger.Debug("allowing new connections from source to answer IP after DNS response", zap.Stringer("conn.src", src), zap.Stringer("answer.ip", ip), zap.Duration("grace.window", window))
+		f.graceAnswers.AddEntry(graceAnswer{src: src, ip: ip}, window)
+	}
+}
+
+// inPostResponseGrace returns true if a packet from src to dst that
+// starts a new connection was sent within the post-response grace
+// window of a DNS response to src that had dst as an answer.
+func (f *filter) inPostResponseGrace(src, dst netip.Addr, ctInfo *uint32) bool {
+	if f.graceAnswers == nil || ctInfo == nil || *ctInfo != stateNew {
+		return false
+	}
+
+	return f.graceAnswers.EntryExists(graceAnswer{src: src, ip: dst})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/florianl/go-nfqueue"
+	"github.com/google/gopacket/layers"
+	"github.com/matryer/is"
+	"go.uber.org/zap"
+)
+
+func TestPostResponseGrace(t *testing.T) {
+	is := is.New(t)
+
+	f, dnsReqQueue, genericQueue := newCallbackTestFilter(t, &FilterOptions{
+		Name:              "foo",
+		DNSQueue:          1000,
+		TrafficQueue:      1001,
+		IPVersion:         4,
+		AllowAnswersFor:   duration(time.Minute),
+		AllowedHostnames:  []string{"example.com"},
+		PostResponseGrace: duration(2 * time.Second),
+		MatchSNI:          true,
+	})
+	f.graceAnswers = NewTimedCache[graceAnswer](zap.NewNop(), false)
+	f.ipHostnames = NewTimedCache[ipHostname](zap.NewNop(), false)
+	f.reassembly = newReassembler(0, 0)
+	manager, respQueue := newCallbackTestManager(f)
+	reqCallback := newDNSRequestCallback(f)
+	respCallback := newDNSResponseCallback(manager)
+	genericCallback := newGenericCallback(f)
+
+	client := netip.MustParseAddrPort("192.168.1.2:40000")
+	resolver := netip.MustParseAddrPort("192.168.1.1:53")
+	answer := netip.MustParseAddrPort("192.0.2.1:443")
+
+	syn := newTCPPacketBetween(t, netip.AddrPortFrom(client.Addr(), 50000), answer, 1000, nil)
+	genericCallback(newPacketAttribute(1, stateNew, syn))
+	verdict, _ := genericQueue.verdict(1)
+	is.Equal(verdict, nfqueue.NfDrop) // new connections should not be allowed before a response
+
+	reqCallback(newPacketAttribute(2, stateNew, newDNSPacketBetween(t, client, resolver, newTestDNSRequest("example.com"))))
+	verdict, _ = dnsReqQueue.verdict(2)
+	is.Equal(verdict, nfqueue.NfAccept)
+	response := newTestDNSRequest("example.com")
+	response.QR = true
+	response.Answers = []layers.DNSResourceRecord{
+		{
+			Name:  []byte("example.com"),
+			Type:  layers.DNSTypeA,
+			Class: layers.DNSClassIN,
+			TTL:   60,
+			IP:    net.IPv4(192, 0, 2, 1),
+		},
+	}
+	respCallback(newPacketAttribute(3, stateEstablishedReply, newDNSPacketBetween(t, resolver, client, response)))
+	verdict, _ = respQueue.verdict(3)
+	is.Equal(verdict, nfqueue.NfAccept)
+
+	// expire the answer IP right after its response
+	f.removeAllowedIP(answer.Addr())
+
+	genericCallback(newPacketAttribute(4, stateNew, syn))
+	verdict, _ = genericQueue.verdict(4)
+	is.Equal(verdict, nfqueue.NfAccept)                                // new connections to answer IPs should be allowed after a response
+	is.Equal(f.packetsAllowedBy[allowedByPostResponseGrace], int64(1)) // packets allowed by the grace window should be counted
+
+	genericCallback(newPacketAttribute(5, stateEstablished, syn))
+	verdict, _ = genericQueue.verdict(5)
+	is.Equal(verdict, nfqueue.NfDrop) // only new connections should be allowed
+
+	otherDst := newTCPPacketBetween(t, netip.AddrPortFrom(client.Addr(), 50001), netip.MustParseAddrPort("198.51.100.1:443"), 1000, nil)
+	genericCallback(newPacketAttribute(6, stateNew, otherDst))
+	verdict, _ = genericQueue.verdict(6)
+	is.Equal(verdict, nfqueue.NfDrop) // new connections to IPs that weren't answers should not be allowed
+
+	otherSrc := newTCPPacketBetween(t, netip.MustParseAddrPort("192.168.1.3:50000"), answer, 1000, nil)
+	genericCallback(newPacketAttribute(7, stateNew, otherSrc))
+	verdict, _ = genericQueue.verdict(7)
+	is.Equal(verdict, nfqueue.NfDrop) // new connections from other sources should not be allowed
+
+	hello := newTCPPacketBetween(t, netip.AddrPortFrom(client.Addr(), 50000), answer, 1001, newClientHello(t, "evil.com"))
+	genericCallback(newPacketAttribute(8, stateNew, hello))
+	verdict, _ = genericQueue.verdict(8)
+	is.Equal(verdict, nfqueue.NfDrop) // server names should still be matched within the grace window
+
+	expires, ok := f.graceAnswers.Expires(graceAnswer{src: client.Addr(), ip: answer.Addr()})
+	is.True(ok)
+	is.True(time.Until(expires) <= 2*time.Second) // grace window should only last as long as configured
+
+	var disabled filter
+	is.True(!disabled.inPostResponseGrace(client.Addr(), answer.Addr(), &[]uint32{stateNew}[0])) // new connections should not be allowed if the grace window is disabled
+}
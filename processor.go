@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"go.uber.org/zap"
+)
+
+// responseProcessor allows IPs and hostnames from DNS responses. A
+// custom responseProcessor can be set on a filter to allow traffic
+// based on records that aren't handled by default.
+type responseProcessor interface {
+	// processResponse is called with every DNS response the filter
+	// accepts. connID identifies the connection of the DNS request
+	// and ifIndex is the index of the interface the response was
+	// received on, which may be nil. IPs and hostnames should be
+	// allowed with f.allowIP and f.allowHostname.
+	processResponse(logger *zap.Logger, f *filter, dns *layers.DNS, connID connectionID, ifIndex *uint32)
+}
+
+// defaultResponseProcessor allows IPs from A and AAAA answers, and
+// hostnames from CNAME and SRV answers. If the filter checks bailiwick,
+// answers that are out of bailiwick are ignored. If the filter allows
+// SRV ports, the ports of SRV answers are allowed for the IPs their
+// targets resolve to.
+type defaultResponseProcessor struct{}
+
+func (defaultResponseProcessor) processResponse(logger *zap.Logger, f *filter, dns *layers.DNS, _ connectionID, ifIndex *uint32) {
+	ttl := time.Duration(f.opts.AllowAnswersFor)
+
+	var inBailiwick *hostnameTrie
+	if f.opts.BailiwickCheck {
+		inBailiwick = bailiwick(dns)
+	}
+	srvPorts := f.srvTargetPorts(dns)
+	for _, answer := range dns.Answers {
+		if inBailiwick != nil && !inBailiwick.matches(normalizeHostname(string(answer.Name))) {
+			logger.Warn("ignoring out-of-bailiwick answer", zap.ByteString("answer.name", answer.Name), zap.Stringer("answer.type", answer.Type), zap.Strings("response.questions", questionStrings(dns.Questions)))
+			continue
+		}
+
+		switch answer.Type {
+		case layers.DNSTypeA, layers.DNSTypeAAAA:
+			// temporarily add A and AAAA answers to allowed IP list
+			ip, ok := netip.AddrFromSlice(answer.IP)
+			if !ok {
+				logger.Error("error converting IP", zap.Stringer("answer.ip", answer.IP))
+				continue
+			}
+			f.allowIP(logger, zoneLinkLocal(ip, ifIndex), ttl)
+			f.allowSRVAddrs(logger, zoneLinkLocal(ip, ifIndex), srvPorts, ttl)
+		case layers.DNSTypeCNAME:
+			// temporarily add CNAME answers to allowed hostnames list
+			f.allowHostname(logger, string(answer.CNAME), answerSource(answer), ttl)
+		case layers.DNSTypeSRV:
+			// temporarily add SRV answers to allowed hostnames list
+			f.allowHostname(logger, string(answer.SRV.Name), answerSource(answer), ttl)
+			f.allowSRVTarget(logger, string(answer.SRV.Name), answer.SRV.Port, ttl)
+		}
+	}
+}
+
+// bailiwick returns a trie that matches the names answers of a
+// response are allowed to be owned by: the names of its questions, the
+// targets of CNAME answers owned by those names, and their subdomains.
+func bailiwick(dns *layers.DNS) *hostnameTrie {
+	var t hostnameTrie
+	for _, question := range dns.Questions {
+		t.add(normalizeHostname(string(question.Name)))
+	}
+
+	// CNAME chains may be in any order, so follow them until no
+	// more targets are added
+	for added := true; added; {
+		added = false
+		for _, answer := range dns.Answers {
+			if answer.Type != layers.DNSTypeCNAME || !t.matches(normalizeHostname(string(answer.Name))) {
+				continue
+			}
+			if t.add(normalizeHostname(string(answer.CNAME))) {
+				added = true
+			}
+		}
+	}
+
+	return &t
+}
+
+// allowIP temporarily allows traffic to ip unless it is listed by a
+// DNSBL.
+func (f *filter) allowIP(logger *zap.Logger, ip netip.Addr, ttl time.Duration) {
+	// IPv4-mapped IPv6 addresses will be connected to over IPv4, so
+	// allow the IPv4 address as well
+	if ip.Is4In6() {
+		unmapped := ip.Unmap()
+		if f.ipBlocklisted(logger, unmapped) {
+			return
+		}
+		f.allowAnswerIP(logger, unmapped, ttl)
+	} else if f.ipBlocklisted(logger, ip) {
+		return
+	}
+
+	f.allowAnswerIP(logger, ip, ttl)
+}
+
+// allowAnswerIP allows ip from a DNS answer for ttl, unless it is
+// already allowed and won't expire within opts.AnswerDedupWindow.
+// Short TTL hostnames are often resolved again, so this avoids
+// resetting the expiry of their IPs and logging them every time.
+func (f *filter) allowAnswerIP(logger *zap.Logger, ip netip.Addr, ttl time.Duration) {
+	if window := time.Duration(f.opts.AnswerDedupWindow); window != 0 {
+		if expires, ok := f.allowedIPs.Expires(ip); ok && time.Until(expires) > window {
+			logger.Debug("IP from DNS reply is already allowed", zap.Stringer("answer.ip", ip), zap.Time("ip.expires", expires))
+			return
+		}
+	}
+
+	logger.Info("allowing IP from DNS reply", zap.Stringer("answer.ip", ip), zap.Duration("answer.ttl", ttl))
+	f.allowIPBy(ip, allowedByDNSAnswer, ttl)
+	f.mirrorAllowedIP(ip, stateSourceDNSResponse, "", ttl)
+}
+
+// HostnameSource is the DNS answer that caused a hostname to be
+// allowed.
+type HostnameSource struct {
+	// Type is the type of the answer, "CNAME" or "SRV"
+	Type string `json:"type"`
+	// Name is the name that owns the answer
+	Name string `json:"name"`
+}
+
+// answerSource returns the source of hostnames allowed from answer.
+func answerSource(answer layers.DNSResourceRecord) HostnameSource {
+	return HostnameSource{
+		Type: answer.Type.String(),
+		Name: normalizeHostname(string(answer.Name)),
+	}
+}
+
+// sourcedHostname is a hostname allowed at runtime and an answer that
+// caused it to be allowed.
+type sourcedHostname struct {
+	hostname string
+	source   HostnameSource
+}
+
+// allowHostname temporarily allows DNS requests for hostname unless
+// only explicitly allowed hostnames should be allowed. source is the
+// answer hostname is from.
+func (f *filter) allowHostname(logger *zap.Logger, hostname string, source HostnameSource, ttl time.Duration) {
+	if f.opts.DisableDynamicHostnames {
+		return
+	}
+
+	logger.Info("allowing hostname from DNS reply", zap.String("answer.name", hostname), zap.String("answer.type", source.Type), zap.String("answer.owner", source.Name), zap.Duration("answer.ttl", ttl))
+	f.additionalHostnames.AddEntry(hostname, ttl)
+	if f.hostnameSources != nil {
+		f.hostnameSources.AddEntry(sourcedHostname{hostname: hostname, source: source}, ttl)
+	}
+	f.mirrorAdditionalHostname(hostname, ttl)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/matryer/is"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// txtResponseProcessor allows IPs declared in TXT records in the form
+// "ip=<address>" in addition to the default record types.
+type txtResponseProcessor struct {
+	defaultResponseProcessor
+}
+
+func (t txtResponseProcessor) processResponse(logger *zap.Logger, f *filter, dns *layers.DNS, connID connectionID, ifIndex *uint32) {
+	t.defaultResponseProcessor.processResponse(logger, f, dns, connID, ifIndex)
+
+	for _, answer := range dns.Answers {
+		if answer.Type != layers.DNSTypeTXT {
+			continue
+		}
+		for _, txt := range answer.TXTs {
+			ip, err := netip.ParseAddr(strings.TrimPrefix(string(txt), "ip="))
+			if err != nil {
+				continue
+			}
+			f.allowIP(logger, ip, time.Duration(f.opts.AllowAnswersFor))
+		}
+	}
+}
+
+func TestCustomResponseProcessor(t *testing.T) {
+	is := is.New(t)
+
+	f := newTestFilter(&FilterOptions{
+		Name:            "foo",
+		DNSQueue:        1000,
+		TrafficQueue:    1001,
+		AllowAnswersFor: duration(time.Minute),
+	})
+	f.responseProcessor = txtResponseProcessor{}
+	t.Cleanup(f.close)
+
+	f.allowAnswers(zap.NewNop(), &layers.DNS{
+		Answers: []layers.DNSResourceRecord{
+			{
+				Name:  []byte("example.com"),
+				Type:  layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+				IP:    net.IP{192, 0, 2, 1},
+			},
+			{
+				Name:  []byte("example.com"),
+				Type:  layers.DNSTypeTXT,
+				Class: layers.DNSClassIN,
+				TXTs:  [][]byte{[]byte("ip=192.0.2.2"), []byte("v=spf1 -all")},
+			},
+		},
+	}, connectionID{}, nil)
+
+	is.True(f.allowedIPs.EntryExists(netip.MustParseAddr("192.0.2.1"))) // IPs from A records should be allowed by default
+	is.True(f.allowedIPs.EntryExists(netip.MustParseAddr("192.0.2.2"))) // IPs declared in TXT records should be allowed
+	is.Equal(f.allowedIPs.Len(), 2)                                     // unrelated TXT records should be ignored
+}
+
+func TestAnswerDedupWindow(t *testing.T) {
+	is := is.New(t)
+
+	f := newTestFilter(&FilterOptions{
+		Name:              "foo",
+		DNSQueue:          1000,
+		TrafficQueue:      1001,
+		AllowAnswersFor:   duration(time.Minute),
+		AnswerDedupWindow: duration(10 * time.Second),
+	})
+	t.Cleanup(f.close)
+
+	core, logs := observer.New(zap.InfoLevel)
+	logger := zap.New(core)
+	ip := netip.MustParseAddr("192.0.2.1")
+
+	f.allowIP(logger, ip, time.Minute)
+	expires, ok := f.allowedIPs.Expires(ip)
+	is.True(ok) // IP should be allowed
+
+	for i := 0; i < 3; i++ {
+		f.allowIP(logger, ip, time.Minute)
+	}
+	is.Equal(logs.FilterMessage("allowing IP from DNS reply").Len(), 1) // repeated answers within the window should not be logged
+	newExpires, _ := f.allowedIPs.Expires(ip)
+	is.Equal(newExpires, expires) // repeated answers within the window should not refresh the IP
+
+	// make the IP expire within the window
+	f.allowedIPs.AddEntry(ip, 5*time.Second)
+	f.allowIP(logger, ip, time.Minute)
+	is.Equal(logs.FilterMessage("allowing IP from DNS reply").Len(), 2) // answers should be allowed again once the IP is about to expire
+	newExpires, _ = f.allowedIPs.Expires(ip)
+	is.True(time.Until(newExpires) > 10*time.Second) // IPs about to expire should be refreshed
+}
+
+func TestBailiwickCheck(t *testing.T) {
+	dns := &layers.DNS{
+		Questions: []layers.DNSQuestion{
+			{
+				Name:  []byte("Example.com"),
+				Type:  layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+			},
+		},
+		Answers: []layers.DNSResourceRecord{
+			// CNAME chains may be in any order
+			{
+				Name:  []byte("cdn.example.net"),
+				Type:  layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+				IP:    net.IP{192, 0, 2, 1},
+			},
+			{
+				Name:  []byte("example.com."),
+				Type:  layers.DNSTypeCNAME,
+				Class: layers.DNSClassIN,
+				CNAME: []byte("cdn.example.net"),
+			},
+			{
+				Name:  []byte("www.example.com"),
+				Type:  layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+				IP:    net.IP{192, 0, 2, 2},
+			},
+			{
+				Name:  []byte("attacker.com"),
+				Type:  layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+				IP:    net.IP{192, 0, 2, 3},
+			},
+			{
+				Name:  []byte("attacker.com"),
+				Type:  layers.DNSTypeCNAME,
+				Class: layers.DNSClassIN,
+				CNAME: []byte("poisoned.com"),
+			},
+			{
+				Name:  []byte("poisoned.com"),
+				Type:  layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+				IP:    net.IP{192, 0, 2, 4},
+			},
+		},
+	}
+
+	tests := []struct {
+		testName       string
+		bailiwickCheck bool
+		allowedIPs     []string
+		deniedIPs      []string
+	}{
+		{
+			testName:       "bailiwick not checked",
+			bailiwickCheck: false,
+			allowedIPs:     []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"},
+		},
+		{
+			testName:       "bailiwick checked",
+			bailiwickCheck: true,
+			allowedIPs:     []string{"192.0.2.1", "192.0.2.2"},
+			deniedIPs:      []string{"192.0.2.3", "192.0.2.4"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			is := is.New(t)
+
+			f := newTestFilter(&FilterOptions{
+				Name:            "foo",
+				DNSQueue:        1000,
+				TrafficQueue:    1001,
+				AllowAnswersFor: duration(time.Minute),
+				BailiwickCheck:  tt.bailiwickCheck,
+			})
+			t.Cleanup(f.close)
+
+			f.allowAnswers(zap.NewNop(), dns, connectionID{}, nil)
+
+			for _, ip := range tt.allowedIPs {
+				is.True(f.allowedIPs.EntryExists(netip.MustParseAddr(ip))) // in-bailiwick IP should be allowed
+			}
+			for _, ip := range tt.deniedIPs {
+				is.True(!f.allowedIPs.EntryExists(netip.MustParseAddr(ip))) // out-of-bailiwick IP should not be allowed
+			}
+			is.True(f.additionalHostnames.EntryExists("cdn.example.net"))                   // in-bailiwick CNAME target should be allowed
+			is.Equal(f.additionalHostnames.EntryExists("poisoned.com"), !tt.bailiwickCheck) // out-of-bailiwick CNAME target should only be allowed if bailiwick isn't checked
+			is.True(f.hostnameSources.EntryExists(sourcedHostname{
+				hostname: "cdn.example.net",
+				source:   HostnameSource{Type: "CNAME", Name: "example.com"},
+			})) // answer that allowed the CNAME target should be recorded
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/florianl/go-nfqueue"
+	"github.com/mdlayher/netlink"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// netfilter constants x/sys/unix doesn't define
+const (
+	nfQueue         = 3 // NF_QUEUE
+	nfqnlMsgVerdict = 1 // NFQNL_MSG_VERDICT
+	nfqaVerdictHdr  = 2 // NFQA_VERDICT_HDR
+)
+
+// packetQueue is an nfqueue that verdicts of packets are set on.
+type packetQueue interface {
+	SetVerdict(id uint32, verdict int) error
+	// sendVerdict sends a verdict message built by
+	// queueVerdictMessage
+	sendVerdict(msg netlink.Message) error
+	Close() error
+}
+
+// nfPacketQueue is a packetQueue of an opened nfqueue.
+type nfPacketQueue struct {
+	*nfqueue.Nfqueue
+}
+
+func (n nfPacketQueue) sendVerdict(msg netlink.Message) error {
+	_, err := n.Con.Send(msg)
+	return err
+}
+
+// queueVerdictMessage returns a netlink message that sets the verdict
+// of packet id of queueNum to pass it to nextQueue. go-nfqueue only
+// sets the lowest byte of verdicts, but the queue to pass a packet to
+// is stored in the upper 16 bits of NF_QUEUE verdicts.
+func queueVerdictMessage(queueNum uint16, id uint32, nextQueue uint16) (netlink.Message, error) {
+	// struct nfqnl_msg_verdict_hdr
+	verdictHdr := make([]byte, 8)
+	binary.BigEndian.PutUint32(verdictHdr[:4], nfQueue|uint32(nextQueue)<<16)
+	binary.BigEndian.PutUint32(verdictHdr[4:], id)
+
+	attrs, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: nfqaVerdictHdr, Data: verdictHdr},
+	})
+	if err != nil {
+		return netlink.Message{}, err
+	}
+
+	// struct nfgenmsg, the queue number is the resource ID
+	data := []byte{unix.AF_UNSPEC, unix.NFNETLINK_V0, 0, 0}
+	binary.BigEndian.PutUint16(data[2:], queueNum)
+
+	return netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.NFNL_SUBSYS_QUEUE<<8 | nfqnlMsgVerdict),
+			Flags: netlink.Request,
+		},
+		Data: append(data, attrs...),
+	}, nil
+}
+
+// nextQueuePacketQueue is a traffic queue that passes accepted
+// packets to another nfqueue instead of accepting them.
+type nextQueuePacketQueue struct {
+	packetQueue
+	queueNum  uint16
+	nextQueue uint16
+}
+
+func (n nextQueuePacketQueue) SetVerdict(id uint32, verdict int) error {
+	if verdict != nfqueue.NfAccept {
+		return n.packetQueue.SetVerdict(id, verdict)
+	}
+
+	msg, err := queueVerdictMessage(n.queueNum, id, n.nextQueue)
+	if err != nil {
+		return err
+	}
+
+	return n.sendVerdict(msg)
+}
+
+// trafficQueue returns the traffic queue verdicts should be set on.
+// Accepted packets are passed to opts.NextQueue instead if it is set,
+// so other tools can process them.
+func (f *filter) trafficQueue() packetQueue {
+	if f.opts.NextQueue == 0 {
+		return f.genericNF
+	}
+
+	return nextQueuePacketQueue{
+		packetQueue: f.genericNF,
+		queueNum:    f.opts.TrafficQueue,
+		nextQueue:   f.opts.NextQueue,
+	}
+}
+
+// setVerdict counts and sets the verdict of packet id of nf. If the
+// verdict can't be set, the packet is queued to be dropped and false
+// is returned.
+func (f *filter) setVerdict(logger *zap.Logger, nf packetQueue, id uint32, verdict int) bool {
+	f.countVerdict(verdict)
+	return f.deadLetters.setVerdict(logger, nf, id, verdict)
+}
+
+// setTrafficVerdict counts and sets the verdict of packet id of the
+// traffic queue like setVerdict.
+func (f *filter) setTrafficVerdict(logger *zap.Logger, id uint32, verdict int) bool {
+	return f.setVerdict(logger, f.trafficQueue(), id, verdict)
+}
+
+// setVerdict sets the verdict of packet id of the DNS response queue
+// like filter.setVerdict. The verdict is counted by filter, which is
+// the filter the response is to, unless it is nil.
+func (f *FilterManager) setVerdict(logger *zap.Logger, filter *filter, id uint32, verdict int) bool {
+	if filter != nil {
+		filter.countVerdict(verdict)
+	}
+	return f.deadLetters.setVerdict(logger, f.dnsRespNF, id, verdict)
+}
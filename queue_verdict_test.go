@@ -0,0 +1,28 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestQueueVerdictMessage(t *testing.T) {
+	is := is.New(t)
+
+	msg, err := queueVerdictMessage(1001, 42, 2000)
+	is.NoErr(err)
+	is.Equal(msg.Header.Type, netlink.HeaderType(unix.NFNL_SUBSYS_QUEUE<<8|nfqnlMsgVerdict)) // message should be a verdict
+	is.Equal(msg.Data[:4], []byte{unix.AF_UNSPEC, unix.NFNETLINK_V0, 0x03, 0xe9})            // verdict should be set on the traffic queue
+
+	attrs, err := netlink.UnmarshalAttributes(msg.Data[4:])
+	is.NoErr(err)
+	is.Equal(len(attrs), 1)
+	is.Equal(attrs[0].Type, uint16(nfqaVerdictHdr))
+	verdict := binary.BigEndian.Uint32(attrs[0].Data[:4])
+	is.Equal(verdict&0xffff, uint32(nfQueue))                        // allowed packet should be queued
+	is.Equal(verdict>>16, uint32(2000))                              // allowed packet should be passed to the next queue
+	is.Equal(binary.BigEndian.Uint32(attrs[0].Data[4:]), uint32(42)) // verdict should be set for the packet
+}
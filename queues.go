@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// nfqueueProcPath lists the nfqueues that are currently bound by
+// processes, one queue per line.
+const nfqueueProcPath = "/proc/net/netfilter/nfnetlink_queue"
+
+// inUseQueues returns the nfqueue numbers that are currently bound.
+func inUseQueues() (map[uint16]bool, error) {
+	f, err := os.Open(nfqueueProcPath)
+	if err != nil {
+		// the file won't exist if no queues have been bound since
+		// the nfnetlink_queue module was loaded
+		if errors.Is(err, os.ErrNotExist) {
+			return map[uint16]bool{}, nil
+		}
+		return nil, fmt.Errorf("error opening %s: %v", nfqueueProcPath, err)
+	}
+	defer f.Close()
+
+	return parseQueues(f)
+}
+
+// parseQueues parses the queue numbers from the contents of
+// /proc/net/netfilter/nfnetlink_queue. The queue number is the first
+// field of each line.
+func parseQueues(r io.Reader) (map[uint16]bool, error) {
+	queues := make(map[uint16]bool)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		queueNum, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing queue number %q: %v", fields[0], err)
+		}
+		queues[uint16(queueNum)] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading queues: %v", err)
+	}
+
+	return queues, nil
+}
+
+// availableQueues returns count queue numbers starting from base that
+// aren't in inUse.
+func availableQueues(inUse map[uint16]bool, base uint16, count int) ([]uint16, error) {
+	queues := make([]uint16, 0, count)
+	for queueNum := int(base); queueNum <= math.MaxUint16 && len(queues) < count; queueNum++ {
+		if !inUse[uint16(queueNum)] {
+			queues = append(queues, uint16(queueNum))
+		}
+	}
+	if len(queues) < count {
+		return nil, fmt.Errorf("only %d queues starting from %d are available", len(queues), base)
+	}
+
+	return queues, nil
+}
+
+// queues returns every nfqueue number used by the config.
+func (c *Config) queues() []uint16 {
+	queues := []uint16{c.InboundDNSQueue}
+	for _, filterOpt := range c.Filters {
+		if filterOpt.DNSQueue != 0 {
+			queues = append(queues, filterOpt.DNSQueue)
+		}
+		if filterOpt.TrafficQueue != 0 {
+			queues = append(queues, filterOpt.TrafficQueue)
+		}
+	}
+
+	return queues
+}
+
+// queueConflicts returns the queues used by the config that are
+// already bound, along with suggested queue numbers starting from
+// base to use instead.
+func (c *Config) queueConflicts(base uint16) ([]uint16, []uint16, error) {
+	inUse, err := inUseQueues()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var conflicts []uint16
+	queues := c.queues()
+	for _, queueNum := range queues {
+		if inUse[queueNum] {
+			conflicts = append(conflicts, queueNum)
+		}
+	}
+	if len(conflicts) == 0 {
+		return nil, nil, nil
+	}
+
+	// don't suggest queues the config is already using
+	for _, queueNum := range queues {
+		inUse[queueNum] = true
+	}
+	suggestions, err := availableQueues(inUse, base, len(conflicts))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return conflicts, suggestions, nil
+}
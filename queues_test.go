@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestParseQueues(t *testing.T) {
+	is := is.New(t)
+
+	queues, err := parseQueues(strings.NewReader(`    1  12345     0 2 65535     0     0        7  1
+ 1000  12345     0 2 65535     0     0        3  1
+ 1001  12345     0 2 65535     0     0        0  1
+`))
+	is.NoErr(err) // parsing queues should succeed
+	is.Equal(queues, map[uint16]bool{
+		1:    true,
+		1000: true,
+		1001: true,
+	}) // all queue numbers should be parsed
+
+	_, err = parseQueues(strings.NewReader("abc 12345 0 2 65535 0 0 0 1\n"))
+	is.True(err != nil) // invalid queue numbers should fail to parse
+}
+
+func TestAvailableQueues(t *testing.T) {
+	is := is.New(t)
+
+	inUse := map[uint16]bool{
+		1000: true,
+		1001: true,
+		1003: true,
+	}
+
+	queues, err := availableQueues(inUse, 1000, 3)
+	is.NoErr(err)                                // finding available queues should succeed
+	is.Equal(queues, []uint16{1002, 1004, 1005}) // queues in use should be skipped
+
+	_, err = availableQueues(inUse, 65534, 3)
+	is.True(err != nil) // there should be an error when not enough queues are available
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultMaxReassemblyBytes is how much of a connection's stream
+	// can be buffered by default, which is enough for any TLS record
+	defaultMaxReassemblyBytes = 5 + 1<<14
+	// defaultMaxReassemblyConns is how many connections can be
+	// reassembled at once by default
+	defaultMaxReassemblyConns = 1024
+	// reassemblyTimeout is how long a connection can be reassembled
+	// for before its reassembly fails
+	reassemblyTimeout = 10 * time.Second
+	// reassemblyFailedTimeout is how long connections whose
+	// reassembly failed are dropped for. It is longer than TCP keeps
+	// retransmitting unacknowledged segments with default settings,
+	// so the rest of a ClientHello can't be sent once it expires.
+	reassemblyFailedTimeout = 20 * time.Minute
+)
+
+var (
+	errReassemblyTooLarge  = errors.New("reassembled data would exceed the limit of a connection")
+	errTooManyReassemblies = errors.New("too many connections are being reassembled")
+	errReassemblyGap       = errors.New("a segment is missing")
+	errReassemblyTimeout   = errors.New("reassembly did not complete in time")
+	errReassemblyFailed    = errors.New("reassembly previously failed")
+)
+
+// reassembler buffers the payloads of consecutive TCP segments of
+// connections so data spanning multiple segments can be inspected.
+// Memory use is bounded by limiting how many bytes can be buffered
+// for each connection and how many connections can be reassembled
+// at once. Connections that exceed either limit, are missing a
+// segment or aren't complete in time are marked as failed and dropped
+// until the mark expires.
+type reassembler struct {
+	maxBytes int
+	maxConns int
+
+	mtx     sync.Mutex
+	streams map[connectionID]*reassemblyStream
+}
+
+type reassemblyStream struct {
+	data []byte
+	// nextSeq is the sequence number of the byte after data
+	nextSeq uint32
+	// started is when reassembly started, or when it failed if
+	// failed is true
+	started time.Time
+	// failed is true if a limit was exceeded, a segment is missing
+	// or reassembly timed out, data isn't buffered for failed streams
+	failed bool
+}
+
+func newReassembler(maxBytes, maxConns int) *reassembler {
+	if maxBytes == 0 {
+		maxBytes = defaultMaxReassemblyBytes
+	}
+	if maxConns == 0 {
+		maxConns = defaultMaxReassemblyConns
+	}
+
+	return &reassembler{
+		maxBytes: maxBytes,
+		maxConns: maxConns,
+		streams:  make(map[connectionID]*reassemblyStream),
+	}
+}
+
+// add appends the payload of a segment starting at sequence number
+// seq to the data buffered for connID. Once complete returns true for
+// the buffered data, reassembly stops and the data is returned with
+// true. Payloads of connections that aren't being reassembled are
+// returned as is if complete returns true for them, otherwise
+// reassembly is started. Data that is already buffered is skipped as
+// segments may be retransmitted.
+//
+// An error is returned if a segment is missing, a limit would be
+// exceeded or reassembly doesn't complete in time, after which errors
+// are returned for the connection until it has been failed for
+// reassemblyFailedTimeout.
+func (r *reassembler) add(connID connectionID, seq uint32, payload []byte, complete func([]byte) bool) ([]byte, bool, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	now := time.Now()
+	s, ok := r.streams[connID]
+	if ok && s.failed {
+		if now.Sub(s.started) < reassemblyFailedTimeout {
+			return nil, false, errReassemblyFailed
+		}
+		delete(r.streams, connID)
+		ok = false
+	}
+	if ok && now.Sub(s.started) >= reassemblyTimeout {
+		s.fail(now)
+		return nil, false, errReassemblyTimeout
+	}
+	if !ok {
+		if complete(payload) {
+			return payload, true, nil
+		}
+
+		if len(r.streams) >= r.maxConns {
+			r.removeExpired(now)
+		}
+		if len(r.streams) >= r.maxConns {
+			return nil, false, errTooManyReassemblies
+		}
+
+		s = &reassemblyStream{
+			nextSeq: seq,
+			started: now,
+		}
+		r.streams[connID] = s
+	}
+
+	// sequence numbers wrap, so compare them by their difference
+	offset := s.nextSeq - seq
+	if int32(offset) < 0 {
+		s.fail(now)
+		return nil, false, errReassemblyGap
+	}
+	if int(offset) >= len(payload) {
+		return nil, false, nil
+	}
+	payload = payload[offset:]
+
+	if len(s.data)+len(payload) > r.maxBytes {
+		s.fail(now)
+		return nil, false, errReassemblyTooLarge
+	}
+	s.data = append(s.data, payload...)
+	s.nextSeq += uint32(len(payload))
+
+	if !complete(s.data) {
+		return nil, false, nil
+	}
+	delete(r.streams, connID)
+
+	return s.data, true, nil
+}
+
+// removeExpired marks streams that timed out as failed and removes
+// streams whose failure expired, r.mtx must be held.
+func (r *reassembler) removeExpired(now time.Time) {
+	for connID, s := range r.streams {
+		if s.failed && now.Sub(s.started) >= reassemblyFailedTimeout {
+			delete(r.streams, connID)
+		} else if !s.failed && now.Sub(s.started) >= reassemblyTimeout {
+			s.fail(now)
+		}
+	}
+}
+
+func (s *reassemblyStream) fail(now time.Time) {
+	s.failed = true
+	s.data = nil
+	s.started = now
+}
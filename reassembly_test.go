@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+// endsWithPeriod is a completion predicate for tests, streams are
+// complete once they end with a period
+func endsWithPeriod(data []byte) bool {
+	return bytes.HasSuffix(data, []byte("."))
+}
+
+func TestReassembly(t *testing.T) {
+	is := is.New(t)
+
+	r := newReassembler(8, 2)
+	connA := connectionID{dst: netip.MustParseAddrPort("192.0.2.1:443")}
+	connB := connectionID{dst: netip.MustParseAddrPort("192.0.2.2:443")}
+	connC := connectionID{dst: netip.MustParseAddrPort("192.0.2.3:443")}
+
+	data, ready, err := r.add(connA, 100, []byte("ab."), endsWithPeriod)
+	is.NoErr(err)
+	is.True(ready)                // complete segments should not be buffered
+	is.Equal(string(data), "ab.") // complete segments should be returned as is
+	is.Equal(len(r.streams), 0)   // complete segments should not start reassembly
+
+	_, ready, err = r.add(connA, 100, []byte("abc"), endsWithPeriod)
+	is.NoErr(err)
+	is.True(!ready)             // incomplete segments should be buffered
+	is.Equal(len(r.streams), 1) // connection should be reassembled
+
+	_, ready, err = r.add(connA, 100, []byte("abc"), endsWithPeriod)
+	is.NoErr(err)
+	is.True(!ready) // retransmitted segments should be skipped
+
+	data, ready, err = r.add(connA, 102, []byte("cd."), endsWithPeriod)
+	is.NoErr(err)
+	is.True(ready)                  // reassembly should complete once the data is complete
+	is.Equal(string(data), "abcd.") // only new data of overlapping segments should be buffered
+	is.Equal(len(r.streams), 0)     // reassembly should stop once the data is complete
+
+	_, _, err = r.add(connA, 100, []byte("abcdef"), endsWithPeriod)
+	is.NoErr(err)
+	_, _, err = r.add(connA, 106, []byte("ghi"), endsWithPeriod)
+	is.Equal(err, errReassemblyTooLarge) // oversized reassembly buffers should be rejected
+	_, _, err = r.add(connA, 106, []byte("g."), endsWithPeriod)
+	is.Equal(err, errReassemblyFailed) // connections that exceeded a limit should keep being rejected
+
+	_, _, err = r.add(connB, 0, []byte("a"), endsWithPeriod)
+	is.NoErr(err)
+	_, _, err = r.add(connC, 0, []byte("a"), endsWithPeriod)
+	is.Equal(err, errTooManyReassemblies) // reassembling too many connections should be rejected
+
+	_, _, err = r.add(connB, 1, []byte("."), endsWithPeriod)
+	is.NoErr(err)
+	_, _, err = r.add(connC, 0, []byte("a"), endsWithPeriod)
+	is.NoErr(err) // connections should be reassembled once others are complete
+
+	_, _, err = r.add(connC, 5, []byte("b"), endsWithPeriod)
+	is.Equal(err, errReassemblyGap) // connections with missing segments should be rejected
+}
+
+func TestReassemblyExpiry(t *testing.T) {
+	is := is.New(t)
+
+	r := newReassembler(0, 1)
+	connA := connectionID{dst: netip.MustParseAddrPort("192.0.2.1:443")}
+	connB := connectionID{dst: netip.MustParseAddrPort("192.0.2.2:443")}
+
+	_, _, err := r.add(connA, 0, []byte("a"), endsWithPeriod)
+	is.NoErr(err)
+	r.streams[connA].started = time.Now().Add(-reassemblyTimeout)
+	_, _, err = r.add(connA, 1, []byte("."), endsWithPeriod)
+	is.Equal(err, errReassemblyTimeout) // connections that weren't reassembled in time should be rejected
+	_, _, err = r.add(connA, 1, []byte("."), endsWithPeriod)
+	is.Equal(err, errReassemblyFailed) // connections that timed out should keep being rejected
+	_, _, err = r.add(connA, 2, []byte("b."), endsWithPeriod)
+	is.Equal(err, errReassemblyFailed) // later segments of connections that timed out should be rejected
+
+	_, _, err = r.add(connB, 0, []byte("a"), endsWithPeriod)
+	is.Equal(err, errTooManyReassemblies) // failed connections should count towards the limit
+
+	r.streams[connA].started = time.Now().Add(-reassemblyFailedTimeout)
+	_, _, err = r.add(connB, 0, []byte("a"), endsWithPeriod)
+	is.NoErr(err) // expired failures should not count towards the limit
+	_, ok := r.streams[connA]
+	is.True(!ok) // expired failures should be removed
+
+	r.streams[connB].started = time.Now().Add(-reassemblyTimeout)
+	_, _, err = r.add(connA, 0, []byte("a"), endsWithPeriod)
+	is.Equal(err, errTooManyReassemblies) // connections that timed out should not be removed
+	is.True(r.streams[connB].failed)      // connections that timed out should be marked as failed
+}
+
+func TestReassemblySeqWrap(t *testing.T) {
+	is := is.New(t)
+
+	r := newReassembler(0, 0)
+	conn := connectionID{dst: netip.MustParseAddrPort("192.0.2.1:443")}
+
+	_, _, err := r.add(conn, 0xfffffffe, []byte("abc"), endsWithPeriod)
+	is.NoErr(err)
+	data, ready, err := r.add(conn, 1, []byte("de."), endsWithPeriod)
+	is.NoErr(err)
+	is.True(ready)
+	is.Equal(string(data), "abcde.") // sequence numbers should wrap
+}
@@ -0,0 +1,48 @@
+package main
+
+import "sync"
+
+// ringBuffer keeps the items most recently added to it. Once full, the
+// oldest items are overwritten.
+type ringBuffer[T any] struct {
+	mtx  sync.Mutex
+	buf  []T
+	next int // index the next item will be stored at
+	full bool
+}
+
+func newRingBuffer[T any](size int) *ringBuffer[T] {
+	return &ringBuffer[T]{
+		buf: make([]T, size),
+	}
+}
+
+func (r *ringBuffer[T]) add(item T) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.buf[r.next] = item
+	r.next++
+	if r.next == len(r.buf) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// items returns the stored items from oldest to newest.
+func (r *ringBuffer[T]) items() []T {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if !r.full {
+		items := make([]T, r.next)
+		copy(items, r.buf[:r.next])
+		return items
+	}
+
+	items := make([]T, 0, len(r.buf))
+	items = append(items, r.buf[r.next:]...)
+	items = append(items, r.buf[:r.next]...)
+
+	return items
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	sdNotifyReady    = "READY=1"
+	sdNotifyStopping = "STOPPING=1"
+	sdNotifyWatchdog = "WATCHDOG=1"
+)
+
+// sdNotifier sends notifications to systemd's service manager.
+type sdNotifier struct {
+	conn *net.UnixConn
+}
+
+// newSDNotifier connects to the socket in $NOTIFY_SOCKET. A nil
+// sdNotifier is returned if the socket isn't set, which happens when
+// not running under systemd or when the service isn't of type notify.
+//
+// The socket should be connected to before seccomp filters are
+// installed, only writing to it is allowed afterwards.
+func newSDNotifier() (*sdNotifier, error) {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return nil, nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to notify socket: %v", err)
+	}
+
+	return &sdNotifier{conn: conn}, nil
+}
+
+// notify sends states, such as "READY=1", to systemd.
+func (s *sdNotifier) notify(states ...string) error {
+	_, err := s.conn.Write([]byte(formatNotifyMessage(states...)))
+	return err
+}
+
+func (s *sdNotifier) close() error {
+	return s.conn.Close()
+}
+
+// formatNotifyMessage formats states as a notification, which is
+// newline separated variable assignments.
+func formatNotifyMessage(states ...string) string {
+	return strings.Join(states, "\n")
+}
+
+// watchdogInterval returns how often systemd's watchdog should be
+// pinged, which is half of the watchdog timeout as systemd
+// recommends. False is returned if the watchdog isn't enabled for
+// this process.
+func watchdogInterval() (time.Duration, bool, error) {
+	usecStr := os.Getenv("WATCHDOG_USEC")
+	if usecStr == "" {
+		return 0, false, nil
+	}
+	// the watchdog may be meant for a different process
+	if pidStr := os.Getenv("WATCHDOG_PID"); pidStr != "" {
+		pid, err := strconv.Atoi(pidStr)
+		if err != nil {
+			return 0, false, fmt.Errorf("error parsing $WATCHDOG_PID: %v", err)
+		}
+		if pid != os.Getpid() {
+			return 0, false, nil
+		}
+	}
+
+	usec, err := strconv.ParseUint(usecStr, 10, 63)
+	if err != nil {
+		return 0, false, fmt.Errorf("error parsing $WATCHDOG_USEC: %v", err)
+	}
+	if usec == 0 {
+		return 0, false, errors.New("$WATCHDOG_USEC must be greater than 0")
+	}
+
+	return time.Duration(usec) * time.Microsecond / 2, true, nil
+}
+
+// startWatchdog pings systemd's watchdog every interval until ctx is
+// canceled, but only while every filter is healthy. Getting the
+// status of filters also requires their caches to be responsive, so
+// pings stop if filters are deadlocked and systemd will restart
+// Egress Eddie.
+func (f *FilterManager) startWatchdog(ctx context.Context, notifier *sdNotifier, interval time.Duration) {
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+
+		f.runWatchdog(ctx, notifier, interval)
+	}()
+}
+
+func (f *FilterManager) runWatchdog(ctx context.Context, notifier *sdNotifier, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		status := f.Status()
+		if !status.Ready || status.FiltersHealthy != status.FiltersTotal {
+			f.logger.Warn("not pinging watchdog as filters are unhealthy", zap.Int("filters.healthy", status.FiltersHealthy), zap.Int("filters.total", status.FiltersTotal))
+			continue
+		}
+		if stalled := f.stalledCallbacks(); len(stalled) != 0 {
+			f.logger.Warn("not pinging watchdog as packets are not being processed", zap.Strings("filters", stalled))
+			continue
+		}
+		if err := notifier.notify(sdNotifyWatchdog); err != nil {
+			f.logger.Error("error pinging watchdog", zap.NamedError("error", err))
+		}
+	}
+}
+
+// stalledCallbacks returns the names of filters whose callbacks had
+// packets pending at the last watchdog interval and finished none
+// since. The DNS response queue is named after the manager's queue.
+func (f *FilterManager) stalledCallbacks() []string {
+	var stalled []string
+	if f.progress.stalled() {
+		stalled = append(stalled, "dns responses")
+	}
+	for _, filter := range f.currentFilters() {
+		// every filter must be checked so the progress of each is
+		// updated every interval
+		if filter.progress.stalled() {
+			stalled = append(stalled, filter.opts.Name)
+		}
+	}
+
+	return stalled
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/florianl/go-nfqueue"
+	"github.com/matryer/is"
+	"go.uber.org/zap"
+)
+
+func TestSDNotify(t *testing.T) {
+	is := is.New(t)
+
+	t.Setenv("NOTIFY_SOCKET", "")
+	notifier, err := newSDNotifier()
+	is.NoErr(err)            // missing notify socket should not be an error
+	is.True(notifier == nil) // notifications should be disabled without a notify socket
+
+	socketPath := filepath.Join(t.TempDir(), "notify.sock")
+	capture, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	is.NoErr(err) // creating capture socket should succeed
+	t.Cleanup(func() { capture.Close() })
+
+	t.Setenv("NOTIFY_SOCKET", socketPath)
+	notifier, err = newSDNotifier()
+	is.NoErr(err) // connecting to notify socket should succeed
+	t.Cleanup(func() { notifier.close() })
+
+	buf := make([]byte, 1024)
+	for _, states := range [][]string{
+		{sdNotifyReady},
+		{sdNotifyWatchdog},
+		{sdNotifyStopping, "STATUS=stopping filters"},
+	} {
+		is.NoErr(notifier.notify(states...)) // sending notification should succeed
+
+		is.NoErr(capture.SetReadDeadline(time.Now().Add(time.Second)))
+		n, err := capture.Read(buf)
+		is.NoErr(err)                                             // reading notification should succeed
+		is.Equal(string(buf[:n]), formatNotifyMessage(states...)) // notification should be sent as a single datagram
+	}
+
+	is.Equal(formatNotifyMessage(sdNotifyStopping, "STATUS=stopping filters"), "STOPPING=1\nSTATUS=stopping filters") // states should be separated by newlines
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	tests := []struct {
+		testName    string
+		usec        string
+		pid         string
+		expected    time.Duration
+		expectedOK  bool
+		expectedErr bool
+	}{
+		{"watchdog disabled", "", "", 0, false, false},
+		{"watchdog enabled", "30000000", "", 15 * time.Second, true, false},
+		{"watchdog for this process", "30000000", strconv.Itoa(os.Getpid()), 15 * time.Second, true, false},
+		{"watchdog for other process", "30000000", strconv.Itoa(os.Getpid() + 1), 0, false, false},
+		{"invalid timeout", "abc", "", 0, false, true},
+		{"zero timeout", "0", "", 0, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			is := is.New(t)
+
+			t.Setenv("WATCHDOG_USEC", tt.usec)
+			t.Setenv("WATCHDOG_PID", tt.pid)
+
+			interval, ok, err := watchdogInterval()
+			is.Equal(err != nil, tt.expectedErr) // error should be returned for invalid values
+			is.Equal(ok, tt.expectedOK)          // watchdog should only be enabled for this process
+			is.Equal(interval, tt.expected)      // interval should be half of the timeout
+		})
+	}
+}
+
+func TestWatchdogHealth(t *testing.T) {
+	is := is.New(t)
+
+	socketPath := filepath.Join(t.TempDir(), "notify.sock")
+	capture, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	is.NoErr(err) // creating capture socket should succeed
+	t.Cleanup(func() { capture.Close() })
+
+	t.Setenv("NOTIFY_SOCKET", socketPath)
+	notifier, err := newSDNotifier()
+	is.NoErr(err) // connecting to notify socket should succeed
+	t.Cleanup(func() { notifier.close() })
+
+	foo := newTestFilter(&FilterOptions{Name: "foo", DNSQueue: 1000})
+	t.Cleanup(foo.close)
+	foo.dnsReqNFReady = make(chan struct{})
+	f := FilterManager{
+		ready:   make(chan struct{}),
+		logger:  zap.NewNop(),
+		filters: []*filter{foo},
+	}
+	close(f.ready)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f.startWatchdog(ctx, notifier, 10*time.Millisecond)
+	t.Cleanup(func() {
+		cancel()
+		f.wg.Wait()
+	})
+
+	buf := make([]byte, 1024)
+	is.NoErr(capture.SetReadDeadline(time.Now().Add(100 * time.Millisecond)))
+	_, err = capture.Read(buf)
+	is.True(errors.Is(err, os.ErrDeadlineExceeded)) // watchdog should not be pinged while filters are unhealthy
+
+	close(foo.dnsReqNFReady)
+	is.NoErr(capture.SetReadDeadline(time.Now().Add(time.Second)))
+	n, err := capture.Read(buf)
+	is.NoErr(err)                               // watchdog should be pinged once filters are healthy
+	is.Equal(string(buf[:n]), sdNotifyWatchdog) // watchdog ping should be sent
+}
+
+func TestWatchdogStalledCallbacks(t *testing.T) {
+	is := is.New(t)
+
+	socketPath := filepath.Join(t.TempDir(), "notify.sock")
+	capture, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	is.NoErr(err) // creating capture socket should succeed
+	t.Cleanup(func() { capture.Close() })
+
+	t.Setenv("NOTIFY_SOCKET", socketPath)
+	notifier, err := newSDNotifier()
+	is.NoErr(err) // connecting to notify socket should succeed
+	t.Cleanup(func() { notifier.close() })
+
+	foo := newTestFilter(&FilterOptions{Name: "foo", DNSQueue: 1000})
+	t.Cleanup(foo.close)
+	foo.dnsReqNFReady = make(chan struct{})
+	close(foo.dnsReqNFReady)
+	foo.progress = &callbackProgress{}
+	f := FilterManager{
+		ready:    make(chan struct{}),
+		logger:   zap.NewNop(),
+		progress: &callbackProgress{},
+		filters:  []*filter{foo},
+	}
+	close(f.ready)
+
+	// wedge a callback of foo
+	release := make(chan struct{})
+	entered := make(chan struct{})
+	done := make(chan struct{})
+	hook := foo.progress.track(func(nfqueue.Attribute) int {
+		close(entered)
+		<-release
+		return 0
+	})
+	go func() {
+		defer close(done)
+		hook(nfqueue.Attribute{})
+	}()
+	<-entered
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f.startWatchdog(ctx, notifier, 10*time.Millisecond)
+	t.Cleanup(func() {
+		cancel()
+		f.wg.Wait()
+	})
+
+	buf := make([]byte, 1024)
+	// the first interval has nothing to compare progress to, so the
+	// watchdog may be pinged once
+	is.NoErr(capture.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = capture.Read(buf)
+	is.NoErr(err) // watchdog should be pinged before a callback is known to be stalled
+
+	is.NoErr(capture.SetReadDeadline(time.Now().Add(100 * time.Millisecond)))
+	_, err = capture.Read(buf)
+	is.True(errors.Is(err, os.ErrDeadlineExceeded)) // watchdog should not be pinged while a callback is stalled
+
+	close(release)
+	<-done
+	is.NoErr(capture.SetReadDeadline(time.Now().Add(time.Second)))
+	n, err := capture.Read(buf)
+	is.NoErr(err)                               // watchdog should be pinged once the callback makes progress
+	is.Equal(string(buf[:n]), sdNotifyWatchdog) // watchdog ping should be sent
+}
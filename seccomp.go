@@ -144,6 +144,8 @@ var allowedSyscalls = seccomp.SyscallRules{
 var networkSyscalls = seccomp.SyscallRules{
 	unix.SYS_CONNECT:     {},
 	unix.SYS_GETPEERNAME: {},
+	// needed to generate random values for TLS connections
+	unix.SYS_GETRANDOM:   {},
 	unix.SYS_GETSOCKNAME: {},
 	unix.SYS_OPENAT: {
 		{
@@ -192,18 +194,153 @@ var networkSyscalls = seccomp.SyscallRules{
 	},
 }
 
+// diagnosticDumpSyscalls allow diagnostic reports to be created with
+// os.CreateTemp
+var diagnosticDumpSyscalls = seccomp.SyscallRules{
+	unix.SYS_OPENAT: {
+		{
+			seccomp.MatchAny{},
+			seccomp.MatchAny{},
+			seccomp.EqualTo(unix.O_RDWR | unix.O_CREAT | unix.O_EXCL | unix.O_CLOEXEC),
+		},
+	},
+}
+
+// textfileSyscalls allow metrics textfiles to be written with
+// os.CreateTemp and atomically renamed
+var textfileSyscalls = seccomp.SyscallRules{
+	unix.SYS_OPENAT: {
+		{
+			seccomp.MatchAny{},
+			seccomp.MatchAny{},
+			seccomp.EqualTo(unix.O_RDWR | unix.O_CREAT | unix.O_EXCL | unix.O_CLOEXEC),
+		},
+	},
+	unix.SYS_FCHMOD: {
+		{
+			seccomp.MatchAny{},
+			seccomp.EqualTo(0o644),
+		},
+	},
+	unix.SYS_RENAMEAT: {},
+	unix.SYS_UNLINKAT: {
+		{
+			seccomp.MatchAny{},
+			seccomp.MatchAny{},
+			seccomp.EqualTo(0),
+		},
+	},
+}
+
+// stateDBSyscalls allow the state database to be opened, written to
+// and closed by bbolt
+var stateDBSyscalls = seccomp.SyscallRules{
+	unix.SYS_OPENAT: {
+		{
+			seccomp.MatchAny{},
+			seccomp.MatchAny{},
+			seccomp.EqualTo(unix.O_RDWR | unix.O_CREAT | unix.O_CLOEXEC),
+		},
+	},
+	unix.SYS_FLOCK: {
+		{
+			seccomp.MatchAny{},
+			seccomp.EqualTo(unix.LOCK_EX | unix.LOCK_NB),
+		},
+		{
+			seccomp.MatchAny{},
+			seccomp.EqualTo(unix.LOCK_UN),
+		},
+	},
+	unix.SYS_MMAP: {
+		{
+			seccomp.MatchAny{},
+			seccomp.MatchAny{},
+			seccomp.EqualTo(unix.PROT_READ),
+			seccomp.EqualTo(unix.MAP_SHARED),
+			seccomp.GreaterThan(0),
+			seccomp.EqualTo(0),
+		},
+	},
+	unix.SYS_PREAD64:   {},
+	unix.SYS_PWRITE64:  {},
+	unix.SYS_FDATASYNC: {},
+	unix.SYS_FSYNC:     {},
+	unix.SYS_FTRUNCATE: {},
+}
+
+// adminSocketSyscalls allow connections to the admin socket to be
+// accepted and served, and the config file to be read to reload
+// filters
+var adminSocketSyscalls = seccomp.SyscallRules{
+	unix.SYS_OPENAT: {
+		{
+			seccomp.MatchAny{},
+			seccomp.MatchAny{},
+			seccomp.EqualTo(unix.O_RDONLY | unix.O_CLOEXEC),
+		},
+	},
+	unix.SYS_ACCEPT4: {
+		{
+			seccomp.MatchAny{},
+			seccomp.MatchAny{},
+			seccomp.MatchAny{},
+			seccomp.EqualTo(unix.SOCK_NONBLOCK | unix.SOCK_CLOEXEC),
+		},
+	},
+	unix.SYS_GETSOCKNAME: {},
+	unix.SYS_SHUTDOWN: {
+		{
+			seccomp.MatchAny{},
+			seccomp.EqualTo(unix.SHUT_WR),
+		},
+	},
+}
+
+// cpuAffinitySyscalls allow filters to pin their threads to CPUs
+var cpuAffinitySyscalls = seccomp.SyscallRules{
+	unix.SYS_SCHED_SETAFFINITY: {
+		{
+			seccomp.EqualTo(0),
+		},
+	},
+}
+
 type nullEmitter struct{}
 
 func (nullEmitter) Emit(depth int, level log.Level, timestamp time.Time, format string, v ...interface{}) {
 }
 
-func installSeccompFilters(logger *zap.Logger, needsNetworking bool) (int, error) {
+// installSeccompFilters installs seccomp filters that only allow the
+// syscalls the features enabled in config need, and returns how many
+// syscalls are allowed.
+func installSeccompFilters(logger *zap.Logger, config *Config) (int, error) {
 	// only allow Egress Eddie to make outbound connections if DNS
 	// requests will need to be made directly
-	if needsNetworking {
+	if config.needsNetworking() {
 		logger.Debug("allowing networking syscalls")
 		allowedSyscalls.Merge(networkSyscalls)
 	}
+	if config.DiagnosticDumpDir != "" {
+		logger.Debug("allowing diagnostic dump syscalls")
+		allowedSyscalls.Merge(diagnosticDumpSyscalls)
+	}
+	if config.TextfilePath != "" {
+		logger.Debug("allowing metrics textfile syscalls")
+		allowedSyscalls.Merge(textfileSyscalls)
+	}
+	if config.StateDBPath != "" {
+		logger.Debug("allowing state database syscalls")
+		allowedSyscalls.Merge(stateDBSyscalls)
+	}
+	if config.AdminSocketPath != "" {
+		logger.Debug("allowing admin socket syscalls")
+		allowedSyscalls.Merge(adminSocketSyscalls)
+	}
+	if config.pinsCPUs() {
+		logger.Debug("allowing CPU affinity syscalls")
+		allowedSyscalls.Merge(cpuAffinitySyscalls)
+	}
 
 	// disable logging from seccomp package
 	log.SetTarget(&nullEmitter{})
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	tlsRecordTypeHandshake    = 0x16
+	tlsHandshakeClientHello   = 0x01
+	tlsExtensionServerName    = 0x00
+	tlsServerNameTypeHostname = 0x00
+)
+
+// ipHostname is an allowed IP and a hostname that caused it to be
+// allowed.
+type ipHostname struct {
+	ip       netip.Addr
+	hostname string
+}
+
+// addProvenance records that ip was allowed because of hostname.
+func (f *filter) addProvenance(ip netip.Addr, hostname string, ttl time.Duration) {
+	if f.ipHostnames == nil {
+		return
+	}
+
+	f.ipHostnames.AddEntry(ipHostname{ip: ip, hostname: normalizeHostname(hostname)}, ttl)
+}
+
+// addAnswerProvenance records that IPs from A and AAAA answers were
+// allowed because of the questions and every name in the answers, so
+// responses with CNAME chains are handled.
+func (f *filter) addAnswerProvenance(dns *layers.DNS, ifIndex *uint32) {
+	if f.ipHostnames == nil {
+		return
+	}
+
+	hostnames := make([]string, 0, len(dns.Questions)+len(dns.Answers))
+	for _, question := range dns.Questions {
+		hostnames = append(hostnames, string(question.Name))
+	}
+	for _, answer := range dns.Answers {
+		hostnames = append(hostnames, string(answer.Name))
+	}
+
+	ttl := time.Duration(f.opts.AllowAnswersFor)
+	for _, answer := range dns.Answers {
+		if answer.Type != layers.DNSTypeA && answer.Type != layers.DNSTypeAAAA {
+			continue
+		}
+		ip, ok := netip.AddrFromSlice(answer.IP)
+		if !ok {
+			continue
+		}
+		ip = zoneLinkLocal(ip, ifIndex)
+
+		for _, hostname := range hostnames {
+			f.addProvenance(ip, hostname, ttl)
+			if ip.Is4In6() {
+				f.addProvenance(ip.Unmap(), hostname, ttl)
+			}
+		}
+	}
+}
+
+// sniMismatch returns the server name of a TLS ClientHello at the
+// start of payload and true if that server name didn't cause dst to
+// be allowed. Packets without a server name never mismatch.
+func (f *filter) sniMismatch(dst netip.Addr, payload []byte) (string, bool) {
+	serverName, ok := parseSNI(payload)
+	if !ok {
+		return "", false
+	}
+
+	return serverName, !f.ipHostnames.EntryExists(ipHostname{ip: dst, hostname: normalizeHostname(serverName)})
+}
+
+// reassembleClientHello returns the start of the stream of a TCP
+// connection once it is known whether it has a TLS server name.
+// ClientHellos that span multiple segments are reassembled, and false
+// is returned until the server name or the end of the ClientHello is
+// available so the segments before it can be allowed.
+func (f *filter) reassembleClientHello(connID connectionID, seq uint32, payload []byte) ([]byte, bool, error) {
+	return f.reassembly.add(connID, seq, payload, clientHelloComplete)
+}
+
+// clientHelloComplete returns true if the server name or the end of
+// the ClientHello at the start of data is available, or data doesn't
+// start with a ClientHello.
+func clientHelloComplete(data []byte) bool {
+	_, ok := parseSNI(data)
+	return ok || !clientHelloTruncated(data)
+}
+
+// clientHelloTruncated returns true if payload is the start of a TLS
+// record holding a ClientHello that continues past payload.
+func clientHelloTruncated(payload []byte) bool {
+	if len(payload) == 0 || payload[0] != tlsRecordTypeHandshake {
+		return false
+	}
+	if len(payload) < 5 {
+		return true
+	}
+	if len(payload) > 5 && payload[5] != tlsHandshakeClientHello {
+		return false
+	}
+
+	recordLen := int(binary.BigEndian.Uint16(payload[3:]))
+	return len(payload) < 5+recordLen
+}
+
+// parseSNI returns the server name of a TLS ClientHello at the start
+// of payload. The ClientHello may be truncated as only a single TCP
+// segment is available, so the server name is returned if the
+// extension is present in payload.
+func parseSNI(payload []byte) (string, bool) {
+	// record header: type, version and length
+	if len(payload) < 5 || payload[0] != tlsRecordTypeHandshake {
+		return "", false
+	}
+	p := payload[5:]
+
+	// handshake header: type and length
+	if len(p) < 4 || p[0] != tlsHandshakeClientHello {
+		return "", false
+	}
+	p = p[4:]
+
+	// client version and random
+	if len(p) < 34 {
+		return "", false
+	}
+	p = p[34:]
+
+	// session ID
+	p, ok := skipVector(p, 1)
+	if !ok {
+		return "", false
+	}
+	// cipher suites
+	p, ok = skipVector(p, 2)
+	if !ok {
+		return "", false
+	}
+	// compression methods
+	p, ok = skipVector(p, 1)
+	if !ok {
+		return "", false
+	}
+
+	// extensions, the length of all extensions isn't checked as the
+	// ClientHello may be truncated
+	if len(p) < 2 {
+		return "", false
+	}
+	p = p[2:]
+	for len(p) >= 4 {
+		extType := binary.BigEndian.Uint16(p)
+		extLen := int(binary.BigEndian.Uint16(p[2:]))
+		p = p[4:]
+		if len(p) < extLen {
+			return "", false
+		}
+		if extType != tlsExtensionServerName {
+			p = p[extLen:]
+			continue
+		}
+
+		// server name list
+		names := p[:extLen]
+		if len(names) < 2 {
+			return "", false
+		}
+		names = names[2:]
+		for len(names) >= 3 {
+			nameType := names[0]
+			nameLen := int(binary.BigEndian.Uint16(names[1:]))
+			names = names[3:]
+			if len(names) < nameLen {
+				return "", false
+			}
+			if nameType == tlsServerNameTypeHostname {
+				return string(names[:nameLen]), true
+			}
+			names = names[nameLen:]
+		}
+		return "", false
+	}
+
+	return "", false
+}
+
+// skipVector skips a TLS vector whose length is encoded in lenSize
+// bytes.
+func skipVector(p []byte, lenSize int) ([]byte, bool) {
+	if len(p) < lenSize {
+		return nil, false
+	}
+
+	var n int
+	for i := 0; i < lenSize; i++ {
+		n = n<<8 | int(p[i])
+	}
+	p = p[lenSize:]
+	if len(p) < n {
+		return nil, false
+	}
+
+	return p[n:], true
+}
+
+// normalizeHostname lowercases hostname and removes a trailing dot.
+func normalizeHostname(hostname string) string {
+	return strings.ToLower(strings.TrimSuffix(hostname, "."))
+}
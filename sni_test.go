@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/matryer/is"
+	"go.uber.org/zap"
+)
+
+func TestParseSNI(t *testing.T) {
+	is := is.New(t)
+
+	hello := newClientHello(t, "example.com")
+	serverName, ok := parseSNI(hello)
+	is.True(ok)                         // server name should be found
+	is.Equal(serverName, "example.com") // server name should be parsed
+
+	_, ok = parseSNI(newClientHello(t, ""))
+	is.True(!ok) // ClientHellos without a server name should not have one
+
+	_, ok = parseSNI(hello[:50])
+	is.True(!ok) // truncated ClientHellos should not panic
+
+	_, ok = parseSNI([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	is.True(!ok) // non-TLS payloads should not have a server name
+}
+
+func TestMatchSNI(t *testing.T) {
+	is := is.New(t)
+
+	f := newTestFilter(&FilterOptions{
+		AllowAnswersFor:  duration(time.Minute),
+		AllowedHostnames: []string{"a.com"},
+		MatchSNI:         true,
+	})
+	f.ipHostnames = NewTimedCache[ipHostname](zap.NewNop(), false)
+	t.Cleanup(f.close)
+
+	f.allowAnswers(zap.NewNop(), &layers.DNS{
+		Questions: []layers.DNSQuestion{
+			{
+				Name:  []byte("a.com"),
+				Type:  layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+			},
+		},
+		Answers: []layers.DNSResourceRecord{
+			{
+				Name:  []byte("a.com"),
+				Type:  layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+				IP:    net.IP{192, 0, 2, 1},
+			},
+		},
+	}, connectionID{}, nil)
+	f.allowAnswers(zap.NewNop(), &layers.DNS{
+		Questions: []layers.DNSQuestion{
+			{
+				Name:  []byte("www.a.com"),
+				Type:  layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+			},
+		},
+		Answers: []layers.DNSResourceRecord{
+			{
+				Name:  []byte("www.a.com"),
+				Type:  layers.DNSTypeCNAME,
+				Class: layers.DNSClassIN,
+				CNAME: []byte("a.cdn.net"),
+			},
+			{
+				Name:  []byte("a.cdn.net"),
+				Type:  layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+				IP:    net.IP{192, 0, 2, 2},
+			},
+		},
+	}, connectionID{}, nil)
+
+	src := netip.MustParseAddr("192.168.1.2")
+	dst := netip.MustParseAddr("192.0.2.1")
+	mechanism, err := f.validateIPs(zap.NewNop(), src, dst)
+	is.NoErr(err)
+	is.Equal(mechanism, allowedByDNSAnswer) // IP should be allowed via a.com
+
+	serverName, mismatch := f.sniMismatch(dst, newClientHello(t, "b.com"))
+	is.True(mismatch)             // connection to IP allowed via a.com with b.com SNI should be dropped
+	is.Equal(serverName, "b.com") // mismatched server name should be returned
+
+	_, mismatch = f.sniMismatch(dst, newClientHello(t, "A.com"))
+	is.True(!mismatch) // server names should be matched case-insensitively
+
+	_, mismatch = f.sniMismatch(netip.MustParseAddr("192.0.2.2"), newClientHello(t, "www.a.com"))
+	is.True(!mismatch) // hostnames of CNAME chains should match
+
+	_, mismatch = f.sniMismatch(dst, nil)
+	is.True(!mismatch) // packets without a ClientHello should not be dropped
+}
+
+func TestReassembleClientHello(t *testing.T) {
+	is := is.New(t)
+
+	f := newTestFilter(&FilterOptions{MatchSNI: true})
+	f.reassembly = newReassembler(0, 0)
+	conn := connectionID{
+		src: netip.MustParseAddrPort("192.168.1.2:40000"),
+		dst: netip.MustParseAddrPort("192.0.2.1:443"),
+	}
+
+	hello := newClientHello(t, "example.com")
+	_, ready, err := f.reassembleClientHello(conn, 1000, hello[:40])
+	is.NoErr(err)
+	is.True(!ready) // the first segment of a split ClientHello should be buffered
+
+	data, ready, err := f.reassembleClientHello(conn, 1040, hello[40:])
+	is.NoErr(err)
+	is.True(ready) // ClientHello should be available once all segments are buffered
+	serverName, ok := parseSNI(data)
+	is.True(ok)
+	is.Equal(serverName, "example.com")    // server name of a reassembled ClientHello should be found
+	is.Equal(len(f.reassembly.streams), 0) // reassembly should stop once the ClientHello is available
+
+	data, ready, err = f.reassembleClientHello(conn, 1000, hello)
+	is.NoErr(err)
+	is.True(ready)        // whole ClientHellos should not be buffered
+	is.Equal(data, hello) // whole ClientHellos should be returned as is
+	is.Equal(len(f.reassembly.streams), 0)
+
+	f.reassembly = newReassembler(40, 0)
+	_, _, err = f.reassembleClientHello(conn, 1000, hello[:40])
+	is.NoErr(err)
+	_, _, err = f.reassembleClientHello(conn, 1040, hello[40:])
+	is.Equal(err, errReassemblyTooLarge) // ClientHellos larger than the limit should be dropped
+}
+
+// newClientHello returns the first TLS record a client sends when
+// connecting to serverName.
+func newClientHello(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	go func() {
+		conn := tls.Client(client, &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: serverName == "",
+		})
+		// the handshake will fail once the server side is closed
+		_ = conn.Handshake()
+	}()
+
+	buf := make([]byte, 16384)
+	if err := server.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("error setting read deadline: %v", err)
+	}
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatalf("error reading ClientHello: %v", err)
+	}
+
+	return buf[:n]
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"go.uber.org/zap"
+)
+
+// hostnamePort is the target and port of an SRV answer.
+type hostnamePort struct {
+	hostname string
+	port     uint16
+}
+
+// allowSRVTarget records the port an SRV answer advertised for its
+// target, so the port can be allowed for the IPs the target resolves
+// to.
+func (f *filter) allowSRVTarget(logger *zap.Logger, target string, port uint16, ttl time.Duration) {
+	if f.srvTargets == nil {
+		return
+	}
+
+	logger.Info("allowing port of SRV target", zap.String("answer.name", target), zap.Uint16("answer.port", port), zap.Duration("answer.ttl", ttl))
+	f.srvTargets.AddEntry(hostnamePort{hostname: normalizeHostname(target), port: port}, ttl)
+}
+
+// srvTargetPorts returns the ports advertised by SRV answers for the
+// questions of a DNS response.
+func (f *filter) srvTargetPorts(dns *layers.DNS) []uint16 {
+	if f.srvTargets == nil {
+		return nil
+	}
+
+	questions := make(map[string]bool, len(dns.Questions))
+	for _, question := range dns.Questions {
+		questions[normalizeHostname(string(question.Name))] = true
+	}
+
+	var ports []uint16
+	f.srvTargets.Range(func(target hostnamePort, _ time.Time) bool {
+		if questions[target.hostname] {
+			ports = append(ports, target.port)
+		}
+		return true
+	})
+
+	return ports
+}
+
+// allowSRVAddrs allows connecting to ip on the ports advertised for it
+// by SRV answers.
+func (f *filter) allowSRVAddrs(logger *zap.Logger, ip netip.Addr, ports []uint16, ttl time.Duration) {
+	// IPv4-mapped IPv6 addresses will be connected to over IPv4, the
+	// same as in allowIP
+	if ip.Is4In6() {
+		f.allowSRVAddrs(logger, ip.Unmap(), ports, ttl)
+	}
+	for _, port := range ports {
+		addr := netip.AddrPortFrom(ip, port)
+		logger.Info("allowing address of SRV target", zap.Stringer("answer.addr", addr), zap.Duration("answer.ttl", ttl))
+		f.srvAddrs.AddEntry(addr, ttl)
+	}
+}
+
+// srvPortAllowed returns true if dst was advertised by an SRV answer
+// and srcPort is allowed.
+func (f *filter) srvPortAllowed(srcPort uint16, dst netip.AddrPort) bool {
+	if f.srvAddrs == nil {
+		return false
+	}
+	if len(f.opts.AllowedSrcPorts) > 0 && !containsPort(f.opts.AllowedSrcPorts, srcPort) {
+		return false
+	}
+
+	return f.srvAddrs.EntryExists(dst)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+	"github.com/matryer/is"
+	"go.uber.org/zap"
+)
+
+func TestAllowSRVPorts(t *testing.T) {
+	is := is.New(t)
+
+	f := newTestFilter(&FilterOptions{
+		AllowedHostnames: []string{"example.com"},
+		AllowAnswersFor:  duration(dnsQueryTimeout),
+		AllowedDstPorts:  []uint16{443},
+		AllowSRVPorts:    true,
+	})
+	f.srvTargets = NewTimedCache[hostnamePort](zap.NewNop(), false)
+	f.srvAddrs = NewTimedCache[netip.AddrPort](zap.NewNop(), false)
+	t.Cleanup(f.close)
+
+	f.allowAnswers(zap.NewNop(), &layers.DNS{
+		QR: true,
+		Questions: []layers.DNSQuestion{
+			{Name: []byte("_sip._tcp.example.com"), Type: layers.DNSTypeSRV, Class: layers.DNSClassIN},
+		},
+		Answers: []layers.DNSResourceRecord{
+			{
+				Name:  []byte("_sip._tcp.example.com"),
+				Type:  layers.DNSTypeSRV,
+				Class: layers.DNSClassIN,
+				SRV:   layers.DNSSRV{Port: 5060, Name: []byte("sip.example.org")},
+			},
+		},
+	}, connectionID{}, nil)
+	is.True(f.additionalHostnames.EntryExists("sip.example.org")) // SRV target should be allowed
+
+	// the client resolves the SRV target
+	f.allowAnswers(zap.NewNop(), &layers.DNS{
+		QR: true,
+		Questions: []layers.DNSQuestion{
+			{Name: []byte("sip.example.org"), Type: layers.DNSTypeA, Class: layers.DNSClassIN},
+		},
+		Answers: []layers.DNSResourceRecord{
+			{Name: []byte("sip.example.org"), Type: layers.DNSTypeA, Class: layers.DNSClassIN, IP: net.IPv4(192, 0, 2, 10)},
+		},
+	}, connectionID{}, nil)
+	// an unrelated hostname resolves to a different IP
+	f.allowAnswers(zap.NewNop(), &layers.DNS{
+		QR: true,
+		Questions: []layers.DNSQuestion{
+			{Name: []byte("www.example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN},
+		},
+		Answers: []layers.DNSResourceRecord{
+			{Name: []byte("www.example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN, IP: net.IPv4(192, 0, 2, 20)},
+		},
+	}, connectionID{}, nil)
+
+	target := netip.MustParseAddr("192.0.2.10")
+	is.True(f.allowedIPs.EntryExists(target))                                     // IP of SRV target should be allowed
+	is.True(!f.validPorts(40000, 5060))                                           // SRV port should not be allowed by allowedDstPorts
+	is.True(f.srvPortAllowed(40000, netip.AddrPortFrom(target, 5060)))            // SRV port should be allowed for the IP of the target
+	is.True(!f.srvPortAllowed(40000, netip.AddrPortFrom(target, 5061)))           // other ports should not be allowed for the IP of the target
+	is.True(!f.srvPortAllowed(40000, netip.MustParseAddrPort("192.0.2.20:5060"))) // SRV port should not be allowed for other IPs
+
+	f.opts.AllowedSrcPorts = []uint16{50000}
+	is.True(!f.srvPortAllowed(40000, netip.AddrPortFrom(target, 5060))) // disallowed source ports should still be dropped
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+const (
+	// stateDBQueueSize is how many changes can be waiting to be
+	// written to the state database before changes are dropped
+	stateDBQueueSize = 4096
+	// stateDBBatchSize is how many changes are written at once
+	stateDBBatchSize = 512
+	// stateDBFlushInterval is how often changes are written if there
+	// are less than stateDBBatchSize of them
+	stateDBFlushInterval = time.Second
+	// stateDBPruneInterval is how often expired entries are removed
+	// from the state database
+	stateDBPruneInterval = time.Minute
+	// stateDBLockTimeout is how long to wait for readers of the state
+	// database to release it
+	stateDBLockTimeout = 5 * time.Second
+
+	stateBucketAllowedIPs          = "allowedIPs"
+	stateBucketAdditionalHostnames = "additionalHostnames"
+
+	stateSourceDNSResponse  = "dnsResponse"
+	stateSourceCachedLookup = "cachedLookup"
+	stateSourceReverseDNS   = "reverseLookup"
+)
+
+// stateDB mirrors the allowed IPs and additional hostnames of filters
+// to a bbolt database so external tools can inspect them. Each filter
+// has a bucket holding a bucket of each cache, and entries are stored
+// as JSON encoded stateEntries.
+//
+// Changes are queued and written in batches by a separate goroutine so
+// packet callbacks are never slowed down. The database is only opened
+// while changes are written, so readers can open it read-only in
+// between.
+type stateDB struct {
+	// accessed atomically, kept first to ensure 64-bit alignment
+	dropped int64
+
+	logger  *zap.Logger
+	path    string
+	changes chan stateChange
+}
+
+type stateChangeKind uint8
+
+const (
+	stateAdd stateChangeKind = iota
+	stateRemove
+	stateRemoveFilter
+)
+
+type stateChange struct {
+	kind   stateChangeKind
+	filter string
+	bucket string
+	key    string
+	entry  stateEntry
+}
+
+// stateEntry is an entry of a cache of a filter. Entries may be kept
+// up to stateDBPruneInterval after they expire, so readers should
+// check Expires.
+type stateEntry struct {
+	// Source is what caused the entry to be added
+	Source string `json:"source"`
+	// Hostname is the hostname an IP was allowed because of, if known
+	Hostname string    `json:"hostname,omitempty"`
+	Expires  time.Time `json:"expires"`
+}
+
+// newStateDB creates the state database at path, removing any state
+// left over from previous runs.
+func newStateDB(logger *zap.Logger, path string) (*stateDB, error) {
+	s := stateDB{
+		logger:  logger,
+		path:    path,
+		changes: make(chan stateChange, stateDBQueueSize),
+	}
+
+	err := s.update(func(tx *bolt.Tx) error {
+		// buckets can't be deleted while iterating over them
+		var names [][]byte
+		err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			names = append(names, name)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error resetting state database: %v", err)
+	}
+
+	return &s, nil
+}
+
+// update opens the database, runs fn in a read-write transaction and
+// closes the database.
+func (s *stateDB) update(fn func(tx *bolt.Tx) error) error {
+	db, err := bolt.Open(s.path, 0o644, &bolt.Options{Timeout: stateDBLockTimeout})
+	if err != nil {
+		return err
+	}
+
+	err = db.Update(fn)
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// queue queues a change to be written, or drops it if too many
+// changes are already queued.
+func (s *stateDB) queue(change stateChange) {
+	select {
+	case s.changes <- change:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+	}
+}
+
+func (s *stateDB) add(filter, bucket, key string, entry stateEntry) {
+	s.queue(stateChange{kind: stateAdd, filter: filter, bucket: bucket, key: key, entry: entry})
+}
+
+func (s *stateDB) remove(filter, bucket, key string) {
+	s.queue(stateChange{kind: stateRemove, filter: filter, bucket: bucket, key: key})
+}
+
+// removeFilter removes all state of a filter.
+func (s *stateDB) removeFilter(filter string) {
+	s.queue(stateChange{kind: stateRemoveFilter, filter: filter})
+}
+
+// run writes queued changes until ctx is canceled, after which
+// changes that are still queued are written.
+func (s *stateDB) run(ctx context.Context) {
+	ticker := time.NewTicker(stateDBFlushInterval)
+	defer ticker.Stop()
+
+	var (
+		batch     = make([]stateChange, 0, stateDBBatchSize)
+		lastPrune = time.Now()
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			for n := len(s.changes); n > 0; n-- {
+				batch = append(batch, <-s.changes)
+			}
+			s.flush(batch, false, time.Now())
+			return
+		case change := <-s.changes:
+			batch = append(batch, change)
+			if len(batch) < stateDBBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		prune := now.Sub(lastPrune) >= stateDBPruneInterval
+		if len(batch) == 0 && !prune {
+			continue
+		}
+		if prune {
+			lastPrune = now
+		}
+
+		s.flush(batch, prune, now)
+		batch = batch[:0]
+	}
+}
+
+// flush writes batch to the database, and removes entries that
+// expired before now if prune is true.
+func (s *stateDB) flush(batch []stateChange, prune bool, now time.Time) {
+	if dropped := atomic.SwapInt64(&s.dropped, 0); dropped > 0 {
+		s.logger.Warn("dropped state database changes as too many were queued", zap.Int64("changes.dropped", dropped))
+	}
+	if len(batch) == 0 && !prune {
+		return
+	}
+
+	err := s.update(func(tx *bolt.Tx) error {
+		for _, change := range batch {
+			if err := applyStateChange(tx, change); err != nil {
+				return err
+			}
+		}
+		if prune {
+			return pruneStateEntries(tx, now)
+		}
+		return nil
+	})
+	if err != nil {
+		s.logger.Error("error writing to state database", zap.String("stateDB.path", s.path), zap.Int("changes.count", len(batch)), zap.NamedError("error", err))
+	}
+}
+
+func applyStateChange(tx *bolt.Tx, change stateChange) error {
+	if change.kind == stateRemoveFilter {
+		err := tx.DeleteBucket([]byte(change.filter))
+		if errors.Is(err, bolt.ErrBucketNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	filterBucket, err := tx.CreateBucketIfNotExists([]byte(change.filter))
+	if err != nil {
+		return err
+	}
+	bucket, err := filterBucket.CreateBucketIfNotExists([]byte(change.bucket))
+	if err != nil {
+		return err
+	}
+
+	if change.kind == stateRemove {
+		return bucket.Delete([]byte(change.key))
+	}
+
+	entry, err := json.Marshal(change.entry)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(change.key), entry)
+}
+
+// pruneStateEntries removes entries that expired before now.
+func pruneStateEntries(tx *bolt.Tx, now time.Time) error {
+	return tx.ForEach(func(_ []byte, filterBucket *bolt.Bucket) error {
+		return filterBucket.ForEach(func(name, _ []byte) error {
+			bucket := filterBucket.Bucket(name)
+			if bucket == nil {
+				return nil
+			}
+
+			// keys can't be deleted while iterating over a bucket
+			var expired [][]byte
+			err := bucket.ForEach(func(key, value []byte) error {
+				var entry stateEntry
+				if err := json.Unmarshal(value, &entry); err != nil || entry.Expires.Before(now) {
+					expired = append(expired, key)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, key := range expired {
+				if err := bucket.Delete(key); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	})
+}
+
+// mirrorAllowedIP records that ip was allowed in the state database
+// if it is enabled.
+func (f *filter) mirrorAllowedIP(ip netip.Addr, source, hostname string, ttl time.Duration) {
+	if f.state == nil {
+		return
+	}
+
+	f.state.add(f.opts.Name, stateBucketAllowedIPs, ip.String(), stateEntry{
+		Source:   source,
+		Hostname: hostname,
+		Expires:  time.Now().Add(ttl),
+	})
+}
+
+// mirrorRemovedIP records that ip is no longer allowed in the state
+// database if it is enabled.
+func (f *filter) mirrorRemovedIP(ip netip.Addr) {
+	if f.state == nil {
+		return
+	}
+
+	f.state.remove(f.opts.Name, stateBucketAllowedIPs, ip.String())
+}
+
+// mirrorAdditionalHostname records that hostname was allowed in the
+// state database if it is enabled.
+func (f *filter) mirrorAdditionalHostname(hostname string, ttl time.Duration) {
+	if f.state == nil {
+		return
+	}
+
+	f.state.add(f.opts.Name, stateBucketAdditionalHostnames, hostname, stateEntry{
+		Source:  stateSourceDNSResponse,
+		Expires: time.Now().Add(ttl),
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// readStateEntry returns the entry of key in a bucket of a filter in
+// the state database at path.
+func readStateEntry(t *testing.T, path, filter, bucket, key string) (stateEntry, bool) {
+	t.Helper()
+
+	db, err := bolt.Open(path, 0o644, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("error opening state database: %v", err)
+	}
+	defer db.Close()
+
+	var (
+		entry stateEntry
+		found bool
+	)
+	err = db.View(func(tx *bolt.Tx) error {
+		filterBucket := tx.Bucket([]byte(filter))
+		if filterBucket == nil {
+			return nil
+		}
+		b := filterBucket.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		value := b.Get([]byte(key))
+		if value == nil {
+			return nil
+		}
+
+		found = true
+		return json.Unmarshal(value, &entry)
+	})
+	if err != nil {
+		t.Fatalf("error reading state database: %v", err)
+	}
+
+	return entry, found
+}
+
+func TestStateDB(t *testing.T) {
+	is := is.New(t)
+
+	path := filepath.Join(t.TempDir(), "state.db")
+	state, err := newStateDB(zap.NewNop(), path)
+	is.NoErr(err) // creating state database should succeed
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		state.run(ctx)
+	}()
+
+	f := newTestFilter(&FilterOptions{Name: "foo"})
+	t.Cleanup(f.close)
+	f.state = state
+
+	f.allowIP(zap.NewNop(), netip.MustParseAddr("192.0.2.1"), time.Minute)
+	f.allowHostname(zap.NewNop(), "cname.example.com", HostnameSource{Type: "CNAME", Name: "example.com"}, time.Minute)
+	f.cacheAddrs(zap.NewNop(), "cached.example.com", []netip.Addr{netip.MustParseAddr("192.0.2.2")})
+
+	// changes are written asynchronously
+	time.Sleep(2 * stateDBFlushInterval)
+
+	entry, ok := readStateEntry(t, path, "foo", stateBucketAllowedIPs, "192.0.2.1")
+	is.True(ok)                                                // allowed IP should be written
+	is.Equal(entry.Source, stateSourceDNSResponse)             // source of allowed IP should be written
+	is.True(entry.Expires.After(time.Now()))                   // expiry of allowed IP should be written
+	is.True(entry.Expires.Before(time.Now().Add(time.Minute))) // expiry should match the TTL
+
+	entry, ok = readStateEntry(t, path, "foo", stateBucketAllowedIPs, "192.0.2.2")
+	is.True(ok)                                     // cached IP should be written
+	is.Equal(entry.Source, stateSourceCachedLookup) // source of cached IP should be written
+	is.Equal(entry.Hostname, "cached.example.com")  // hostname of cached IP should be written
+
+	_, ok = readStateEntry(t, path, "foo", stateBucketAdditionalHostnames, "cname.example.com")
+	is.True(ok) // additional hostname should be written
+
+	f.mirrorRemovedIP(netip.MustParseAddr("192.0.2.1"))
+	state.removeFilter("bar")
+	cancel()
+	<-done
+
+	_, ok = readStateEntry(t, path, "foo", stateBucketAllowedIPs, "192.0.2.1")
+	is.True(!ok) // removed IP should be deleted after queued changes are flushed
+
+	state.removeFilter("foo")
+	state.flush([]stateChange{<-state.changes}, false, time.Now())
+	_, ok = readStateEntry(t, path, "foo", stateBucketAllowedIPs, "192.0.2.2")
+	is.True(!ok) // state of removed filters should be deleted
+
+	_, err = newStateDB(zap.NewNop(), path)
+	is.NoErr(err) // reopening state database should succeed
+}
+
+func TestStateDBPrune(t *testing.T) {
+	is := is.New(t)
+
+	path := filepath.Join(t.TempDir(), "state.db")
+	state, err := newStateDB(zap.NewNop(), path)
+	is.NoErr(err) // creating state database should succeed
+
+	now := time.Now()
+	state.flush([]stateChange{
+		{kind: stateAdd, filter: "foo", bucket: stateBucketAllowedIPs, key: "192.0.2.1", entry: stateEntry{Expires: now.Add(-time.Second)}},
+		{kind: stateAdd, filter: "foo", bucket: stateBucketAllowedIPs, key: "192.0.2.2", entry: stateEntry{Expires: now.Add(time.Second)}},
+	}, true, now)
+
+	_, ok := readStateEntry(t, path, "foo", stateBucketAllowedIPs, "192.0.2.1")
+	is.True(!ok) // expired entries should be pruned
+	_, ok = readStateEntry(t, path, "foo", stateBucketAllowedIPs, "192.0.2.2")
+	is.True(ok) // unexpired entries should be kept
+
+	_, err = newStateDB(zap.NewNop(), path)
+	is.NoErr(err) // reopening state database should succeed
+	_, ok = readStateEntry(t, path, "foo", stateBucketAllowedIPs, "192.0.2.2")
+	is.True(!ok) // state of previous runs should be removed
+}
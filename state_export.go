@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// stateExportVersion is the version of the format state is exported
+// in, it must be changed if the format changes incompatibly.
+const stateExportVersion = 1
+
+// ErrStateVersion is returned by FilterManager.ImportState if the
+// state was exported in an unsupported format.
+var ErrStateVersion = errors.New("unsupported state version")
+
+// stateExport is the state of all filters of a FilterManager.
+type stateExport struct {
+	Version int           `json:"version"`
+	Filters []filterState `json:"filters"`
+}
+
+// filterState is the state of the caches of a filter. Entries expire
+// at the same time they would have in the exporting process, so their
+// TTLs decay while state is handed off.
+type filterState struct {
+	Name                string               `json:"name"`
+	AllowedIPs          []exportedIP         `json:"allowedIPs,omitempty"`
+	Provenance          []exportedProvenance `json:"provenance,omitempty"`
+	AdditionalHostnames []exportedHostname   `json:"additionalHostnames,omitempty"`
+	Connections         []exportedConnection `json:"connections,omitempty"`
+}
+
+type exportedIP struct {
+	IP netip.Addr `json:"ip"`
+	// Source is the mechanism that allowed the IP
+	Source  string    `json:"source"`
+	Expires time.Time `json:"expires"`
+}
+
+type exportedProvenance struct {
+	IP       netip.Addr `json:"ip"`
+	Hostname string     `json:"hostname"`
+	Expires  time.Time  `json:"expires"`
+}
+
+type exportedHostname struct {
+	Hostname string    `json:"hostname"`
+	Expires  time.Time `json:"expires"`
+}
+
+type exportedConnection struct {
+	UDP     bool           `json:"udp"`
+	Src     netip.AddrPort `json:"src"`
+	Dst     netip.AddrPort `json:"dst"`
+	Expires time.Time      `json:"expires"`
+	// Count is how many more requests are in flight on the connection
+	Count int `json:"count,omitempty"`
+}
+
+// ExportState writes the allowed IPs, additional hostnames and
+// tracked DNS connections of every filter that haven't expired to w,
+// so a newly started process can import them with ImportState.
+func (f *FilterManager) ExportState(w io.Writer) error {
+	filters := f.currentFilters()
+	export := stateExport{
+		Version: stateExportVersion,
+		Filters: make([]filterState, len(filters)),
+	}
+	for i, filter := range filters {
+		export.Filters[i] = filter.exportState(time.Now())
+	}
+
+	if err := json.NewEncoder(w).Encode(export); err != nil {
+		return fmt.Errorf("error writing state: %v", err)
+	}
+
+	return nil
+}
+
+// exportState returns the entries of the caches of the filter that
+// haven't expired before now. The caches are locked at once so the
+// entries are consistent with each other.
+func (f *filter) exportState(now time.Time) filterState {
+	var lockers []sync.Locker
+	if f.allowedIPs != nil {
+		lockers = append(lockers, f.allowedIPs.mtx.RLocker())
+	}
+	if f.ipMechanisms != nil {
+		lockers = append(lockers, f.ipMechanisms.mtx.RLocker())
+	}
+	if f.ipHostnames != nil {
+		lockers = append(lockers, f.ipHostnames.mtx.RLocker())
+	}
+	if f.additionalHostnames != nil {
+		lockers = append(lockers, f.additionalHostnames.mtx.RLocker())
+	}
+	lockers = append(lockers, f.connections.mtx.RLocker())
+	for _, l := range lockers {
+		l.Lock()
+		defer l.Unlock()
+	}
+
+	state := filterState{Name: f.opts.Name}
+	if f.allowedIPs != nil {
+		mechanisms := make(map[netip.Addr]allowMechanism)
+		if f.ipMechanisms != nil {
+			for _, e := range f.ipMechanisms.entriesLocked(now) {
+				if cur, ok := mechanisms[e.entry.ip]; !ok || mechanismPriority(e.entry.mechanism) < mechanismPriority(cur) {
+					mechanisms[e.entry.ip] = e.entry.mechanism
+				}
+			}
+		}
+		for _, e := range f.allowedIPs.entriesLocked(now) {
+			mechanism, ok := mechanisms[e.entry]
+			if !ok {
+				mechanism = allowedByDNSAnswer
+			}
+			state.AllowedIPs = append(state.AllowedIPs, exportedIP{
+				IP:      e.entry,
+				Source:  mechanism.String(),
+				Expires: e.expires,
+			})
+		}
+	}
+	if f.ipHostnames != nil {
+		for _, e := range f.ipHostnames.entriesLocked(now) {
+			state.Provenance = append(state.Provenance, exportedProvenance{
+				IP:       e.entry.ip,
+				Hostname: e.entry.hostname,
+				Expires:  e.expires,
+			})
+		}
+	}
+	if f.additionalHostnames != nil {
+		for _, e := range f.additionalHostnames.entriesLocked(now) {
+			state.AdditionalHostnames = append(state.AdditionalHostnames, exportedHostname{
+				Hostname: e.entry,
+				Expires:  e.expires,
+			})
+		}
+	}
+	for _, e := range f.connections.entriesLocked(now) {
+		state.Connections = append(state.Connections, exportedConnection{
+			UDP:     e.entry.isUDP,
+			Src:     e.entry.src,
+			Dst:     e.entry.dst,
+			Expires: e.expires,
+			Count:   e.count,
+		})
+	}
+
+	return state
+}
+
+// mechanismPriority returns the index of m in mechanismPrecedence.
+func mechanismPriority(m allowMechanism) int {
+	for i := range mechanismPrecedence {
+		if mechanismPrecedence[i] == m {
+			return i
+		}
+	}
+
+	return len(mechanismPrecedence)
+}
+
+// parseAllowMechanism returns the mechanism named name.
+func parseAllowMechanism(name string) (allowMechanism, bool) {
+	for m := allowedByDNSAnswer; m < numAllowMechanisms; m++ {
+		if m.String() == name {
+			return m, true
+		}
+	}
+
+	return allowedByNone, false
+}
+
+// ImportState adds state written by ExportState to the caches of the
+// filters with the same names. Entries that have expired since they
+// were exported are skipped, and state of filters that don't exist is
+// ignored.
+func (f *FilterManager) ImportState(r io.Reader) error {
+	var export stateExport
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return fmt.Errorf("error reading state: %v", err)
+	}
+	if export.Version != stateExportVersion {
+		return fmt.Errorf("%w: %d", ErrStateVersion, export.Version)
+	}
+
+	filters := make(map[string]*filter)
+	for _, filter := range f.currentFilters() {
+		filters[filter.opts.Name] = filter
+	}
+	for _, state := range export.Filters {
+		filter, ok := filters[state.Name]
+		if !ok {
+			f.logger.Warn("ignoring state of unknown filter", zap.String("filter.name", state.Name))
+			continue
+		}
+		if err := filter.importState(state, time.Now()); err != nil {
+			return fmt.Errorf("filter %q: %v", state.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (f *filter) importState(state filterState, now time.Time) error {
+	// validate all entries first so state is either fully imported
+	// or not at all
+	mechanisms := make([]allowMechanism, len(state.AllowedIPs))
+	for i, e := range state.AllowedIPs {
+		mechanism, ok := parseAllowMechanism(e.Source)
+		if !ok {
+			return fmt.Errorf("allowed IP %s has unknown source %q", e.IP, e.Source)
+		}
+		mechanisms[i] = mechanism
+	}
+	if f.allowedIPs == nil && len(state.AllowedIPs) > 0 {
+		return errors.New("allowed IPs can't be imported into a filter without a traffic queue")
+	}
+
+	var imported int
+	for i, e := range state.AllowedIPs {
+		ttl := e.Expires.Sub(now)
+		if ttl <= 0 {
+			continue
+		}
+		f.allowIPBy(e.IP, mechanisms[i], ttl)
+		f.mirrorAllowedIP(e.IP, e.Source, "", ttl)
+		imported++
+	}
+	for _, e := range state.Provenance {
+		if ttl := e.Expires.Sub(now); ttl > 0 {
+			f.addProvenance(e.IP, e.Hostname, ttl)
+		}
+	}
+	if f.additionalHostnames != nil {
+		for _, e := range state.AdditionalHostnames {
+			ttl := e.Expires.Sub(now)
+			if ttl <= 0 {
+				continue
+			}
+			f.additionalHostnames.AddEntry(e.Hostname, ttl)
+			f.mirrorAdditionalHostname(e.Hostname, ttl)
+			imported++
+		}
+	}
+	for _, e := range state.Connections {
+		ttl := e.Expires.Sub(now)
+		if ttl <= 0 {
+			continue
+		}
+		connID := connectionID{isUDP: e.UDP, src: e.Src, dst: e.Dst}
+		// each time a connection is added its count is incremented
+		for i := 0; i <= e.Count; i++ {
+			f.connections.AddEntry(connID, ttl)
+		}
+		imported++
+	}
+
+	f.logger.Info("imported state", zap.Int("entries.count", imported))
+
+	return nil
+}
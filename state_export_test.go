@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"go.uber.org/zap"
+)
+
+func TestExportImportState(t *testing.T) {
+	is := is.New(t)
+
+	newManager := func() (*FilterManager, *filter) {
+		foo := newTestFilter(&FilterOptions{
+			Name:            "foo",
+			DNSQueue:        1000,
+			TrafficQueue:    1001,
+			AllowAnswersFor: duration(time.Minute),
+		})
+		foo.ipHostnames = NewTimedCache[ipHostname](zap.NewNop(), false)
+		t.Cleanup(foo.close)
+
+		return &FilterManager{
+			logger:  zap.NewNop(),
+			filters: []*filter{foo},
+		}, foo
+	}
+
+	var (
+		answerIP  = netip.MustParseAddr("192.0.2.1")
+		lookupIP  = netip.MustParseAddr("2001:db8::1")
+		expiredIP = netip.MustParseAddr("192.0.2.2")
+		connID    = connectionID{
+			isUDP: true,
+			src:   netip.MustParseAddrPort("192.168.1.2:40000"),
+			dst:   netip.MustParseAddrPort("192.168.1.1:53"),
+		}
+	)
+
+	old, oldFoo := newManager()
+	oldFoo.allowIPBy(answerIP, allowedByDNSAnswer, time.Minute)
+	oldFoo.allowIPBy(lookupIP, allowedByReverseLookup, time.Hour)
+	oldFoo.allowIPBy(expiredIP, allowedByDNSAnswer, 50*time.Millisecond)
+	oldFoo.addProvenance(answerIP, "www.example.com", time.Minute)
+	oldFoo.additionalHostnames.AddEntry("cdn.example.net", time.Minute)
+	oldFoo.connections.AddEntry(connID, dnsQueryTimeout)
+	oldFoo.connections.AddEntry(connID, dnsQueryTimeout)
+
+	var buf bytes.Buffer
+	is.NoErr(old.ExportState(&buf))
+	// wait until an exported entry expires
+	time.Sleep(100 * time.Millisecond)
+
+	current, newFoo := newManager()
+	is.NoErr(current.ImportState(bytes.NewReader(buf.Bytes())))
+
+	is.True(newFoo.allowedIPs.EntryExists(answerIP))                                 // allowed IPs should be imported
+	is.True(!newFoo.allowedIPs.EntryExists(expiredIP))                               // expired IPs should not be imported
+	is.Equal(newFoo.allowedBy(lookupIP), allowedByReverseLookup)                     // mechanisms of IPs should be imported
+	is.True(newFoo.ipHostnames.EntryExists(ipHostname{answerIP, "www.example.com"})) // provenance of IPs should be imported
+	is.True(newFoo.additionalHostnames.EntryExists("cdn.example.net"))               // additional hostnames should be imported
+
+	oldExpires, _ := oldFoo.allowedIPs.Expires(answerIP)
+	newExpires, _ := newFoo.allowedIPs.Expires(answerIP)
+	diff := newExpires.Sub(oldExpires)
+	is.True(diff > -10*time.Millisecond && diff < 10*time.Millisecond) // TTLs should decay while state is handed off
+
+	// connections are counted, so a connection with two requests in
+	// flight should be removed twice
+	newFoo.connections.RemoveEntry(connID)
+	is.True(newFoo.connections.EntryExists(connID)) // connection counts should be imported
+	newFoo.connections.RemoveEntry(connID)
+	is.True(!newFoo.connections.EntryExists(connID))
+
+	// exporting imported state should result in the same state
+	var reexported bytes.Buffer
+	is.NoErr(current.ExportState(&reexported))
+	var state stateExport
+	is.NoErr(json.Unmarshal(reexported.Bytes(), &state))
+	is.Equal(len(state.Filters), 1)
+	is.Equal(len(state.Filters[0].AllowedIPs), 2)
+}
+
+func TestImportStateErrors(t *testing.T) {
+	is := is.New(t)
+
+	foo := newTestFilter(&FilterOptions{Name: "foo"})
+	t.Cleanup(foo.close)
+	f := &FilterManager{
+		logger:  zap.NewNop(),
+		filters: []*filter{foo},
+	}
+
+	err := f.ImportState(strings.NewReader(`{"version":2,"filters":[]}`))
+	is.True(errors.Is(err, ErrStateVersion)) // unknown versions should not be imported
+
+	err = f.ImportState(strings.NewReader(`{"version":1,"filters":[{"name":"foo","allowedIPs":[{"ip":"192.0.2.1","source":"magic","expires":"2999-01-01T00:00:00Z"}]}]}`))
+	is.True(err != nil)                                                    // unknown sources should not be imported
+	is.True(!foo.allowedIPs.EntryExists(netip.MustParseAddr("192.0.2.1"))) // invalid state should not be partially imported
+
+	is.NoErr(f.ImportState(strings.NewReader(`{"version":1,"filters":[{"name":"bar"}]}`))) // state of unknown filters should be ignored
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/florianl/go-nfqueue"
+)
+
+// ManagerStatus describes the health of a FilterManager.
+type ManagerStatus struct {
+	Ready          bool
+	FiltersTotal   int
+	FiltersHealthy int
+	StartTime      time.Time
+	UptimeDuration time.Duration
+	Filters        []FilterStatus
+	// Paused is true if egress is paused and all packets are dropped
+	Paused bool
+	// VerdictsDropped is how many verdict decisions weren't published
+	// because the queue of the verdict producer was full
+	VerdictsDropped int64
+	// DNSResponseDeadLetters is how many DNS responses could not have
+	// their verdicts set
+	DNSResponseDeadLetters int64
+}
+
+// FilterStatus describes the health of a filter.
+type FilterStatus struct {
+	Name           string
+	IsHealthy      bool
+	PacketsAllowed int64
+	PacketsDropped int64
+	// PacketsAllowedBy is how many packets of the traffic queue were
+	// allowed by each mechanism that allows IPs, keyed by the name
+	// of the mechanism
+	PacketsAllowedBy map[string]int64
+	// NoDataResponses is how many NOERROR DNS responses without
+	// answers were accepted
+	NoDataResponses int64
+	// DNSLatencies are how long resolvers took to respond to DNS
+	// requests for each hostname, sorted by hostname
+	DNSLatencies []DNSLatency
+	// FailingOpen is true if the filter is allowing all traffic
+	// because of a resolver outage
+	FailingOpen bool
+	// FailOpens is how many times the filter started failing open
+	FailOpens int64
+	// AllowedIPsNearLimit is true if the amount of allowed IPs
+	// exceeded warnAllowedIPsThreshold
+	AllowedIPsNearLimit bool
+	Connections         CacheStats
+	AllowedIPs          CacheStats
+	// HostnamesExpiredInUse is how many hostnames allowed from answers
+	// expired shortly after being matched
+	HostnamesExpiredInUse int64
+	// PacketsDeduplicated is how many packets got the verdict of an
+	// identical packet instead of being inspected, they aren't
+	// counted in PacketsAllowed or PacketsDropped
+	PacketsDeduplicated int64
+	// DeadLetters is how many packets could not have their verdicts
+	// set and were queued to be dropped again
+	DeadLetters int64
+	// AdditionalHostnames is how many hostnames are currently allowed
+	// from CNAME and SRV answers
+	AdditionalHostnames int
+}
+
+// HostnameStats is how many times an allowed hostname of a filter
+// matched a hostname.
+type HostnameStats struct {
+	Hostname string
+	Matches  int64
+}
+
+// HostnameStats returns how many times each allowed hostname of a
+// filter matched, in the order the hostnames are allowed. Allowed
+// hostnames that never matched have 0 matches, and are candidates
+// for removal.
+func (f *FilterManager) HostnameStats(filterName string) ([]HostnameStats, error) {
+	for _, filter := range f.currentFilters() {
+		if filter.opts.Name == filterName {
+			return filter.hostnameStats(), nil
+		}
+	}
+
+	return nil, fmt.Errorf("filter %q: %w", filterName, ErrFilterNotFound)
+}
+
+func (f *filter) hostnameStats() []HostnameStats {
+	f.hostnamesMtx.RLock()
+	hostnames := f.opts.AllowedHostnames
+	f.hostnamesMtx.RUnlock()
+
+	trie := f.allowedHostnames.Load().(*hostnameTrie)
+	stats := make([]HostnameStats, len(hostnames))
+	for i, hostname := range hostnames {
+		stats[i] = HostnameStats{
+			Hostname: hostname,
+			Matches:  trie.hits(hostname),
+		}
+	}
+
+	return stats
+}
+
+// Status returns the current health of the FilterManager and its
+// filters.
+func (f *FilterManager) Status() ManagerStatus {
+	filters := f.currentFilters()
+	status := ManagerStatus{
+		Ready:           isClosed(f.ready),
+		FiltersTotal:    len(filters),
+		StartTime:       f.startTime,
+		UptimeDuration:  time.Since(f.startTime),
+		Filters:         make([]FilterStatus, len(filters)),
+		Paused:          f.Paused(),
+		VerdictsDropped: f.verdicts.droppedDecisions(),
+
+		DNSResponseDeadLetters: f.deadLetters.total(),
+	}
+
+	for i, filter := range filters {
+		status.Filters[i] = filter.status()
+		if status.Filters[i].IsHealthy {
+			status.FiltersHealthy++
+		}
+	}
+
+	return status
+}
+
+func (f *filter) status() FilterStatus {
+	status := FilterStatus{
+		Name:            f.opts.Name,
+		IsHealthy:       f.isHealthy(),
+		PacketsAllowed:  atomic.LoadInt64(&f.packetsAllowed),
+		PacketsDropped:  atomic.LoadInt64(&f.packetsDropped),
+		NoDataResponses: atomic.LoadInt64(&f.noDataResponses),
+		DNSLatencies:    f.dnsLatencies.snapshot(),
+		Connections:     f.connections.Stats(),
+		DeadLetters:     f.deadLetters.total(),
+	}
+	if f.allowedIPs != nil {
+		status.PacketsAllowedBy = make(map[string]int64, numAllowMechanisms-1)
+		for m := allowedByDNSAnswer; m < numAllowMechanisms; m++ {
+			status.PacketsAllowedBy[m.String()] = atomic.LoadInt64(&f.packetsAllowedBy[m])
+		}
+		status.AllowedIPs = f.allowedIPs.Stats()
+		// allowed IPs may have expired since they were last checked
+		status.AllowedIPsNearLimit = f.allowedIPsNearLimitAt(uint(status.AllowedIPs.Len))
+		status.HostnamesExpiredInUse = atomic.LoadInt64(&f.hostnamesExpiredInUse)
+		status.PacketsDeduplicated = atomic.LoadInt64(&f.packetsDeduplicated)
+	}
+	if f.additionalHostnames != nil {
+		status.AdditionalHostnames = f.additionalHostnames.Len()
+	}
+	if f.outage != nil {
+		status.FailingOpen = atomic.LoadInt32(&f.outage.failingOpen) == 1
+		status.FailOpens = atomic.LoadInt64(&f.outage.failOpens)
+	}
+
+	return status
+}
+
+// isHealthy returns true if the nfqueues of the filter are setup.
+func (f *filter) isHealthy() bool {
+	if f.opts.DNSQueue != 0 && !isClosed(f.dnsReqNFReady) {
+		return false
+	}
+	if f.opts.TrafficQueue != 0 && !isClosed(f.genericNFReady) {
+		return false
+	}
+
+	return true
+}
+
+// countVerdict records a verdict that was set for a packet.
+func (f *filter) countVerdict(verdict int) {
+	if verdict == nfqueue.NfAccept {
+		atomic.AddInt64(&f.packetsAllowed, 1)
+	} else {
+		atomic.AddInt64(&f.packetsDropped, 1)
+	}
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/florianl/go-nfqueue"
+	"github.com/matryer/is"
+)
+
+func TestStatus(t *testing.T) {
+	is := is.New(t)
+
+	healthy := newTestFilter(&FilterOptions{
+		Name:         "healthy",
+		DNSQueue:     1000,
+		TrafficQueue: 1001,
+	})
+	healthy.dnsReqNFReady = make(chan struct{})
+	healthy.genericNFReady = make(chan struct{})
+	close(healthy.dnsReqNFReady)
+	close(healthy.genericNFReady)
+	healthy.countVerdict(nfqueue.NfAccept)
+	healthy.countVerdict(nfqueue.NfAccept)
+	healthy.countVerdict(nfqueue.NfDrop)
+	healthy.countAllowedBy(allowedByDNSAnswer)
+	healthy.countAllowedBy(allowedByReverseLookup)
+
+	starting := newTestFilter(&FilterOptions{
+		Name:         "starting",
+		DNSQueue:     2000,
+		TrafficQueue: 2001,
+	})
+	starting.dnsReqNFReady = make(chan struct{})
+	starting.genericNFReady = make(chan struct{})
+	close(starting.dnsReqNFReady)
+
+	f := FilterManager{
+		ready:   make(chan struct{}),
+		filters: []*filter{healthy, starting},
+	}
+	is.True(!f.Status().Ready) // manager should not be ready until setup is finished
+
+	close(f.ready)
+	status := f.Status()
+	is.True(status.Ready)              // manager should be ready
+	is.Equal(status.FiltersTotal, 2)   // all filters should be counted
+	is.Equal(status.FiltersHealthy, 1) // only filters with all nfqueues setup should be healthy
+	is.Equal(status.Filters, []FilterStatus{
+		{
+			Name:           "healthy",
+			IsHealthy:      true,
+			PacketsAllowed: 2,
+			PacketsDropped: 1,
+			PacketsAllowedBy: map[string]int64{
+				"dnsResponse":       1,
+				"cachedLookup":      0,
+				"reverseLookup":     1,
+				"postResponseGrace": 0,
+			},
+		},
+		{
+			Name:      "starting",
+			IsHealthy: false,
+			PacketsAllowedBy: map[string]int64{
+				"dnsResponse":       0,
+				"cachedLookup":      0,
+				"reverseLookup":     0,
+				"postResponseGrace": 0,
+			},
+		},
+	}) // status of each filter should be reported
+}
+
+func TestHostnameStats(t *testing.T) {
+	is := is.New(t)
+
+	foo := newTestFilter(&FilterOptions{
+		Name:             "foo",
+		AllowedHostnames: []string{"example.com", "example.org", "unused.net"},
+	})
+	f := FilterManager{
+		filters: []*filter{foo},
+	}
+
+	for _, hostname := range []string{"example.com", "www.example.com", "api.example.com", "example.org", "example.net"} {
+		foo.hostnameAllowed(hostname)
+	}
+	// matching rules for logging shouldn't count as matches
+	foo.matchedRule("example.org")
+
+	stats, err := f.HostnameStats("foo")
+	is.NoErr(err)
+	is.Equal(stats, []HostnameStats{
+		{Hostname: "example.com", Matches: 3},
+		{Hostname: "example.org", Matches: 1},
+		{Hostname: "unused.net", Matches: 0},
+	}) // matches of subdomains should count towards the allowed hostname, and unused hostnames should have no matches
+
+	is.NoErr(foo.updateAllowedHostnames([]string{"example.org", "example.net"}))
+	foo.hostnameAllowed("example.net")
+
+	stats, err = f.HostnameStats("foo")
+	is.NoErr(err)
+	is.Equal(stats, []HostnameStats{
+		{Hostname: "example.org", Matches: 1},
+		{Hostname: "example.net", Matches: 1},
+	}) // matches should be kept when allowed hostnames are updated
+
+	_, err = f.HostnameStats("bar")
+	is.True(errors.Is(err, ErrFilterNotFound)) // stats of unknown filters should not be returned
+}
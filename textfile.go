@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultTextfileInterval is how often metrics are written to
+// textfilePath by default.
+const defaultTextfileInterval = 15 * time.Second
+
+// labelEscaper escapes label values in the Prometheus exposition
+// format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// runTextfileWriter periodically writes the metrics of the
+// FilterManager to path until ctx is canceled.
+func (f *FilterManager) runTextfileWriter(ctx context.Context, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := writeTextfile(path, f.Status()); err != nil {
+			f.logger.Error("error writing metrics textfile", zap.String("textfile.path", path), zap.NamedError("error", err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// writeTextfile atomically writes metrics to path so node_exporter's
+// textfile collector never reads a partially written file.
+func writeTextfile(path string, status ManagerStatus) error {
+	var buf bytes.Buffer
+	writeMetrics(&buf, status)
+
+	// the textfile collector only reads files ending in ".prom", so
+	// make sure the temporary file is ignored
+	file, err := os.CreateTemp(filepath.Dir(path), ".egress-eddie-*.prom.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file: %v", err)
+	}
+	tmpPath := file.Name()
+
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("error writing temporary file: %v", err)
+	}
+	// os.CreateTemp creates files that only the owner can read, but
+	// node_exporter is usually run as a different user
+	if err := file.Chmod(0o644); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("error setting permissions of temporary file: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error closing temporary file: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error renaming temporary file: %v", err)
+	}
+
+	return nil
+}
+
+// writeMetrics writes status in the Prometheus text exposition
+// format.
+func writeMetrics(w io.Writer, status ManagerStatus) {
+	writeMetric(w, "egress_eddie_up", "gauge", "Whether all filters have been started.", "", boolMetric(status.Ready))
+	writeMetric(w, "egress_eddie_uptime_seconds", "gauge", "Seconds since filters were started.", "", status.UptimeDuration.Seconds())
+	writeMetric(w, "egress_eddie_paused", "gauge", "Whether egress is paused and all packets are dropped.", "", boolMetric(status.Paused))
+	writeMetric(w, "egress_eddie_verdicts_dropped_total", "counter", "Verdict decisions that weren't published because the producer's queue was full.", "", float64(status.VerdictsDropped))
+	writeMetric(w, "egress_eddie_dns_response_dead_letter_total", "counter", "DNS responses whose verdicts could not be set and were queued to be dropped again.", "", float64(status.DNSResponseDeadLetters))
+
+	filterMetrics := []struct {
+		name  string
+		typ   string
+		help  string
+		value func(FilterStatus) float64
+	}{
+		{
+			name:  "egress_eddie_filter_healthy",
+			typ:   "gauge",
+			help:  "Whether all nfqueues of the filter are set up.",
+			value: func(s FilterStatus) float64 { return boolMetric(s.IsHealthy) },
+		},
+		{
+			name:  "egress_eddie_packets_allowed_total",
+			typ:   "counter",
+			help:  "Packets the filter allowed.",
+			value: func(s FilterStatus) float64 { return float64(s.PacketsAllowed) },
+		},
+		{
+			name:  "egress_eddie_packets_dropped_total",
+			typ:   "counter",
+			help:  "Packets the filter dropped.",
+			value: func(s FilterStatus) float64 { return float64(s.PacketsDropped) },
+		},
+		{
+			name:  "egress_eddie_nodata_responses_total",
+			typ:   "counter",
+			help:  "NOERROR DNS responses without answers the filter accepted.",
+			value: func(s FilterStatus) float64 { return float64(s.NoDataResponses) },
+		},
+		{
+			name:  "egress_eddie_failing_open",
+			typ:   "gauge",
+			help:  "Whether the filter is allowing all traffic because of a resolver outage.",
+			value: func(s FilterStatus) float64 { return boolMetric(s.FailingOpen) },
+		},
+		{
+			name:  "egress_eddie_hostnames_expired_in_use_total",
+			typ:   "counter",
+			help:  "Hostnames allowed from DNS answers that expired shortly after being matched.",
+			value: func(s FilterStatus) float64 { return float64(s.HostnamesExpiredInUse) },
+		},
+		{
+			name:  "egress_eddie_packets_deduplicated_total",
+			typ:   "counter",
+			help:  "Packets that got the verdict of an identical packet without being inspected.",
+			value: func(s FilterStatus) float64 { return float64(s.PacketsDeduplicated) },
+		},
+		{
+			name:  "egress_eddie_allowed_ips_near_limit",
+			typ:   "gauge",
+			help:  "Whether the amount of allowed IPs exceeded the warning threshold.",
+			value: func(s FilterStatus) float64 { return boolMetric(s.AllowedIPsNearLimit) },
+		},
+		{
+			name:  "egress_eddie_fail_opens_total",
+			typ:   "counter",
+			help:  "Times the filter started failing open.",
+			value: func(s FilterStatus) float64 { return float64(s.FailOpens) },
+		},
+		{
+			name:  "egress_eddie_dead_letter_total",
+			typ:   "counter",
+			help:  "Packets whose verdicts could not be set and were queued to be dropped again.",
+			value: func(s FilterStatus) float64 { return float64(s.DeadLetters) },
+		},
+		{
+			name:  "egress_eddie_additional_hostnames",
+			typ:   "gauge",
+			help:  "Hostnames currently allowed from CNAME and SRV answers.",
+			value: func(s FilterStatus) float64 { return float64(s.AdditionalHostnames) },
+		},
+	}
+	for _, m := range filterMetrics {
+		writeHeader(w, m.name, m.typ, m.help)
+		for _, filter := range status.Filters {
+			writeSample(w, m.name, filterLabels(filter.Name, ""), m.value(filter))
+		}
+	}
+
+	const allowedByName = "egress_eddie_packets_allowed_by_total"
+	writeHeader(w, allowedByName, "counter", "Packets the filter allowed by each mechanism that allows IPs.")
+	for _, filter := range status.Filters {
+		// write mechanisms in a consistent order
+		for m := allowedByDNSAnswer; m < numAllowMechanisms; m++ {
+			count, ok := filter.PacketsAllowedBy[m.String()]
+			if !ok {
+				continue
+			}
+			labels := strings.TrimSuffix(filterLabels(filter.Name, ""), "}") + `,mechanism="` + m.String() + `"}`
+			writeSample(w, allowedByName, labels, float64(count))
+		}
+	}
+
+	const latencyName = "egress_eddie_dns_response_latency_seconds"
+	writeHeader(w, latencyName, "histogram", "How long resolvers took to respond to DNS requests for each hostname.")
+	for _, filter := range status.Filters {
+		for _, latency := range filter.DNSLatencies {
+			labels := strings.TrimSuffix(filterLabels(filter.Name, ""), "}") + `,hostname="` + labelEscaper.Replace(latency.Hostname) + `"`
+			for i, bound := range dnsLatencyBuckets {
+				writeSample(w, latencyName+"_bucket", labels+fmt.Sprintf(`,le="%g"}`, bound.Seconds()), float64(latency.Buckets[i]))
+			}
+			writeSample(w, latencyName+"_bucket", labels+`,le="+Inf"}`, float64(latency.Count))
+			writeSample(w, latencyName+"_sum", labels+"}", latency.Sum.Seconds())
+			writeSample(w, latencyName+"_count", labels+"}", float64(latency.Count))
+		}
+	}
+
+	cacheMetrics := []struct {
+		name  string
+		typ   string
+		help  string
+		value func(CacheStats) float64
+	}{
+		{
+			name:  "egress_eddie_cache_entries",
+			typ:   "gauge",
+			help:  "Entries currently in the cache.",
+			value: func(s CacheStats) float64 { return float64(s.Len) },
+		},
+		{
+			name:  "egress_eddie_cache_hits_total",
+			typ:   "counter",
+			help:  "Cache lookups that found an entry.",
+			value: func(s CacheStats) float64 { return float64(s.Hits) },
+		},
+		{
+			name:  "egress_eddie_cache_misses_total",
+			typ:   "counter",
+			help:  "Cache lookups that did not find an entry.",
+			value: func(s CacheStats) float64 { return float64(s.Misses) },
+		},
+		{
+			name:  "egress_eddie_cache_evictions_total",
+			typ:   "counter",
+			help:  "Cache entries removed before they expired, the caches have no capacity limit.",
+			value: func(s CacheStats) float64 { return float64(s.Evictions) },
+		},
+		{
+			name:  "egress_eddie_cache_expirations_total",
+			typ:   "counter",
+			help:  "Cache entries removed because they expired.",
+			value: func(s CacheStats) float64 { return float64(s.Expirations) },
+		},
+	}
+	for _, m := range cacheMetrics {
+		writeHeader(w, m.name, m.typ, m.help)
+		for _, filter := range status.Filters {
+			writeSample(w, m.name, filterLabels(filter.Name, "connections"), m.value(filter.Connections))
+			writeSample(w, m.name, filterLabels(filter.Name, "allowed_ips"), m.value(filter.AllowedIPs))
+		}
+	}
+}
+
+func writeMetric(w io.Writer, name, typ, help, labels string, value float64) {
+	writeHeader(w, name, typ, help)
+	writeSample(w, name, labels, value)
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+func writeSample(w io.Writer, name, labels string, value float64) {
+	fmt.Fprintf(w, "%s%s %g\n", name, labels, value)
+}
+
+func filterLabels(filterName, cache string) string {
+	labels := `{filter="` + labelEscaper.Replace(filterName) + `"`
+	if cache != "" {
+		labels += `,cache="` + cache + `"`
+	}
+
+	return labels + "}"
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
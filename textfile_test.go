@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/florianl/go-nfqueue"
+	"github.com/matryer/is"
+	"go.uber.org/zap"
+)
+
+var (
+	metricHeaderRe = regexp.MustCompile(`^# (HELP|TYPE) ([a-zA-Z_:][a-zA-Z0-9_:]*) (.+)$`)
+	metricSampleRe = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\]|\\.)*"(?:,[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\]|\\.)*")*\})? (\S+)$`)
+)
+
+func TestWriteTextfile(t *testing.T) {
+	is := is.New(t)
+
+	foo := newTestFilter(&FilterOptions{
+		Name:            `foo "bar"`,
+		DNSQueue:        1000,
+		TrafficQueue:    1001,
+		AllowAnswersFor: duration(time.Minute),
+	})
+	foo.dnsReqNFReady = make(chan struct{})
+	foo.genericNFReady = make(chan struct{})
+	close(foo.dnsReqNFReady)
+	close(foo.genericNFReady)
+	foo.countVerdict(nfqueue.NfAccept)
+	foo.countVerdict(nfqueue.NfAccept)
+	foo.countVerdict(nfqueue.NfDrop)
+	foo.allowedIPs.AddEntry(netip.MustParseAddr("192.0.2.1"), time.Minute)
+	foo.countAllowedBy(allowedByReverseLookup)
+	foo.dnsLatencies.record("example.com", 20*time.Millisecond)
+	foo.deadLetters = newDeadLetterQueue(zap.NewNop())
+	foo.deadLetters.add(newFakeQueue(), 1)
+	t.Cleanup(foo.close)
+
+	f := FilterManager{
+		ready:     make(chan struct{}),
+		startTime: time.Now(),
+		logger:    zap.NewNop(),
+		filters:   []*filter{foo},
+	}
+	close(f.ready)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "egress_eddie.prom")
+	is.NoErr(writeTextfile(path, f.Status()))
+	// write again to ensure existing textfiles are replaced
+	is.NoErr(writeTextfile(path, f.Status()))
+
+	entries, err := os.ReadDir(dir)
+	is.NoErr(err)
+	is.Equal(len(entries), 1) // temporary files should not be left behind
+
+	info, err := os.Stat(path)
+	is.NoErr(err)
+	is.Equal(info.Mode().Perm(), os.FileMode(0o644)) // textfile should be readable by node_exporter
+
+	file, err := os.Open(path)
+	is.NoErr(err)
+	defer file.Close()
+
+	samples := make(map[string]string)
+	typed := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			matches := metricHeaderRe.FindStringSubmatch(line)
+			is.True(matches != nil) // comment lines should be valid HELP or TYPE lines
+			if matches[1] == "TYPE" {
+				is.True(!typed[matches[2]]) // metrics should only be typed once
+				typed[matches[2]] = true
+			}
+			continue
+		}
+
+		matches := metricSampleRe.FindStringSubmatch(line)
+		is.True(matches != nil)                  // sample lines should be valid
+		is.True(typed[metricFamily(matches[1])]) // metrics should be typed before their samples
+		samples[matches[1]+matches[2]] = matches[3]
+	}
+	is.NoErr(scanner.Err())
+
+	is.Equal(samples["egress_eddie_paused"], "0")                                                  // egress should not be paused
+	is.Equal(samples["egress_eddie_up"], "1")                                                      // manager readiness should be written
+	is.Equal(samples[`egress_eddie_filter_healthy{filter="foo \"bar\""}`], "1")                    // filter health should be written
+	is.Equal(samples[`egress_eddie_packets_allowed_total{filter="foo \"bar\""}`], "2")             // allowed packets should be written
+	is.Equal(samples[`egress_eddie_packets_dropped_total{filter="foo \"bar\""}`], "1")             // dropped packets should be written
+	is.Equal(samples[`egress_eddie_cache_entries{filter="foo \"bar\"",cache="allowed_ips"}`], "1") // cache sizes should be written
+	is.Equal(samples[`egress_eddie_cache_entries{filter="foo \"bar\"",cache="connections"}`], "0") // empty caches should be written
+	is.Equal(samples[`egress_eddie_fail_opens_total{filter="foo \"bar\""}`], "0")                  // fail opens should be written
+	is.Equal(samples[`egress_eddie_dead_letter_total{filter="foo \"bar\""}`], "1")                 // dead letters should be written
+	is.Equal(samples["egress_eddie_dns_response_dead_letter_total"], "0")                          // DNS response dead letters should be written
+
+	is.Equal(samples[`egress_eddie_packets_allowed_by_total{filter="foo \"bar\"",mechanism="reverseLookup"}`], "1") // packets allowed by each mechanism should be written
+	is.Equal(samples[`egress_eddie_packets_allowed_by_total{filter="foo \"bar\"",mechanism="dnsResponse"}`], "0")   // mechanisms that allowed no packets should be written
+
+	is.Equal(samples[`egress_eddie_dns_response_latency_seconds_bucket{filter="foo \"bar\"",hostname="example.com",le="0.01"}`], "0")  // latencies should not be counted in smaller buckets
+	is.Equal(samples[`egress_eddie_dns_response_latency_seconds_bucket{filter="foo \"bar\"",hostname="example.com",le="0.025"}`], "1") // latencies should be counted in their bucket
+	is.Equal(samples[`egress_eddie_dns_response_latency_seconds_bucket{filter="foo \"bar\"",hostname="example.com",le="+Inf"}`], "1")  // latencies should be counted in the +Inf bucket
+	is.Equal(samples[`egress_eddie_dns_response_latency_seconds_sum{filter="foo \"bar\"",hostname="example.com"}`], "0.02")            // latency sum should be written
+	is.Equal(samples[`egress_eddie_dns_response_latency_seconds_count{filter="foo \"bar\"",hostname="example.com"}`], "1")             // latency count should be written
+}
+
+// metricFamily returns the name of the metric a sample belongs to.
+func metricFamily(sample string) string {
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		if strings.HasSuffix(sample, suffix) {
+			return strings.TrimSuffix(sample, suffix)
+		}
+	}
+
+	return sample
+}
@@ -2,24 +2,54 @@ package main
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
 )
 
 type TimedCache[T comparable] struct {
+	// accessed atomically, kept first to ensure 64-bit alignment
+	hits        int64
+	misses      int64
+	evictions   int64
+	expirations int64
+
 	mtx    sync.RWMutex
 	wg     sync.WaitGroup
 	logger *zap.Logger
 
 	cache map[T]*countedTimer
 	count bool
+	// onExpire is called with entries that expired, but not entries
+	// that were removed
+	onExpire func(entry T)
 }
 
 type countedTimer struct {
-	count  int
-	status chan timerStatus
-	timer  *time.Timer
+	count int
+	// added is when the entry was last added
+	added   time.Time
+	expires time.Time
+	status  chan timerStatus
+	timer   *time.Timer
+}
+
+// CacheStats contains metrics about the usage of a TimedCache.
+type CacheStats struct {
+	// Len is the number of entries currently in the cache.
+	Len int
+	// Hits is the number of lookups that found an entry. Entries
+	// checked with EntryExists aren't counted.
+	Hits int64
+	// Misses is the number of lookups that did not find an entry.
+	Misses int64
+	// Evictions is the number of entries that were removed with
+	// RemoveEntry before they expired.
+	Evictions int64
+	// Expirations is the number of entries that were removed because
+	// their TTL elapsed.
+	Expirations int64
 }
 
 // timerStatus is used to communicate with a child goroutine that is
@@ -58,17 +88,22 @@ func (t *TimedCache[T]) AddEntry(entry T, ttl time.Duration) {
 			<-ct.timer.C
 		}
 		ct.timer.Reset(ttl)
+		ct.added = time.Now()
+		ct.expires = ct.added.Add(ttl)
 		ct.status <- start
 		return
 	}
 
 	timer := time.NewTimer(ttl)
 	status := make(chan timerStatus)
+	now := time.Now()
 
 	t.cache[entry] = &countedTimer{
-		count:  0,
-		status: status,
-		timer:  timer,
+		count:   0,
+		added:   now,
+		expires: now.Add(ttl),
+		status:  status,
+		timer:   timer,
 	}
 
 	t.wg.Add(1)
@@ -94,19 +129,90 @@ func (t *TimedCache[T]) AddEntry(entry T, ttl time.Duration) {
 
 		t.mtx.Lock()
 		delete(t.cache, entry)
+		onExpire := t.onExpire
 		t.mtx.Unlock()
+		atomic.AddInt64(&t.expirations, 1)
+
+		if onExpire != nil {
+			onExpire(entry)
+		}
 	}()
 }
 
+// OnExpire sets a function that is called with each entry that
+// expires. It isn't called with entries that are removed.
+func (t *TimedCache[T]) OnExpire(fn func(entry T)) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.onExpire = fn
+}
+
+// Len returns the number of entries currently in the cache.
+func (t *TimedCache[T]) Len() int {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	return len(t.cache)
+}
+
+// EntryExists returns true if entry is in the cache. It isn't counted
+// as a hit or miss, use Lookup for that.
 func (t *TimedCache[T]) EntryExists(entry T) bool {
 	t.mtx.RLock()
 	defer t.mtx.RUnlock()
 
 	_, ok := t.cache[entry]
+	return ok
+}
+
+// Lookup returns true if entry is in the cache and counts it as a hit,
+// or as a miss if it isn't.
+func (t *TimedCache[T]) Lookup(entry T) bool {
+	ok := t.EntryExists(entry)
+	t.countLookup(ok)
 
 	return ok
 }
 
+// countLookup counts a lookup that was made with EntryExists as a hit
+// if found is true, or as a miss otherwise.
+func (t *TimedCache[T]) countLookup(found bool) {
+	if found {
+		atomic.AddInt64(&t.hits, 1)
+	} else {
+		atomic.AddInt64(&t.misses, 1)
+	}
+}
+
+// Expires returns when entry will expire, or false if entry isn't in
+// the cache.
+func (t *TimedCache[T]) Expires(entry T) (time.Time, bool) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	ct, ok := t.cache[entry]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return ct.expires, true
+}
+
+// Added returns when entry was last added, or false if entry isn't in
+// the cache.
+func (t *TimedCache[T]) Added(entry T) (time.Time, bool) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	ct, ok := t.cache[entry]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return ct.added, true
+}
+
 func (t *TimedCache[T]) RemoveEntry(entry T) {
 	t.mtx.Lock()
 	defer t.mtx.Unlock()
@@ -129,6 +235,106 @@ func (t *TimedCache[T]) RemoveEntry(entry T) {
 
 	t.logger.Debug("deleting entry", zap.Any("entry", entry))
 	delete(t.cache, entry)
+	atomic.AddInt64(&t.evictions, 1)
+}
+
+// Range calls fn for each entry in the cache along with the time the
+// entry will expire. If fn returns false, iteration is stopped. fn
+// must not modify the cache.
+func (t *TimedCache[T]) Range(fn func(entry T, expires time.Time) bool) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	for entry, ct := range t.cache {
+		if !fn(entry, ct.expires) {
+			return
+		}
+	}
+}
+
+// CopyTo adds all entries that haven't expired to other with their
+// remaining TTLs. If both caches count entries, the counts of entries
+// are copied as well.
+func (t *TimedCache[T]) CopyTo(other *TimedCache[T]) {
+	type entryState struct {
+		entry T
+		ttl   time.Duration
+		count int
+	}
+
+	// copy entries before adding them to other so both caches aren't
+	// locked at once
+	t.mtx.RLock()
+	now := time.Now()
+	entries := make([]entryState, 0, len(t.cache))
+	for entry, ct := range t.cache {
+		ttl := ct.expires.Sub(now)
+		if ttl <= 0 {
+			continue
+		}
+		entries = append(entries, entryState{
+			entry: entry,
+			ttl:   ttl,
+			count: ct.count,
+		})
+	}
+	t.mtx.RUnlock()
+
+	for _, e := range entries {
+		other.AddEntry(e.entry, e.ttl)
+		if !other.count || e.count == 0 {
+			continue
+		}
+
+		other.mtx.Lock()
+		if ct, ok := other.cache[e.entry]; ok {
+			ct.count += e.count
+		}
+		other.mtx.Unlock()
+	}
+}
+
+// cachedEntry is an entry of a TimedCache, when it will expire and
+// how many more times it was added.
+type cachedEntry[T comparable] struct {
+	entry   T
+	expires time.Time
+	count   int
+}
+
+// entriesLocked returns the entries that haven't expired before now.
+// The caller must hold at least a read lock of t.mtx, so entries of
+// multiple caches can be read consistently.
+func (t *TimedCache[T]) entriesLocked(now time.Time) []cachedEntry[T] {
+	entries := make([]cachedEntry[T], 0, len(t.cache))
+	for entry, ct := range t.cache {
+		if !ct.expires.After(now) {
+			continue
+		}
+		entries = append(entries, cachedEntry[T]{
+			entry:   entry,
+			expires: ct.expires,
+			count:   ct.count,
+		})
+	}
+
+	return entries
+}
+
+// Stats returns the number of entries in the cache and how many
+// lookups, removals and expirations there have been. The cache has no
+// capacity limit, so evictions are entries removed with RemoveEntry.
+func (t *TimedCache[T]) Stats() CacheStats {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	return CacheStats{
+		Len:         len(t.cache),
+		Hits:        atomic.LoadInt64(&t.hits),
+		Misses:      atomic.LoadInt64(&t.misses),
+		Evictions:   atomic.LoadInt64(&t.evictions),
+		Expirations: atomic.LoadInt64(&t.expirations),
+	}
 }
 
 func (t *TimedCache[T]) Stop() {
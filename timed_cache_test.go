@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"go.uber.org/zap"
+)
+
+func TestCacheStats(t *testing.T) {
+	is := is.New(t)
+
+	cache := NewTimedCache[string](zap.NewNop(), false)
+	defer cache.Stop()
+
+	cache.AddEntry("foo", time.Hour)
+	cache.AddEntry("bar", time.Hour)
+	cache.AddEntry("baz", 10*time.Millisecond)
+
+	is.True(cache.Lookup("foo"))       // added entry should exist
+	is.True(!cache.Lookup("oof"))      // entry that wasn't added should not exist
+	is.True(cache.EntryExists("bar"))  // added entry should exist
+	is.True(!cache.EntryExists("rab")) // entry that wasn't added should not exist
+
+	cache.RemoveEntry("bar")
+	time.Sleep(100 * time.Millisecond) // wait until entry should expire
+
+	is.Equal(cache.Stats(), CacheStats{
+		Len:         1,
+		Hits:        1,
+		Misses:      1,
+		Evictions:   1,
+		Expirations: 1,
+	})
+}
+
+func TestCacheCopyTo(t *testing.T) {
+	is := is.New(t)
+
+	cache := NewTimedCache[int](zap.NewNop(), false)
+	defer cache.Stop()
+
+	for i := 0; i < 100; i++ {
+		ttl := time.Hour
+		if i%2 == 0 {
+			ttl = 10 * time.Millisecond
+		}
+		cache.AddEntry(i, ttl)
+	}
+	time.Sleep(100 * time.Millisecond) // wait until entries should expire
+
+	other := NewTimedCache[int](zap.NewNop(), false)
+	defer other.Stop()
+	cache.CopyTo(other)
+
+	entries := make(map[int]time.Time)
+	other.Range(func(entry int, expires time.Time) bool {
+		entries[entry] = expires
+		return true
+	})
+	is.Equal(len(entries), 50) // only live entries should be copied
+	for entry, expires := range entries {
+		is.True(entry%2 == 1)                         // expired entries should not be copied
+		is.True(time.Until(expires) > 59*time.Minute) // remaining TTL of entries should be kept
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/florianl/go-nfqueue"
+	"go.uber.org/zap"
+)
+
+// defaultVerdictQueueSize is how many verdict decisions are buffered
+// for the producer if "verdictQueueSize" isn't set.
+const defaultVerdictQueueSize = 4096
+
+// verdictDecision is a verdict a filter made on a packet of its
+// traffic queue.
+type verdictDecision struct {
+	Time    time.Time  `json:"time"`
+	Filter  string     `json:"filter"`
+	Src     netip.Addr `json:"src"`
+	Dst     netip.Addr `json:"dst"`
+	Allowed bool       `json:"allowed"`
+	// AllowedBy is the mechanism that allowed the packet, if it was
+	// allowed by its IPs
+	AllowedBy string `json:"allowedBy,omitempty"`
+	// Reason is why the verdict was set before the IPs of the packet
+	// were checked, if it was
+	Reason string `json:"reason,omitempty"`
+}
+
+// verdictProducer publishes JSON encoded verdict decisions. produce is
+// only called from one goroutine at a time, and may block.
+type verdictProducer interface {
+	produce(ctx context.Context, msg []byte) error
+}
+
+// fileVerdictProducer appends verdict decisions to a file, one JSON
+// object per line.
+type fileVerdictProducer struct {
+	file *os.File
+}
+
+func newFileVerdictProducer(path string) (*fileVerdictProducer, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("error opening verdict file: %w", err)
+	}
+
+	return &fileVerdictProducer{file: file}, nil
+}
+
+func (p *fileVerdictProducer) produce(_ context.Context, msg []byte) error {
+	_, err := p.file.Write(append(msg, '\n'))
+	return err
+}
+
+func (p *fileVerdictProducer) Close() error {
+	return p.file.Close()
+}
+
+// verdictExporter publishes verdict decisions with a verdictProducer
+// asynchronously. Decisions are buffered in a bounded queue, and are
+// dropped if the queue is full so a slow producer never blocks nfqueue
+// callbacks.
+type verdictExporter struct {
+	logger   *zap.Logger
+	producer verdictProducer
+	queue    chan verdictDecision
+	// dropped is how many decisions were dropped because the queue
+	// was full, accessed atomically
+	dropped int64
+	errors  *errorLimiter
+}
+
+func newVerdictExporter(logger *zap.Logger, producer verdictProducer, queueSize int) *verdictExporter {
+	if queueSize == 0 {
+		queueSize = defaultVerdictQueueSize
+	}
+
+	return &verdictExporter{
+		logger:   logger,
+		producer: producer,
+		queue:    make(chan verdictDecision, queueSize),
+		errors:   newErrorLimiter(errorLogInterval),
+	}
+}
+
+// publish queues decision to be published without blocking. A nil
+// verdictExporter ignores decisions.
+func (v *verdictExporter) publish(decision verdictDecision) {
+	if v == nil {
+		return
+	}
+
+	select {
+	case v.queue <- decision:
+	default:
+		atomic.AddInt64(&v.dropped, 1)
+	}
+}
+
+// droppedDecisions returns how many decisions were dropped because
+// the queue was full.
+func (v *verdictExporter) droppedDecisions() int64 {
+	if v == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&v.dropped)
+}
+
+// run publishes queued decisions until ctx is canceled, then closes
+// the producer if it can be closed.
+func (v *verdictExporter) run(ctx context.Context) {
+	if closer, ok := v.producer.(io.Closer); ok {
+		defer func() {
+			if err := closer.Close(); err != nil {
+				v.logger.Error("error closing verdict producer", zap.NamedError("error", err))
+			}
+		}()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case decision := <-v.queue:
+			msg, err := json.Marshal(decision)
+			if err != nil {
+				v.errors.log(v.logger, "error encoding verdict decision", err)
+				continue
+			}
+			if err := v.producer.produce(ctx, msg); err != nil {
+				v.errors.log(v.logger, "error publishing verdict decision", err)
+			}
+		}
+	}
+}
+
+// exportVerdict publishes the verdict the filter made on a packet from
+// src to dst, if verdicts are exported. reason is why the verdict was
+// set before the IPs of the packet were checked, if it was.
+func (f *filter) exportVerdict(src, dst netip.Addr, verdict int, mechanism allowMechanism, reason string) {
+	if f.verdicts == nil {
+		return
+	}
+
+	decision := verdictDecision{
+		Time:    time.Now(),
+		Filter:  f.opts.Name,
+		Src:     src,
+		Dst:     dst,
+		Allowed: verdict == nfqueue.NfAccept,
+		Reason:  reason,
+	}
+	if decision.Allowed && mechanism != allowedByNone {
+		decision.AllowedBy = mechanism.String()
+	}
+	f.verdicts.publish(decision)
+}
+
+// exportPacketVerdict is like exportVerdict, but reads the IPs from the
+// header of the packet as the verdict was set before it was parsed.
+func (f *filter) exportPacketVerdict(attr nfqueue.Attribute, verdict int, reason string) {
+	if f.verdicts == nil {
+		return
+	}
+
+	var src, dst netip.Addr
+	if attr.Payload != nil {
+		src, dst = packetAddrs(*attr.Payload, f.opts.IPVersion)
+	}
+	f.exportVerdict(src, dst, verdict, allowedByNone, reason)
+}
+
+// packetAddrs returns the source and destination IPs of packet without
+// parsing it. Invalid IPs are returned if the header is truncated.
+func packetAddrs(packet []byte, ipVersion int) (netip.Addr, netip.Addr) {
+	var src, dst netip.Addr
+	if packetIsIPv6(packet, ipVersion) {
+		if len(packet) >= 40 {
+			src = netip.AddrFrom16(*(*[16]byte)(packet[8:24]))
+			dst = netip.AddrFrom16(*(*[16]byte)(packet[24:40]))
+		}
+	} else if len(packet) >= 20 {
+		src = netip.AddrFrom4(*(*[4]byte)(packet[12:16]))
+		dst = netip.AddrFrom4(*(*[4]byte)(packet[16:20]))
+	}
+
+	return src, dst
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/florianl/go-nfqueue"
+	"github.com/matryer/is"
+	"go.uber.org/zap"
+)
+
+// mockProducer captures the messages it is asked to publish.
+type mockProducer struct {
+	mtx      sync.Mutex
+	msgs     [][]byte
+	produced chan struct{}
+	err      error
+}
+
+func (m *mockProducer) produce(_ context.Context, msg []byte) error {
+	m.mtx.Lock()
+	m.msgs = append(m.msgs, msg)
+	m.mtx.Unlock()
+	m.produced <- struct{}{}
+
+	return m.err
+}
+
+func (m *mockProducer) decisions(t *testing.T) []verdictDecision {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	decisions := make([]verdictDecision, len(m.msgs))
+	for i, msg := range m.msgs {
+		if err := json.Unmarshal(msg, &decisions[i]); err != nil {
+			t.Fatalf("error decoding verdict decision: %v", err)
+		}
+	}
+
+	return decisions
+}
+
+func TestExportVerdicts(t *testing.T) {
+	is := is.New(t)
+
+	producer := &mockProducer{produced: make(chan struct{}, 2)}
+	verdicts := newVerdictExporter(zap.NewNop(), producer, 0)
+	f := newTestFilter(&FilterOptions{Name: "foo"})
+	f.verdicts = verdicts
+	t.Cleanup(f.close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		verdicts.run(ctx)
+	}()
+
+	src := netip.MustParseAddr("192.168.1.2")
+	allowedDst := netip.MustParseAddr("192.0.2.1")
+	droppedDst := netip.MustParseAddr("192.0.2.2")
+	f.exportVerdict(src, allowedDst, nfqueue.NfAccept, allowedByDNSAnswer, "")
+	f.exportVerdict(src, droppedDst, nfqueue.NfDrop, allowedByNone, "")
+	for i := 0; i < 2; i++ {
+		select {
+		case <-producer.produced:
+		case <-time.After(time.Second):
+			t.Fatal("verdict decision was not published")
+		}
+	}
+	cancel()
+	<-done
+
+	decisions := producer.decisions(t)
+	is.Equal(len(decisions), 2)                     // every verdict should be published
+	is.Equal(decisions[0].Filter, "foo")            // name of filter should be published
+	is.Equal(decisions[0].Src, src)                 // source of packet should be published
+	is.Equal(decisions[0].Dst, allowedDst)          // destination of packet should be published
+	is.True(decisions[0].Allowed)                   // allowed verdict should be published as allowed
+	is.Equal(decisions[0].AllowedBy, "dnsResponse") // mechanism that allowed the packet should be published
+	is.Equal(decisions[1].Dst, droppedDst)          // decisions should be published in order
+	is.True(!decisions[1].Allowed)                  // dropped verdict should be published as dropped
+	is.Equal(decisions[1].AllowedBy, "")            // dropped verdicts should not have a mechanism
+	is.Equal(verdicts.droppedDecisions(), int64(0)) // no decisions should be dropped
+}
+
+func TestExportVerdictsBackpressure(t *testing.T) {
+	is := is.New(t)
+
+	producer := &mockProducer{
+		produced: make(chan struct{}, 2),
+		err:      errors.New("broker unavailable"),
+	}
+	verdicts := newVerdictExporter(zap.NewNop(), producer, 1)
+	f := newTestFilter(&FilterOptions{Name: "foo"})
+	f.verdicts = verdicts
+	t.Cleanup(f.close)
+
+	src := netip.MustParseAddr("192.168.1.2")
+	dst := netip.MustParseAddr("192.0.2.1")
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		// the producer isn't running, so only the first decision
+		// fits in the queue
+		for i := 0; i < 3; i++ {
+			f.exportVerdict(src, dst, nfqueue.NfDrop, allowedByNone, "")
+		}
+	}()
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("publishing verdict decisions blocked")
+	}
+	is.Equal(verdicts.droppedDecisions(), int64(2)) // decisions that didn't fit in the queue should be dropped and counted
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		verdicts.run(ctx)
+	}()
+	<-producer.produced
+	cancel()
+	<-done
+
+	is.Equal(len(producer.decisions(t)), 1) // queued decision should be published even if the producer fails
+
+	var disabled filter
+	disabled.exportVerdict(src, dst, nfqueue.NfDrop, allowedByNone, "") // verdicts should be ignored if they aren't exported
+}
+
+func TestFileVerdictProducer(t *testing.T) {
+	is := is.New(t)
+
+	path := filepath.Join(t.TempDir(), "verdicts.json")
+	is.NoErr(os.WriteFile(path, []byte("{}\n"), 0o640))
+	producer, err := newFileVerdictProducer(path)
+	is.NoErr(err)
+	verdicts := newVerdictExporter(zap.NewNop(), producer, 0)
+
+	f := newTestFilter(&FilterOptions{Name: "foo"})
+	f.verdicts = verdicts
+	t.Cleanup(f.close)
+	src := netip.MustParseAddr("192.168.1.2")
+	dst := netip.MustParseAddr("192.0.2.1")
+	f.exportVerdict(src, dst, nfqueue.NfDrop, allowedByNone, "ports")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		verdicts.run(ctx)
+	}()
+	for len(verdicts.queue) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	contents, err := os.ReadFile(path)
+	is.NoErr(err)
+	lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	is.Equal(len(lines), 2)  // decisions should be appended to the file
+	is.Equal(lines[0], "{}") // existing contents should be kept
+
+	var decision verdictDecision
+	is.NoErr(json.Unmarshal([]byte(lines[1]), &decision))
+	is.Equal(decision.Dst, dst)           // decision should be written as a JSON line
+	is.Equal(decision.Reason, "ports")    // reason of early verdict should be written
+	is.True(producer.file.Close() != nil) // file should be closed once the exporter stops
+}
+
+func TestExportEarlyVerdicts(t *testing.T) {
+	is := is.New(t)
+
+	f, _, genericQueue := newCallbackTestFilter(t, &FilterOptions{
+		Name:             "foo",
+		DNSQueue:         1000,
+		TrafficQueue:     1001,
+		IPVersion:        4,
+		AllowAnswersFor:  duration(time.Minute),
+		AllowedHostnames: []string{"example.com"},
+		AllowedDstPorts:  []uint16{443},
+	})
+	f.verdicts = newVerdictExporter(zap.NewNop(), &mockProducer{}, 0)
+	f.paused = newPauseSwitch()
+	callback := newGenericCallback(f)
+
+	src := netip.MustParseAddrPort("192.168.1.2:40000")
+	dst := netip.MustParseAddrPort("192.0.2.1:80")
+	callback(newPacketAttribute(1, stateNew, newTCPPacketBetween(t, src, dst, 1, nil)))
+	verdict, ok := genericQueue.verdict(1)
+	is.True(ok)                       // verdict should be set
+	is.Equal(verdict, nfqueue.NfDrop) // packet to disallowed port should be dropped
+
+	f.paused.set(true)
+	callback(newPacketAttribute(2, stateNew, newTCPPacketBetween(t, src, dst, 1, nil)))
+	verdict, ok = genericQueue.verdict(2)
+	is.True(ok)                       // verdict should be set
+	is.Equal(verdict, nfqueue.NfDrop) // packet should be dropped while paused
+
+	is.Equal(len(f.verdicts.queue), 2) // verdicts set before IPs are checked should be published
+	for _, reason := range []string{"ports", "paused"} {
+		decision := <-f.verdicts.queue
+		is.Equal(decision.Src, src.Addr()) // source should be published
+		is.Equal(decision.Dst, dst.Addr()) // destination should be published
+		is.True(!decision.Allowed)
+		is.Equal(decision.Reason, reason) // why the verdict was set early should be published
+	}
+}
+
+func TestPacketAddrs(t *testing.T) {
+	is := is.New(t)
+
+	src := netip.MustParseAddrPort("192.168.1.2:40000")
+	dst := netip.MustParseAddrPort("192.0.2.1:443")
+	packet := newTCPPacketBetween(t, src, dst, 1, nil)
+	gotSrc, gotDst := packetAddrs(packet, 0)
+	is.Equal(gotSrc, src.Addr()) // source of IPv4 packet should be read
+	is.Equal(gotDst, dst.Addr()) // destination of IPv4 packet should be read
+
+	gotSrc, gotDst = packetAddrs(packet[:10], 4)
+	is.True(!gotSrc.IsValid() && !gotDst.IsValid()) // IPs of truncated packets should be invalid
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/florianl/go-nfqueue"
+	"go.uber.org/zap"
+)
+
+// workerQueueLen is how many packets can be waiting for a worker
+// before the nfqueue callback blocks. Packets that can't be queued
+// wait in the nfqueue instead, which the kernel bounds.
+const workerQueueLen = 1024
+
+// startWorkerPool starts workers goroutines that call hook, and
+// returns a hook that queues packets to be processed by them. nfqueue
+// calls hooks from a single goroutine per queue, so without workers a
+// slow verdict would delay every following packet of the queue.
+// Verdicts of packets are independent of each other, so hook must be
+// safe to call concurrently.
+//
+// Each worker is pinned to cpus if any are set. Once ctx is canceled
+// workers set the verdicts of packets that are still queued and exit,
+// which is tracked by wg.
+func startWorkerPool(ctx context.Context, wg *sync.WaitGroup, logger *zap.Logger, cpus []int, workers int, hook nfqueue.HookFunc) nfqueue.HookFunc {
+	packets := make(chan nfqueue.Attribute, workerQueueLen)
+
+	for i := 0; i < workers; i++ {
+		workerHook := pinHook(logger, cpus, hook)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			runWorker(ctx, packets, workerHook)
+		}()
+	}
+
+	return func(attr nfqueue.Attribute) int {
+		select {
+		case packets <- attr:
+		case <-ctx.Done():
+			// the workers may have exited, the packet will be
+			// dropped when the nfqueue is closed
+		}
+		return 0
+	}
+}
+
+func runWorker(ctx context.Context, packets <-chan nfqueue.Attribute, hook nfqueue.HookFunc) {
+	for {
+		select {
+		case attr := <-packets:
+			hook(attr)
+		case <-ctx.Done():
+			// the nfqueue isn't closed until workers exit, so
+			// verdicts of queued packets can still be set
+			for {
+				select {
+				case attr := <-packets:
+					hook(attr)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
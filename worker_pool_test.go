@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/florianl/go-nfqueue"
+	"github.com/matryer/is"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+func newTestAttribute(packetID uint32) nfqueue.Attribute {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, packetID)
+
+	return nfqueue.Attribute{
+		PacketID: &packetID,
+		Payload:  &payload,
+	}
+}
+
+func TestWorkerPoolVerdicts(t *testing.T) {
+	is := is.New(t)
+
+	const packets = 4096
+
+	var (
+		mtx        sync.Mutex
+		verdicts   = make(map[uint32]int)
+		duplicates int
+	)
+	// decide verdicts from payloads like the generic callback does,
+	// processing packets for different amounts of time so they finish
+	// out of order
+	hook := func(attr nfqueue.Attribute) int {
+		time.Sleep(time.Duration(rand.Intn(100)) * time.Microsecond)
+
+		verdict := nfqueue.NfDrop
+		if binary.BigEndian.Uint32(*attr.Payload)%2 == 0 {
+			verdict = nfqueue.NfAccept
+		}
+
+		mtx.Lock()
+		if _, ok := verdicts[*attr.PacketID]; ok {
+			duplicates++
+		}
+		verdicts[*attr.PacketID] = verdict
+		mtx.Unlock()
+
+		return 0
+	}
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	poolHook := startWorkerPool(ctx, &wg, zap.NewNop(), nil, 8, hook)
+
+	for id := uint32(0); id < packets; id++ {
+		is.Equal(poolHook(newTestAttribute(id)), 0) // queueing packets should not stop the nfqueue
+	}
+	// workers should process queued packets before exiting
+	cancel()
+	wg.Wait()
+
+	is.Equal(duplicates, 0)          // packets should only be processed once
+	is.Equal(len(verdicts), packets) // every packet should have a verdict
+	for id, verdict := range verdicts {
+		expected := nfqueue.NfDrop
+		if id%2 == 0 {
+			expected = nfqueue.NfAccept
+		}
+		is.Equal(verdict, expected) // verdicts should be set for the packets they were decided for
+	}
+}
+
+func TestWorkerPoolGenericCallback(t *testing.T) {
+	is := is.New(t)
+
+	const packets = 1024
+
+	f, _, genericQueue := newCallbackTestFilter(t, &FilterOptions{
+		Name:             "foo",
+		TrafficQueue:     1001,
+		TrafficWorkers:   8,
+		IPVersion:        4,
+		AllowAnswersFor:  duration(time.Minute),
+		AllowedHostnames: []string{"example.com"},
+	})
+	allowed := netip.MustParseAddrPort("192.0.2.1:443")
+	denied := netip.MustParseAddrPort("192.0.2.2:443")
+	f.allowIPBy(allowed.Addr(), allowedByDNSAnswer, time.Minute)
+
+	// pin workers to the first CPU the test may run on, and check
+	// packets are processed on it
+	var current unix.CPUSet
+	is.NoErr(unix.SchedGetaffinity(0, &current))
+	cpu := 0
+	for !current.IsSet(cpu) {
+		cpu++
+	}
+	var unpinned int32
+	callback := newGenericCallback(f)
+	hook := func(attr nfqueue.Attribute) int {
+		var set unix.CPUSet
+		if err := unix.SchedGetaffinity(0, &set); err != nil || set.Count() != 1 || !set.IsSet(cpu) {
+			atomic.AddInt32(&unpinned, 1)
+		}
+		return callback(attr)
+	}
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	poolHook := startWorkerPool(ctx, &wg, zap.NewNop(), []int{cpu}, f.opts.TrafficWorkers, hook)
+
+	for id := uint32(0); id < packets; id++ {
+		dst := denied
+		if id%2 == 0 {
+			dst = allowed
+		}
+		// use a different source port for each packet so they
+		// aren't deduplicated
+		src := netip.AddrPortFrom(netip.MustParseAddr("192.168.1.2"), uint16(10000+id))
+		is.Equal(poolHook(newPacketAttribute(id, stateNew, newTCPPacketBetween(t, src, dst, 1, nil))), 0) // queueing packets should not stop the nfqueue
+	}
+	// workers should process queued packets before exiting
+	cancel()
+	wg.Wait()
+
+	for id := uint32(0); id < packets; id++ {
+		expected := nfqueue.NfDrop
+		if id%2 == 0 {
+			expected = nfqueue.NfAccept
+		}
+		verdict, ok := genericQueue.verdict(id)
+		is.True(ok)                 // every packet should have a verdict
+		is.Equal(verdict, expected) // verdicts should be set for the packets they were decided for
+	}
+	is.Equal(atomic.LoadInt32(&unpinned), int32(0)) // packets should be processed by pinned workers
+
+	status := f.status()
+	is.Equal(status.PacketsAllowed, int64(packets/2)) // allowed packets should be counted once
+	is.Equal(status.PacketsDropped, int64(packets/2)) // dropped packets should be counted once
+}
+
+func BenchmarkWorkerPool(b *testing.B) {
+	// simulate a slow verdict, such as one that needs a reverse lookup
+	var processed sync.WaitGroup
+	hook := func(attr nfqueue.Attribute) int {
+		time.Sleep(50 * time.Microsecond)
+		processed.Done()
+		return 0
+	}
+	attr := newTestAttribute(1)
+
+	b.Run("inline", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			processed.Add(1)
+			hook(attr)
+		}
+		processed.Wait()
+	})
+
+	for _, workers := range []int{4, 16} {
+		workers := workers
+		b.Run(fmt.Sprintf("%d workers", workers), func(b *testing.B) {
+			var wg sync.WaitGroup
+			ctx, cancel := context.WithCancel(context.Background())
+			poolHook := startWorkerPool(ctx, &wg, zap.NewNop(), nil, workers, hook)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				processed.Add(1)
+				poolHook(attr)
+			}
+			processed.Wait()
+			b.StopTimer()
+
+			cancel()
+			wg.Wait()
+		})
+	}
+}